@@ -14,12 +14,21 @@ import (
 	"proxyrouter/internal/acl"
 	"proxyrouter/internal/admin"
 	"proxyrouter/internal/api"
+	"proxyrouter/internal/auth"
 	"proxyrouter/internal/config"
+	"proxyrouter/internal/conntrack"
 	"proxyrouter/internal/db"
+	"proxyrouter/internal/metrics"
 	"proxyrouter/internal/proxyhttp"
+	"proxyrouter/internal/proxymixed"
+	"proxyrouter/internal/proxyproto"
 	"proxyrouter/internal/proxysocks"
 	"proxyrouter/internal/refresh"
 	"proxyrouter/internal/router"
+	"proxyrouter/internal/secrets"
+	"proxyrouter/internal/settings"
+	"proxyrouter/internal/shaping"
+	"proxyrouter/internal/tunnel"
 	"proxyrouter/internal/version"
 )
 
@@ -54,6 +63,24 @@ func main() {
 		log.Fatalf("Failed to run database migrations: %v", err)
 	}
 
+	// Load the key used to encrypt upstream proxy credentials
+	var secretBox *secrets.Box
+	if cfg.Security.CredentialKey != "" {
+		secretBox, err = secrets.NewFromBase64(cfg.Security.CredentialKey)
+	} else {
+		secretBox, err = secrets.LoadOrCreateKeyFile(cfg.GetCredentialKeyFile())
+	}
+	if err != nil {
+		log.Fatalf("Failed to load credential key: %v", err)
+	}
+
+	// Runtime settings: overrides in the settings table win over the file
+	settingsService, err := settings.New(context.Background(), database.GetDB(), cfg, slog.Default())
+	if err != nil {
+		log.Fatalf("Failed to load settings: %v", err)
+	}
+	runtimeCfg := settingsService.Config()
+
 	// Initialize components
 	aclManager := acl.New(database.GetDB())
 	routerEngine := router.New(database.GetDB())
@@ -61,19 +88,58 @@ func main() {
 		database.GetDB(),
 		cfg.Tor.SocksAddress,
 		cfg.GetDialTimeout(),
+		secretBox,
+		router.FailoverPolicy{
+			Candidates:       cfg.Routing.FailoverCandidates,
+			Budget:           cfg.GetFailoverBudget(),
+			FailureThreshold: cfg.Routing.FailureThreshold,
+		},
 	)
-	refresher := refresh.New(database.GetDB(), &cfg.Refresh)
+	refresher := refresh.New(database.GetDB(), &runtimeCfg.Refresh, secretBox)
+	proxyUsers := auth.NewProxyUsers(database.GetDB(), cfg.Security.PasswordHash)
+
+	var proxyMetrics *metrics.Metrics
+	if cfg.Metrics.Enabled {
+		proxyMetrics = metrics.New(database.GetDB())
+	}
 
 	// Initialize job manager
-	refreshJobManager := refresh.NewJobManager(refresher, cfg, slog.Default())
+	refreshJobManager := refresh.NewJobManager(refresher, runtimeCfg, slog.Default())
+	settingsService.Subscribe(func(c *config.Config) {
+		refresher.Reconfigure(c.Refresh)
+		refreshJobManager.Reconfigure(c)
+	})
+
+	// Load balancers whose client addresses are believed
+	trustedProxies, err := acl.NewTrustedProxies(cfg.Security.TrustedProxies)
+	if err != nil {
+		log.Fatalf("Failed to parse trusted proxies: %v", err)
+	}
+	var proxyProtocol *proxyproto.Policy
+	if cfg.Security.ProxyProtocol {
+		proxyProtocol = &proxyproto.Policy{Trusted: trustedProxies, Timeout: cfg.GetReadTimeout()}
+	}
 
 	// Initialize servers
+	tracker := conntrack.New()
+	shaper := shaping.New(aclManager, proxyUsers, proxyMetrics)
+	tunnelTimeouts := tunnel.Timeouts{
+		Idle:        cfg.GetTunnelIdleTimeout(),
+		MaxLifetime: cfg.GetTunnelLifetime(),
+	}
 	httpProxy := proxyhttp.New(
 		cfg.Listen.HTTPProxy,
 		aclManager,
 		routerEngine,
 		dialerFactory,
+		proxyUsers,
+		cfg.Security.ProxyAuth.Required,
+		proxyMetrics,
 		cfg.GetReadTimeout(),
+		tracker,
+		shaper,
+		tunnelTimeouts,
+		proxyProtocol,
 	)
 
 	socks5Proxy := proxysocks.New(
@@ -81,7 +147,14 @@ func main() {
 		aclManager,
 		routerEngine,
 		dialerFactory,
+		proxyUsers,
+		cfg.Security.ProxyAuth.Required,
 		cfg.GetDialTimeout(),
+		cfg.GetUDPIdleTimeout(),
+		tracker,
+		shaper,
+		tunnelTimeouts,
+		proxyProtocol,
 	)
 
 	apiServer := api.New(
@@ -89,8 +162,13 @@ func main() {
 		database,
 		aclManager,
 		routerEngine,
+		dialerFactory,
+		proxyUsers,
 		refresher,
+		tracker,
 		cfg,
+		proxyProtocol,
+		settingsService,
 	)
 
 	// Create context for graceful shutdown
@@ -105,6 +183,10 @@ func main() {
 		sig := <-sigChan
 		fmt.Printf("Received signal %v, shutting down...\n", sig)
 		cancel()
+
+		<-sigChan
+		fmt.Println("Received second signal, exiting without draining connections")
+		os.Exit(1)
 	}()
 
 	// Start job manager
@@ -113,8 +195,11 @@ func main() {
 	}
 	defer refreshJobManager.Stop()
 
+	// Report the throughput of bandwidth limits
+	go shaper.Run(ctx)
+
 	// Start servers
-	errChan := make(chan error, 4)
+	errChan := make(chan error, 6)
 
 	// Start HTTP proxy
 	go func() {
@@ -130,16 +215,39 @@ func main() {
 		}
 	}()
 
-	// Start API server
+	// Start SOCKS4 proxy if configured
+	if cfg.Listen.Socks4Proxy != "" {
+		go func() {
+			if err := socks5Proxy.StartSOCKS4(ctx, cfg.Listen.Socks4Proxy); err != nil {
+				errChan <- fmt.Errorf("SOCKS4 proxy error: %w", err)
+			}
+		}()
+	}
+
+	// Start the mixed HTTP/SOCKS listener if configured
+	if cfg.Listen.Mixed != "" {
+		mixedProxy := proxymixed.New(cfg.Listen.Mixed, socks5Proxy, httpProxy, cfg.GetReadTimeout(), tracker, proxyProtocol)
+		go func() {
+			if err := mixedProxy.Start(ctx); err != nil {
+				errChan <- fmt.Errorf("Mixed proxy error: %w", err)
+			}
+		}()
+	}
+
+	// Start API server; it stays up while connections drain so they can be
+	// watched
+	apiCtx, stopAPI := context.WithCancel(context.Background())
+	defer stopAPI()
 	go func() {
-		if err := apiServer.Start(ctx); err != nil {
+		if err := apiServer.Start(apiCtx); err != nil {
 			errChan <- fmt.Errorf("API server error: %w", err)
 		}
 	}()
 
 	// Start admin server if enabled
+	var adminServer *admin.Server
 	if cfg.Admin.Enabled {
-		adminServer := admin.NewServer(cfg, database, refresher)
+		adminServer = admin.NewServer(cfg, database, refresher, routerEngine, dialerFactory, tracker, trustedProxies, settingsService)
 		go func() {
 			if err := adminServer.Start(ctx); err != nil {
 				errChan <- fmt.Errorf("Admin server error: %w", err)
@@ -147,9 +255,52 @@ func main() {
 		}()
 	}
 
+	// Reload the configuration when the file changes or on SIGHUP
+	auditor := admin.NewAuthManager(database.GetDB(), &admin.Config{})
+	reloader := config.NewReloader(*configPath, cfg, slog.Default(), func(ctx context.Context, detail string) error {
+		return auditor.LogAudit(ctx, "system", "config_reload", detail, "")
+	})
+	reloader.OnReload(func(c *config.Config) {
+		dialerFactory.Reconfigure(c.Tor.SocksAddress, c.GetDialTimeout(), router.FailoverPolicy{
+			Candidates:       c.Routing.FailoverCandidates,
+			Budget:           c.GetFailoverBudget(),
+			FailureThreshold: c.Routing.FailureThreshold,
+		})
+		settingsService.SetFileConfig(c)
+		if adminServer != nil {
+			adminServer.SetAllowCIDRs(c.Admin.AllowCIDRs)
+		}
+	})
+	go func() {
+		if err := reloader.Watch(ctx); err != nil {
+			slog.Error("Config file is not watched, reload with SIGHUP", "error", err)
+		}
+	}()
+
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hupChan:
+				reloader.Reload(ctx, "SIGHUP")
+			}
+		}
+	}()
+
 	// Wait for context cancellation or error
 	select {
 	case <-ctx.Done():
+		// The listeners are closed, let open connections finish
+		fmt.Printf("Draining %d open connections for up to %v...\n", tracker.Len(), cfg.GetDrainTimeout())
+		drainCtx, cancelDrain := context.WithTimeout(context.Background(), cfg.GetDrainTimeout())
+		if closed := tracker.Shutdown(drainCtx); closed > 0 {
+			fmt.Printf("Closed %d connections still open after the drain period\n", closed)
+		}
+		cancelDrain()
+		stopAPI()
 		fmt.Println("Shutdown complete")
 	case err := <-errChan:
 		log.Fatalf("Server error: %v", err)
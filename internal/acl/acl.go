@@ -4,13 +4,27 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
-	"net"
+	"net/netip"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// Actions of ACL entries
+const (
+	ActionAllow = "allow"
+	ActionDeny  = "deny"
+)
+
+// DefaultPriority is the priority of entries that do not set one
+const DefaultPriority = 100
+
 // ACL represents the access control list
 type ACL struct {
-	db *sql.DB
+	db       *sql.DB
+	table    atomic.Pointer[prefixTable] // nil until loaded or after a failed reload
+	reloadMu sync.Mutex
 }
 
 // New creates a new ACL instance
@@ -18,34 +32,28 @@ func New(db *sql.DB) *ACL {
 	return &ACL{db: db}
 }
 
-// IsAllowed checks if the given IP address is allowed
+// IsAllowed checks if the given IP address is allowed. The entries that
+// contain it are ranked by priority, then prefix length, with deny winning a
+// tie, and the first one decides. Addresses no entry contains are denied.
 func (a *ACL) IsAllowed(ctx context.Context, clientIP string) (bool, error) {
-	// Parse the client IP
-	ip := net.ParseIP(clientIP)
-	if ip == nil {
+	addr, err := netip.ParseAddr(clientIP)
+	if err != nil {
 		return false, fmt.Errorf("invalid IP address: %s", clientIP)
 	}
 
-	// Get all allowed subnets
-	subnets, err := a.GetAllowedSubnets(ctx)
+	table, err := a.prefixTable(ctx)
 	if err != nil {
-		return false, fmt.Errorf("failed to get allowed subnets: %w", err)
-	}
-
-	// Check if IP is in any allowed subnet
-	for _, cidr := range subnets {
-		if a.ipInCIDR(ip, cidr) {
-			return true, nil
-		}
+		return false, fmt.Errorf("failed to load ACL: %w", err)
 	}
 
-	return false, nil
+	entry := table.decide(addr, time.Now())
+	return entry != nil && entry.Action == ActionAllow, nil
 }
 
 // GetAllowedSubnets returns all allowed CIDR subnets
 func (a *ACL) GetAllowedSubnets(ctx context.Context) ([]string, error) {
-	query := "SELECT cidr FROM acl_subnets ORDER BY cidr"
-	rows, err := a.db.QueryContext(ctx, query)
+	query := "SELECT cidr FROM acl_subnets WHERE action = ? ORDER BY cidr"
+	rows, err := a.db.QueryContext(ctx, query, ActionAllow)
 	if err != nil {
 		return nil, fmt.Errorf("failed to query allowed subnets: %w", err)
 	}
@@ -67,7 +75,8 @@ func (a *ACL) GetAllowedSubnets(ctx context.Context) ([]string, error) {
 	return subnets, nil
 }
 
-// AddSubnet adds a new allowed subnet
+// AddSubnet adds a new allowed subnet with the default priority. A subnet
+// that is already listed is left as it is.
 func (a *ACL) AddSubnet(ctx context.Context, cidr string) error {
 	// Validate CIDR format
 	if err := a.validateCIDR(cidr); err != nil {
@@ -80,9 +89,158 @@ func (a *ACL) AddSubnet(ctx context.Context, cidr string) error {
 		return fmt.Errorf("failed to add subnet: %w", err)
 	}
 
+	a.changed(ctx)
+	return nil
+}
+
+// AddEntry adds an allow or deny entry, replacing the entry of the same
+// CIDR if there is one, and sets its ID. An empty action means allow.
+func (a *ACL) AddEntry(ctx context.Context, entry *Subnet) error {
+	if entry.Action == "" {
+		entry.Action = ActionAllow
+	}
+	if err := a.validateEntry(entry); err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO acl_subnets (cidr, action, priority, comment, expires_at, bandwidth_limit)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (cidr) DO UPDATE SET
+			action = excluded.action,
+			priority = excluded.priority,
+			comment = excluded.comment,
+			expires_at = excluded.expires_at,
+			bandwidth_limit = excluded.bandwidth_limit
+	`
+	_, err := a.db.ExecContext(ctx, query,
+		entry.CIDR,
+		entry.Action,
+		entry.Priority,
+		entry.Comment,
+		utcTime(entry.ExpiresAt),
+		positiveLimit(entry.BandwidthLimit),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to add ACL entry: %w", err)
+	}
+
+	if err := a.db.QueryRowContext(ctx, "SELECT id FROM acl_subnets WHERE cidr = ?", entry.CIDR).Scan(&entry.ID); err != nil {
+		return fmt.Errorf("failed to get ACL entry id: %w", err)
+	}
+
+	a.changed(ctx)
+	return nil
+}
+
+// EntryUpdate holds the fields of an ACL entry to change; nil fields are
+// kept. An empty comment, a zero expiry time and a bandwidth limit of zero
+// clear their field.
+type EntryUpdate struct {
+	Action         *string
+	Priority       *int
+	Comment        *string
+	ExpiresAt      *time.Time
+	BandwidthLimit *int
+}
+
+// UpdateEntry changes an ACL entry and reports whether it was found
+func (a *ACL) UpdateEntry(ctx context.Context, id int, update EntryUpdate) (bool, error) {
+	var sets []string
+	var args []interface{}
+
+	if update.Action != nil {
+		if err := validateAction(*update.Action); err != nil {
+			return false, err
+		}
+		sets = append(sets, "action = ?")
+		args = append(args, *update.Action)
+	}
+	if update.Priority != nil {
+		sets = append(sets, "priority = ?")
+		args = append(args, *update.Priority)
+	}
+	if update.Comment != nil {
+		sets = append(sets, "comment = ?")
+		if *update.Comment != "" {
+			args = append(args, *update.Comment)
+		} else {
+			args = append(args, nil)
+		}
+	}
+	if update.ExpiresAt != nil {
+		sets = append(sets, "expires_at = ?")
+		if !update.ExpiresAt.IsZero() {
+			args = append(args, utcTime(update.ExpiresAt))
+		} else {
+			args = append(args, nil)
+		}
+	}
+	if update.BandwidthLimit != nil {
+		sets = append(sets, "bandwidth_limit = ?")
+		args = append(args, positiveLimit(update.BandwidthLimit))
+	}
+	if len(sets) == 0 {
+		return false, fmt.Errorf("no fields to update")
+	}
+
+	query := fmt.Sprintf("UPDATE acl_subnets SET %s WHERE id = ?", strings.Join(sets, ", "))
+	result, err := a.db.ExecContext(ctx, query, append(args, id)...)
+	if err != nil {
+		return false, fmt.Errorf("failed to update ACL entry: %w", err)
+	}
+	a.changed(ctx)
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to get rows affected: %w", err)
+	}
+	return rowsAffected > 0, nil
+}
+
+// SetBandwidthLimit sets the bandwidth limit shared by the clients of a
+// subnet in bytes per second. A limit of zero or less removes it.
+func (a *ACL) SetBandwidthLimit(ctx context.Context, cidr string, limit int) error {
+	query := "UPDATE acl_subnets SET bandwidth_limit = ? WHERE cidr = ?"
+	result, err := a.db.ExecContext(ctx, query, positiveLimit(&limit), cidr)
+	if err != nil {
+		return fmt.Errorf("failed to set bandwidth limit: %w", err)
+	}
+	a.changed(ctx)
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("subnet with CIDR %s not found", cidr)
+	}
+
 	return nil
 }
 
+// BandwidthLimit returns the most specific allowed subnet with a bandwidth
+// limit that contains the client IP, and its limit. It returns 0 if there is
+// none.
+func (a *ACL) BandwidthLimit(ctx context.Context, clientIP string) (string, int, error) {
+	addr, err := netip.ParseAddr(clientIP)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid IP address: %s", clientIP)
+	}
+
+	table, err := a.prefixTable(ctx)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to load ACL: %w", err)
+	}
+
+	entry := table.bandwidthLimit(addr, time.Now())
+	if entry == nil {
+		return "", 0, nil
+	}
+	return entry.CIDR, *entry.BandwidthLimit, nil
+}
+
 // RemoveSubnet removes an allowed subnet
 func (a *ACL) RemoveSubnet(ctx context.Context, id int) error {
 	query := "DELETE FROM acl_subnets WHERE id = ?"
@@ -90,6 +248,7 @@ func (a *ACL) RemoveSubnet(ctx context.Context, id int) error {
 	if err != nil {
 		return fmt.Errorf("failed to remove subnet: %w", err)
 	}
+	a.changed(ctx)
 
 	rowsAffected, err := result.RowsAffected()
 	if err != nil {
@@ -110,6 +269,7 @@ func (a *ACL) RemoveSubnetByCIDR(ctx context.Context, cidr string) error {
 	if err != nil {
 		return fmt.Errorf("failed to remove subnet: %w", err)
 	}
+	a.changed(ctx)
 
 	rowsAffected, err := result.RowsAffected()
 	if err != nil {
@@ -123,9 +283,10 @@ func (a *ACL) RemoveSubnetByCIDR(ctx context.Context, cidr string) error {
 	return nil
 }
 
-// GetSubnets returns all subnets with their IDs
+// GetSubnets returns all entries with their IDs in the order they are
+// checked, expired ones included
 func (a *ACL) GetSubnets(ctx context.Context) ([]Subnet, error) {
-	query := "SELECT id, cidr FROM acl_subnets ORDER BY cidr"
+	query := "SELECT id, cidr, action, priority, comment, expires_at, bandwidth_limit FROM acl_subnets ORDER BY priority, cidr"
 	rows, err := a.db.QueryContext(ctx, query)
 	if err != nil {
 		return nil, fmt.Errorf("failed to query subnets: %w", err)
@@ -135,9 +296,13 @@ func (a *ACL) GetSubnets(ctx context.Context) ([]Subnet, error) {
 	var subnets []Subnet
 	for rows.Next() {
 		var subnet Subnet
-		if err := rows.Scan(&subnet.ID, &subnet.CIDR); err != nil {
+		var expiresAt sql.NullTime
+		if err := rows.Scan(&subnet.ID, &subnet.CIDR, &subnet.Action, &subnet.Priority, &subnet.Comment, &expiresAt, &subnet.BandwidthLimit); err != nil {
 			return nil, fmt.Errorf("failed to scan subnet: %w", err)
 		}
+		if expiresAt.Valid {
+			subnet.ExpiresAt = &expiresAt.Time
+		}
 		subnets = append(subnets, subnet)
 	}
 
@@ -148,56 +313,98 @@ func (a *ACL) GetSubnets(ctx context.Context) ([]Subnet, error) {
 	return subnets, nil
 }
 
-// Subnet represents an ACL subnet entry
-type Subnet struct {
-	ID   int    `json:"id"`
-	CIDR string `json:"cidr"`
+// Reload rebuilds the prefix table from the database. Changes made through
+// the ACL reload it automatically; call Reload after editing the acl_subnets
+// table directly.
+func (a *ACL) Reload(ctx context.Context) error {
+	a.reloadMu.Lock()
+	defer a.reloadMu.Unlock()
+
+	subnets, err := a.GetSubnets(ctx)
+	if err != nil {
+		// Leave the table stale so the next lookup retries
+		a.table.Store(nil)
+		return err
+	}
+
+	a.table.Store(newPrefixTable(subnets))
+	return nil
 }
 
-// validateCIDR validates that the CIDR format is correct
-func (a *ACL) validateCIDR(cidr string) error {
-	_, _, err := net.ParseCIDR(cidr)
-	return err
+// changed reloads the prefix table after a mutation. A failed reload is
+// retried by the next lookup, the mutation itself has been committed.
+func (a *ACL) changed(ctx context.Context) {
+	a.Reload(ctx)
 }
 
-// ipInCIDR checks if an IP is within a CIDR range
-func (a *ACL) ipInCIDR(ip net.IP, cidr string) bool {
-	_, network, err := net.ParseCIDR(cidr)
+// prefixTable returns the current prefix table, loading it on first use
+func (a *ACL) prefixTable(ctx context.Context) (*prefixTable, error) {
+	if table := a.table.Load(); table != nil {
+		return table, nil
+	}
+
+	a.reloadMu.Lock()
+	defer a.reloadMu.Unlock()
+
+	// Another lookup may have loaded it while we waited
+	if table := a.table.Load(); table != nil {
+		return table, nil
+	}
+
+	subnets, err := a.GetSubnets(ctx)
 	if err != nil {
-		return false
+		return nil, err
 	}
-	return network.Contains(ip)
+	table := newPrefixTable(subnets)
+	a.table.Store(table)
+	return table, nil
 }
 
-// ExtractClientIP extracts the client IP from various sources
-func ExtractClientIP(remoteAddr string, headers map[string]string) string {
-	// Check for X-Forwarded-For header
-	if forwardedFor := headers["X-Forwarded-For"]; forwardedFor != "" {
-		// Take the first IP in the chain
-		ips := strings.Split(forwardedFor, ",")
-		if len(ips) > 0 {
-			ip := strings.TrimSpace(ips[0])
-			if net.ParseIP(ip) != nil {
-				return ip
-			}
-		}
+// Subnet represents an ACL entry
+type Subnet struct {
+	ID             int        `json:"id"`
+	CIDR           string     `json:"cidr"`
+	Action         string     `json:"action"`   // "allow" or "deny"
+	Priority       int        `json:"priority"` // lower is checked first
+	Comment        *string    `json:"comment,omitempty"`
+	ExpiresAt      *time.Time `json:"expires_at,omitempty"`      // ignored from then on
+	BandwidthLimit *int       `json:"bandwidth_limit,omitempty"` // bytes per second, shared by the subnet's clients
+}
+
+// validateEntry checks the CIDR and action of an entry
+func (a *ACL) validateEntry(entry *Subnet) error {
+	if err := a.validateCIDR(entry.CIDR); err != nil {
+		return fmt.Errorf("invalid CIDR format: %w", err)
 	}
+	return validateAction(entry.Action)
+}
 
-	// Check for X-Real-IP header
-	if realIP := headers["X-Real-IP"]; realIP != "" {
-		if net.ParseIP(realIP) != nil {
-			return realIP
-		}
+// validateAction checks that an action is allow or deny
+func validateAction(action string) error {
+	if action != ActionAllow && action != ActionDeny {
+		return fmt.Errorf("invalid action %q, must be %q or %q", action, ActionAllow, ActionDeny)
 	}
+	return nil
+}
 
-	// Use remote address
-	if remoteAddr != "" {
-		// Remove port if present
-		if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
-			return host
-		}
-		return remoteAddr
+// validateCIDR validates that the CIDR format is correct
+func (a *ACL) validateCIDR(cidr string) error {
+	_, err := netip.ParsePrefix(cidr)
+	return err
+}
+
+// utcTime returns a timestamp in UTC for storage, or nil
+func utcTime(t *time.Time) interface{} {
+	if t == nil {
+		return nil
 	}
+	return t.UTC()
+}
 
-	return ""
+// positiveLimit returns a bandwidth limit for storage, or nil for none
+func positiveLimit(limit *int) interface{} {
+	if limit == nil || *limit <= 0 {
+		return nil
+	}
+	return *limit
 }
@@ -1,62 +1,17 @@
 package acl
 
 import (
-	"net"
+	"context"
+	"net/netip"
+	"path/filepath"
 	"testing"
-)
+	"time"
 
-func TestExtractClientIP(t *testing.T) {
-	tests := []struct {
-		name       string
-		remoteAddr string
-		headers    map[string]string
-		expected   string
-	}{
-		{
-			name:       "X-Forwarded-For header",
-			remoteAddr: "192.168.1.1:1234",
-			headers: map[string]string{
-				"X-Forwarded-For": "10.0.0.1, 192.168.1.2",
-			},
-			expected: "10.0.0.1",
-		},
-		{
-			name:       "X-Real-IP header",
-			remoteAddr: "192.168.1.1:1234",
-			headers: map[string]string{
-				"X-Real-IP": "10.0.0.2",
-			},
-			expected: "10.0.0.2",
-		},
-		{
-			name:       "remote address with port",
-			remoteAddr: "192.168.1.1:1234",
-			headers:    map[string]string{},
-			expected:   "192.168.1.1",
-		},
-		{
-			name:       "remote address without port",
-			remoteAddr: "192.168.1.1",
-			headers:    map[string]string{},
-			expected:   "192.168.1.1",
-		},
-		{
-			name:       "empty remote address",
-			remoteAddr: "",
-			headers:    map[string]string{},
-			expected:   "",
-		},
-	}
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			result := ExtractClientIP(tt.remoteAddr, tt.headers)
-			if result != tt.expected {
-				t.Errorf("ExtractClientIP() = %v, want %v", result, tt.expected)
-			}
-		})
-	}
-}
+	"proxyrouter/internal/db"
+)
 
 func TestValidateCIDR(t *testing.T) {
 	tests := []struct {
@@ -88,29 +43,140 @@ func TestValidateCIDR(t *testing.T) {
 	}
 }
 
-func TestIPInCIDR(t *testing.T) {
+func TestIsAllowed(t *testing.T) {
+	database, err := db.New(filepath.Join(t.TempDir(), "test.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { database.Close() })
+	require.NoError(t, database.RunMigrations(filepath.Join("..", "..", "migrations")))
+
+	ctx := context.Background()
+	a := New(database.GetDB())
+	past := time.Now().Add(-time.Hour)
+	future := time.Now().Add(time.Hour)
+
+	// The seeded 192.168.10.0/24 and 192.168.11.0/24 allow entries apply
+	require.NoError(t, a.AddEntry(ctx, &Subnet{CIDR: "192.168.10.66/32", Action: ActionDeny, Priority: DefaultPriority}))
+	require.NoError(t, a.AddEntry(ctx, &Subnet{CIDR: "192.168.11.0/25", Action: ActionDeny, Priority: DefaultPriority + 1}))
+	require.NoError(t, a.AddEntry(ctx, &Subnet{CIDR: "10.0.0.0/8", Priority: DefaultPriority, ExpiresAt: &past}))
+	require.NoError(t, a.AddEntry(ctx, &Subnet{CIDR: "10.1.0.0/16", Priority: DefaultPriority, ExpiresAt: &future}))
+	require.NoError(t, a.AddEntry(ctx, &Subnet{CIDR: "2001:db8::/32", Priority: DefaultPriority}))
+	require.NoError(t, a.AddEntry(ctx, &Subnet{CIDR: "2001:db8:bad::/48", Action: ActionDeny, Priority: DefaultPriority}))
+
 	tests := []struct {
-		name     string
-		ip       string
-		cidr     string
-		expected bool
+		ip      string
+		allowed bool
 	}{
-		{"in range", "192.168.10.5", "192.168.10.0/24", true},
-		{"in range", "192.168.10.255", "192.168.10.0/24", true},
-		{"not in range", "192.168.11.5", "192.168.10.0/24", false},
-		{"invalid IP", "invalid", "192.168.10.0/24", false},
-		{"invalid CIDR", "192.168.10.5", "invalid", false},
+		{"192.168.10.5", true},
+		{"192.168.10.66", false},        // a more specific deny
+		{"::ffff:192.168.10.66", false}, // the same client seen over IPv6
+		{"::ffff:192.168.10.5", true},   // IPv4-mapped
+		{"192.168.11.5", true},          // the deny has a lower priority
+		{"10.2.0.1", false},             // expired
+		{"10.1.0.1", true},              // not expired yet
+		{"2001:db8::1", true},
+		{"2001:db8:bad::1", false},
+		{"2001:db9::1", false},  // no entry
+		{"fe80::1%eth0", false}, // zones are ignored
+		{"172.16.0.1", false},
+	}
+	for _, tt := range tests {
+		allowed, err := a.IsAllowed(ctx, tt.ip)
+		require.NoError(t, err, tt.ip)
+		assert.Equal(t, tt.allowed, allowed, tt.ip)
 	}
 
-	acl := &ACL{}
+	_, err = a.IsAllowed(ctx, "invalid")
+	assert.Error(t, err)
+}
 
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			ip := net.ParseIP(tt.ip)
-			result := acl.ipInCIDR(ip, tt.cidr)
-			if result != tt.expected {
-				t.Errorf("ipInCIDR(%q, %q) = %v, want %v", tt.ip, tt.cidr, result, tt.expected)
-			}
-		})
+func TestUpdateEntry(t *testing.T) {
+	database, err := db.New(filepath.Join(t.TempDir(), "test.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { database.Close() })
+	require.NoError(t, database.RunMigrations(filepath.Join("..", "..", "migrations")))
+
+	ctx := context.Background()
+	a := New(database.GetDB())
+	comment := "contractor laptop"
+	entry := &Subnet{CIDR: "10.9.0.0/16", Priority: DefaultPriority, Comment: &comment}
+	require.NoError(t, a.AddEntry(ctx, entry))
+	require.NotZero(t, entry.ID)
+
+	allowed, err := a.IsAllowed(ctx, "10.9.1.1")
+	require.NoError(t, err)
+	assert.True(t, allowed)
+
+	// A change takes effect at once
+	deny := ActionDeny
+	found, err := a.UpdateEntry(ctx, entry.ID, EntryUpdate{Action: &deny})
+	require.NoError(t, err)
+	assert.True(t, found)
+	allowed, err = a.IsAllowed(ctx, "10.9.1.1")
+	require.NoError(t, err)
+	assert.False(t, allowed)
+
+	// A temporary grant ends at its expiry
+	allow := ActionAllow
+	expiresAt := time.Now().Add(time.Hour)
+	empty := ""
+	_, err = a.UpdateEntry(ctx, entry.ID, EntryUpdate{Action: &allow, ExpiresAt: &expiresAt, Comment: &empty})
+	require.NoError(t, err)
+
+	subnets, err := a.GetSubnets(ctx)
+	require.NoError(t, err)
+	var updated *Subnet
+	for i := range subnets {
+		if subnets[i].ID == entry.ID {
+			updated = &subnets[i]
+		}
 	}
+	require.NotNil(t, updated)
+	assert.Equal(t, ActionAllow, updated.Action)
+	assert.Nil(t, updated.Comment)
+	require.NotNil(t, updated.ExpiresAt)
+	assert.WithinDuration(t, expiresAt, *updated.ExpiresAt, time.Second)
+
+	table, err := a.prefixTable(ctx)
+	require.NoError(t, err)
+	assert.NotNil(t, table.decide(netip.MustParseAddr("10.9.1.1"), time.Now()))
+	assert.Nil(t, table.decide(netip.MustParseAddr("10.9.1.1"), expiresAt.Add(time.Second)))
+
+	bad := "block"
+	_, err = a.UpdateEntry(ctx, entry.ID, EntryUpdate{Action: &bad})
+	assert.Error(t, err)
+	found, err = a.UpdateEntry(ctx, entry.ID+100, EntryUpdate{Action: &allow})
+	require.NoError(t, err)
+	assert.False(t, found)
+
+	// Posting the same CIDR again replaces the entry
+	require.NoError(t, a.AddEntry(ctx, &Subnet{CIDR: "10.9.0.0/16", Action: ActionDeny, Priority: 5}))
+	subnets, err = a.GetSubnets(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "10.9.0.0/16", subnets[0].CIDR)
+	assert.Equal(t, ActionDeny, subnets[0].Action)
+	assert.Nil(t, subnets[0].ExpiresAt)
+}
+
+func TestReloadAfterDirectEdit(t *testing.T) {
+	database, err := db.New(filepath.Join(t.TempDir(), "test.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { database.Close() })
+	require.NoError(t, database.RunMigrations(filepath.Join("..", "..", "migrations")))
+
+	ctx := context.Background()
+	a := New(database.GetDB())
+	allowed, err := a.IsAllowed(ctx, "127.0.0.1")
+	require.NoError(t, err)
+	assert.False(t, allowed)
+
+	_, err = database.GetDB().Exec("INSERT INTO acl_subnets (cidr) VALUES ('127.0.0.0/8')")
+	require.NoError(t, err)
+	allowed, err = a.IsAllowed(ctx, "127.0.0.1")
+	require.NoError(t, err)
+	assert.False(t, allowed, "the table is only rebuilt on reload")
+
+	require.NoError(t, a.Reload(ctx))
+	allowed, err = a.IsAllowed(ctx, "127.0.0.1")
+	require.NoError(t, err)
+	assert.True(t, allowed)
 }
@@ -0,0 +1,126 @@
+package acl
+
+import (
+	"net/netip"
+	"time"
+)
+
+// prefixTable is an immutable binary trie of the ACL entries, keyed by the
+// bits of their prefixes. IPv4 prefixes are stored as IPv4-mapped IPv6
+// prefixes, so "10.0.0.0/8" also matches a client seen as "::ffff:10.1.2.3".
+// It is built from the database when the ACL changes and swapped in
+// atomically, so decisions never touch SQLite.
+type prefixTable struct {
+	root prefixNode
+}
+
+// prefixNode holds the entries whose prefix ends at its depth
+type prefixNode struct {
+	children [2]*prefixNode
+	entries  []*Subnet
+}
+
+// newPrefixTable indexes entries by prefix, skipping any that do not parse
+func newPrefixTable(entries []Subnet) *prefixTable {
+	t := &prefixTable{}
+	for i := range entries {
+		prefix, err := netip.ParsePrefix(entries[i].CIDR)
+		if err != nil {
+			continue
+		}
+		t.insert(normalizePrefix(prefix), &entries[i])
+	}
+	return t
+}
+
+// insert adds an entry under a normalized prefix
+func (t *prefixTable) insert(prefix netip.Prefix, entry *Subnet) {
+	addr := prefix.Addr().As16()
+	node := &t.root
+	for i := 0; i < prefix.Bits(); i++ {
+		bit := addrBit(addr, i)
+		if node.children[bit] == nil {
+			node.children[bit] = &prefixNode{}
+		}
+		node = node.children[bit]
+	}
+	node.entries = append(node.entries, entry)
+}
+
+// lookup calls visit with each unexpired entry whose prefix contains addr,
+// from the shortest prefix to the longest
+func (t *prefixTable) lookup(addr netip.Addr, now time.Time, visit func(bits int, entry *Subnet)) {
+	key := normalizeAddr(addr).As16()
+	node := &t.root
+	for bits := 0; node != nil; bits++ {
+		for _, entry := range node.entries {
+			if entry.ExpiresAt == nil || entry.ExpiresAt.After(now) {
+				visit(bits, entry)
+			}
+		}
+		if bits == 128 {
+			break
+		}
+		node = node.children[addrBit(key, bits)]
+	}
+}
+
+// decide returns the entry that decides whether addr may connect, or nil if
+// no entry contains it. The lowest priority wins, then the longest prefix,
+// then deny.
+func (t *prefixTable) decide(addr netip.Addr, now time.Time) *Subnet {
+	var best *Subnet
+	bestBits := 0
+	t.lookup(addr, now, func(bits int, entry *Subnet) {
+		if best == nil || outranks(entry, bits, best, bestBits) {
+			best, bestBits = entry, bits
+		}
+	})
+	return best
+}
+
+// outranks reports whether entry a with a prefix of aBits decides before
+// entry b with a prefix of bBits
+func outranks(a *Subnet, aBits int, b *Subnet, bBits int) bool {
+	if a.Priority != b.Priority {
+		return a.Priority < b.Priority
+	}
+	if aBits != bBits {
+		return aBits > bBits
+	}
+	return a.Action == ActionDeny && b.Action != ActionDeny
+}
+
+// bandwidthLimit returns the most specific allow entry with a bandwidth
+// limit that contains addr, or nil
+func (t *prefixTable) bandwidthLimit(addr netip.Addr, now time.Time) *Subnet {
+	var best *Subnet
+	t.lookup(addr, now, func(bits int, entry *Subnet) {
+		if entry.Action == ActionAllow && entry.BandwidthLimit != nil && *entry.BandwidthLimit > 0 {
+			best = entry
+		}
+	})
+	return best
+}
+
+// normalizePrefix masks a prefix and maps IPv4 into the IPv4-mapped IPv6
+// range
+func normalizePrefix(prefix netip.Prefix) netip.Prefix {
+	prefix = prefix.Masked()
+	if prefix.Addr().Is4() {
+		return netip.PrefixFrom(netip.AddrFrom16(prefix.Addr().As16()), prefix.Bits()+96)
+	}
+	return prefix
+}
+
+// normalizeAddr maps an IPv4 address into the IPv4-mapped IPv6 range and
+// drops its zone
+func normalizeAddr(addr netip.Addr) netip.Addr {
+	return netip.AddrFrom16(addr.As16())
+}
+
+// addrBit returns bit i of a 128-bit address, counting from the most
+// significant
+func addrBit(addr [16]byte, i int) int {
+	return int(addr[i/8]>>(7-i%8)) & 1
+}
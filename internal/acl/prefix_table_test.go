@@ -0,0 +1,75 @@
+package acl
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrefixTableContains(t *testing.T) {
+	tests := []struct {
+		name     string
+		ip       string
+		cidr     string
+		expected bool
+	}{
+		{"in range", "192.168.10.5", "192.168.10.0/24", true},
+		{"in range", "192.168.10.255", "192.168.10.0/24", true},
+		{"not in range", "192.168.11.5", "192.168.10.0/24", false},
+		{"unmasked CIDR", "192.168.10.5", "192.168.10.1/24", true},
+		{"invalid CIDR", "192.168.10.5", "invalid", false},
+		{"IPv4-mapped client", "::ffff:192.168.10.5", "192.168.10.0/24", true},
+		{"IPv4-mapped CIDR", "192.168.10.5", "::ffff:192.168.10.0/120", true},
+		{"IPv6", "2001:db8::1", "2001:db8::/32", true},
+		{"IPv6 not in range", "2001:db9::1", "2001:db8::/32", false},
+		{"IPv6 client, IPv4 CIDR", "2001:db8::1", "0.0.0.0/0", false},
+		{"IPv4 client, IPv6 CIDR", "192.168.10.5", "2001:db8::/32", false},
+		{"any IPv6 address", "::ffff:10.0.0.1", "::/0", true},
+		{"host route", "2001:db8::1", "2001:db8::1/128", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			table := newPrefixTable([]Subnet{{CIDR: tt.cidr, Action: ActionAllow}})
+			entry := table.decide(netip.MustParseAddr(tt.ip), time.Now())
+			assert.Equal(t, tt.expected, entry != nil, "%s in %s", tt.ip, tt.cidr)
+		})
+	}
+}
+
+func TestPrefixTableDecide(t *testing.T) {
+	limit := 1000
+	table := newPrefixTable([]Subnet{
+		{ID: 1, CIDR: "10.0.0.0/8", Action: ActionAllow, Priority: 100, BandwidthLimit: &limit},
+		{ID: 2, CIDR: "10.1.0.0/16", Action: ActionDeny, Priority: 100},
+		{ID: 3, CIDR: "10.1.2.0/24", Action: ActionAllow, Priority: 50},
+		{ID: 4, CIDR: "::ffff:10.2.0.0/112", Action: ActionDeny, Priority: 100},
+		{ID: 5, CIDR: "10.2.0.0/16", Action: ActionAllow, Priority: 100},
+	})
+	now := time.Now()
+
+	tests := []struct {
+		ip string
+		id int
+	}{
+		{"10.0.0.1", 1}, // only entry
+		{"10.1.0.1", 2}, // longer prefix
+		{"10.1.2.1", 3}, // lower priority beats a longer deny
+		{"10.2.0.1", 4}, // same prefix and priority, deny wins
+	}
+	for _, tt := range tests {
+		entry := table.decide(netip.MustParseAddr(tt.ip), now)
+		if assert.NotNil(t, entry, tt.ip) {
+			assert.Equal(t, tt.id, entry.ID, tt.ip)
+		}
+	}
+
+	// Bandwidth limits come from allow entries only
+	entry := table.bandwidthLimit(netip.MustParseAddr("10.1.2.1"), now)
+	if assert.NotNil(t, entry) {
+		assert.Equal(t, 1, entry.ID)
+	}
+	assert.Nil(t, table.bandwidthLimit(netip.MustParseAddr("192.168.0.1"), now))
+}
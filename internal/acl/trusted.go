@@ -0,0 +1,121 @@
+package acl
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// TrustedProxies are the load balancers and reverse proxies whose PROXY
+// protocol headers and X-Forwarded-For headers are believed. A nil
+// *TrustedProxies trusts no one.
+type TrustedProxies struct {
+	prefixes []netip.Prefix
+}
+
+// NewTrustedProxies parses a list of CIDRs or single IP addresses
+func NewTrustedProxies(cidrs []string) (*TrustedProxies, error) {
+	t := &TrustedProxies{}
+	for _, cidr := range cidrs {
+		prefix, err := parseTrustedPrefix(strings.TrimSpace(cidr))
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", cidr, err)
+		}
+		t.prefixes = append(t.prefixes, prefix)
+	}
+	return t, nil
+}
+
+// parseTrustedPrefix parses a CIDR, or an IP address as a single host
+func parseTrustedPrefix(s string) (netip.Prefix, error) {
+	if !strings.Contains(s, "/") {
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		addr = addr.Unmap().WithZone("")
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+	prefix, err := netip.ParsePrefix(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return prefix.Masked(), nil
+}
+
+// Len returns the number of trusted prefixes
+func (t *TrustedProxies) Len() int {
+	if t == nil {
+		return 0
+	}
+	return len(t.prefixes)
+}
+
+// Contains reports whether ip, with or without a port, is a trusted proxy
+func (t *TrustedProxies) Contains(ip string) bool {
+	if t.Len() == 0 {
+		return false
+	}
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap().WithZone("")
+	for _, prefix := range t.prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ExtractClientIP returns the IP of the client behind remoteAddr. Headers
+// are only believed when remoteAddr is a trusted proxy: X-Forwarded-For is
+// read from the nearest hop back to the first address that is not a trusted
+// proxy, and X-Real-IP is used when there is no X-Forwarded-For.
+func ExtractClientIP(remoteAddr string, headers http.Header, trusted *TrustedProxies) string {
+	clientIP := remoteAddr
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		clientIP = host
+	}
+	if !trusted.Contains(clientIP) {
+		return clientIP
+	}
+
+	if hops := forwardedFor(headers); len(hops) > 0 {
+		for i := len(hops) - 1; i >= 0; i-- {
+			if net.ParseIP(hops[i]) == nil {
+				break
+			}
+			clientIP = hops[i]
+			if !trusted.Contains(clientIP) {
+				break
+			}
+		}
+		return clientIP
+	}
+
+	if realIP := strings.TrimSpace(headers.Get("X-Real-IP")); net.ParseIP(realIP) != nil {
+		return realIP
+	}
+	return clientIP
+}
+
+// forwardedFor returns the addresses of all X-Forwarded-For headers, the
+// client first
+func forwardedFor(headers http.Header) []string {
+	var hops []string
+	for _, field := range headers.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(field, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, hop)
+			}
+		}
+	}
+	return hops
+}
@@ -0,0 +1,106 @@
+package acl
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTrustedProxiesContains(t *testing.T) {
+	trusted, err := NewTrustedProxies([]string{"10.0.0.0/8", "192.168.1.5", "fd00::/8"})
+	require.NoError(t, err)
+
+	assert.True(t, trusted.Contains("10.1.2.3"))
+	assert.True(t, trusted.Contains("10.1.2.3:4567"))
+	assert.True(t, trusted.Contains("::ffff:10.1.2.3"))
+	assert.True(t, trusted.Contains("192.168.1.5"))
+	assert.True(t, trusted.Contains("[fd00::1]:80"))
+	assert.False(t, trusted.Contains("192.168.1.6"))
+	assert.False(t, trusted.Contains("not-an-ip"))
+
+	var none *TrustedProxies
+	assert.False(t, none.Contains("10.1.2.3"))
+
+	_, err = NewTrustedProxies([]string{"10.0.0.0/33"})
+	assert.Error(t, err)
+}
+
+func TestExtractClientIP(t *testing.T) {
+	trusted, err := NewTrustedProxies([]string{"192.168.1.0/24"})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		headers    http.Header
+		expected   string
+	}{
+		{
+			name:       "X-Forwarded-For from a trusted proxy",
+			remoteAddr: "192.168.1.1:1234",
+			headers:    http.Header{"X-Forwarded-For": {"10.0.0.1"}},
+			expected:   "10.0.0.1",
+		},
+		{
+			name:       "X-Forwarded-For through several trusted proxies",
+			remoteAddr: "192.168.1.1:1234",
+			headers:    http.Header{"X-Forwarded-For": {"10.0.0.1, 192.168.1.2"}},
+			expected:   "10.0.0.1",
+		},
+		{
+			name:       "X-Forwarded-For entries before the first untrusted hop are ignored",
+			remoteAddr: "192.168.1.1:1234",
+			headers:    http.Header{"X-Forwarded-For": {"1.1.1.1", "10.0.0.1"}},
+			expected:   "10.0.0.1",
+		},
+		{
+			name:       "invalid X-Forwarded-For entry",
+			remoteAddr: "192.168.1.1:1234",
+			headers:    http.Header{"X-Forwarded-For": {"garbage, 192.168.1.2"}},
+			expected:   "192.168.1.2",
+		},
+		{
+			name:       "X-Forwarded-For from an untrusted client",
+			remoteAddr: "10.9.9.9:1234",
+			headers:    http.Header{"X-Forwarded-For": {"10.0.0.1"}},
+			expected:   "10.9.9.9",
+		},
+		{
+			name:       "X-Real-IP from a trusted proxy",
+			remoteAddr: "192.168.1.1:1234",
+			headers:    http.Header{"X-Real-Ip": {"10.0.0.2"}},
+			expected:   "10.0.0.2",
+		},
+		{
+			name:       "X-Real-IP from an untrusted client",
+			remoteAddr: "10.9.9.9:1234",
+			headers:    http.Header{"X-Real-Ip": {"10.0.0.2"}},
+			expected:   "10.9.9.9",
+		},
+		{
+			name:       "remote address with port",
+			remoteAddr: "192.168.1.1:1234",
+			expected:   "192.168.1.1",
+		},
+		{
+			name:       "remote address without port",
+			remoteAddr: "192.168.1.1",
+			expected:   "192.168.1.1",
+		},
+		{
+			name:     "empty remote address",
+			expected: "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, ExtractClientIP(tt.remoteAddr, tt.headers, trusted))
+		})
+	}
+
+	// Without trusted proxies no header is believed
+	assert.Equal(t, "192.168.1.1", ExtractClientIP("192.168.1.1:1234", http.Header{"X-Forwarded-For": {"10.0.0.1"}}, nil))
+}
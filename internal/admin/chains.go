@@ -0,0 +1,305 @@
+package admin
+
+import (
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"proxyrouter/internal/router"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// ListChains displays CHAIN routes and a form to create new ones
+func (h *Handlers) ListChains(w http.ResponseWriter, r *http.Request) {
+	// Get session from context
+	session, ok := r.Context().Value("session").(*Session)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	routes, err := h.router.GetRoutesWithContext(r.Context())
+	if err != nil {
+		slog.Error("Failed to get routes", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	// Generate CSRF token
+	csrfToken := h.middleware.generateCSRFToken(session.Username)
+
+	var rows strings.Builder
+	for _, route := range routes {
+		if route.Group != router.RouteGroupChain {
+			continue
+		}
+		fmt.Fprintf(&rows, `
+                <tr>
+                    <td>%d</td>
+                    <td>%s</td>
+                    <td>%s</td>
+                    <td>%d</td>
+                    <td>%t</td>
+                    <td>
+                        <form method="post" action="/admin/chains/%d/hops">
+                            <input type="hidden" name="csrf_token" value="%s">
+                            <textarea name="hops" rows="3">%s</textarea>
+                            <button type="submit" class="btn">Save Hops</button>
+                        </form>
+                    </td>
+                    <td>
+                        <form method="post" action="/admin/chains/%d/delete">
+                            <input type="hidden" name="csrf_token" value="%s">
+                            <button type="submit" class="btn" style="background: #dc3545;">Delete</button>
+                        </form>
+                    </td>
+                </tr>`,
+			route.ID,
+			template.HTMLEscapeString(stringOrAny(route.ClientCIDR)),
+			template.HTMLEscapeString(stringOrAny(route.HostGlob)),
+			route.Precedence,
+			route.Enabled,
+			route.ID, csrfToken, template.HTMLEscapeString(formatHops(route.Hops)),
+			route.ID, csrfToken,
+		)
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	fmt.Fprintf(w, `
+<!DOCTYPE html>
+<html>
+<head>
+    <title>Proxy Chains - ProxyRouter Admin</title>
+    <style>
+        body { font-family: Arial, sans-serif; margin: 20px; }
+        .container { max-width: 1200px; margin: 0 auto; }
+        .header { background: #f5f5f5; padding: 20px; margin-bottom: 20px; }
+        .nav { background: #333; color: white; padding: 10px; }
+        .nav a { color: white; text-decoration: none; margin-right: 20px; }
+        .content { padding: 20px; }
+        .form-group { margin-bottom: 15px; }
+        .form-group label { display: block; margin-bottom: 5px; }
+        .form-group input, .form-group textarea { width: 100%%; padding: 8px; }
+        .btn { background: #007cba; color: white; padding: 10px 20px; border: none; cursor: pointer; }
+        .btn:hover { background: #005a87; }
+        table { width: 100%%; border-collapse: collapse; margin-bottom: 20px; }
+        th, td { border: 1px solid #ddd; padding: 8px; text-align: left; vertical-align: top; }
+    </style>
+</head>
+<body>
+    <div class="container">
+        <div class="header">
+            <h1>Proxy Chains</h1>
+        </div>
+        <div class="nav">
+            <a href="/admin/">Dashboard</a>
+            <a href="/admin/settings">Settings</a>
+            <a href="/admin/upload">Upload Proxies</a>
+            <a href="/admin/chains">Chains</a>
+            <a href="/admin/explain">Explain</a>
+            <a href="/admin/connections">Connections</a>
+            <a href="/admin/users">Users</a>
+            <form method="post" action="/admin/logout" style="display: inline;">
+                <button type="submit" class="btn" style="background: #dc3545;">Logout</button>
+            </form>
+        </div>
+        <div class="content">
+            <h2>Chain Routes</h2>
+            <p>One hop per line, dialed top to bottom: <code>TOR</code>, <code>GENERAL</code> or <code>UPSTREAM &lt;proxy id&gt;</code>, optionally followed by <code>timeout=&lt;ms&gt;</code>.</p>
+            <table>
+                <tr><th>ID</th><th>Client CIDR</th><th>Host Glob</th><th>Precedence</th><th>Enabled</th><th>Hops</th><th></th></tr>%s
+            </table>
+            <h2>Create Chain</h2>
+            <form method="post" action="/admin/chains">
+                <input type="hidden" name="csrf_token" value="%s">
+                <div class="form-group">
+                    <label>Host glob (empty = any host):</label>
+                    <input type="text" name="host_glob" placeholder="*.example.com">
+                </div>
+                <div class="form-group">
+                    <label>Client CIDR (empty = any client):</label>
+                    <input type="text" name="client_cidr" placeholder="192.168.10.0/24">
+                </div>
+                <div class="form-group">
+                    <label>Precedence:</label>
+                    <input type="number" name="precedence" value="100">
+                </div>
+                <div class="form-group">
+                    <label>Hops:</label>
+                    <textarea name="hops" rows="4" placeholder="TOR&#10;UPSTREAM 12 timeout=5000"></textarea>
+                </div>
+                <button type="submit" class="btn">Create Chain</button>
+            </form>
+        </div>
+    </div>
+</body>
+</html>
+`, rows.String(), csrfToken)
+}
+
+// CreateChain handles creation of a CHAIN route
+func (h *Handlers) CreateChain(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	hops, err := parseHops(r.FormValue("hops"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid hops: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	precedence := 100
+	if value := r.FormValue("precedence"); value != "" {
+		precedence, err = strconv.Atoi(value)
+		if err != nil {
+			http.Error(w, "Invalid precedence", http.StatusBadRequest)
+			return
+		}
+	}
+
+	route := router.Route{
+		Group:      router.RouteGroupChain,
+		HostGlob:   optionalString(r.FormValue("host_glob")),
+		ClientCIDR: optionalString(r.FormValue("client_cidr")),
+		Precedence: precedence,
+		Enabled:    true,
+		Hops:       hops,
+	}
+
+	if err := h.router.CreateRouteWithContext(r.Context(), &route); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to create chain: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	h.logChainAudit(r, "create_chain", fmt.Sprintf("route %d: %s", route.ID, formatHops(hops)))
+	http.Redirect(w, r, "/admin/chains", http.StatusSeeOther)
+}
+
+// UpdateChainHops replaces the hops of a CHAIN route
+func (h *Handlers) UpdateChainHops(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid route ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	hops, err := parseHops(r.FormValue("hops"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid hops: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	if err := h.router.SetRouteHops(r.Context(), id, hops); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to update chain: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	h.logChainAudit(r, "update_chain", fmt.Sprintf("route %d: %s", id, formatHops(hops)))
+	http.Redirect(w, r, "/admin/chains", http.StatusSeeOther)
+}
+
+// DeleteChain deletes a CHAIN route and its hops
+func (h *Handlers) DeleteChain(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid route ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.router.DeleteRouteWithContext(r.Context(), id); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to delete chain: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	h.logChainAudit(r, "delete_chain", fmt.Sprintf("route %d", id))
+	http.Redirect(w, r, "/admin/chains", http.StatusSeeOther)
+}
+
+// logChainAudit records a chain change in the audit log
+func (h *Handlers) logChainAudit(r *http.Request, action, details string) {
+	if session, ok := r.Context().Value("session").(*Session); ok {
+		h.authManager.LogAudit(r.Context(), session.Username, action, details, h.middleware.getClientIP(r))
+	}
+}
+
+// parseHops parses one hop per line, e.g. "TOR" or "UPSTREAM 12 timeout=5000"
+func parseHops(text string) ([]router.Hop, error) {
+	var hops []router.Hop
+
+	for _, line := range strings.Split(text, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		hop := router.Hop{Group: router.RouteGroup(strings.ToUpper(fields[0]))}
+		for _, field := range fields[1:] {
+			if value, ok := strings.CutPrefix(field, "timeout="); ok {
+				timeout, err := strconv.Atoi(value)
+				if err != nil {
+					return nil, fmt.Errorf("invalid timeout in %q", line)
+				}
+				hop.TimeoutMS = &timeout
+				continue
+			}
+
+			proxyID, err := strconv.Atoi(field)
+			if err != nil || hop.ProxyID != nil {
+				return nil, fmt.Errorf("unexpected %q in %q", field, line)
+			}
+			hop.ProxyID = &proxyID
+		}
+
+		hops = append(hops, hop)
+	}
+
+	if err := router.ValidateHops(hops); err != nil {
+		return nil, err
+	}
+
+	return hops, nil
+}
+
+// formatHops renders hops in the format accepted by parseHops
+func formatHops(hops []router.Hop) string {
+	lines := make([]string, 0, len(hops))
+	for _, hop := range hops {
+		line := string(hop.Group)
+		if hop.ProxyID != nil {
+			line += " " + strconv.Itoa(*hop.ProxyID)
+		}
+		if hop.TimeoutMS != nil {
+			line += " timeout=" + strconv.Itoa(*hop.TimeoutMS)
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// optionalString returns nil for an empty form value
+func optionalString(value string) *string {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return nil
+	}
+	return &value
+}
+
+// stringOrAny renders an optional match field
+func stringOrAny(value *string) string {
+	if value == nil {
+		return "any"
+	}
+	return *value
+}
@@ -0,0 +1,142 @@
+package admin
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// connectionsRefreshSeconds is how often the connections page reloads itself
+const connectionsRefreshSeconds = 5
+
+// ListConnections displays the open proxy connections with a button to
+// close each of them
+func (h *Handlers) ListConnections(w http.ResponseWriter, r *http.Request) {
+	// Get session from context
+	session, ok := r.Context().Value("session").(*Session)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// Generate CSRF token
+	csrfToken := h.middleware.generateCSRFToken(session.Username)
+
+	conns := h.tracker.List()
+	var rows strings.Builder
+	for _, conn := range conns {
+		fmt.Fprintf(&rows, `
+                <tr>
+                    <td>%d</td>
+                    <td>%s</td>
+                    <td>%s</td>
+                    <td>%s</td>
+                    <td>%s</td>
+                    <td>%s</td>
+                    <td>%s</td>
+                    <td>%s</td>
+                    <td>%s</td>
+                    <td>%d</td>
+                    <td>%d</td>
+                    <td>
+                        <form method="post" action="/admin/connections/%d/close">
+                            <input type="hidden" name="csrf_token" value="%s">
+                            <button type="submit" class="btn" style="background: #dc3545;">Close</button>
+                        </form>
+                    </td>
+                </tr>`,
+			conn.ID,
+			template.HTMLEscapeString(conn.ClientIP),
+			template.HTMLEscapeString(conn.User),
+			template.HTMLEscapeString(conn.Protocol),
+			template.HTMLEscapeString(conn.Target),
+			idOrNone(conn.RouteID),
+			template.HTMLEscapeString(conn.Group),
+			idOrNone(conn.ProxyID),
+			time.Since(conn.StartedAt).Round(time.Second),
+			conn.BytesIn,
+			conn.BytesOut,
+			conn.ID, csrfToken,
+		)
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	fmt.Fprintf(w, `
+<!DOCTYPE html>
+<html>
+<head>
+    <title>Connections - ProxyRouter Admin</title>
+    <meta http-equiv="refresh" content="%d">
+    <style>
+        body { font-family: Arial, sans-serif; margin: 20px; }
+        .container { max-width: 1200px; margin: 0 auto; }
+        .header { background: #f5f5f5; padding: 20px; margin-bottom: 20px; }
+        .nav { background: #333; color: white; padding: 10px; }
+        .nav a { color: white; text-decoration: none; margin-right: 20px; }
+        .content { padding: 20px; }
+        .btn { background: #007cba; color: white; padding: 10px 20px; border: none; cursor: pointer; }
+        .btn:hover { background: #005a87; }
+        table { width: 100%%; border-collapse: collapse; margin-bottom: 20px; }
+        th, td { border: 1px solid #ddd; padding: 8px; text-align: left; vertical-align: top; }
+    </style>
+</head>
+<body>
+    <div class="container">
+        <div class="header">
+            <h1>Connections</h1>
+        </div>
+        <div class="nav">
+            <a href="/admin/">Dashboard</a>
+            <a href="/admin/settings">Settings</a>
+            <a href="/admin/upload">Upload Proxies</a>
+            <a href="/admin/chains">Chains</a>
+            <a href="/admin/explain">Explain</a>
+            <a href="/admin/connections">Connections</a>
+            <a href="/admin/users">Users</a>
+            <form method="post" action="/admin/logout" style="display: inline;">
+                <button type="submit" class="btn" style="background: #dc3545;">Logout</button>
+            </form>
+        </div>
+        <div class="content">
+            <h2>Open Connections (%d)</h2>
+            <p>This page reloads every %d seconds. Bytes in are read from the client, bytes out are sent to it.</p>
+            <table>
+                <tr><th>ID</th><th>Client</th><th>User</th><th>Protocol</th><th>Target</th><th>Route</th><th>Group</th><th>Proxy</th><th>Age</th><th>Bytes In</th><th>Bytes Out</th><th></th></tr>%s
+            </table>
+        </div>
+    </div>
+</body>
+</html>
+`, connectionsRefreshSeconds, len(conns), connectionsRefreshSeconds, rows.String())
+}
+
+// CloseConnection forcibly closes an open proxy connection
+func (h *Handlers) CloseConnection(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid connection ID", http.StatusBadRequest)
+		return
+	}
+
+	if h.tracker.Close(id) {
+		if session, ok := r.Context().Value("session").(*Session); ok {
+			h.authManager.LogAudit(r.Context(), session.Username, "close_connection", fmt.Sprintf("connection %d", id), h.middleware.getClientIP(r))
+		}
+	}
+
+	// A connection that ended in the meantime is gone either way
+	http.Redirect(w, r, "/admin/connections", http.StatusSeeOther)
+}
+
+// idOrNone renders an optional ID
+func idOrNone(id *int) string {
+	if id == nil {
+		return "-"
+	}
+	return strconv.Itoa(*id)
+}
@@ -0,0 +1,266 @@
+package admin
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"proxyrouter/internal/router"
+)
+
+// explainForm holds the request and draft route fields of the explain panel
+type explainForm struct {
+	values url.Values
+}
+
+// get returns a form value, escaped for HTML
+func (f explainForm) get(name string) string {
+	return template.HTMLEscapeString(f.values.Get(name))
+}
+
+// ExplainRoute displays which route a request would take and why earlier
+// routes were skipped, optionally with a draft route that has not been saved
+func (h *Handlers) ExplainRoute(w http.ResponseWriter, r *http.Request) {
+	form := explainForm{values: r.URL.Query()}
+
+	var result string
+	if form.values.Get("client") != "" && form.values.Get("host") != "" {
+		result = h.renderExplanation(r, form.values)
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	fmt.Fprintf(w, `
+<!DOCTYPE html>
+<html>
+<head>
+    <title>Explain Route - ProxyRouter Admin</title>
+    <style>
+        body { font-family: Arial, sans-serif; margin: 20px; }
+        .container { max-width: 1200px; margin: 0 auto; }
+        .header { background: #f5f5f5; padding: 20px; margin-bottom: 20px; }
+        .nav { background: #333; color: white; padding: 10px; }
+        .nav a { color: white; text-decoration: none; margin-right: 20px; }
+        .content { padding: 20px; }
+        .form-row { display: flex; gap: 10px; margin-bottom: 15px; }
+        .form-row label { flex: 1; }
+        .form-row input, .form-row select { width: 100%%; padding: 8px; box-sizing: border-box; }
+        .btn { background: #007cba; color: white; padding: 10px 20px; border: none; cursor: pointer; }
+        .btn:hover { background: #005a87; }
+        .match { background: #d4edda; padding: 10px; margin-bottom: 15px; }
+        .error { background: #f8d7da; padding: 10px; margin-bottom: 15px; }
+        table { width: 100%%; border-collapse: collapse; margin-bottom: 20px; }
+        th, td { border: 1px solid #ddd; padding: 8px; text-align: left; vertical-align: top; }
+    </style>
+</head>
+<body>
+    <div class="container">
+        <div class="header">
+            <h1>Explain Route</h1>
+        </div>
+        <div class="nav">
+            <a href="/admin/">Dashboard</a>
+            <a href="/admin/settings">Settings</a>
+            <a href="/admin/upload">Upload Proxies</a>
+            <a href="/admin/chains">Chains</a>
+            <a href="/admin/explain">Explain</a>
+            <a href="/admin/connections">Connections</a>
+            <a href="/admin/users">Users</a>
+            <form method="post" action="/admin/logout" style="display: inline;">
+                <button type="submit" class="btn" style="background: #dc3545;">Logout</button>
+            </form>
+        </div>
+        <div class="content">
+            <form method="get" action="/admin/explain">
+                <h2>Request</h2>
+                <div class="form-row">
+                    <label>Client IP <input type="text" name="client" value="%s" placeholder="192.168.10.5"></label>
+                    <label>User <input type="text" name="user" value="%s"></label>
+                    <label>Host <input type="text" name="host" value="%s" placeholder="www.example.com"></label>
+                    <label>Port <input type="number" name="port" value="%s" placeholder="443"></label>
+                </div>
+                <div class="form-row">
+                    <label>Method <input type="text" name="method" value="%s" placeholder="CONNECT"></label>
+                    <label>Scheme <input type="text" name="scheme" value="%s" placeholder="http"></label>
+                    <label>Path <input type="text" name="path" value="%s" placeholder="/"></label>
+                </div>
+                <h2>Draft Route (optional)</h2>
+                <p>Fill in a group to test a rule as if it had been saved.</p>
+                <div class="form-row">
+                    <label>Group <input type="text" name="draft_group" value="%s" placeholder="LOCAL"></label>
+                    <label>Precedence <input type="number" name="draft_precedence" value="%s" placeholder="100"></label>
+                    <label>Upstream proxy ID <input type="number" name="draft_proxy_id" value="%s"></label>
+                </div>
+                <div class="form-row">
+                    <label>Client CIDR <input type="text" name="draft_client_cidr" value="%s"></label>
+                    <label>Client user <input type="text" name="draft_client_user" value="%s"></label>
+                    <label>Host glob <input type="text" name="draft_host_glob" value="%s" placeholder="*.example.com"></label>
+                    <label>Host regex <input type="text" name="draft_host_regex" value="%s"></label>
+                </div>
+                <div class="form-row">
+                    <label>Ports <input type="text" name="draft_dst_ports" value="%s" placeholder="80,443"></label>
+                    <label>Methods <input type="text" name="draft_methods" value="%s"></label>
+                    <label>Time window <input type="text" name="draft_time_window" value="%s" placeholder="* 9-17 * * 1-5"></label>
+                </div>
+                <button type="submit" class="btn">Explain</button>
+            </form>
+            %s
+        </div>
+    </div>
+</body>
+</html>
+`,
+		form.get("client"), form.get("user"), form.get("host"), form.get("port"),
+		form.get("method"), form.get("scheme"), form.get("path"),
+		form.get("draft_group"), form.get("draft_precedence"), form.get("draft_proxy_id"),
+		form.get("draft_client_cidr"), form.get("draft_client_user"), form.get("draft_host_glob"), form.get("draft_host_regex"),
+		form.get("draft_dst_ports"), form.get("draft_methods"), form.get("draft_time_window"),
+		result,
+	)
+}
+
+// renderExplanation evaluates the request in values and renders the result
+func (h *Handlers) renderExplanation(r *http.Request, values url.Values) string {
+	req := router.Request{
+		ClientIP: strings.TrimSpace(values.Get("client")),
+		Username: strings.TrimSpace(values.Get("user")),
+		Host:     strings.TrimSpace(values.Get("host")),
+		Scheme:   strings.TrimSpace(values.Get("scheme")),
+		Method:   strings.TrimSpace(values.Get("method")),
+		Path:     strings.TrimSpace(values.Get("path")),
+	}
+	if value := strings.TrimSpace(values.Get("port")); value != "" {
+		port, err := strconv.Atoi(value)
+		if err != nil {
+			return explainError("Invalid port")
+		}
+		req.Port = port
+	}
+
+	draft, err := parseDraftRoute(values)
+	if err != nil {
+		return explainError(fmt.Sprintf("Invalid draft route: %v", err))
+	}
+
+	explanation, err := h.router.Explain(r.Context(), req, draft)
+	if err != nil {
+		return explainError(fmt.Sprintf("Failed to explain route: %v", err))
+	}
+
+	var out strings.Builder
+	if explanation.Route == nil {
+		out.WriteString(`<div class="error">No route matches this request.</div>`)
+	} else {
+		fmt.Fprintf(&out, `<div class="match"><strong>Matched:</strong> %s</div>`, template.HTMLEscapeString(describeRoute(explanation.Route)))
+
+		plan, err := h.dialerFactory.Plan(r.Context(), explanation.Route, req.ClientIP, req.Host)
+		if err != nil {
+			out.WriteString(explainError(fmt.Sprintf("Dialer: %v", err)))
+		} else {
+			fmt.Fprintf(&out, `<div class="match"><strong>Dialer:</strong> %s</div>`, template.HTMLEscapeString(describePlan(plan)))
+		}
+	}
+
+	if len(explanation.Evaluated) > 0 {
+		out.WriteString(`<h2>Skipped Routes</h2><table><tr><th>Route</th><th>Condition</th><th>Reason</th></tr>`)
+		for _, evaluation := range explanation.Evaluated {
+			fmt.Fprintf(&out, `<tr><td>%s</td><td>%s</td><td>%s</td></tr>`,
+				template.HTMLEscapeString(describeRoute(evaluation.Route)),
+				template.HTMLEscapeString(evaluation.Condition),
+				template.HTMLEscapeString(evaluation.Reason),
+			)
+		}
+		out.WriteString(`</table>`)
+	}
+
+	return out.String()
+}
+
+// parseDraftRoute builds the draft route from the form, or returns nil when
+// no group is given
+func parseDraftRoute(values url.Values) (*router.Route, error) {
+	group := strings.ToUpper(strings.TrimSpace(values.Get("draft_group")))
+	if group == "" {
+		return nil, nil
+	}
+
+	switch router.RouteGroup(group) {
+	case router.RouteGroupLocal, router.RouteGroupTor, router.RouteGroupGeneral, router.RouteGroupUpstream:
+	default:
+		return nil, fmt.Errorf("group must be LOCAL, TOR, GENERAL or UPSTREAM")
+	}
+
+	draft := &router.Route{
+		Group:      router.RouteGroup(group),
+		Precedence: 100,
+		Enabled:    true,
+		ClientCIDR: optionalString(values.Get("draft_client_cidr")),
+		ClientUser: optionalString(values.Get("draft_client_user")),
+		HostGlob:   optionalString(values.Get("draft_host_glob")),
+		HostRegex:  optionalString(values.Get("draft_host_regex")),
+		DstPorts:   optionalString(values.Get("draft_dst_ports")),
+		Methods:    optionalString(values.Get("draft_methods")),
+		TimeWindow: optionalString(values.Get("draft_time_window")),
+	}
+
+	if value := strings.TrimSpace(values.Get("draft_precedence")); value != "" {
+		precedence, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid precedence")
+		}
+		draft.Precedence = precedence
+	}
+
+	if value := strings.TrimSpace(values.Get("draft_proxy_id")); value != "" {
+		proxyID, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy ID")
+		}
+		draft.ProxyID = &proxyID
+	}
+
+	return draft, nil
+}
+
+// describeRoute summarises a route on one line
+func describeRoute(route *router.Route) string {
+	name := fmt.Sprintf("#%d", route.ID)
+	if route.ID == 0 {
+		name = "draft"
+	}
+	return fmt.Sprintf("%s %s (precedence %d, client %s, host %s)",
+		name, route.Group, route.Precedence, stringOrAny(route.ClientCIDR), stringOrAny(route.HostGlob))
+}
+
+// describePlan summarises a dial plan on one line
+func describePlan(plan *router.DialPlan) string {
+	if plan.Direct {
+		return "direct connection"
+	}
+
+	proxies := make([]string, 0, len(plan.Proxies))
+	for _, proxy := range plan.Proxies {
+		entry := fmt.Sprintf("%s %s", proxy.Group, proxy.Address)
+		if proxy.ProxyID != nil {
+			entry = fmt.Sprintf("%s %s (proxy %d)", proxy.Group, proxy.Address, *proxy.ProxyID)
+		}
+		proxies = append(proxies, entry)
+	}
+
+	separator := " or else "
+	if plan.Group == router.RouteGroupChain {
+		separator = " then "
+	}
+	description := strings.Join(proxies, separator)
+	if plan.Pinned {
+		description += " (pinned by sticky session)"
+	}
+	return description
+}
+
+// explainError renders an error box
+func explainError(message string) string {
+	return fmt.Sprintf(`<div class="error">%s</div>`, template.HTMLEscapeString(message))
+}
@@ -8,34 +8,46 @@ import (
 	"html/template"
 	"io"
 	"net/http"
+	"net/url"
 	"strings"
 	"time"
 
 	"proxyrouter/internal/config"
+	"proxyrouter/internal/conntrack"
 	"proxyrouter/internal/db"
 	"proxyrouter/internal/refresh"
+	"proxyrouter/internal/router"
+	"proxyrouter/internal/settings"
 
 	"log/slog"
 )
 
 // Handlers provides HTTP handlers for the admin interface
 type Handlers struct {
-	config      *config.Config
-	database    *db.Database
-	authManager *AuthManager
-	middleware  *Middleware
-	refresher   *refresh.Refresher
-	templates   *template.Template
+	config        *config.Config
+	database      *db.Database
+	authManager   *AuthManager
+	middleware    *Middleware
+	refresher     *refresh.Refresher
+	router        *router.Router
+	dialerFactory *router.DialerFactory
+	tracker       *conntrack.Tracker
+	settings      *settings.Service
+	templates     *template.Template
 }
 
 // NewHandlers creates a new handlers instance
-func NewHandlers(cfg *config.Config, database *db.Database, authManager *AuthManager, middleware *Middleware, refresher *refresh.Refresher) *Handlers {
+func NewHandlers(cfg *config.Config, database *db.Database, authManager *AuthManager, middleware *Middleware, refresher *refresh.Refresher, routerEngine *router.Router, dialerFactory *router.DialerFactory, tracker *conntrack.Tracker, settings *settings.Service) *Handlers {
 	h := &Handlers{
-		config:      cfg,
-		database:    database,
-		authManager: authManager,
-		middleware:  middleware,
-		refresher:   refresher,
+		config:        cfg,
+		database:      database,
+		authManager:   authManager,
+		middleware:    middleware,
+		refresher:     refresher,
+		router:        routerEngine,
+		dialerFactory: dialerFactory,
+		tracker:       tracker,
+		settings:      settings,
 	}
 
 	// Load templates
@@ -82,6 +94,9 @@ func (h *Handlers) loadTemplates() {
             <a href="/admin/">Dashboard</a>
             <a href="/admin/settings">Settings</a>
             <a href="/admin/upload">Upload Proxies</a>
+            <a href="/admin/chains">Chains</a>
+            <a href="/admin/explain">Explain</a>
+            <a href="/admin/connections">Connections</a>
             <a href="/admin/users">Users</a>
             <form method="post" action="/admin/logout" style="display: inline;">
                 <input type="hidden" name="csrf_token" value="{{.CSRFToken}}">
@@ -305,6 +320,9 @@ func (h *Handlers) Dashboard(w http.ResponseWriter, r *http.Request) {
             <a href="/admin/">Dashboard</a>
             <a href="/admin/settings">Settings</a>
             <a href="/admin/upload">Upload Proxies</a>
+            <a href="/admin/chains">Chains</a>
+            <a href="/admin/explain">Explain</a>
+            <a href="/admin/connections">Connections</a>
             <a href="/admin/users">Users</a>
             %s
             <form method="post" action="/admin/logout" style="display: inline;">
@@ -474,6 +492,9 @@ func (h *Handlers) UploadForm(w http.ResponseWriter, r *http.Request) {
             <a href="/admin/">Dashboard</a>
             <a href="/admin/settings">Settings</a>
             <a href="/admin/upload">Upload Proxies</a>
+            <a href="/admin/chains">Chains</a>
+            <a href="/admin/explain">Explain</a>
+            <a href="/admin/connections">Connections</a>
             <a href="/admin/users">Users</a>
             <form method="post" action="/admin/logout" style="display: inline;">
                 <button type="submit" class="btn" style="background: #dc3545;">Logout</button>
@@ -492,7 +513,7 @@ func (h *Handlers) UploadForm(w http.ResponseWriter, r *http.Request) {
                     <input type="file" name="file" accept=".txt,.csv" id="file-input">
                 </div>
                 <div class="form-group">
-                    <label>Or paste proxies (one per line, format: host:port or scheme://host:port):</label>
+                    <label>Or paste proxies (one per line, format: host:port or scheme://[user:pass@]host:port):</label>
                     <textarea name="proxies" rows="10" placeholder="127.0.0.1:8080&#10;http://proxy.example.com:3128&#10;socks5://socks.example.com:1080" id="proxies-textarea"></textarea>
                 </div>
                 <button type="submit" class="btn" id="submit-btn" disabled>Upload Proxies</button>
@@ -554,6 +575,10 @@ func (h *Handlers) UploadForm(w http.ResponseWriter, r *http.Request) {
 
 // UploadProxies handles proxy upload
 func (h *Handlers) UploadProxies(w http.ResponseWriter, r *http.Request) {
+	if maxMB := h.settings.Config().Admin.MaxUploadSizeMB; maxMB > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, int64(maxMB)<<20)
+	}
+
 	// Parse multipart form
 	if err := r.ParseMultipartForm(32 << 20); err != nil { // 32MB max
 		http.Error(w, "File too large", http.StatusBadRequest)
@@ -617,7 +642,16 @@ func (h *Handlers) parseCSVFile(file io.Reader) ([]string, error) {
 			if len(record) >= 3 && record[2] != "" {
 				scheme = record[2]
 			}
-			proxies = append(proxies, fmt.Sprintf("%s://%s:%s", scheme, host, port))
+			// Optional username and password columns
+			userinfo := ""
+			if len(record) >= 4 && record[3] != "" {
+				password := ""
+				if len(record) >= 5 {
+					password = record[4]
+				}
+				userinfo = url.UserPassword(record[3], password).String() + "@"
+			}
+			proxies = append(proxies, fmt.Sprintf("%s://%s%s:%s", scheme, userinfo, host, port))
 		}
 	}
 
@@ -658,9 +692,21 @@ func (h *Handlers) parseTextInput(text string) []string {
 
 // importProxies imports proxies into the database
 func (h *Handlers) importProxies(ctx context.Context, proxies []string) (imported, updated, skipped int, err error) {
-	// TODO: Implement proxy import logic
-	// This would use the refresh package to import proxies
-	return len(proxies), 0, 0, nil
+	var proxyList []refresh.Proxy
+	for _, line := range proxies {
+		proxy, err := h.refresher.ParseProxyLine(line, "manual")
+		if err != nil {
+			skipped++
+			continue
+		}
+		proxyList = append(proxyList, proxy)
+	}
+
+	if err := h.refresher.ImportProxies(ctx, proxyList); err != nil {
+		return 0, 0, 0, err
+	}
+
+	return len(proxyList), 0, skipped, nil
 }
 
 // ListUsers displays the user management page
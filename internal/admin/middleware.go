@@ -11,9 +11,12 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/time/rate"
+
+	"proxyrouter/internal/acl"
 )
 
 // Middleware provides middleware functions for the admin interface
@@ -22,6 +25,7 @@ type Middleware struct {
 	config       *Config
 	rateLimiters map[string]*rate.Limiter
 	mu           sync.RWMutex
+	allowCIDRs   atomic.Pointer[[]string]
 }
 
 // NewMiddleware creates a new middleware instance
@@ -161,10 +165,21 @@ func (m *Middleware) LoginRateLimit(next http.Handler) http.Handler {
 	})
 }
 
-// CIDRGuard middleware restricts access based on CIDR ranges
-func (m *Middleware) CIDRGuard(allowCIDRs []string) func(http.Handler) http.Handler {
+// SetAllowCIDRs changes the CIDR ranges CIDRGuard lets in; none lets
+// everyone in
+func (m *Middleware) SetAllowCIDRs(allowCIDRs []string) {
+	m.allowCIDRs.Store(&allowCIDRs)
+}
+
+// CIDRGuard middleware restricts access to the CIDR ranges set with
+// SetAllowCIDRs
+func (m *Middleware) CIDRGuard() func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var allowCIDRs []string
+			if stored := m.allowCIDRs.Load(); stored != nil {
+				allowCIDRs = *stored
+			}
 			if len(allowCIDRs) == 0 {
 				next.ServeHTTP(w, r)
 				return
@@ -213,25 +228,7 @@ func (m *Middleware) SecurityHeaders(next http.Handler) http.Handler {
 
 // getClientIP extracts the client IP from the request
 func (m *Middleware) getClientIP(r *http.Request) string {
-	// Check X-Forwarded-For header
-	if forwardedFor := r.Header.Get("X-Forwarded-For"); forwardedFor != "" {
-		ips := strings.Split(forwardedFor, ",")
-		if len(ips) > 0 {
-			return strings.TrimSpace(ips[0])
-		}
-	}
-
-	// Check X-Real-IP header
-	if realIP := r.Header.Get("X-Real-IP"); realIP != "" {
-		return realIP
-	}
-
-	// Use RemoteAddr
-	host, _, ok := strings.Cut(r.RemoteAddr, ":")
-	if !ok {
-		return r.RemoteAddr
-	}
-	return host
+	return acl.ExtractClientIP(r.RemoteAddr, r.Header, m.config.TrustedProxies)
 }
 
 // getRateLimiter gets or creates a rate limiter for an IP
@@ -10,9 +10,13 @@ import (
 	"strconv"
 	"time"
 
+	"proxyrouter/internal/acl"
 	"proxyrouter/internal/config"
+	"proxyrouter/internal/conntrack"
 	"proxyrouter/internal/db"
 	"proxyrouter/internal/refresh"
+	"proxyrouter/internal/router"
+	"proxyrouter/internal/settings"
 
 	"log/slog"
 
@@ -30,8 +34,9 @@ type Server struct {
 	server      *http.Server
 }
 
-// NewServer creates a new admin server
-func NewServer(cfg *config.Config, database *db.Database, refresher *refresh.Refresher) *Server {
+// NewServer creates a new admin server. Forwarding headers are only believed
+// from trustedProxies, and the upload limit is read from settings.
+func NewServer(cfg *config.Config, database *db.Database, refresher *refresh.Refresher, routerEngine *router.Router, dialerFactory *router.DialerFactory, tracker *conntrack.Tracker, trustedProxies *acl.TrustedProxies, settings *settings.Service) *Server {
 	// Auto-generate session secret if empty
 	sessionSecret := cfg.Admin.SessionSecret
 	if sessionSecret == "" {
@@ -45,15 +50,18 @@ func NewServer(cfg *config.Config, database *db.Database, refresher *refresh.Ref
 		PasswordHash:  cfg.Security.PasswordHash,
 		MaxAttempts:   cfg.Security.Login.MaxAttempts,
 		WindowSeconds: cfg.Security.Login.WindowSeconds,
+
+		TrustedProxies: trustedProxies,
 	}
 
 	authManager := NewAuthManager(database.GetDB(), authConfig)
 
 	// Create middleware
 	mw := NewMiddleware(authManager, authConfig)
+	mw.SetAllowCIDRs(cfg.Admin.AllowCIDRs)
 
 	// Create handlers
-	handlers := NewHandlers(cfg, database, authManager, mw, refresher)
+	handlers := NewHandlers(cfg, database, authManager, mw, refresher, routerEngine, dialerFactory, tracker, settings)
 
 	// Create server
 	s := &Server{
@@ -70,6 +78,11 @@ func NewServer(cfg *config.Config, database *db.Database, refresher *refresh.Ref
 	return s
 }
 
+// SetAllowCIDRs changes the CIDR ranges allowed to reach the admin UI
+func (s *Server) SetAllowCIDRs(allowCIDRs []string) {
+	s.middleware.SetAllowCIDRs(allowCIDRs)
+}
+
 // generateSessionSecret generates a random session secret
 func generateSessionSecret() string {
 	b := make([]byte, 32)
@@ -84,9 +97,8 @@ func (s *Server) setupRoutes() {
 	// Global middleware
 	r.Use(middleware.Recoverer)
 	r.Use(middleware.RequestID)
-	r.Use(middleware.RealIP)
 	r.Use(s.middleware.SecurityHeaders)
-	r.Use(s.middleware.CIDRGuard(s.config.Admin.AllowCIDRs))
+	r.Use(s.middleware.CIDRGuard())
 	r.Use(s.middleware.RateLimit)
 
 	// Root redirect to admin login
@@ -123,6 +135,19 @@ func (s *Server) setupRoutes() {
 			protected.Get("/upload", s.handlers.UploadForm)
 			protected.Post("/upload", s.handlers.UploadProxies)
 
+			// Proxy chains
+			protected.Get("/chains", s.handlers.ListChains)
+			protected.Post("/chains", s.handlers.CreateChain)
+			protected.Post("/chains/{id}/hops", s.handlers.UpdateChainHops)
+			protected.Post("/chains/{id}/delete", s.handlers.DeleteChain)
+
+			// Route explain
+			protected.Get("/explain", s.handlers.ExplainRoute)
+
+			// Open proxy connections
+			protected.Get("/connections", s.handlers.ListConnections)
+			protected.Post("/connections/{id}/close", s.handlers.CloseConnection)
+
 			// Users
 			protected.Get("/users", s.handlers.ListUsers)
 			protected.Get("/users/change-password", s.handlers.ChangePassword)
@@ -11,10 +11,13 @@ import (
 	"time"
 
 	"proxyrouter/internal/acl"
+	"proxyrouter/internal/auth"
 	"proxyrouter/internal/config"
+	"proxyrouter/internal/conntrack"
 	"proxyrouter/internal/db"
 	"proxyrouter/internal/refresh"
 	"proxyrouter/internal/router"
+	"proxyrouter/internal/settings"
 	"proxyrouter/internal/version"
 
 	"github.com/go-chi/chi/v5"
@@ -23,21 +26,29 @@ import (
 
 // Handler handles API requests
 type Handler struct {
-	db        *db.Database
-	acl       *acl.ACL
-	router    *router.Router
-	refresher *refresh.Refresher
-	config    *config.Config
+	db            *db.Database
+	acl           *acl.ACL
+	router        *router.Router
+	dialerFactory *router.DialerFactory
+	proxyUsers    *auth.ProxyUsers
+	refresher     *refresh.Refresher
+	tracker       *conntrack.Tracker
+	config        *config.Config
+	settings      *settings.Service
 }
 
 // NewHandler creates a new API handler
-func NewHandler(db *db.Database, acl *acl.ACL, router *router.Router, refresher *refresh.Refresher, config *config.Config) *Handler {
+func NewHandler(db *db.Database, acl *acl.ACL, router *router.Router, dialerFactory *router.DialerFactory, proxyUsers *auth.ProxyUsers, refresher *refresh.Refresher, tracker *conntrack.Tracker, config *config.Config, settings *settings.Service) *Handler {
 	return &Handler{
-		db:        db,
-		acl:       acl,
-		router:    router,
-		refresher: refresher,
-		config:    config,
+		db:            db,
+		acl:           acl,
+		router:        router,
+		dialerFactory: dialerFactory,
+		proxyUsers:    proxyUsers,
+		refresher:     refresher,
+		tracker:       tracker,
+		config:        config,
+		settings:      settings,
 	}
 }
 
@@ -49,22 +60,70 @@ type HealthResponse struct {
 	Uptime    string    `json:"uptime"`
 }
 
-// ACLSubnet represents an ACL subnet entry
+// ACLSubnet represents an ACL entry
 type ACLSubnet struct {
-	ID   int    `json:"id"`
-	CIDR string `json:"cidr"`
+	ID             int     `json:"id"`
+	CIDR           string  `json:"cidr"`
+	Action         string  `json:"action"`
+	Priority       int     `json:"priority"`
+	Comment        *string `json:"comment,omitempty"`
+	ExpiresAt      *string `json:"expires_at,omitempty"`
+	Expired        bool    `json:"expired"`
+	BandwidthLimit *int    `json:"bandwidth_limit,omitempty"`
 }
 
 // RouteResponse represents a routing rule response
 type RouteResponse struct {
-	ID         int     `json:"id"`
-	Group      string  `json:"group"`
-	Precedence int     `json:"precedence"`
-	HostGlob   *string `json:"host_glob,omitempty"`
-	ClientCIDR *string `json:"client_cidr,omitempty"`
-	ProxyID    *int    `json:"proxy_id,omitempty"`
-	Enabled    bool    `json:"enabled"`
-	CreatedAt  string  `json:"created_at"`
+	ID             int          `json:"id"`
+	Group          string       `json:"group"`
+	Precedence     int          `json:"precedence"`
+	HostGlob       *string      `json:"host_glob,omitempty"`
+	ClientCIDR     *string      `json:"client_cidr,omitempty"`
+	ProxyID        *int         `json:"proxy_id,omitempty"`
+	Enabled        bool         `json:"enabled"`
+	CreatedAt      string       `json:"created_at"`
+	Hops           []router.Hop `json:"hops,omitempty"`
+	Strategy       string       `json:"strategy,omitempty"`
+	Affinity       string       `json:"affinity,omitempty"`
+	AffinityTTLSec *int         `json:"affinity_ttl_sec,omitempty"`
+	HostRegex      *string      `json:"host_regex,omitempty"`
+	DstPorts       *string      `json:"dst_ports,omitempty"`
+	Schemes        *string      `json:"schemes,omitempty"`
+	Methods        *string      `json:"methods,omitempty"`
+	PathPrefix     *string      `json:"path_prefix,omitempty"`
+	TimeWindow     *string      `json:"time_window,omitempty"`
+	ClientUser     *string      `json:"client_user,omitempty"`
+	BandwidthLimit *int         `json:"bandwidth_limit,omitempty"`
+	IdleTimeoutSec *int         `json:"idle_timeout_sec,omitempty"`
+	MaxLifetimeSec *int         `json:"max_lifetime_sec,omitempty"`
+}
+
+// newRouteResponse converts a route for the API
+func newRouteResponse(route router.Route) RouteResponse {
+	return RouteResponse{
+		ID:             route.ID,
+		Group:          string(route.Group),
+		Precedence:     route.Precedence,
+		HostGlob:       route.HostGlob,
+		ClientCIDR:     route.ClientCIDR,
+		ProxyID:        route.ProxyID,
+		Enabled:        route.Enabled,
+		CreatedAt:      route.CreatedAt.Format(time.RFC3339),
+		Hops:           route.Hops,
+		Strategy:       string(route.Strategy),
+		Affinity:       string(route.Affinity),
+		AffinityTTLSec: route.AffinityTTLSec,
+		HostRegex:      route.HostRegex,
+		DstPorts:       route.DstPorts,
+		Schemes:        route.Schemes,
+		Methods:        route.Methods,
+		PathPrefix:     route.PathPrefix,
+		TimeWindow:     route.TimeWindow,
+		ClientUser:     route.ClientUser,
+		BandwidthLimit: route.BandwidthLimit,
+		IdleTimeoutSec: route.IdleTimeoutSec,
+		MaxLifetimeSec: route.MaxLifetimeSec,
+	}
 }
 
 // Proxy represents a proxy entry
@@ -80,13 +139,12 @@ type Proxy struct {
 	ErrorMessage    *string `json:"error_message,omitempty"`
 	CreatedAt       string  `json:"created_at"`
 	ProxyURL        *string `json:"proxy_url,omitempty"`
+	Username        *string `json:"username,omitempty"`
+	Password        string  `json:"password,omitempty"` // always redacted
 }
 
-// Setting represents a setting entry
-type Setting struct {
-	Key   string `json:"key"`
-	Value string `json:"value"`
-}
+// redactedPassword replaces stored proxy passwords in API responses
+const redactedPassword = "********"
 
 // ErrorResponse represents an error response
 type ErrorResponse struct {
@@ -137,21 +195,38 @@ func (h *Handler) GetACL(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	now := time.Now()
 	var response []ACLSubnet
 	for _, subnet := range subnets {
-		response = append(response, ACLSubnet{
-			ID:   subnet.ID,
-			CIDR: subnet.CIDR,
-		})
+		entry := ACLSubnet{
+			ID:             subnet.ID,
+			CIDR:           subnet.CIDR,
+			Action:         subnet.Action,
+			Priority:       subnet.Priority,
+			Comment:        subnet.Comment,
+			BandwidthLimit: subnet.BandwidthLimit,
+		}
+		if subnet.ExpiresAt != nil {
+			expiresAt := subnet.ExpiresAt.Format(time.RFC3339)
+			entry.ExpiresAt = &expiresAt
+			entry.Expired = !subnet.ExpiresAt.After(now)
+		}
+		response = append(response, entry)
 	}
 
 	render.JSON(w, r, response)
 }
 
-// AddACL handles POST /acl requests
+// AddACL handles POST /acl requests. Posting a CIDR that already has an
+// entry replaces it.
 func (h *Handler) AddACL(w http.ResponseWriter, r *http.Request) {
 	var request struct {
-		CIDR string `json:"cidr"`
+		CIDR           string  `json:"cidr"`
+		Action         string  `json:"action,omitempty"`   // "allow" (default) or "deny"
+		Priority       *int    `json:"priority,omitempty"` // defaults to 100
+		Comment        *string `json:"comment,omitempty"`
+		ExpiresAt      *string `json:"expires_at,omitempty"` // RFC 3339
+		BandwidthLimit *int    `json:"bandwidth_limit,omitempty"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
@@ -172,16 +247,123 @@ func (h *Handler) AddACL(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := h.acl.AddSubnet(r.Context(), request.CIDR); err != nil {
+	entry := acl.Subnet{
+		CIDR:           request.CIDR,
+		Action:         request.Action,
+		Priority:       acl.DefaultPriority,
+		BandwidthLimit: request.BandwidthLimit,
+	}
+	if request.Priority != nil {
+		entry.Priority = *request.Priority
+	}
+	if request.Comment != nil && *request.Comment != "" {
+		entry.Comment = request.Comment
+	}
+	if request.ExpiresAt != nil && *request.ExpiresAt != "" {
+		expiresAt, err := time.Parse(time.RFC3339, *request.ExpiresAt)
+		if err != nil {
+			render.JSON(w, r, ErrorResponse{
+				Error:   "invalid_expires_at",
+				Message: "expires_at must be an RFC 3339 time",
+				Code:    http.StatusBadRequest,
+			})
+			return
+		}
+		entry.ExpiresAt = &expiresAt
+	}
+
+	if err := h.acl.AddEntry(r.Context(), &entry); err != nil {
 		render.JSON(w, r, ErrorResponse{
-			Error:   "invalid_cidr",
-			Message: fmt.Sprintf("Invalid CIDR: %v", err),
+			Error:   "invalid_acl_entry",
+			Message: fmt.Sprintf("Invalid ACL entry: %v", err),
 			Code:    http.StatusBadRequest,
 		})
 		return
 	}
 
-	render.JSON(w, r, map[string]string{"status": "added"})
+	render.JSON(w, r, map[string]interface{}{"status": "added", "id": entry.ID})
+}
+
+// UpdateACL handles PATCH /acl/{id} requests
+func (h *Handler) UpdateACL(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		render.JSON(w, r, ErrorResponse{
+			Error:   "invalid_id",
+			Message: "Invalid ACL ID",
+			Code:    http.StatusBadRequest,
+		})
+		return
+	}
+
+	var request struct {
+		Action         *string `json:"action,omitempty"`
+		Priority       *int    `json:"priority,omitempty"`
+		Comment        *string `json:"comment,omitempty"`         // empty clears the comment
+		ExpiresAt      *string `json:"expires_at,omitempty"`      // RFC 3339, empty never expires
+		BandwidthLimit *int    `json:"bandwidth_limit,omitempty"` // zero removes the limit
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		render.JSON(w, r, ErrorResponse{
+			Error:   "invalid_request",
+			Message: "Invalid JSON in request body",
+			Code:    http.StatusBadRequest,
+		})
+		return
+	}
+
+	update := acl.EntryUpdate{
+		Action:         request.Action,
+		Priority:       request.Priority,
+		Comment:        request.Comment,
+		BandwidthLimit: request.BandwidthLimit,
+	}
+	if request.ExpiresAt != nil {
+		var expiresAt time.Time
+		if *request.ExpiresAt != "" {
+			expiresAt, err = time.Parse(time.RFC3339, *request.ExpiresAt)
+			if err != nil {
+				render.JSON(w, r, ErrorResponse{
+					Error:   "invalid_expires_at",
+					Message: "expires_at must be an RFC 3339 time",
+					Code:    http.StatusBadRequest,
+				})
+				return
+			}
+		}
+		update.ExpiresAt = &expiresAt
+	}
+
+	if update == (acl.EntryUpdate{}) {
+		render.JSON(w, r, ErrorResponse{
+			Error:   "no_updates",
+			Message: "No fields to update",
+			Code:    http.StatusBadRequest,
+		})
+		return
+	}
+
+	found, err := h.acl.UpdateEntry(r.Context(), id, update)
+	if err != nil {
+		render.JSON(w, r, ErrorResponse{
+			Error:   "invalid_acl_entry",
+			Message: fmt.Sprintf("Failed to update ACL entry: %v", err),
+			Code:    http.StatusBadRequest,
+		})
+		return
+	}
+
+	if !found {
+		render.JSON(w, r, ErrorResponse{
+			Error:   "not_found",
+			Message: "ACL entry not found",
+			Code:    http.StatusNotFound,
+		})
+		return
+	}
+
+	render.JSON(w, r, map[string]string{"status": "updated"})
 }
 
 // DeleteACL handles DELETE /acl/{id} requests
@@ -223,16 +405,7 @@ func (h *Handler) GetRoutes(w http.ResponseWriter, r *http.Request) {
 
 	var response []RouteResponse
 	for _, route := range routes {
-		response = append(response, RouteResponse{
-			ID:         route.ID,
-			Group:      string(route.Group),
-			Precedence: route.Precedence,
-			HostGlob:   route.HostGlob,
-			ClientCIDR: route.ClientCIDR,
-			ProxyID:    route.ProxyID,
-			Enabled:    route.Enabled,
-			CreatedAt:  route.CreatedAt.Format(time.RFC3339),
-		})
+		response = append(response, newRouteResponse(route))
 	}
 
 	render.JSON(w, r, response)
@@ -241,12 +414,26 @@ func (h *Handler) GetRoutes(w http.ResponseWriter, r *http.Request) {
 // CreateRoute handles POST /routes requests
 func (h *Handler) CreateRoute(w http.ResponseWriter, r *http.Request) {
 	var request struct {
-		Group      string  `json:"group"`
-		Precedence int     `json:"precedence"`
-		HostGlob   *string `json:"host_glob,omitempty"`
-		ClientCIDR *string `json:"client_cidr,omitempty"`
-		ProxyID    *int    `json:"proxy_id,omitempty"`
-		Enabled    bool    `json:"enabled"`
+		Group          string       `json:"group"`
+		Precedence     int          `json:"precedence"`
+		HostGlob       *string      `json:"host_glob,omitempty"`
+		ClientCIDR     *string      `json:"client_cidr,omitempty"`
+		ProxyID        *int         `json:"proxy_id,omitempty"`
+		Enabled        bool         `json:"enabled"`
+		Hops           []router.Hop `json:"hops,omitempty"`
+		Strategy       string       `json:"strategy,omitempty"`
+		Affinity       string       `json:"affinity,omitempty"`
+		AffinityTTLSec *int         `json:"affinity_ttl_sec,omitempty"`
+		HostRegex      *string      `json:"host_regex,omitempty"`
+		DstPorts       *string      `json:"dst_ports,omitempty"`
+		Schemes        *string      `json:"schemes,omitempty"`
+		Methods        *string      `json:"methods,omitempty"`
+		PathPrefix     *string      `json:"path_prefix,omitempty"`
+		TimeWindow     *string      `json:"time_window,omitempty"`
+		ClientUser     *string      `json:"client_user,omitempty"`
+		BandwidthLimit *int         `json:"bandwidth_limit,omitempty"`
+		IdleTimeoutSec *int         `json:"idle_timeout_sec,omitempty"`
+		MaxLifetimeSec *int         `json:"max_lifetime_sec,omitempty"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
@@ -273,6 +460,15 @@ func (h *Handler) CreateRoute(w http.ResponseWriter, r *http.Request) {
 	switch group {
 	case router.RouteGroupLocal, router.RouteGroupGeneral, router.RouteGroupTor, router.RouteGroupUpstream:
 		// Valid group
+	case router.RouteGroupChain:
+		if err := router.ValidateHops(request.Hops); err != nil {
+			render.JSON(w, r, ErrorResponse{
+				Error:   "invalid_hops",
+				Message: err.Error(),
+				Code:    http.StatusBadRequest,
+			})
+			return
+		}
 	default:
 		render.JSON(w, r, ErrorResponse{
 			Error:   "invalid_group",
@@ -282,13 +478,62 @@ func (h *Handler) CreateRoute(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !router.ValidStrategy(router.Strategy(request.Strategy)) {
+		render.JSON(w, r, ErrorResponse{
+			Error:   "invalid_strategy",
+			Message: fmt.Sprintf("Unknown load-balancing strategy: %s", request.Strategy),
+			Code:    http.StatusBadRequest,
+		})
+		return
+	}
+
+	if !router.ValidAffinity(router.Affinity(request.Affinity)) {
+		render.JSON(w, r, ErrorResponse{
+			Error:   "invalid_affinity",
+			Message: fmt.Sprintf("Unknown affinity: %s", request.Affinity),
+			Code:    http.StatusBadRequest,
+		})
+		return
+	}
+
+	// Zero keeps the default timeouts, as it does on update
+	if request.IdleTimeoutSec != nil && *request.IdleTimeoutSec <= 0 {
+		request.IdleTimeoutSec = nil
+	}
+	if request.MaxLifetimeSec != nil && *request.MaxLifetimeSec <= 0 {
+		request.MaxLifetimeSec = nil
+	}
+
 	route := router.Route{
-		Group:      group,
-		Precedence: request.Precedence,
-		HostGlob:   request.HostGlob,
-		ClientCIDR: request.ClientCIDR,
-		ProxyID:    request.ProxyID,
-		Enabled:    request.Enabled,
+		Group:          group,
+		Precedence:     request.Precedence,
+		HostGlob:       request.HostGlob,
+		ClientCIDR:     request.ClientCIDR,
+		ProxyID:        request.ProxyID,
+		Enabled:        request.Enabled,
+		Hops:           request.Hops,
+		Strategy:       router.Strategy(request.Strategy),
+		Affinity:       router.Affinity(request.Affinity),
+		AffinityTTLSec: request.AffinityTTLSec,
+		HostRegex:      request.HostRegex,
+		DstPorts:       request.DstPorts,
+		Schemes:        request.Schemes,
+		Methods:        request.Methods,
+		PathPrefix:     request.PathPrefix,
+		TimeWindow:     request.TimeWindow,
+		ClientUser:     request.ClientUser,
+		BandwidthLimit: request.BandwidthLimit,
+		IdleTimeoutSec: request.IdleTimeoutSec,
+		MaxLifetimeSec: request.MaxLifetimeSec,
+	}
+
+	if err := router.ValidateRoute(&route); err != nil {
+		render.JSON(w, r, ErrorResponse{
+			Error:   "invalid_route",
+			Message: err.Error(),
+			Code:    http.StatusBadRequest,
+		})
+		return
 	}
 
 	if err := h.router.CreateRoute(&route); err != nil {
@@ -300,16 +545,7 @@ func (h *Handler) CreateRoute(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	render.JSON(w, r, RouteResponse{
-		ID:         route.ID,
-		Group:      string(route.Group),
-		Precedence: route.Precedence,
-		HostGlob:   route.HostGlob,
-		ClientCIDR: route.ClientCIDR,
-		ProxyID:    route.ProxyID,
-		Enabled:    route.Enabled,
-		CreatedAt:  route.CreatedAt.Format(time.RFC3339),
-	})
+	render.JSON(w, r, newRouteResponse(route))
 }
 
 // UpdateRoute handles PUT /routes/{id} requests
@@ -326,12 +562,26 @@ func (h *Handler) UpdateRoute(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var request struct {
-		Group      string  `json:"group,omitempty"`
-		Precedence *int    `json:"precedence,omitempty"`
-		HostGlob   *string `json:"host_glob,omitempty"`
-		ClientCIDR *string `json:"client_cidr,omitempty"`
-		ProxyID    *int    `json:"proxy_id,omitempty"`
-		Enabled    *bool   `json:"enabled,omitempty"`
+		Group          string       `json:"group,omitempty"`
+		Precedence     *int         `json:"precedence,omitempty"`
+		HostGlob       *string      `json:"host_glob,omitempty"`
+		ClientCIDR     *string      `json:"client_cidr,omitempty"`
+		ProxyID        *int         `json:"proxy_id,omitempty"`
+		Enabled        *bool        `json:"enabled,omitempty"`
+		Strategy       *string      `json:"strategy,omitempty"`
+		Affinity       *string      `json:"affinity,omitempty"`
+		AffinityTTLSec *int         `json:"affinity_ttl_sec,omitempty"`
+		HostRegex      *string      `json:"host_regex,omitempty"`
+		DstPorts       *string      `json:"dst_ports,omitempty"`
+		Schemes        *string      `json:"schemes,omitempty"`
+		Methods        *string      `json:"methods,omitempty"`
+		PathPrefix     *string      `json:"path_prefix,omitempty"`
+		TimeWindow     *string      `json:"time_window,omitempty"`
+		ClientUser     *string      `json:"client_user,omitempty"`
+		BandwidthLimit *int         `json:"bandwidth_limit,omitempty"`
+		IdleTimeoutSec *int         `json:"idle_timeout_sec,omitempty"`
+		MaxLifetimeSec *int         `json:"max_lifetime_sec,omitempty"`
+		Hops           []router.Hop `json:"hops,omitempty"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
@@ -363,8 +613,124 @@ func (h *Handler) UpdateRoute(w http.ResponseWriter, r *http.Request) {
 	if request.Enabled != nil {
 		updates["enabled"] = *request.Enabled
 	}
+	if request.Strategy != nil {
+		if !router.ValidStrategy(router.Strategy(*request.Strategy)) {
+			render.JSON(w, r, ErrorResponse{
+				Error:   "invalid_strategy",
+				Message: fmt.Sprintf("Unknown load-balancing strategy: %s", *request.Strategy),
+				Code:    http.StatusBadRequest,
+			})
+			return
+		}
+		// An empty strategy restores the default
+		if *request.Strategy == "" {
+			updates["strategy"] = nil
+		} else {
+			updates["strategy"] = *request.Strategy
+		}
+	}
+	if request.Affinity != nil {
+		if !router.ValidAffinity(router.Affinity(*request.Affinity)) {
+			render.JSON(w, r, ErrorResponse{
+				Error:   "invalid_affinity",
+				Message: fmt.Sprintf("Unknown affinity: %s", *request.Affinity),
+				Code:    http.StatusBadRequest,
+			})
+			return
+		}
+		if *request.Affinity == "" {
+			updates["affinity"] = nil
+		} else {
+			updates["affinity"] = *request.Affinity
+		}
+	}
+	if request.AffinityTTLSec != nil {
+		// Zero restores the default TTL
+		if *request.AffinityTTLSec <= 0 {
+			updates["affinity_ttl_sec"] = nil
+		} else {
+			updates["affinity_ttl_sec"] = *request.AffinityTTLSec
+		}
+	}
+	if request.BandwidthLimit != nil {
+		// Zero removes the limit
+		if *request.BandwidthLimit <= 0 {
+			updates["bandwidth_limit"] = nil
+		} else {
+			updates["bandwidth_limit"] = *request.BandwidthLimit
+		}
+	}
+	// Zero restores the default timeouts
+	timeouts := map[string]*int{
+		"idle_timeout_sec": request.IdleTimeoutSec,
+		"max_lifetime_sec": request.MaxLifetimeSec,
+	}
+	for column, value := range timeouts {
+		if value == nil {
+			continue
+		}
+		if *value <= 0 {
+			updates[column] = nil
+		} else {
+			updates[column] = *value
+		}
+	}
+
+	// An empty condition is cleared
+	conditions := map[string]*string{
+		"host_regex":  request.HostRegex,
+		"dst_ports":   request.DstPorts,
+		"schemes":     request.Schemes,
+		"methods":     request.Methods,
+		"path_prefix": request.PathPrefix,
+		"time_window": request.TimeWindow,
+		"client_user": request.ClientUser,
+	}
+	for column, value := range conditions {
+		switch {
+		case value == nil:
+		case *value == "":
+			updates[column] = nil
+		default:
+			updates[column] = *value
+		}
+	}
 
-	if err := h.router.UpdateRoute(r.Context(), id, updates); err != nil {
+	if err := router.ValidateRouteUpdates(updates); err != nil {
+		render.JSON(w, r, ErrorResponse{
+			Error:   "invalid_route",
+			Message: err.Error(),
+			Code:    http.StatusBadRequest,
+		})
+		return
+	}
+
+	// A route becoming a chain needs hops, given now or kept from before
+	if request.Hops != nil || router.RouteGroup(request.Group) == router.RouteGroupChain {
+		hops := request.Hops
+		if hops == nil {
+			existing, err := h.router.GetRouteHops(r.Context(), id)
+			if err != nil {
+				render.JSON(w, r, ErrorResponse{
+					Error:   "database_error",
+					Message: fmt.Sprintf("Failed to get route hops: %v", err),
+					Code:    http.StatusInternalServerError,
+				})
+				return
+			}
+			hops = existing
+		}
+		if err := router.ValidateHops(hops); err != nil {
+			render.JSON(w, r, ErrorResponse{
+				Error:   "invalid_hops",
+				Message: err.Error(),
+				Code:    http.StatusBadRequest,
+			})
+			return
+		}
+	}
+
+	if err := h.router.UpdateRoute(r.Context(), id, updates, request.Hops); err != nil {
 		render.JSON(w, r, ErrorResponse{
 			Error:   "database_error",
 			Message: fmt.Sprintf("Failed to update route: %v", err),
@@ -387,16 +753,7 @@ func (h *Handler) UpdateRoute(w http.ResponseWriter, r *http.Request) {
 	// Find the updated route
 	for _, route := range routes {
 		if route.ID == id {
-			render.JSON(w, r, RouteResponse{
-				ID:         route.ID,
-				Group:      string(route.Group),
-				Precedence: route.Precedence,
-				HostGlob:   route.HostGlob,
-				ClientCIDR: route.ClientCIDR,
-				ProxyID:    route.ProxyID,
-				Enabled:    route.Enabled,
-				CreatedAt:  route.CreatedAt.Format(time.RFC3339),
-			})
+			render.JSON(w, r, newRouteResponse(route))
 			return
 		}
 	}
@@ -433,11 +790,415 @@ func (h *Handler) DeleteRoute(w http.ResponseWriter, r *http.Request) {
 	render.JSON(w, r, map[string]string{"status": "deleted"})
 }
 
+// GetRouteHops handles GET /routes/{id}/hops requests
+func (h *Handler) GetRouteHops(w http.ResponseWriter, r *http.Request) {
+	idStr := chi.URLParam(r, "id")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		render.JSON(w, r, ErrorResponse{
+			Error:   "invalid_id",
+			Message: "Invalid route ID",
+			Code:    http.StatusBadRequest,
+		})
+		return
+	}
+
+	hops, err := h.router.GetRouteHops(r.Context(), id)
+	if err != nil {
+		render.JSON(w, r, ErrorResponse{
+			Error:   "database_error",
+			Message: fmt.Sprintf("Failed to get route hops: %v", err),
+			Code:    http.StatusInternalServerError,
+		})
+		return
+	}
+
+	if hops == nil {
+		hops = []router.Hop{}
+	}
+	render.JSON(w, r, hops)
+}
+
+// SetRouteHops handles PUT /routes/{id}/hops requests
+func (h *Handler) SetRouteHops(w http.ResponseWriter, r *http.Request) {
+	idStr := chi.URLParam(r, "id")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		render.JSON(w, r, ErrorResponse{
+			Error:   "invalid_id",
+			Message: "Invalid route ID",
+			Code:    http.StatusBadRequest,
+		})
+		return
+	}
+
+	var request struct {
+		Hops []router.Hop `json:"hops"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		render.JSON(w, r, ErrorResponse{
+			Error:   "invalid_request",
+			Message: "Invalid JSON in request body",
+			Code:    http.StatusBadRequest,
+		})
+		return
+	}
+
+	if err := router.ValidateHops(request.Hops); err != nil {
+		render.JSON(w, r, ErrorResponse{
+			Error:   "invalid_hops",
+			Message: err.Error(),
+			Code:    http.StatusBadRequest,
+		})
+		return
+	}
+
+	if err := h.router.SetRouteHops(r.Context(), id, request.Hops); err != nil {
+		render.JSON(w, r, ErrorResponse{
+			Error:   "database_error",
+			Message: fmt.Sprintf("Failed to update route hops: %v", err),
+			Code:    http.StatusInternalServerError,
+		})
+		return
+	}
+
+	render.JSON(w, r, request.Hops)
+}
+
+// RouteEvaluationResponse explains why a route did not match
+type RouteEvaluationResponse struct {
+	Route     RouteResponse `json:"route"`
+	Condition string        `json:"condition"`
+	Reason    string        `json:"reason"`
+}
+
+// ExplainResponse describes how a request would be routed and dialed
+type ExplainResponse struct {
+	Route     *RouteResponse            `json:"route"`
+	Evaluated []RouteEvaluationResponse `json:"evaluated"`
+	Dial      *router.DialPlan          `json:"dial,omitempty"`
+	DialError string                    `json:"dial_error,omitempty"`
+}
+
+// ExplainRoute handles GET /routes/explain requests. It reports the route a
+// request would take, why earlier routes were skipped and the proxies the
+// dialer would pick, without dialing.
+func (h *Handler) ExplainRoute(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	req := router.Request{
+		ClientIP: query.Get("client"),
+		Username: query.Get("user"),
+		Host:     query.Get("host"),
+		Scheme:   query.Get("scheme"),
+		Method:   query.Get("method"),
+		Path:     query.Get("path"),
+	}
+
+	if req.ClientIP == "" || req.Host == "" {
+		render.JSON(w, r, ErrorResponse{
+			Error:   "invalid_request",
+			Message: "client and host are required",
+			Code:    http.StatusBadRequest,
+		})
+		return
+	}
+
+	if value := query.Get("port"); value != "" {
+		port, err := strconv.Atoi(value)
+		if err != nil || port < 1 || port > 65535 {
+			render.JSON(w, r, ErrorResponse{
+				Error:   "invalid_request",
+				Message: "Invalid port",
+				Code:    http.StatusBadRequest,
+			})
+			return
+		}
+		req.Port = port
+	}
+
+	if value := query.Get("time"); value != "" {
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			render.JSON(w, r, ErrorResponse{
+				Error:   "invalid_request",
+				Message: "time must be RFC 3339",
+				Code:    http.StatusBadRequest,
+			})
+			return
+		}
+		req.Time = t.Local()
+	}
+
+	ctx := r.Context()
+	if session := query.Get("session"); session != "" {
+		ctx = router.WithSessionID(ctx, session)
+	}
+
+	explanation, err := h.router.Explain(ctx, req, nil)
+	if err != nil {
+		render.JSON(w, r, ErrorResponse{
+			Error:   "database_error",
+			Message: fmt.Sprintf("Failed to explain route: %v", err),
+			Code:    http.StatusInternalServerError,
+		})
+		return
+	}
+
+	response := ExplainResponse{Evaluated: []RouteEvaluationResponse{}}
+	for _, evaluation := range explanation.Evaluated {
+		response.Evaluated = append(response.Evaluated, RouteEvaluationResponse{
+			Route:     newRouteResponse(*evaluation.Route),
+			Condition: evaluation.Condition,
+			Reason:    evaluation.Reason,
+		})
+	}
+
+	if explanation.Route != nil {
+		route := newRouteResponse(*explanation.Route)
+		response.Route = &route
+
+		plan, err := h.dialerFactory.Plan(ctx, explanation.Route, req.ClientIP, req.Host)
+		if err != nil {
+			response.DialError = err.Error()
+		} else {
+			response.Dial = plan
+		}
+	}
+
+	render.JSON(w, r, response)
+}
+
+// GetSessions handles GET /sessions requests
+func (h *Handler) GetSessions(w http.ResponseWriter, r *http.Request) {
+	render.JSON(w, r, h.dialerFactory.Sessions())
+}
+
+// FlushSessions handles DELETE /sessions requests. A route_id query
+// parameter limits the flush to one route.
+func (h *Handler) FlushSessions(w http.ResponseWriter, r *http.Request) {
+	routeID := 0
+	if value := r.URL.Query().Get("route_id"); value != "" {
+		id, err := strconv.Atoi(value)
+		if err != nil || id <= 0 {
+			render.JSON(w, r, ErrorResponse{
+				Error:   "invalid_id",
+				Message: "Invalid route ID",
+				Code:    http.StatusBadRequest,
+			})
+			return
+		}
+		routeID = id
+	}
+
+	flushed := h.dialerFactory.FlushSessions(routeID)
+	render.JSON(w, r, map[string]int{"flushed": flushed})
+}
+
+// GetConnections handles GET /connections requests
+func (h *Handler) GetConnections(w http.ResponseWriter, r *http.Request) {
+	render.JSON(w, r, h.tracker.List())
+}
+
+// CloseConnection handles DELETE /connections/{id} requests
+func (h *Handler) CloseConnection(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		render.JSON(w, r, ErrorResponse{
+			Error:   "invalid_id",
+			Message: "Invalid connection ID",
+			Code:    http.StatusBadRequest,
+		})
+		return
+	}
+
+	if !h.tracker.Close(id) {
+		render.JSON(w, r, ErrorResponse{
+			Error:   "not_found",
+			Message: "Connection not found",
+			Code:    http.StatusNotFound,
+		})
+		return
+	}
+
+	render.JSON(w, r, map[string]string{"status": "closed"})
+}
+
+// GetProxyUsers handles GET /proxy-users requests
+func (h *Handler) GetProxyUsers(w http.ResponseWriter, r *http.Request) {
+	users, err := h.proxyUsers.List(r.Context())
+	if err != nil {
+		render.JSON(w, r, ErrorResponse{
+			Error:   "database_error",
+			Message: fmt.Sprintf("Failed to get proxy users: %v", err),
+			Code:    http.StatusInternalServerError,
+		})
+		return
+	}
+
+	render.JSON(w, r, users)
+}
+
+// CreateProxyUser handles POST /proxy-users requests
+func (h *Handler) CreateProxyUser(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Username       string `json:"username"`
+		Password       string `json:"password"`
+		BandwidthLimit *int   `json:"bandwidth_limit,omitempty"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		render.JSON(w, r, ErrorResponse{
+			Error:   "invalid_request",
+			Message: "Invalid JSON in request body",
+			Code:    http.StatusBadRequest,
+		})
+		return
+	}
+
+	if err := auth.ValidateProxyUsername(request.Username); err != nil {
+		render.JSON(w, r, ErrorResponse{
+			Error:   "invalid_username",
+			Message: err.Error(),
+			Code:    http.StatusBadRequest,
+		})
+		return
+	}
+
+	if request.Password == "" {
+		render.JSON(w, r, ErrorResponse{
+			Error:   "missing_password",
+			Message: "Password is required",
+			Code:    http.StatusBadRequest,
+		})
+		return
+	}
+
+	user, err := h.proxyUsers.Create(r.Context(), request.Username, request.Password)
+	if err == nil && request.BandwidthLimit != nil && *request.BandwidthLimit > 0 {
+		_, err = h.proxyUsers.Update(r.Context(), user.ID, nil, nil, request.BandwidthLimit)
+		user.BandwidthLimit = request.BandwidthLimit
+	}
+	if err != nil {
+		render.JSON(w, r, ErrorResponse{
+			Error:   "database_error",
+			Message: fmt.Sprintf("Failed to create proxy user: %v", err),
+			Code:    http.StatusInternalServerError,
+		})
+		return
+	}
+
+	render.JSON(w, r, user)
+}
+
+// UpdateProxyUser handles PUT /proxy-users/{id} requests to change a
+// password, enable and disable a user or set its bandwidth limit
+func (h *Handler) UpdateProxyUser(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		render.JSON(w, r, ErrorResponse{
+			Error:   "invalid_id",
+			Message: "Invalid proxy user ID",
+			Code:    http.StatusBadRequest,
+		})
+		return
+	}
+
+	var request struct {
+		Password       *string `json:"password,omitempty"`
+		Enabled        *bool   `json:"enabled,omitempty"`
+		BandwidthLimit *int    `json:"bandwidth_limit,omitempty"` // zero removes the limit
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		render.JSON(w, r, ErrorResponse{
+			Error:   "invalid_request",
+			Message: "Invalid JSON in request body",
+			Code:    http.StatusBadRequest,
+		})
+		return
+	}
+
+	if request.Password == nil && request.Enabled == nil && request.BandwidthLimit == nil {
+		render.JSON(w, r, ErrorResponse{
+			Error:   "no_updates",
+			Message: "No fields to update",
+			Code:    http.StatusBadRequest,
+		})
+		return
+	}
+
+	if request.Password != nil && *request.Password == "" {
+		render.JSON(w, r, ErrorResponse{
+			Error:   "missing_password",
+			Message: "Password must not be empty",
+			Code:    http.StatusBadRequest,
+		})
+		return
+	}
+
+	found, err := h.proxyUsers.Update(r.Context(), id, request.Password, request.Enabled, request.BandwidthLimit)
+	if err != nil {
+		render.JSON(w, r, ErrorResponse{
+			Error:   "database_error",
+			Message: fmt.Sprintf("Failed to update proxy user: %v", err),
+			Code:    http.StatusInternalServerError,
+		})
+		return
+	}
+
+	if !found {
+		render.JSON(w, r, ErrorResponse{
+			Error:   "not_found",
+			Message: "Proxy user not found",
+			Code:    http.StatusNotFound,
+		})
+		return
+	}
+
+	render.JSON(w, r, map[string]string{"status": "updated"})
+}
+
+// DeleteProxyUser handles DELETE /proxy-users/{id} requests
+func (h *Handler) DeleteProxyUser(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		render.JSON(w, r, ErrorResponse{
+			Error:   "invalid_id",
+			Message: "Invalid proxy user ID",
+			Code:    http.StatusBadRequest,
+		})
+		return
+	}
+
+	found, err := h.proxyUsers.Delete(r.Context(), id)
+	if err != nil {
+		render.JSON(w, r, ErrorResponse{
+			Error:   "database_error",
+			Message: fmt.Sprintf("Failed to delete proxy user: %v", err),
+			Code:    http.StatusInternalServerError,
+		})
+		return
+	}
+
+	if !found {
+		render.JSON(w, r, ErrorResponse{
+			Error:   "not_found",
+			Message: "Proxy user not found",
+			Code:    http.StatusNotFound,
+		})
+		return
+	}
+
+	render.JSON(w, r, map[string]string{"status": "deleted"})
+}
+
 // GetProxies handles GET /proxies requests
 func (h *Handler) GetProxies(w http.ResponseWriter, r *http.Request) {
 	query := `
 		SELECT id, proxy_type, ip, port, source, working, latency, 
-		       tested_timestamp, error_message, created_at, proxy_url
+		       tested_timestamp, error_message, created_at, proxy_url,
+		       username, password_enc IS NOT NULL
 		FROM proxies
 		ORDER BY created_at DESC
 	`
@@ -459,10 +1220,12 @@ func (h *Handler) GetProxies(w http.ResponseWriter, r *http.Request) {
 		var testedTimestamp sql.NullString
 		var errorMessage sql.NullString
 		var proxyURL sql.NullString
+		var hasPassword bool
 
 		err := rows.Scan(
 			&proxy.ID, &proxy.ProxyType, &proxy.IP, &proxy.Port, &proxy.Source,
 			&proxy.Working, &proxy.Latency, &testedTimestamp, &errorMessage, &proxy.CreatedAt, &proxyURL,
+			&proxy.Username, &hasPassword,
 		)
 		if err != nil {
 			continue
@@ -477,6 +1240,9 @@ func (h *Handler) GetProxies(w http.ResponseWriter, r *http.Request) {
 		if proxyURL.Valid {
 			proxy.ProxyURL = &proxyURL.String
 		}
+		if hasPassword {
+			proxy.Password = redactedPassword
+		}
 
 		proxies = append(proxies, proxy)
 	}
@@ -577,9 +1343,7 @@ func (h *Handler) CheckProxy(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Get proxy from database
-	query := `SELECT id, proxy_type, ip, port FROM proxies WHERE id = ?`
-	var proxy refresh.Proxy
-	err = h.db.QueryRow(context.Background(), query, id).Scan(&proxy.ID, &proxy.ProxyType, &proxy.IP, &proxy.Port)
+	proxy, err := h.refresher.LoadProxy(context.Background(), id)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			render.JSON(w, r, ErrorResponse{
@@ -677,31 +1441,11 @@ func (h *Handler) DeleteProxy(w http.ResponseWriter, r *http.Request) {
 
 // GetSettings handles GET /settings requests
 func (h *Handler) GetSettings(w http.ResponseWriter, r *http.Request) {
-	query := `SELECT key, value FROM settings ORDER BY key`
-	rows, err := h.db.Query(context.Background(), query)
-	if err != nil {
-		render.JSON(w, r, ErrorResponse{
-			Error:   "database_error",
-			Message: fmt.Sprintf("Failed to get settings: %v", err),
-			Code:    http.StatusInternalServerError,
-		})
-		return
-	}
-	defer rows.Close()
-
-	var settings []Setting
-	for rows.Next() {
-		var setting Setting
-		if err := rows.Scan(&setting.Key, &setting.Value); err != nil {
-			continue
-		}
-		settings = append(settings, setting)
-	}
-
-	render.JSON(w, r, settings)
+	render.JSON(w, r, h.settings.List())
 }
 
-// UpdateSettings handles PATCH /settings requests
+// UpdateSettings handles PATCH /settings requests. The values override
+// config.yaml and take effect at once.
 func (h *Handler) UpdateSettings(w http.ResponseWriter, r *http.Request) {
 	var request map[string]string
 	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
@@ -722,52 +1466,50 @@ func (h *Handler) UpdateSettings(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Start transaction
-	tx, err := h.db.Begin()
-	if err != nil {
+	if err := h.settings.Validate(request); err != nil {
 		render.JSON(w, r, ErrorResponse{
-			Error:   "database_error",
-			Message: fmt.Sprintf("Failed to begin transaction: %v", err),
-			Code:    http.StatusInternalServerError,
+			Error:   "invalid_setting",
+			Message: err.Error(),
+			Code:    http.StatusBadRequest,
 		})
 		return
 	}
-	defer tx.Rollback()
 
-	// Update each setting
-	stmt, err := tx.Prepare("INSERT OR REPLACE INTO settings (key, value) VALUES (?, ?)")
-	if err != nil {
+	if err := h.settings.Update(r.Context(), request); err != nil {
 		render.JSON(w, r, ErrorResponse{
 			Error:   "database_error",
-			Message: fmt.Sprintf("Failed to prepare statement: %v", err),
+			Message: fmt.Sprintf("Failed to update settings: %v", err),
 			Code:    http.StatusInternalServerError,
 		})
 		return
 	}
-	defer stmt.Close()
 
-	for key, value := range request {
-		_, err := stmt.Exec(key, value)
-		if err != nil {
-			render.JSON(w, r, ErrorResponse{
-				Error:   "database_error",
-				Message: fmt.Sprintf("Failed to update setting %s: %v", key, err),
-				Code:    http.StatusInternalServerError,
-			})
-			return
-		}
+	render.JSON(w, r, map[string]string{"status": "updated"})
+}
+
+// ResetSetting handles DELETE /settings/{key} requests. The value from
+// config.yaml applies again.
+func (h *Handler) ResetSetting(w http.ResponseWriter, r *http.Request) {
+	key := chi.URLParam(r, "key")
+	if !settings.Known(key) {
+		render.JSON(w, r, ErrorResponse{
+			Error:   "not_found",
+			Message: fmt.Sprintf("Unknown setting %q", key),
+			Code:    http.StatusNotFound,
+		})
+		return
 	}
 
-	if err := tx.Commit(); err != nil {
+	if err := h.settings.Reset(r.Context(), key); err != nil {
 		render.JSON(w, r, ErrorResponse{
 			Error:   "database_error",
-			Message: fmt.Sprintf("Failed to commit transaction: %v", err),
+			Message: err.Error(),
 			Code:    http.StatusInternalServerError,
 		})
 		return
 	}
 
-	render.JSON(w, r, map[string]string{"status": "updated"})
+	render.JSON(w, r, map[string]string{"status": "reset"})
 }
 
 // TorControl handles Tor control requests
@@ -7,10 +7,14 @@ import (
 	"time"
 
 	"proxyrouter/internal/acl"
+	"proxyrouter/internal/auth"
 	"proxyrouter/internal/config"
+	"proxyrouter/internal/conntrack"
 	"proxyrouter/internal/db"
+	"proxyrouter/internal/proxyproto"
 	"proxyrouter/internal/refresh"
 	"proxyrouter/internal/router"
+	"proxyrouter/internal/settings"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
@@ -19,18 +23,21 @@ import (
 
 // Server represents the API server
 type Server struct {
-	listenAddr string
-	handler    *Handler
-	chiRouter  *chi.Mux
+	listenAddr    string
+	handler       *Handler
+	chiRouter     *chi.Mux
+	proxyProtocol *proxyproto.Policy
 }
 
-// New creates a new API server
-func New(listenAddr string, db *db.Database, acl *acl.ACL, router *router.Router, refresher *refresh.Refresher, config *config.Config) *Server {
-	handler := NewHandler(db, acl, router, refresher, config)
+// New creates a new API server. Peers trusted by proxyProtocol, which may be
+// nil, pass on the client address in a PROXY protocol header.
+func New(listenAddr string, db *db.Database, acl *acl.ACL, router *router.Router, dialerFactory *router.DialerFactory, proxyUsers *auth.ProxyUsers, refresher *refresh.Refresher, tracker *conntrack.Tracker, config *config.Config, proxyProtocol *proxyproto.Policy, settings *settings.Service) *Server {
+	handler := NewHandler(db, acl, router, dialerFactory, proxyUsers, refresher, tracker, config, settings)
 	s := &Server{
-		listenAddr: listenAddr,
-		handler:    handler,
-		chiRouter:  chi.NewRouter(),
+		listenAddr:    listenAddr,
+		handler:       handler,
+		chiRouter:     chi.NewRouter(),
+		proxyProtocol: proxyProtocol,
 	}
 
 	s.setupRoutes()
@@ -61,6 +68,7 @@ func (s *Server) setupRoutes() {
 		r.Route("/acl", func(r chi.Router) {
 			r.Get("/", s.handler.GetACL)
 			r.Post("/", s.handler.AddACL)
+			r.Patch("/{id}", s.handler.UpdateACL)
 			r.Delete("/{id}", s.handler.DeleteACL)
 		})
 
@@ -68,8 +76,31 @@ func (s *Server) setupRoutes() {
 		r.Route("/routes", func(r chi.Router) {
 			r.Get("/", s.handler.GetRoutes)
 			r.Post("/", s.handler.CreateRoute)
+			r.Get("/explain", s.handler.ExplainRoute)
 			r.Put("/{id}", s.handler.UpdateRoute)
 			r.Delete("/{id}", s.handler.DeleteRoute)
+			r.Get("/{id}/hops", s.handler.GetRouteHops)
+			r.Put("/{id}/hops", s.handler.SetRouteHops)
+		})
+
+		// Sticky sessions
+		r.Route("/sessions", func(r chi.Router) {
+			r.Get("/", s.handler.GetSessions)
+			r.Delete("/", s.handler.FlushSessions)
+		})
+
+		// Open proxy connections
+		r.Route("/connections", func(r chi.Router) {
+			r.Get("/", s.handler.GetConnections)
+			r.Delete("/{id}", s.handler.CloseConnection)
+		})
+
+		// Proxy client credentials
+		r.Route("/proxy-users", func(r chi.Router) {
+			r.Get("/", s.handler.GetProxyUsers)
+			r.Post("/", s.handler.CreateProxyUser)
+			r.Put("/{id}", s.handler.UpdateProxyUser)
+			r.Delete("/{id}", s.handler.DeleteProxyUser)
 		})
 
 		// Proxies
@@ -86,6 +117,7 @@ func (s *Server) setupRoutes() {
 		r.Route("/settings", func(r chi.Router) {
 			r.Get("/", s.handler.GetSettings)
 			r.Patch("/", s.handler.UpdateSettings)
+			r.Delete("/{key}", s.handler.ResetSetting)
 		})
 
 		// Tor Control
@@ -98,6 +130,11 @@ func (s *Server) setupRoutes() {
 
 // Start starts the API server
 func (s *Server) Start(ctx context.Context) error {
+	listener, err := s.proxyProtocol.Listen(s.listenAddr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", s.listenAddr, err)
+	}
+
 	fmt.Printf("API server listening on %s\n", s.listenAddr)
 
 	server := &http.Server{
@@ -107,7 +144,7 @@ func (s *Server) Start(ctx context.Context) error {
 
 	// Start server in a goroutine
 	go func() {
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
 			fmt.Printf("API server error: %v\n", err)
 		}
 	}()
@@ -8,6 +8,8 @@ import (
 	"time"
 
 	"golang.org/x/time/rate"
+
+	"proxyrouter/internal/acl"
 )
 
 // AuthConfig represents authentication configuration
@@ -137,52 +139,20 @@ func (rl *RateLimiter) Close() {
 	}
 }
 
-// ProxyAuth provides proxy authentication
-type ProxyAuth struct {
-	config AuthConfig
-}
-
-// NewProxyAuth creates a new proxy authenticator
-func NewProxyAuth(config AuthConfig) *ProxyAuth {
-	return &ProxyAuth{
-		config: config,
-	}
-}
-
-// AuthenticateProxyRequest authenticates a proxy request
-func (pa *ProxyAuth) AuthenticateProxyRequest(r *http.Request) error {
-	if !pa.config.Enabled {
-		return nil // No auth required
-	}
-
-	// Check Basic auth for proxy requests
-	if pa.config.Username != "" && pa.config.Password != "" {
-		username, password, ok := r.BasicAuth()
-		if !ok {
-			return fmt.Errorf("proxy authentication required")
-		}
-
-		if username != pa.config.Username || password != pa.config.Password {
-			return fmt.Errorf("invalid proxy credentials")
-		}
-
-		return nil
-	}
-
-	return nil
-}
-
 // Middleware provides HTTP middleware for authentication and rate limiting
 type Middleware struct {
-	auth       *Authenticator
-	rateLimiter *RateLimiter
+	auth           *Authenticator
+	rateLimiter    *RateLimiter
+	trustedProxies *acl.TrustedProxies
 }
 
-// NewMiddleware creates new middleware
-func NewMiddleware(auth *Authenticator, rateLimiter *RateLimiter) *Middleware {
+// NewMiddleware creates new middleware. Forwarding headers are only believed
+// from trustedProxies.
+func NewMiddleware(auth *Authenticator, rateLimiter *RateLimiter, trustedProxies *acl.TrustedProxies) *Middleware {
 	return &Middleware{
-		auth:        auth,
-		rateLimiter: rateLimiter,
+		auth:           auth,
+		rateLimiter:    rateLimiter,
+		trustedProxies: trustedProxies,
 	}
 }
 
@@ -200,7 +170,7 @@ func (m *Middleware) AuthMiddleware(next http.Handler) http.Handler {
 // RateLimitMiddleware returns rate limiting middleware
 func (m *Middleware) RateLimitMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		clientIP := getClientIP(r)
+		clientIP := m.getClientIP(r)
 		if !m.rateLimiter.Allow(clientIP) {
 			http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
 			return
@@ -210,24 +180,6 @@ func (m *Middleware) RateLimitMiddleware(next http.Handler) http.Handler {
 }
 
 // getClientIP extracts the client IP from the request
-func getClientIP(r *http.Request) string {
-	// Check X-Forwarded-For header
-	if forwardedFor := r.Header.Get("X-Forwarded-For"); forwardedFor != "" {
-		ips := strings.Split(forwardedFor, ",")
-		if len(ips) > 0 {
-			return strings.TrimSpace(ips[0])
-		}
-	}
-
-	// Check X-Real-IP header
-	if realIP := r.Header.Get("X-Real-IP"); realIP != "" {
-		return realIP
-	}
-
-	// Use RemoteAddr
-	host, _, ok := strings.Cut(r.RemoteAddr, ":")
-	if !ok {
-		return r.RemoteAddr
-	}
-	return host
+func (m *Middleware) getClientIP(r *http.Request) string {
+	return acl.ExtractClientIP(r.RemoteAddr, r.Header, m.trustedProxies)
 }
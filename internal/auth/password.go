@@ -0,0 +1,102 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// HashPassword hashes a password with the given algorithm, "argon2id" or "bcrypt"
+func HashPassword(algorithm, password string) (string, error) {
+	switch algorithm {
+	case "argon2id":
+		return hashArgon2ID(password)
+	case "bcrypt":
+		return hashBcrypt(password)
+	default:
+		return "", fmt.Errorf("unsupported hash algorithm: %s", algorithm)
+	}
+}
+
+// VerifyPassword verifies a password against an argon2id or bcrypt hash
+func VerifyPassword(password, hash string) (bool, error) {
+	if strings.HasPrefix(hash, "$argon2id$") {
+		return verifyArgon2ID(password, hash)
+	} else if strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") {
+		return verifyBcrypt(password, hash)
+	}
+	return false, fmt.Errorf("unsupported hash format")
+}
+
+// verifyArgon2ID verifies an Argon2id hash
+func verifyArgon2ID(password, hash string) (bool, error) {
+	// Parse the hash
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return false, fmt.Errorf("invalid argon2id hash format")
+	}
+
+	var time uint32
+	var memory uint32
+	var parallelism uint8
+
+	_, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &parallelism)
+	if err != nil {
+		return false, fmt.Errorf("failed to parse argon2id parameters: %w", err)
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, fmt.Errorf("failed to decode salt: %w", err)
+	}
+
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return false, fmt.Errorf("failed to decode key: %w", err)
+	}
+
+	// Generate hash with same parameters
+	computedKey := argon2.IDKey([]byte(password), salt, time, memory, parallelism, uint32(len(key)))
+
+	// Compare keys
+	return subtle.ConstantTimeCompare(computedKey, key) == 1, nil
+}
+
+// verifyBcrypt verifies a bcrypt hash
+func verifyBcrypt(password, hash string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	return err == nil, nil
+}
+
+// hashArgon2ID hashes a password using Argon2id
+func hashArgon2ID(password string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("failed to generate salt: %w", err)
+	}
+
+	// Argon2id parameters: time=3, memory=64MB, parallelism=2
+	key := argon2.IDKey([]byte(password), salt, 3, 64*1024, 2, 32)
+
+	// Format: $argon2id$v=19$m=65536,t=3,p=2$salt$key
+	hash := fmt.Sprintf("$argon2id$v=19$m=%d,t=%d,p=%d$%s$%s",
+		64*1024, 3, 2,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key))
+
+	return hash, nil
+}
+
+// hashBcrypt hashes a password using bcrypt
+func hashBcrypt(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", fmt.Errorf("failed to hash password: %w", err)
+	}
+	return string(hash), nil
+}
@@ -0,0 +1,281 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// verifiedTTL is how long a verified password is remembered, so that a client
+// opening many connections does not pay for a password hash on each one
+const verifiedTTL = 5 * time.Minute
+
+// ProxyUser is a client account for the proxy listeners
+type ProxyUser struct {
+	ID             int       `json:"id"`
+	Username       string    `json:"username"`
+	Enabled        bool      `json:"enabled"`
+	BandwidthLimit *int      `json:"bandwidth_limit,omitempty"` // bytes per second, shared by the user's tunnels
+	CreatedAt      time.Time `json:"created_at"`
+	UpdatedAt      time.Time `json:"updated_at"`
+}
+
+// ProxyUsers stores the credentials of proxy clients in the proxy_users table
+type ProxyUsers struct {
+	db            *sql.DB
+	hashAlgorithm string
+
+	mu         sync.Mutex
+	verified   map[string]verifiedPassword
+	generation uint64 // counts changes to users
+}
+
+// verifiedPassword remembers a password that matched a user's hash
+type verifiedPassword struct {
+	digest  [sha256.Size]byte
+	expires time.Time
+}
+
+// NewProxyUsers creates a proxy user store that hashes new passwords with
+// hashAlgorithm
+func NewProxyUsers(db *sql.DB, hashAlgorithm string) *ProxyUsers {
+	return &ProxyUsers{
+		db:            db,
+		hashAlgorithm: hashAlgorithm,
+		verified:      make(map[string]verifiedPassword),
+	}
+}
+
+// ValidateProxyUsername checks that a username can be sent by SOCKS5 and HTTP
+// clients and does not clash with the session suffix
+func ValidateProxyUsername(username string) error {
+	switch {
+	case username == "":
+		return fmt.Errorf("username is required")
+	case len(username) > 255:
+		return fmt.Errorf("username must be at most 255 bytes")
+	case strings.ContainsAny(username, ": \t\r\n"):
+		return fmt.Errorf("username must not contain colons or whitespace")
+	case strings.Contains(username, "-session-"):
+		return fmt.Errorf("username must not contain \"-session-\"")
+	}
+	return nil
+}
+
+// Authenticate checks a username and password against an enabled user
+func (u *ProxyUsers) Authenticate(ctx context.Context, username, password string) (bool, error) {
+	digest := sha256.Sum256([]byte(password))
+
+	u.mu.Lock()
+	cached, ok := u.verified[username]
+	generation := u.generation
+	u.mu.Unlock()
+	if ok && time.Now().Before(cached.expires) && subtle.ConstantTimeCompare(cached.digest[:], digest[:]) == 1 {
+		return true, nil
+	}
+
+	var passwordHash string
+	query := `SELECT password_hash FROM proxy_users WHERE username = ? AND enabled = 1`
+	err := u.db.QueryRowContext(ctx, query, username).Scan(&passwordHash)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to query proxy user: %w", err)
+	}
+
+	valid, err := VerifyPassword(password, passwordHash)
+	if err != nil {
+		return false, fmt.Errorf("failed to verify password: %w", err)
+	}
+
+	// A hash read before a user changed is not remembered past the change
+	if valid {
+		u.mu.Lock()
+		if u.generation == generation {
+			u.verified[username] = verifiedPassword{digest: digest, expires: time.Now().Add(verifiedTTL)}
+		}
+		u.mu.Unlock()
+	}
+	return valid, nil
+}
+
+// Exists reports whether username is an account, enabled or not
+func (u *ProxyUsers) Exists(ctx context.Context, username string) (bool, error) {
+	var id int
+	err := u.db.QueryRowContext(ctx, `SELECT id FROM proxy_users WHERE username = ?`, username).Scan(&id)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to query proxy user: %w", err)
+	}
+	return true, nil
+}
+
+// forget drops remembered passwords after users change
+func (u *ProxyUsers) forget() {
+	u.mu.Lock()
+	u.verified = make(map[string]verifiedPassword)
+	u.generation++
+	u.mu.Unlock()
+}
+
+// Generation returns a number that changes whenever a user is changed or
+// deleted. A login checked under one generation must be checked again under
+// the next.
+func (u *ProxyUsers) Generation() uint64 {
+	if u == nil {
+		return 0
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.generation
+}
+
+// List returns all proxy users
+func (u *ProxyUsers) List(ctx context.Context) ([]ProxyUser, error) {
+	query := `SELECT id, username, enabled, bandwidth_limit, created_at, updated_at FROM proxy_users ORDER BY username`
+	rows, err := u.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query proxy users: %w", err)
+	}
+	defer rows.Close()
+
+	users := []ProxyUser{}
+	for rows.Next() {
+		var user ProxyUser
+		if err := rows.Scan(&user.ID, &user.Username, &user.Enabled, &user.BandwidthLimit, &user.CreatedAt, &user.UpdatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan proxy user: %w", err)
+		}
+		users = append(users, user)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over proxy users: %w", err)
+	}
+
+	return users, nil
+}
+
+// Create adds an enabled proxy user
+func (u *ProxyUsers) Create(ctx context.Context, username, password string) (*ProxyUser, error) {
+	if err := ValidateProxyUsername(username); err != nil {
+		return nil, err
+	}
+	if password == "" {
+		return nil, fmt.Errorf("password is required")
+	}
+
+	hash, err := HashPassword(u.hashAlgorithm, password)
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash password: %w", err)
+	}
+
+	query := `INSERT INTO proxy_users (username, password_hash) VALUES (?, ?)`
+	result, err := u.db.ExecContext(ctx, query, username, hash)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create proxy user: %w", err)
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get proxy user ID: %w", err)
+	}
+
+	return u.Get(ctx, int(id))
+}
+
+// Get returns a proxy user by ID, or nil if it does not exist
+func (u *ProxyUsers) Get(ctx context.Context, id int) (*ProxyUser, error) {
+	var user ProxyUser
+	query := `SELECT id, username, enabled, bandwidth_limit, created_at, updated_at FROM proxy_users WHERE id = ?`
+	err := u.db.QueryRowContext(ctx, query, id).Scan(&user.ID, &user.Username, &user.Enabled, &user.BandwidthLimit, &user.CreatedAt, &user.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get proxy user: %w", err)
+	}
+	return &user, nil
+}
+
+// Update changes the password, enabled flag and/or bandwidth limit of a proxy
+// user. A limit of zero or less removes it. It returns false if the user does
+// not exist.
+func (u *ProxyUsers) Update(ctx context.Context, id int, password *string, enabled *bool, bandwidthLimit *int) (bool, error) {
+	var sets []string
+	var args []interface{}
+
+	if password != nil {
+		if *password == "" {
+			return false, fmt.Errorf("password must not be empty")
+		}
+		hash, err := HashPassword(u.hashAlgorithm, *password)
+		if err != nil {
+			return false, fmt.Errorf("failed to hash password: %w", err)
+		}
+		sets = append(sets, "password_hash = ?")
+		args = append(args, hash)
+	}
+	if enabled != nil {
+		sets = append(sets, "enabled = ?")
+		args = append(args, *enabled)
+	}
+	if bandwidthLimit != nil {
+		sets = append(sets, "bandwidth_limit = ?")
+		if *bandwidthLimit > 0 {
+			args = append(args, *bandwidthLimit)
+		} else {
+			args = append(args, nil)
+		}
+	}
+	if len(sets) == 0 {
+		return false, fmt.Errorf("no fields to update")
+	}
+
+	query := fmt.Sprintf("UPDATE proxy_users SET %s, updated_at = CURRENT_TIMESTAMP WHERE id = ?", strings.Join(sets, ", "))
+	result, err := u.db.ExecContext(ctx, query, append(args, id)...)
+	if err != nil {
+		return false, fmt.Errorf("failed to update proxy user: %w", err)
+	}
+	u.forget()
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to get rows affected: %w", err)
+	}
+	return rowsAffected > 0, nil
+}
+
+// BandwidthLimit returns the bandwidth limit of an enabled user in bytes per
+// second, or 0 if the user has none
+func (u *ProxyUsers) BandwidthLimit(ctx context.Context, username string) (int, error) {
+	var limit sql.NullInt64
+	query := `SELECT bandwidth_limit FROM proxy_users WHERE username = ? AND enabled = 1`
+	err := u.db.QueryRowContext(ctx, query, username).Scan(&limit)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, fmt.Errorf("failed to query bandwidth limit: %w", err)
+	}
+	return int(limit.Int64), nil
+}
+
+// Delete removes a proxy user. It returns false if the user does not exist.
+func (u *ProxyUsers) Delete(ctx context.Context, id int) (bool, error) {
+	result, err := u.db.ExecContext(ctx, `DELETE FROM proxy_users WHERE id = ?`, id)
+	if err != nil {
+		return false, fmt.Errorf("failed to delete proxy user: %w", err)
+	}
+	u.forget()
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to get rows affected: %w", err)
+	}
+	return rowsAffected > 0, nil
+}
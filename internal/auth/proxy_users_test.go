@@ -0,0 +1,187 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	_ "modernc.org/sqlite"
+)
+
+// newTestProxyUsers creates a proxy user store on an in-memory database
+func newTestProxyUsers(t *testing.T) *ProxyUsers {
+	db, err := sql.Open("sqlite", ":memory:")
+	require.NoError(t, err)
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+
+	_, err = db.Exec(`
+		CREATE TABLE proxy_users (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			username TEXT UNIQUE NOT NULL,
+			password_hash TEXT NOT NULL,
+			enabled INTEGER NOT NULL DEFAULT 1,
+			bandwidth_limit INTEGER,
+			created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+		)
+	`)
+	require.NoError(t, err)
+
+	return NewProxyUsers(db, "bcrypt")
+}
+
+func TestPasswordHashes(t *testing.T) {
+	for _, algorithm := range []string{"argon2id", "bcrypt"} {
+		hash, err := HashPassword(algorithm, "secret")
+		require.NoError(t, err)
+
+		valid, err := VerifyPassword("secret", hash)
+		require.NoError(t, err)
+		assert.True(t, valid, algorithm)
+
+		valid, err = VerifyPassword("wrong", hash)
+		require.NoError(t, err)
+		assert.False(t, valid, algorithm)
+	}
+
+	_, err := HashPassword("md5", "secret")
+	assert.Error(t, err)
+	_, err = VerifyPassword("secret", "plain")
+	assert.Error(t, err)
+}
+
+func TestProxyUsers(t *testing.T) {
+	users := newTestProxyUsers(t)
+	ctx := context.Background()
+
+	alice, err := users.Create(ctx, "alice", "secret")
+	require.NoError(t, err)
+	assert.Equal(t, "alice", alice.Username)
+	assert.True(t, alice.Enabled)
+
+	_, err = users.Create(ctx, "alice", "other")
+	assert.Error(t, err)
+
+	valid, err := users.Authenticate(ctx, "alice", "secret")
+	require.NoError(t, err)
+	assert.True(t, valid)
+
+	valid, err = users.Authenticate(ctx, "alice", "wrong")
+	require.NoError(t, err)
+	assert.False(t, valid)
+
+	valid, err = users.Authenticate(ctx, "bob", "secret")
+	require.NoError(t, err)
+	assert.False(t, valid)
+
+	// A new password replaces the remembered one
+	newPassword := "changed"
+	found, err := users.Update(ctx, alice.ID, &newPassword, nil, nil)
+	require.NoError(t, err)
+	assert.True(t, found)
+
+	valid, err = users.Authenticate(ctx, "alice", "secret")
+	require.NoError(t, err)
+	assert.False(t, valid)
+
+	valid, err = users.Authenticate(ctx, "alice", "changed")
+	require.NoError(t, err)
+	assert.True(t, valid)
+
+	// Disabled users cannot log in
+	disabled := false
+	_, err = users.Update(ctx, alice.ID, nil, &disabled, nil)
+	require.NoError(t, err)
+	valid, err = users.Authenticate(ctx, "alice", "changed")
+	require.NoError(t, err)
+	assert.False(t, valid)
+
+	// They still exist as accounts
+	exists, err := users.Exists(ctx, "alice")
+	require.NoError(t, err)
+	assert.True(t, exists)
+	exists, err = users.Exists(ctx, "bob")
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	list, err := users.List(ctx)
+	require.NoError(t, err)
+	require.Len(t, list, 1)
+	assert.False(t, list[0].Enabled)
+
+	found, err = users.Delete(ctx, alice.ID)
+	require.NoError(t, err)
+	assert.True(t, found)
+
+	found, err = users.Delete(ctx, alice.ID)
+	require.NoError(t, err)
+	assert.False(t, found)
+}
+
+func TestProxyUsersChangeDuringAuthenticate(t *testing.T) {
+	users := newTestProxyUsers(t)
+	ctx := context.Background()
+	_, err := users.Create(ctx, "alice", "secret")
+	require.NoError(t, err)
+
+	// Hold the only connection so Authenticate waits for its query
+	tx, err := users.db.Begin()
+	require.NoError(t, err)
+	done := make(chan bool, 1)
+	go func() {
+		valid, _ := users.Authenticate(ctx, "alice", "secret")
+		done <- valid
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	// The user changes after Authenticate started but before it read the hash
+	users.forget()
+	require.NoError(t, tx.Rollback())
+	assert.True(t, <-done)
+
+	users.mu.Lock()
+	defer users.mu.Unlock()
+	assert.Empty(t, users.verified, "a password checked before a change must not be remembered")
+}
+
+func TestProxyUserBandwidthLimit(t *testing.T) {
+	users := newTestProxyUsers(t)
+	ctx := context.Background()
+
+	alice, err := users.Create(ctx, "alice", "secret")
+	require.NoError(t, err)
+	limit, err := users.BandwidthLimit(ctx, "alice")
+	require.NoError(t, err)
+	assert.Equal(t, 0, limit)
+
+	bandwidth := 1 << 20
+	_, err = users.Update(ctx, alice.ID, nil, nil, &bandwidth)
+	require.NoError(t, err)
+	limit, err = users.BandwidthLimit(ctx, "alice")
+	require.NoError(t, err)
+	assert.Equal(t, bandwidth, limit)
+
+	// Zero removes the limit
+	bandwidth = 0
+	_, err = users.Update(ctx, alice.ID, nil, nil, &bandwidth)
+	require.NoError(t, err)
+	user, err := users.Get(ctx, alice.ID)
+	require.NoError(t, err)
+	assert.Nil(t, user.BandwidthLimit)
+
+	limit, err = users.BandwidthLimit(ctx, "bob")
+	require.NoError(t, err)
+	assert.Equal(t, 0, limit)
+}
+
+func TestValidateProxyUsername(t *testing.T) {
+	assert.NoError(t, ValidateProxyUsername("alice.smith"))
+	assert.Error(t, ValidateProxyUsername(""))
+	assert.Error(t, ValidateProxyUsername("alice:smith"))
+	assert.Error(t, ValidateProxyUsername("alice smith"))
+	assert.Error(t, ValidateProxyUsername("alice-session-1"))
+}
@@ -2,10 +2,14 @@ package config
 
 import (
 	"fmt"
+	"path/filepath"
 	"strings"
 	"time"
 
 	"github.com/spf13/viper"
+
+	"proxyrouter/internal/acl"
+	"proxyrouter/internal/secrets"
 )
 
 // Config holds all configuration for the application
@@ -13,6 +17,7 @@ type Config struct {
 	Listen   ListenConfig   `mapstructure:"listen"`
 	Timeouts TimeoutConfig  `mapstructure:"timeouts"`
 	Tor      TorConfig      `mapstructure:"tor"`
+	Routing  RoutingConfig  `mapstructure:"routing"`
 	Refresh  RefreshConfig  `mapstructure:"refresh"`
 	Database DatabaseConfig `mapstructure:"database"`
 	Logging  LoggingConfig  `mapstructure:"logging"`
@@ -25,14 +30,21 @@ type Config struct {
 type ListenConfig struct {
 	HTTPProxy  string `mapstructure:"http_proxy"`
 	Socks5Proxy string `mapstructure:"socks5_proxy"`
+	Socks4Proxy string `mapstructure:"socks4_proxy"` // optional, "" disables
+	Mixed       string `mapstructure:"mixed"`        // optional HTTP/SOCKS4/SOCKS5 port, "" disables
 	API        string `mapstructure:"api"`
 }
 
 // TimeoutConfig holds timeout settings
 type TimeoutConfig struct {
-	DialMs  int `mapstructure:"dial_ms"`
-	ReadMs  int `mapstructure:"read_ms"`
-	WriteMs int `mapstructure:"write_ms"`
+	DialMs    int `mapstructure:"dial_ms"`
+	ReadMs    int `mapstructure:"read_ms"`
+	WriteMs   int `mapstructure:"write_ms"`
+	UDPIdleMs int `mapstructure:"udp_idle_ms"`
+	DrainMs   int `mapstructure:"drain_ms"` // how long shutdown waits for open connections
+
+	TunnelIdleMs     int `mapstructure:"tunnel_idle_ms"`     // default for routes without idle_timeout_sec, 0 = never
+	TunnelLifetimeMs int `mapstructure:"tunnel_lifetime_ms"` // default for routes without max_lifetime_sec, 0 = never
 }
 
 // TorConfig holds Tor-related settings
@@ -41,19 +53,27 @@ type TorConfig struct {
 	SocksAddress string `mapstructure:"socks_address"`
 }
 
+// RoutingConfig holds settings for dialing through the proxy pool
+type RoutingConfig struct {
+	FailoverCandidates int `mapstructure:"failover_candidates"`
+	FailoverBudgetMs   int `mapstructure:"failover_budget_ms"`
+	FailureThreshold   int `mapstructure:"failure_threshold"`
+}
+
 // RefreshConfig holds proxy refresh settings
 type RefreshConfig struct {
 	EnableGeneralSources bool           `mapstructure:"enable_general_sources"`
 	IntervalSec          int            `mapstructure:"interval_sec"`
 	HealthcheckConcurrency int          `mapstructure:"healthcheck_concurrency"`
+	HealthCheckIntervalSec int          `mapstructure:"health_check_interval_sec"` // 0 = interval_sec
 	Sources              []SourceConfig `mapstructure:"sources"`
 }
 
 // SourceConfig holds proxy source configuration
 type SourceConfig struct {
-	Name string `mapstructure:"name"`
-	URL  string `mapstructure:"url"`
-	Type string `mapstructure:"type"` // "html" or "raw"
+	Name string `mapstructure:"name" json:"name"`
+	URL  string `mapstructure:"url" json:"url"`
+	Type string `mapstructure:"type" json:"type"` // "html" or "raw"
 }
 
 // DatabaseConfig holds database settings
@@ -81,6 +101,7 @@ type AdminConfig struct {
 	BasePath     string   `mapstructure:"base_path"`
 	SessionSecret string  `mapstructure:"session_secret"`
 	AllowCIDRs   []string `mapstructure:"allow_cidrs"`
+	MaxUploadSizeMB int   `mapstructure:"max_upload_size_mb"` // 0 = no limit
 	TLS          TLSConfig `mapstructure:"tls"`
 }
 
@@ -93,8 +114,18 @@ type TLSConfig struct {
 
 // SecurityConfig holds security settings
 type SecurityConfig struct {
-	PasswordHash string         `mapstructure:"password_hash"`
-	Login        LoginConfig    `mapstructure:"login"`
+	PasswordHash      string          `mapstructure:"password_hash"`
+	Login             LoginConfig     `mapstructure:"login"`
+	CredentialKey     string          `mapstructure:"credential_key"`      // base64 AES-256 key for proxy credentials
+	CredentialKeyFile string          `mapstructure:"credential_key_file"` // used when credential_key is empty
+	ProxyAuth         ProxyAuthConfig `mapstructure:"proxy_auth"`
+	TrustedProxies    []string        `mapstructure:"trusted_proxies"` // load balancers whose client addresses are believed
+	ProxyProtocol     bool            `mapstructure:"proxy_protocol"`  // trusted proxies send a PROXY protocol header
+}
+
+// ProxyAuthConfig holds authentication settings for proxy clients
+type ProxyAuthConfig struct {
+	Required bool `mapstructure:"required"` // reject clients without proxy_users credentials
 }
 
 // LoginConfig holds login security settings
@@ -137,15 +168,25 @@ func Load(configPath string) (*Config, error) {
 func setDefaults() {
 	viper.SetDefault("listen.http_proxy", "0.0.0.0:8080")
 	viper.SetDefault("listen.socks5_proxy", "0.0.0.0:1080")
+	viper.SetDefault("listen.socks4_proxy", "")
+	viper.SetDefault("listen.mixed", "")
 	viper.SetDefault("listen.api", "0.0.0.0:8081")
 	viper.SetDefault("timeouts.dial_ms", 8000)
 	viper.SetDefault("timeouts.read_ms", 60000)
 	viper.SetDefault("timeouts.write_ms", 60000)
+	viper.SetDefault("timeouts.udp_idle_ms", 60000)
+	viper.SetDefault("timeouts.drain_ms", 30000)
+	viper.SetDefault("timeouts.tunnel_idle_ms", 300000)
+	viper.SetDefault("timeouts.tunnel_lifetime_ms", 0)
 	viper.SetDefault("tor.enabled", true)
 	viper.SetDefault("tor.socks_address", "127.0.0.1:9050")
+	viper.SetDefault("routing.failover_candidates", 3)
+	viper.SetDefault("routing.failover_budget_ms", 20000)
+	viper.SetDefault("routing.failure_threshold", 2)
 	viper.SetDefault("refresh.enable_general_sources", true)
 	viper.SetDefault("refresh.interval_sec", 900)
 	viper.SetDefault("refresh.healthcheck_concurrency", 50)
+	viper.SetDefault("refresh.health_check_interval_sec", 0)
 	viper.SetDefault("database.path", "/var/lib/proxyr/router.db")
 	viper.SetDefault("logging.level", "info")
 	viper.SetDefault("logging.format", "json")
@@ -159,6 +200,7 @@ func setDefaults() {
 	viper.SetDefault("admin.base_path", "/admin")
 	viper.SetDefault("admin.session_secret", "")
 	viper.SetDefault("admin.allow_cidrs", []string{"127.0.0.1/32"})
+	viper.SetDefault("admin.max_upload_size_mb", 10)
 	viper.SetDefault("admin.tls.enabled", false)
 	viper.SetDefault("admin.tls.cert_file", "")
 	viper.SetDefault("admin.tls.key_file", "")
@@ -167,6 +209,11 @@ func setDefaults() {
 	viper.SetDefault("security.password_hash", "argon2id")
 	viper.SetDefault("security.login.max_attempts", 10)
 	viper.SetDefault("security.login.window_seconds", 900)
+	viper.SetDefault("security.credential_key", "")
+	viper.SetDefault("security.credential_key_file", "")
+	viper.SetDefault("security.proxy_auth.required", false)
+	viper.SetDefault("security.trusted_proxies", []string{})
+	viper.SetDefault("security.proxy_protocol", false)
 }
 
 // validateConfig validates the configuration
@@ -196,6 +243,16 @@ func validateConfig(config *Config) error {
 			ports[port] = "SOCKS5 Proxy"
 		}
 	}
+	if config.Listen.Socks4Proxy != "" {
+		if port := extractPort(config.Listen.Socks4Proxy); port != "" {
+			ports[port] = "SOCKS4 Proxy"
+		}
+	}
+	if config.Listen.Mixed != "" {
+		if port := extractPort(config.Listen.Mixed); port != "" {
+			ports[port] = "Mixed Proxy"
+		}
+	}
 	if config.Listen.API != "" {
 		if port := extractPort(config.Listen.API); port != "" {
 			ports[port] = "API"
@@ -228,6 +285,15 @@ func validateConfig(config *Config) error {
 	if config.Timeouts.WriteMs <= 0 {
 		errors = append(errors, "write timeout must be positive")
 	}
+	if config.Timeouts.DrainMs < 0 {
+		errors = append(errors, "drain timeout must not be negative")
+	}
+	if config.Timeouts.TunnelIdleMs < 0 {
+		errors = append(errors, "tunnel idle timeout must not be negative")
+	}
+	if config.Timeouts.TunnelLifetimeMs < 0 {
+		errors = append(errors, "tunnel lifetime must not be negative")
+	}
 
 	// Check Tor configuration
 	if config.Tor.Enabled {
@@ -242,6 +308,17 @@ func validateConfig(config *Config) error {
 		}
 	}
 
+	// Check routing configuration
+	if config.Routing.FailoverCandidates < 0 {
+		errors = append(errors, "failover candidates must not be negative")
+	}
+	if config.Routing.FailoverBudgetMs < 0 {
+		errors = append(errors, "failover budget must not be negative")
+	}
+	if config.Routing.FailureThreshold < 0 {
+		errors = append(errors, "failure threshold must not be negative")
+	}
+
 	// Check refresh configuration
 	if config.Refresh.IntervalSec < 1 {
 		errors = append(errors, "refresh interval must be at least 1 second")
@@ -249,6 +326,12 @@ func validateConfig(config *Config) error {
 	if config.Refresh.HealthcheckConcurrency < 1 {
 		errors = append(errors, "healthcheck concurrency must be at least 1")
 	}
+	if config.Refresh.HealthCheckIntervalSec < 0 {
+		errors = append(errors, "health check interval must not be negative")
+	}
+	if config.Admin.MaxUploadSizeMB < 0 {
+		errors = append(errors, "max upload size must not be negative")
+	}
 
 	// Check logging configuration
 	if config.Logging.Level != "" {
@@ -296,6 +379,17 @@ func validateConfig(config *Config) error {
 	if config.Security.Login.WindowSeconds < 1 {
 		errors = append(errors, "login window seconds must be at least 1")
 	}
+	if config.Security.CredentialKey != "" {
+		if _, err := secrets.DecodeKey(config.Security.CredentialKey); err != nil {
+			errors = append(errors, fmt.Sprintf("invalid credential key: %v", err))
+		}
+	}
+	if _, err := acl.NewTrustedProxies(config.Security.TrustedProxies); err != nil {
+		errors = append(errors, err.Error())
+	}
+	if config.Security.ProxyProtocol && len(config.Security.TrustedProxies) == 0 {
+		errors = append(errors, "proxy protocol requires at least one trusted proxy")
+	}
 
 	if len(errors) > 0 {
 		return fmt.Errorf("configuration validation failed:\n%s", strings.Join(errors, "\n"))
@@ -337,13 +431,52 @@ func (c *Config) GetWriteTimeout() time.Duration {
 	return time.Duration(c.Timeouts.WriteMs) * time.Millisecond
 }
 
+// GetUDPIdleTimeout returns the UDP association idle timeout as time.Duration
+func (c *Config) GetUDPIdleTimeout() time.Duration {
+	return time.Duration(c.Timeouts.UDPIdleMs) * time.Millisecond
+}
+
+// GetDrainTimeout returns how long shutdown waits for open connections as
+// time.Duration
+func (c *Config) GetDrainTimeout() time.Duration {
+	return time.Duration(c.Timeouts.DrainMs) * time.Millisecond
+}
+
+// GetTunnelIdleTimeout returns how long a tunnel may go without traffic as
+// time.Duration
+func (c *Config) GetTunnelIdleTimeout() time.Duration {
+	return time.Duration(c.Timeouts.TunnelIdleMs) * time.Millisecond
+}
+
+// GetTunnelLifetime returns how long a tunnel may stay open as time.Duration
+func (c *Config) GetTunnelLifetime() time.Duration {
+	return time.Duration(c.Timeouts.TunnelLifetimeMs) * time.Millisecond
+}
+
+// GetFailoverBudget returns the failover budget as time.Duration
+func (c *Config) GetFailoverBudget() time.Duration {
+	return time.Duration(c.Routing.FailoverBudgetMs) * time.Millisecond
+}
+
+// GetCredentialKeyFile returns the path of the proxy credential key file,
+// defaulting to a file next to the database
+func (c *Config) GetCredentialKeyFile() string {
+	if c.Security.CredentialKeyFile != "" {
+		return c.Security.CredentialKeyFile
+	}
+	return filepath.Join(filepath.Dir(c.Database.Path), "credentials.key")
+}
+
 // GetRefreshInterval returns the refresh interval as time.Duration
 func (c *Config) GetRefreshInterval() time.Duration {
 	return time.Duration(c.Refresh.IntervalSec) * time.Second
 }
 
-// GetHealthCheckInterval returns the health check interval as time.Duration
+// GetHealthCheckInterval returns the health check interval as time.Duration,
+// which is the refresh interval unless set
 func (c *Config) GetHealthCheckInterval() time.Duration {
-	// For now, use the same interval as refresh, but this could be configurable
+	if c.Refresh.HealthCheckIntervalSec > 0 {
+		return time.Duration(c.Refresh.HealthCheckIntervalSec) * time.Second
+	}
 	return time.Duration(c.Refresh.IntervalSec) * time.Second
 }
@@ -325,6 +325,68 @@ func TestValidateConfig(t *testing.T) {
 			},
 			wantErr: true,
 		},
+		{
+			name: "invalid trusted proxy",
+			config: &Config{
+				Listen: ListenConfig{
+					HTTPProxy:  "0.0.0.0:8080",
+					Socks5Proxy: "0.0.0.0:1080",
+					API:        "0.0.0.0:8081",
+				},
+				Timeouts: TimeoutConfig{
+					DialMs:  8000,
+					ReadMs:  60000,
+					WriteMs: 60000,
+				},
+				Refresh: RefreshConfig{
+					IntervalSec:          900,
+					HealthcheckConcurrency: 50,
+				},
+				Database: DatabaseConfig{
+					Path: "/tmp/test.db",
+				},
+				Security: SecurityConfig{
+					PasswordHash: "argon2id",
+					Login: LoginConfig{
+						MaxAttempts:   10,
+						WindowSeconds: 900,
+					},
+					TrustedProxies: []string{"10.0.0.0/33"},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "proxy protocol without trusted proxies",
+			config: &Config{
+				Listen: ListenConfig{
+					HTTPProxy:  "0.0.0.0:8080",
+					Socks5Proxy: "0.0.0.0:1080",
+					API:        "0.0.0.0:8081",
+				},
+				Timeouts: TimeoutConfig{
+					DialMs:  8000,
+					ReadMs:  60000,
+					WriteMs: 60000,
+				},
+				Refresh: RefreshConfig{
+					IntervalSec:          900,
+					HealthcheckConcurrency: 50,
+				},
+				Database: DatabaseConfig{
+					Path: "/tmp/test.db",
+				},
+				Security: SecurityConfig{
+					PasswordHash: "argon2id",
+					Login: LoginConfig{
+						MaxAttempts:   10,
+						WindowSeconds: 900,
+					},
+					ProxyProtocol: true,
+				},
+			},
+			wantErr: true,
+		},
 	}
 
 	for _, tt := range tests {
@@ -340,9 +402,14 @@ func TestValidateConfig(t *testing.T) {
 func TestGetTimeouts(t *testing.T) {
 	cfg := &Config{
 		Timeouts: TimeoutConfig{
-			DialMs:  5000,
-			ReadMs:  30000,
-			WriteMs: 30000,
+			DialMs:    5000,
+			ReadMs:    30000,
+			WriteMs:   30000,
+			UDPIdleMs: 90000,
+			DrainMs:   15000,
+
+			TunnelIdleMs:     120000,
+			TunnelLifetimeMs: 3600000,
 		},
 		Refresh: RefreshConfig{
 			IntervalSec: 600,
@@ -361,7 +428,32 @@ func TestGetTimeouts(t *testing.T) {
 		t.Errorf("Expected write timeout to be 30s, got %v", cfg.GetWriteTimeout())
 	}
 
+	if cfg.GetUDPIdleTimeout() != 90*time.Second {
+		t.Errorf("Expected UDP idle timeout to be 90s, got %v", cfg.GetUDPIdleTimeout())
+	}
+
+	if cfg.GetDrainTimeout() != 15*time.Second {
+		t.Errorf("Expected drain timeout to be 15s, got %v", cfg.GetDrainTimeout())
+	}
+
+	if cfg.GetTunnelIdleTimeout() != 2*time.Minute {
+		t.Errorf("Expected tunnel idle timeout to be 2m, got %v", cfg.GetTunnelIdleTimeout())
+	}
+
+	if cfg.GetTunnelLifetime() != time.Hour {
+		t.Errorf("Expected tunnel lifetime to be 1h, got %v", cfg.GetTunnelLifetime())
+	}
+
 	if cfg.GetRefreshInterval() != 10*time.Minute {
 		t.Errorf("Expected refresh interval to be 10m, got %v", cfg.GetRefreshInterval())
 	}
+
+	if cfg.GetHealthCheckInterval() != 10*time.Minute {
+		t.Errorf("Expected health check interval to default to the refresh interval, got %v", cfg.GetHealthCheckInterval())
+	}
+
+	cfg.Refresh.HealthCheckIntervalSec = 300
+	if cfg.GetHealthCheckInterval() != 5*time.Minute {
+		t.Errorf("Expected health check interval to be 5m, got %v", cfg.GetHealthCheckInterval())
+	}
 }
@@ -0,0 +1,58 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+)
+
+// liveKeys are the settings that take effect without a restart. A key is
+// live when it or one of its sections is listed.
+var liveKeys = []string{
+	"timeouts.dial_ms",
+	"tor.socks_address",
+	"routing",
+	"refresh",
+	"admin.allow_cidrs",
+	"admin.max_upload_size_mb",
+}
+
+// Diff returns the keys whose values differ between two configurations, such
+// as "timeouts.dial_ms" or "refresh.sources"
+func Diff(old, new *Config) []string {
+	var keys []string
+	diffValues("", reflect.ValueOf(*old), reflect.ValueOf(*new), &keys)
+	return keys
+}
+
+// diffValues compares two values of the same type, descending into structs
+func diffValues(key string, a, b reflect.Value, keys *[]string) {
+	if a.Kind() != reflect.Struct {
+		if !reflect.DeepEqual(a.Interface(), b.Interface()) {
+			*keys = append(*keys, key)
+		}
+		return
+	}
+
+	for i := 0; i < a.NumField(); i++ {
+		field := a.Type().Field(i)
+		name := field.Tag.Get("mapstructure")
+		if name == "" {
+			name = strings.ToLower(field.Name)
+		}
+		if key != "" {
+			name = key + "." + name
+		}
+		diffValues(name, a.Field(i), b.Field(i), keys)
+	}
+}
+
+// RequiresRestart reports whether a change to key only takes effect after a
+// restart
+func RequiresRestart(key string) bool {
+	for _, live := range liveKeys {
+		if key == live || strings.HasPrefix(key, live+".") {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,152 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// reloadDelay lets a burst of writes to the config file settle before it is
+// read again
+const reloadDelay = 200 * time.Millisecond
+
+// Reloader reads the config file again when asked or when it changes, and
+// hands valid configurations to the components that apply them
+type Reloader struct {
+	path   string
+	logger *slog.Logger
+	audit  func(ctx context.Context, detail string) error
+
+	mu       sync.Mutex
+	running  *Config // the configuration the process started with
+	current  *Config // the last configuration applied
+	appliers []func(*Config)
+}
+
+// NewReloader creates a reloader for the config file at path that cfg was
+// loaded from. Each reload is logged to logger and recorded with audit, which
+// may be nil.
+func NewReloader(path string, cfg *Config, logger *slog.Logger, audit func(ctx context.Context, detail string) error) *Reloader {
+	return &Reloader{
+		path:    filepath.Clean(path),
+		logger:  logger,
+		audit:   audit,
+		running: cfg,
+		current: cfg,
+	}
+}
+
+// OnReload registers apply to be called with each configuration that changes
+// a live setting
+func (r *Reloader) OnReload(apply func(*Config)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.appliers = append(r.appliers, apply)
+}
+
+// Current returns the last configuration applied
+func (r *Reloader) Current() *Config {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.current
+}
+
+// Reload reads and validates the config file and applies its live settings.
+// An invalid file is rejected and the running configuration kept. Changes to
+// settings that need a restart are reported but not applied. trigger names
+// what asked for the reload in logs and the audit log.
+func (r *Reloader) Reload(ctx context.Context, trigger string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	next, err := Load(r.path)
+	if err != nil {
+		r.logger.Error("Config reload rejected", "trigger", trigger, "error", err)
+		r.record(ctx, fmt.Sprintf("%s: rejected: %v", trigger, err))
+		return err
+	}
+
+	var live, restart []string
+	for _, key := range Diff(r.current, next) {
+		if !RequiresRestart(key) {
+			live = append(live, key)
+		}
+	}
+	for _, key := range Diff(r.running, next) {
+		if RequiresRestart(key) {
+			restart = append(restart, key)
+			r.logger.Warn("Config change needs a restart to take effect", "key", key)
+		}
+	}
+
+	if len(live) > 0 {
+		for _, apply := range r.appliers {
+			apply(next)
+		}
+	}
+	r.current = next
+
+	r.logger.Info("Config reloaded", "trigger", trigger, "applied", live, "restart_required", restart)
+	detail := fmt.Sprintf("%s: applied [%s]", trigger, strings.Join(live, ", "))
+	if len(restart) > 0 {
+		detail += fmt.Sprintf(", restart required for [%s]", strings.Join(restart, ", "))
+	}
+	r.record(ctx, detail)
+	return nil
+}
+
+// record writes a reload to the audit log
+func (r *Reloader) record(ctx context.Context, detail string) {
+	if r.audit == nil {
+		return
+	}
+	if err := r.audit(ctx, detail); err != nil {
+		r.logger.Error("Failed to audit config reload", "error", err)
+	}
+}
+
+// Watch reloads the configuration whenever the config file is written or
+// replaced, until ctx is done
+func (r *Reloader) Watch(ctx context.Context) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("failed to create config watcher: %w", err)
+	}
+	defer watcher.Close()
+
+	// Editors and deploy tools often replace the file rather than write it,
+	// so the directory is watched
+	dir := filepath.Dir(r.path)
+	if err := watcher.Add(dir); err != nil {
+		return fmt.Errorf("failed to watch %s: %w", dir, err)
+	}
+
+	var settle <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if filepath.Clean(event.Name) == r.path && event.Op&(fsnotify.Write|fsnotify.Create) != 0 {
+				settle = time.After(reloadDelay)
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			r.logger.Warn("Config watcher error", "error", err)
+		case <-settle:
+			settle = nil
+			r.Reload(ctx, "file change")
+		}
+	}
+}
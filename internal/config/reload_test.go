@@ -0,0 +1,169 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const reloadTestConfig = `
+listen:
+  http_proxy: "127.0.0.1:%HTTP%"
+  socks5_proxy: "127.0.0.1:1080"
+  api: "127.0.0.1:8081"
+
+timeouts:
+  dial_ms: %DIAL%
+
+database:
+  path: "/tmp/test.db"
+`
+
+// writeReloadConfig writes a config file with the given HTTP proxy port and
+// dial timeout
+func writeReloadConfig(t *testing.T, path, httpPort, dialMs string) {
+	t.Helper()
+	content := strings.NewReplacer("%HTTP%", httpPort, "%DIAL%", dialMs).Replace(reloadTestConfig)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	old := &Config{}
+	old.Timeouts.DialMs = 8000
+	old.Listen.HTTPProxy = "0.0.0.0:8080"
+	old.Refresh.Sources = []SourceConfig{{Name: "a", URL: "https://example.com/a.txt", Type: "raw"}}
+
+	new := *old
+	new.Timeouts.DialMs = 5000
+	new.Listen.HTTPProxy = "0.0.0.0:9090"
+	new.Refresh.Sources = []SourceConfig{{Name: "b", URL: "https://example.com/b.txt", Type: "raw"}}
+
+	got := Diff(old, &new)
+	want := []string{"listen.http_proxy", "timeouts.dial_ms", "refresh.sources"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("Diff() = %v, want %v", got, want)
+	}
+
+	if keys := Diff(old, old); len(keys) != 0 {
+		t.Errorf("Diff() of equal configs = %v, want none", keys)
+	}
+}
+
+func TestRequiresRestart(t *testing.T) {
+	tests := map[string]bool{
+		"timeouts.dial_ms":             false,
+		"timeouts.read_ms":             true,
+		"tor.socks_address":            false,
+		"tor.enabled":                  true,
+		"routing.failover_candidates":  false,
+		"refresh.sources":              false,
+		"admin.allow_cidrs":            false,
+		"admin.port":                   true,
+		"listen.http_proxy":            true,
+		"security.trusted_proxies":     true,
+		"refreshing.something_similar": true,
+	}
+	for key, want := range tests {
+		if got := RequiresRestart(key); got != want {
+			t.Errorf("RequiresRestart(%q) = %v, want %v", key, got, want)
+		}
+	}
+}
+
+func TestReloaderReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeReloadConfig(t, path, "8080", "8000")
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	var logs bytes.Buffer
+	var audits []string
+	reloader := NewReloader(path, cfg, slog.New(slog.NewTextHandler(&logs, nil)), func(ctx context.Context, detail string) error {
+		audits = append(audits, detail)
+		return nil
+	})
+	var applied []*Config
+	reloader.OnReload(func(c *Config) {
+		applied = append(applied, c)
+	})
+
+	// A live change is applied, a listen address change only warned about
+	writeReloadConfig(t, path, "9090", "5000")
+	if err := reloader.Reload(context.Background(), "SIGHUP"); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+	if len(applied) != 1 || applied[0].Timeouts.DialMs != 5000 {
+		t.Fatalf("Expected the new dial timeout to be applied once, got %d applies", len(applied))
+	}
+	if reloader.Current().Timeouts.DialMs != 5000 {
+		t.Errorf("Expected current dial timeout 5000, got %d", reloader.Current().Timeouts.DialMs)
+	}
+	if !strings.Contains(logs.String(), "key=listen.http_proxy") {
+		t.Errorf("Expected a restart warning for listen.http_proxy, got logs %q", logs.String())
+	}
+	want := "SIGHUP: applied [timeouts.dial_ms], restart required for [listen.http_proxy]"
+	if len(audits) != 1 || audits[0] != want {
+		t.Errorf("Expected audit %q, got %v", want, audits)
+	}
+
+	// An invalid file is rejected and the running configuration kept
+	writeReloadConfig(t, path, "9090", "-1")
+	if err := reloader.Reload(context.Background(), "file change"); err == nil {
+		t.Fatal("Expected an invalid config to be rejected")
+	}
+	if len(applied) != 1 {
+		t.Errorf("Expected a rejected config not to be applied")
+	}
+	if reloader.Current().Timeouts.DialMs != 5000 {
+		t.Errorf("Expected the previous config to stay current")
+	}
+	if len(audits) != 2 || !strings.HasPrefix(audits[1], "file change: rejected: ") {
+		t.Errorf("Expected the rejection to be audited, got %v", audits)
+	}
+}
+
+func TestReloaderWatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeReloadConfig(t, path, "8080", "8000")
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	reloaded := make(chan *Config, 1)
+	reloader := NewReloader(path, cfg, slog.New(slog.NewTextHandler(&bytes.Buffer{}, nil)), nil)
+	reloader.OnReload(func(c *Config) {
+		reloaded <- c
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	watching := make(chan error, 1)
+	go func() {
+		watching <- reloader.Watch(ctx)
+	}()
+
+	// Give the watcher time to start before the file changes
+	time.Sleep(100 * time.Millisecond)
+	writeReloadConfig(t, path, "8080", "3000")
+
+	select {
+	case c := <-reloaded:
+		if c.Timeouts.DialMs != 3000 {
+			t.Errorf("Expected dial timeout 3000, got %d", c.Timeouts.DialMs)
+		}
+	case err := <-watching:
+		t.Fatalf("Watch() stopped: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the config file change to be applied")
+	}
+}
@@ -0,0 +1,275 @@
+package conntrack
+
+import (
+	"context"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"proxyrouter/internal/halfclose"
+)
+
+// drainPollInterval is how often Shutdown checks for remaining connections
+const drainPollInterval = 50 * time.Millisecond
+
+// Conn is a client connection accepted by one of the proxy listeners. It
+// counts the bytes passing through it and records what the proxy handlers
+// learn about the session. The setters ignore a nil Conn, so handlers also
+// serve connections nobody tracks.
+type Conn struct {
+	net.Conn
+
+	tracker   *Tracker
+	id        uint64
+	listener  string
+	startedAt time.Time
+	bytesIn   atomic.Int64 // read from the client
+	bytesOut  atomic.Int64 // written to the client
+
+	mu       sync.Mutex
+	clientIP string
+	user     string
+	protocol string
+	target   string
+	routeID  *int
+	group    string
+	proxyID  *int
+}
+
+// Info describes a tracked connection
+type Info struct {
+	ID        uint64    `json:"id"`
+	Listener  string    `json:"listener"`
+	Protocol  string    `json:"protocol,omitempty"`
+	ClientIP  string    `json:"client_ip"`
+	User      string    `json:"user,omitempty"`
+	Target    string    `json:"target,omitempty"`
+	RouteID   *int      `json:"route_id,omitempty"`
+	Group     string    `json:"group,omitempty"`
+	ProxyID   *int      `json:"proxy_id,omitempty"`
+	StartedAt time.Time `json:"started_at"`
+	BytesIn   int64     `json:"bytes_in"`
+	BytesOut  int64     `json:"bytes_out"`
+}
+
+// Read implements net.Conn
+func (c *Conn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.bytesIn.Add(int64(n))
+	return n, err
+}
+
+// Write implements net.Conn
+func (c *Conn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.bytesOut.Add(int64(n))
+	return n, err
+}
+
+// CloseWrite half-closes the wrapped connection
+func (c *Conn) CloseWrite() error {
+	return halfclose.CloseWrite(c.Conn)
+}
+
+// ID returns the ID of the connection in its tracker
+func (c *Conn) ID() uint64 {
+	return c.id
+}
+
+// Done removes the connection from its tracker. It must be called once the
+// connection is closed.
+func (c *Conn) Done() {
+	c.tracker.mu.Lock()
+	delete(c.tracker.conns, c.id)
+	c.tracker.mu.Unlock()
+}
+
+// SetClientIP records the address of the client
+func (c *Conn) SetClientIP(clientIP string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.clientIP = clientIP
+}
+
+// SetUser records the proxy user the client logged in as
+func (c *Conn) SetUser(user string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.user = user
+}
+
+// SetTarget records the kind of the current request, e.g. "connect", and
+// the host:port it asks for
+func (c *Conn) SetTarget(protocol, target string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.protocol, c.target = protocol, target
+}
+
+// SetRoute records the route of the current request and its upstream proxy.
+// Without a proxy ID, e.g. for the general pool, the proxy of an earlier
+// request on the same route is kept, as its connection may be reused.
+func (c *Conn) SetRoute(routeID int, group string, proxyID *int) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if proxyID != nil || c.routeID == nil || *c.routeID != routeID {
+		c.proxyID = proxyID
+	}
+	c.routeID, c.group = &routeID, group
+}
+
+// SetProxy records the pool proxy the current request went through
+func (c *Conn) SetProxy(proxyID int) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.proxyID = &proxyID
+}
+
+// Info returns the current state of the connection
+func (c *Conn) Info() Info {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return Info{
+		ID:        c.id,
+		Listener:  c.listener,
+		Protocol:  c.protocol,
+		ClientIP:  c.clientIP,
+		User:      c.user,
+		Target:    c.target,
+		RouteID:   c.routeID,
+		Group:     c.group,
+		ProxyID:   c.proxyID,
+		StartedAt: c.startedAt,
+		BytesIn:   c.bytesIn.Load(),
+		BytesOut:  c.bytesOut.Load(),
+	}
+}
+
+type connKey struct{}
+
+// NewContext returns a context carrying the tracked connection
+func NewContext(ctx context.Context, c *Conn) context.Context {
+	return context.WithValue(ctx, connKey{}, c)
+}
+
+// FromContext returns the connection stored by NewContext, or nil
+func FromContext(ctx context.Context) *Conn {
+	c, _ := ctx.Value(connKey{}).(*Conn)
+	return c
+}
+
+// Tracker keeps the client connections the proxy listeners are serving, so
+// they can be listed and closed, and shutdown can wait for them to finish
+type Tracker struct {
+	mu     sync.Mutex
+	nextID uint64
+	conns  map[uint64]*Conn
+}
+
+// New creates an empty tracker
+func New() *Tracker {
+	return &Tracker{conns: make(map[uint64]*Conn)}
+}
+
+// Track records a connection accepted by listener. The handler should use
+// the returned Conn in place of conn and call its Done method once the
+// connection is closed.
+func (t *Tracker) Track(listener string, conn net.Conn) *Conn {
+	c := &Conn{
+		Conn:      conn,
+		tracker:   t,
+		listener:  listener,
+		startedAt: time.Now(),
+	}
+	if host, _, err := net.SplitHostPort(conn.RemoteAddr().String()); err == nil {
+		c.clientIP = host
+	}
+
+	t.mu.Lock()
+	t.nextID++
+	c.id = t.nextID
+	t.conns[c.id] = c
+	t.mu.Unlock()
+	return c
+}
+
+// List returns the open connections, oldest first
+func (t *Tracker) List() []Info {
+	t.mu.Lock()
+	conns := make([]*Conn, 0, len(t.conns))
+	for _, c := range t.conns {
+		conns = append(conns, c)
+	}
+	t.mu.Unlock()
+
+	infos := make([]Info, 0, len(conns))
+	for _, c := range conns {
+		infos = append(infos, c.Info())
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return infos
+}
+
+// Close closes the open connection with the given ID and reports whether it
+// was found. Its handler notices and ends the session.
+func (t *Tracker) Close(id uint64) bool {
+	t.mu.Lock()
+	c, ok := t.conns[id]
+	t.mu.Unlock()
+	if !ok {
+		return false
+	}
+	c.Conn.Close()
+	return true
+}
+
+// Len returns the number of open connections
+func (t *Tracker) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.conns)
+}
+
+// Shutdown waits for the open connections to finish until ctx is done, then
+// closes the rest. It returns how many connections it had to close.
+func (t *Tracker) Shutdown(ctx context.Context) int {
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+
+	for t.Len() > 0 {
+		select {
+		case <-ctx.Done():
+			return t.closeAll()
+		case <-ticker.C:
+		}
+	}
+	return 0
+}
+
+// closeAll closes every open connection
+func (t *Tracker) closeAll() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, c := range t.conns {
+		c.Conn.Close()
+	}
+	return len(t.conns)
+}
@@ -0,0 +1,130 @@
+package conntrack
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTrackerList(t *testing.T) {
+	tracker := New()
+	client, server := net.Pipe()
+	defer client.Close()
+
+	c := tracker.Track("http", server)
+	c.SetUser("alice")
+	c.SetTarget("connect", "example.com:443")
+	c.SetRoute(3, "UPSTREAM", nil)
+	c.SetProxy(7)
+
+	conns := tracker.List()
+	require.Len(t, conns, 1)
+	assert.Equal(t, uint64(1), conns[0].ID)
+	assert.Equal(t, "http", conns[0].Listener)
+	assert.Equal(t, "alice", conns[0].User)
+	assert.Equal(t, "connect", conns[0].Protocol)
+	assert.Equal(t, "example.com:443", conns[0].Target)
+	require.NotNil(t, conns[0].RouteID)
+	assert.Equal(t, 3, *conns[0].RouteID)
+	assert.Equal(t, "UPSTREAM", conns[0].Group)
+	require.NotNil(t, conns[0].ProxyID)
+	assert.Equal(t, 7, *conns[0].ProxyID)
+
+	c.Done()
+	assert.Empty(t, tracker.List())
+}
+
+func TestTrackerShutdownWaitsForConnections(t *testing.T) {
+	tracker := New()
+	client, server := net.Pipe()
+	defer client.Close()
+	c := tracker.Track("socks5", server)
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		c.Done()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.Equal(t, 0, tracker.Shutdown(ctx))
+}
+
+func TestTrackerShutdownClosesStragglers(t *testing.T) {
+	tracker := New()
+	client, server := net.Pipe()
+	defer client.Close()
+	tracker.Track("socks5", server)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, 1, tracker.Shutdown(ctx))
+
+	_, err := server.Read(make([]byte, 1))
+	assert.Error(t, err, "straggler should be closed")
+}
+
+func TestConnCountsBytes(t *testing.T) {
+	tracker := New()
+	client, server := net.Pipe()
+	defer client.Close()
+	c := tracker.Track("socks5", server)
+	defer c.Done()
+
+	go func() {
+		client.Write([]byte("ping"))
+		client.Read(make([]byte, 6))
+	}()
+	_, err := c.Read(make([]byte, 4))
+	require.NoError(t, err)
+	_, err = c.Write([]byte("pong!!"))
+	require.NoError(t, err)
+
+	info := tracker.List()[0]
+	assert.Equal(t, int64(4), info.BytesIn)
+	assert.Equal(t, int64(6), info.BytesOut)
+}
+
+func TestConnKeepsProxyOfSameRoute(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	c := New().Track("http", server)
+	defer c.Done()
+
+	c.SetRoute(1, "GENERAL", nil)
+	c.SetProxy(5)
+	c.SetRoute(1, "GENERAL", nil)
+	require.NotNil(t, c.Info().ProxyID, "a reused connection keeps its proxy")
+
+	c.SetRoute(2, "LOCAL", nil)
+	assert.Nil(t, c.Info().ProxyID)
+}
+
+func TestTrackerClose(t *testing.T) {
+	tracker := New()
+	client, server := net.Pipe()
+	defer client.Close()
+	c := tracker.Track("http", server)
+	defer c.Done()
+
+	assert.False(t, tracker.Close(c.ID()+1))
+	assert.True(t, tracker.Close(c.ID()))
+
+	_, err := c.Read(make([]byte, 1))
+	assert.Error(t, err, "closed connection should fail")
+}
+
+func TestConnIgnoresUpdatesWhenNil(t *testing.T) {
+	var c *Conn
+	assert.NotPanics(t, func() {
+		c.SetUser("alice")
+		c.SetTarget("http", "example.com:80")
+		c.SetRoute(1, "LOCAL", nil)
+		c.SetProxy(2)
+	})
+	assert.Nil(t, FromContext(context.Background()))
+}
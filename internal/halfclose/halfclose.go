@@ -0,0 +1,17 @@
+// Package halfclose closes the write side of connections through the
+// wrappers the proxies put around them.
+package halfclose
+
+import (
+	"errors"
+	"io"
+)
+
+// CloseWrite closes the write side of w. It returns errors.ErrUnsupported
+// when w cannot be half-closed, so the caller can close it fully instead.
+func CloseWrite(w io.Writer) error {
+	if closer, ok := w.(interface{ CloseWrite() error }); ok {
+		return closer.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}
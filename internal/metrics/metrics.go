@@ -30,6 +30,13 @@ type Metrics struct {
 	// ACL metrics
 	aclDeniedTotal prometheus.Counter
 
+	// Proxy user metrics
+	userRequestsTotal *prometheus.CounterVec
+
+	// Bandwidth shaping metrics
+	shapedBytesTotal *prometheus.CounterVec
+	shapedThroughput *prometheus.GaugeVec
+
 	// Database for metrics collection
 	db *sql.DB
 }
@@ -77,6 +84,18 @@ func New(db *sql.DB) *Metrics {
 			Name: "proxyrouter_acl_denied_total",
 			Help: "Total number of ACL denials",
 		}),
+		userRequestsTotal: promauto.NewCounterVec(prometheus.CounterOpts{
+			Name: "proxyrouter_user_requests_total",
+			Help: "Total number of routed requests by authenticated proxy user",
+		}, []string{"user", "route_group"}),
+		shapedBytesTotal: promauto.NewCounterVec(prometheus.CounterOpts{
+			Name: "proxyrouter_shaped_bytes_total",
+			Help: "Total bytes through tunnels with a bandwidth limit, by limit key and direction",
+		}, []string{"key", "direction"}),
+		shapedThroughput: promauto.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "proxyrouter_shaped_throughput_bytes_per_second",
+			Help: "Current throughput of tunnels with a bandwidth limit, by limit key and direction",
+		}, []string{"key", "direction"}),
 	}
 
 	// Start metrics collection
@@ -156,6 +175,23 @@ func (m *Metrics) RecordACLDenial() {
 	m.aclDeniedTotal.Inc()
 }
 
+// RecordUserRequest records a routed request of an authenticated proxy user
+func (m *Metrics) RecordUserRequest(user, routeGroup string) {
+	m.userRequestsTotal.WithLabelValues(user, routeGroup).Inc()
+}
+
+// RecordShapedTraffic records the bytes that passed a bandwidth limit in one
+// direction during the last interval
+func (m *Metrics) RecordShapedTraffic(key, direction string, bytes int64, interval time.Duration) {
+	m.shapedBytesTotal.WithLabelValues(key, direction).Add(float64(bytes))
+	m.shapedThroughput.WithLabelValues(key, direction).Set(float64(bytes) / interval.Seconds())
+}
+
+// ForgetShapedKey drops the throughput of a bandwidth limit no tunnel uses
+func (m *Metrics) ForgetShapedKey(key string) {
+	m.shapedThroughput.DeletePartialMatch(prometheus.Labels{"key": key})
+}
+
 // GetP95Latency returns the 95th percentile latency
 func (m *Metrics) GetP95Latency() float64 {
 	// This would require implementing a custom histogram or using a different approach
@@ -0,0 +1,394 @@
+package proxyhttp
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"proxyrouter/internal/conntrack"
+	"proxyrouter/internal/router"
+	"proxyrouter/internal/tunnel"
+)
+
+// hopByHopHeaders apply to a single connection and are never forwarded
+var hopByHopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// client is the state of one client connection
+type client struct {
+	conn     net.Conn
+	reader   *bufio.Reader
+	clientIP string
+	entry    *conntrack.Conn // nil when the connection is not tracked
+
+	// authorization is the last Proxy-Authorization header that logged in as
+	// user, so later requests on the connection skip the password check until
+	// the proxy users change
+	authorization string
+	user          string
+	generation    uint64
+
+	// transports keep upstream connections open between requests, one pool
+	// per route, session and user
+	transports map[transportKey]*http.Transport
+
+	mu   sync.Mutex
+	idle bool // waiting for the next request
+}
+
+// transportKey identifies the upstream connections a request may reuse
+type transportKey struct {
+	routeID   int
+	sessionID string
+	user      string // connections are shaped and attributed to their user
+}
+
+// routeKey carries the routedRequest to the transport's dialer
+type routeKey struct{}
+
+// routedRequest is the route a request matched and the user who sent it
+type routedRequest struct {
+	route *router.Route
+	user  string
+}
+
+// newClient wraps an accepted client connection, recording its requests in
+// entry
+func newClient(conn net.Conn, clientIP string, entry *conntrack.Conn) *client {
+	return &client{
+		conn:       conn,
+		reader:     bufio.NewReader(conn),
+		clientIP:   clientIP,
+		entry:      entry,
+		transports: make(map[transportKey]*http.Transport),
+	}
+}
+
+// close closes the client's idle upstream connections
+func (c *client) close() {
+	for _, transport := range c.transports {
+		transport.CloseIdleConnections()
+	}
+}
+
+// startIdle marks the connection as waiting for its next request. It returns
+// false once ctx is done, so no new request is read during shutdown.
+func (c *client) startIdle(ctx context.Context) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if ctx.Err() != nil {
+		return false
+	}
+	c.idle = true
+	return true
+}
+
+// stopIdle marks the connection as serving a request
+func (c *client) stopIdle() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.idle = false
+}
+
+// interruptIdle unblocks a connection that is waiting for its next request
+func (c *client) interruptIdle() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.idle {
+		c.conn.SetReadDeadline(time.Unix(1, 0))
+	}
+}
+
+// login authenticates the Proxy-Authorization header of a request and splits
+// off its session ID. A header that already logged in on this connection is
+// not checked again unless a proxy user changed since.
+func (s *Server) login(ctx context.Context, c *client, header http.Header) (user, sessionID string, ok bool) {
+	username, password, hasCredentials := proxyCredentials(header)
+	user, sessionID = router.SplitSessionUsername(username)
+
+	authorization := header.Get("Proxy-Authorization")
+	generation := s.users.Generation()
+	if hasCredentials && authorization == c.authorization && generation == c.generation {
+		return c.user, sessionID, true
+	}
+
+	user, ok = s.authenticate(ctx, user, password, hasCredentials)
+	if ok && hasCredentials {
+		c.authorization, c.user, c.generation = authorization, user, generation
+	}
+	return user, sessionID, ok
+}
+
+// transport returns the client's upstream connection pool for a route and
+// user. New connections are dialled through the route of the request that
+// needs them.
+func (s *Server) transport(c *client, route *router.Route, sessionID, user string) *http.Transport {
+	key := transportKey{routeID: route.ID, sessionID: sessionID, user: user}
+	if transport, ok := c.transports[key]; ok {
+		return transport
+	}
+
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			routed, _ := ctx.Value(routeKey{}).(*routedRequest)
+			if routed == nil {
+				return nil, fmt.Errorf("route missing from request context")
+			}
+			route := routed.route
+			host, _, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, err
+			}
+
+			dialer, err := s.dialerFactory.CreateDialer(ctx, route, c.clientIP, host)
+			if err != nil {
+				return nil, fmt.Errorf("failed to create dialer for route %s: %w", route.Group, err)
+			}
+			conn, err := dialer.DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			return s.upstream(ctx, conn, c.clientIP, routed.user, route), nil
+		},
+		DisableCompression:    true,
+		IdleConnTimeout:       90 * time.Second,
+		ResponseHeaderTimeout: s.timeout,
+		ExpectContinueTimeout: time.Second,
+	}
+	c.transports[key] = transport
+	return transport
+}
+
+// handleHTTPRequest forwards a plain HTTP request and relays the response. It
+// returns whether the client connection can carry another request.
+func (s *Server) handleHTTPRequest(ctx context.Context, c *client, user, sessionID string, req *http.Request) bool {
+	// For an HTTP proxy, the target is an absolute URL
+	if req.URL.Host == "" || (req.URL.Scheme != "http" && req.URL.Scheme != "https") {
+		fmt.Printf("Invalid proxy request target %s from %s\n", req.RequestURI, c.clientIP)
+		s.sendErrorResponse(c.conn, "400 Bad Request")
+		return false
+	}
+
+	// Extract host and port
+	host := req.URL.Hostname()
+	port := req.URL.Port()
+	if port == "" {
+		if req.URL.Scheme == "https" {
+			port = "443"
+		} else {
+			port = "80"
+		}
+	}
+
+	c.entry.SetTarget("http", net.JoinHostPort(host, port))
+
+	// Find route for this target
+	portNum, _ := strconv.Atoi(port)
+	route, ok := s.matchRoute(ctx, c, user, router.Request{
+		Host:   host,
+		Port:   portNum,
+		Scheme: req.URL.Scheme,
+		Method: req.Method,
+		Path:   req.URL.Path,
+	})
+	if !ok {
+		return false
+	}
+
+	outReq := req.Clone(context.WithValue(ctx, routeKey{}, &routedRequest{route: route, user: user}))
+	outReq.RequestURI = ""
+	outReq.Close = false
+	removeHopByHopHeaders(outReq.Header)
+	if upgrade := upgradeType(req.Header); upgrade != "" {
+		outReq.Header.Set("Connection", "Upgrade")
+		outReq.Header.Set("Upgrade", upgrade)
+	}
+	addVia(outReq.Header, req.ProtoMajor, req.ProtoMinor)
+	if _, ok := outReq.Header["User-Agent"]; !ok {
+		// Keep net/http from sending its own User-Agent
+		outReq.Header.Set("User-Agent", "")
+	}
+
+	// A client waiting for 100 Continue gets it once the target reads the body
+	var body *continueReader
+	if req.ProtoAtLeast(1, 1) && strings.EqualFold(req.Header.Get("Expect"), "100-continue") {
+		body = &continueReader{ReadCloser: req.Body, conn: c.conn}
+		outReq.Body = body
+	}
+
+	resp, err := s.transport(c, route, sessionID, user).RoundTrip(outReq)
+	if err != nil {
+		fmt.Printf("Failed to forward request to %s: %v\n", req.URL.Host, err)
+		s.sendDialErrorResponse(c.conn, err)
+		return false
+	}
+	defer resp.Body.Close()
+
+	// The body is still unread if the client was never asked for it
+	keepAlive := !req.Close
+	if body != nil && !body.finish() {
+		keepAlive = false
+	}
+
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		s.switchProtocols(c, resp)
+		return false
+	}
+
+	removeHopByHopHeaders(resp.Header)
+	addVia(resp.Header, resp.ProtoMajor, resp.ProtoMinor)
+
+	// Bodies of unknown length are chunked for HTTP/1.1 clients, HTTP/1.0
+	// clients read them until the connection closes
+	if resp.ContentLength < 0 && req.Method != http.MethodHead {
+		if req.ProtoAtLeast(1, 1) {
+			resp.TransferEncoding = []string{"chunked"}
+		} else {
+			resp.TransferEncoding = nil
+			keepAlive = false
+		}
+	}
+	if keepAlive && !req.ProtoAtLeast(1, 1) {
+		resp.Header.Set("Connection", "keep-alive")
+	}
+	resp.Proto, resp.ProtoMajor, resp.ProtoMinor = "HTTP/1.1", 1, 1
+	resp.Close = !keepAlive
+
+	// A client that stops reading the response is as idle as a target that
+	// stops sending it
+	writer := &idleWriter{conn: c.conn, timeout: s.timeouts.ForRoute(route).Idle}
+	err = resp.Write(writer)
+	c.conn.SetWriteDeadline(time.Time{})
+	if err != nil {
+		fmt.Printf("Failed to forward HTTP response: %v\n", err)
+		return false
+	}
+
+	// Discard what is left of the request body before reading the next request
+	if keepAlive {
+		req.Body.Close()
+	}
+	return keepAlive
+}
+
+// switchProtocols relays a 101 response and then tunnels the upgraded
+// connection, e.g. a WebSocket
+func (s *Server) switchProtocols(c *client, resp *http.Response) {
+	upstream, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		s.sendErrorResponse(c.conn, "502 Bad Gateway")
+		return
+	}
+
+	addVia(resp.Header, resp.ProtoMajor, resp.ProtoMinor)
+	if _, err := fmt.Fprintf(c.conn, "HTTP/1.1 %s\r\n", resp.Status); err != nil {
+		return
+	}
+	if err := resp.Header.Write(c.conn); err != nil {
+		return
+	}
+	if _, err := io.WriteString(c.conn, "\r\n"); err != nil {
+		return
+	}
+
+	if err := tunnel.Relay(c.conn, c.reader, upstream); err != nil {
+		fmt.Printf("Upgraded connection closed: %v\n", err)
+	}
+}
+
+// removeHopByHopHeaders removes the standard hop-by-hop headers and those
+// named in Connection
+func removeHopByHopHeaders(header http.Header) {
+	for _, field := range header.Values("Connection") {
+		for _, name := range strings.Split(field, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				header.Del(name)
+			}
+		}
+	}
+	for _, name := range hopByHopHeaders {
+		header.Del(name)
+	}
+}
+
+// upgradeType returns the protocol a request asks to upgrade to, or ""
+func upgradeType(header http.Header) string {
+	for _, field := range header.Values("Connection") {
+		for _, name := range strings.Split(field, ",") {
+			if strings.EqualFold(strings.TrimSpace(name), "Upgrade") {
+				return header.Get("Upgrade")
+			}
+		}
+	}
+	return ""
+}
+
+// addVia records this proxy in the Via header
+func addVia(header http.Header, protoMajor, protoMinor int) {
+	header.Add("Via", fmt.Sprintf("%d.%d proxyrouter", protoMajor, protoMinor))
+}
+
+// idleWriter writes to a connection, failing a write that makes no progress
+// for the timeout
+type idleWriter struct {
+	conn    net.Conn
+	timeout time.Duration // zero waits forever
+}
+
+// Write implements io.Writer
+func (w *idleWriter) Write(p []byte) (int, error) {
+	if w.timeout > 0 {
+		w.conn.SetWriteDeadline(time.Now().Add(w.timeout))
+	}
+	return w.conn.Write(p)
+}
+
+// continueReader sends the client 100 Continue when the target first reads
+// the request body
+type continueReader struct {
+	io.ReadCloser
+	conn net.Conn
+
+	mu   sync.Mutex
+	sent bool // 100 Continue was sent
+	done bool // the final response is on its way
+}
+
+// Read implements io.Reader
+func (r *continueReader) Read(p []byte) (int, error) {
+	r.mu.Lock()
+	if !r.sent && !r.done {
+		r.sent = true
+		if _, err := io.WriteString(r.conn, "HTTP/1.1 100 Continue\r\n\r\n"); err != nil {
+			r.mu.Unlock()
+			return 0, err
+		}
+	}
+	r.mu.Unlock()
+
+	return r.ReadCloser.Read(p)
+}
+
+// finish stops 100 Continue from being sent and reports whether it was
+func (r *continueReader) finish() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.done = true
+	return r.sent
+}
@@ -0,0 +1,184 @@
+package proxyhttp
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"proxyrouter/internal/router"
+)
+
+// startEchoTarget serves HTTP and describes each request it received in the
+// response body
+func startEchoTarget(t *testing.T) string {
+	t.Helper()
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(w, "uri=%s\n", r.RequestURI)
+		fmt.Fprintf(w, "remote=%s\n", r.RemoteAddr)
+		fmt.Fprintf(w, "via=%s\n", r.Header.Get("Via"))
+		fmt.Fprintf(w, "user-agent=%s\n", r.Header.Get("User-Agent"))
+		fmt.Fprintf(w, "hop=%s%s\n", r.Header.Get("Proxy-Connection"), r.Header.Get("X-Hop"))
+		fmt.Fprintf(w, "body=%s\n", body)
+	}))
+	t.Cleanup(target.Close)
+	return target.URL
+}
+
+// readResponse reads a response and its body from the proxy
+func readResponse(t *testing.T, reader *bufio.Reader, method string) (*http.Response, map[string]string) {
+	t.Helper()
+
+	resp, err := http.ReadResponse(reader, &http.Request{Method: method})
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	fields := make(map[string]string)
+	for _, line := range strings.Split(string(body), "\n") {
+		if name, value, ok := strings.Cut(line, "="); ok {
+			fields[name] = value
+		}
+	}
+	return resp, fields
+}
+
+func TestHTTPProxyKeepAlive(t *testing.T) {
+	proxyAddr, _, routerEngine, _ := startTestServer(t, false)
+	require.NoError(t, routerEngine.CreateRoute(&router.Route{Group: router.RouteGroupLocal, Precedence: 100, Enabled: true}))
+	targetURL := startEchoTarget(t)
+
+	conn, err := net.Dial("tcp", proxyAddr)
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+
+	_, err = fmt.Fprintf(conn, "GET %s/a?x=1 HTTP/1.1\r\nHost: example.test\r\nProxy-Connection: keep-alive\r\nConnection: X-Hop\r\nX-Hop: 1\r\n\r\n", targetURL)
+	require.NoError(t, err)
+	resp, first := readResponse(t, reader, http.MethodGet)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.False(t, resp.Close)
+	assert.Equal(t, "/a?x=1", first["uri"])
+	assert.Equal(t, "1.1 proxyrouter", first["via"])
+	assert.Equal(t, "", first["user-agent"])
+	assert.Equal(t, "", first["hop"], "hop-by-hop headers must not be forwarded")
+	assert.Contains(t, resp.Header.Get("Via"), "proxyrouter")
+
+	// A chunked body on the same connection reuses the upstream connection
+	_, err = fmt.Fprintf(conn, "POST %s/b HTTP/1.1\r\nHost: example.test\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\n\r\n", targetURL)
+	require.NoError(t, err)
+	resp, second := readResponse(t, reader, http.MethodPost)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "/b", second["uri"])
+	assert.Equal(t, "hello", second["body"])
+	assert.Equal(t, first["remote"], second["remote"])
+}
+
+func TestHTTPProxyKeepsUpstreamConnectionsPerUser(t *testing.T) {
+	proxyAddr, _, routerEngine, users := startTestServer(t, false)
+	require.NoError(t, routerEngine.CreateRoute(&router.Route{Group: router.RouteGroupLocal, Precedence: 100, Enabled: true}))
+	for _, name := range []string{"alice", "bob"} {
+		_, err := users.Create(context.Background(), name, "secret")
+		require.NoError(t, err)
+	}
+	targetURL := startEchoTarget(t)
+
+	conn, err := net.Dial("tcp", proxyAddr)
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+
+	get := func(user string) map[string]string {
+		credentials := base64.StdEncoding.EncodeToString([]byte(user + ":secret"))
+		_, err := fmt.Fprintf(conn, "GET %s/ HTTP/1.1\r\nHost: example.test\r\nProxy-Authorization: Basic %s\r\n\r\n", targetURL, credentials)
+		require.NoError(t, err)
+		resp, fields := readResponse(t, reader, http.MethodGet)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		return fields
+	}
+
+	// Bob's request is not sent over the connection shaped for alice
+	alice := get("alice")
+	assert.Equal(t, alice["remote"], get("alice")["remote"])
+	assert.NotEqual(t, alice["remote"], get("bob")["remote"])
+}
+
+func TestHTTPProxyExpectContinue(t *testing.T) {
+	proxyAddr, _, routerEngine, _ := startTestServer(t, false)
+	require.NoError(t, routerEngine.CreateRoute(&router.Route{Group: router.RouteGroupLocal, Precedence: 100, Enabled: true}))
+	targetURL := startEchoTarget(t)
+
+	conn, err := net.Dial("tcp", proxyAddr)
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+
+	_, err = fmt.Fprintf(conn, "PUT %s/upload HTTP/1.1\r\nHost: example.test\r\nContent-Length: 4\r\nExpect: 100-continue\r\n\r\n", targetURL)
+	require.NoError(t, err)
+
+	// The body is only sent once the proxy asks for it
+	resp, err := http.ReadResponse(reader, nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusContinue, resp.StatusCode)
+	_, err = conn.Write([]byte("data"))
+	require.NoError(t, err)
+
+	resp, fields := readResponse(t, reader, http.MethodPut)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "data", fields["body"])
+}
+
+func TestHTTPProxyRoutesEachRequest(t *testing.T) {
+	proxyAddr, _, routerEngine, _ := startTestServer(t, false)
+	torPath := "/tor"
+	require.NoError(t, routerEngine.CreateRoute(&router.Route{Group: router.RouteGroupTor, PathPrefix: &torPath, Precedence: 10, Enabled: true}))
+	require.NoError(t, routerEngine.CreateRoute(&router.Route{Group: router.RouteGroupLocal, Precedence: 100, Enabled: true}))
+	targetURL := startEchoTarget(t)
+
+	conn, err := net.Dial("tcp", proxyAddr)
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+
+	_, err = fmt.Fprintf(conn, "GET %s/direct HTTP/1.1\r\nHost: example.test\r\n\r\n", targetURL)
+	require.NoError(t, err)
+	resp, _ := readResponse(t, reader, http.MethodGet)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// No Tor daemon is listening, so the second request cannot be routed
+	_, err = fmt.Fprintf(conn, "GET %s/tor HTTP/1.1\r\nHost: example.test\r\n\r\n", targetURL)
+	require.NoError(t, err)
+	resp, _ = readResponse(t, reader, http.MethodGet)
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+	assert.True(t, resp.Close)
+}
+
+func TestRemoveHopByHopHeaders(t *testing.T) {
+	header := http.Header{
+		"Connection":       {"close, X-Private"},
+		"X-Private":        {"1"},
+		"Keep-Alive":       {"timeout=5"},
+		"Proxy-Connection": {"keep-alive"},
+		"Content-Type":     {"text/plain"},
+	}
+
+	removeHopByHopHeaders(header)
+	assert.Equal(t, http.Header{"Content-Type": {"text/plain"}}, header)
+}
@@ -1,17 +1,23 @@
 package proxyhttp
 
 import (
-	"bufio"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net"
-	"net/url"
-	"strings"
+	"net/http"
+	"strconv"
 	"time"
 
 	"proxyrouter/internal/acl"
+	"proxyrouter/internal/auth"
+	"proxyrouter/internal/conntrack"
+	"proxyrouter/internal/metrics"
+	"proxyrouter/internal/proxyproto"
 	"proxyrouter/internal/router"
+	"proxyrouter/internal/shaping"
+	"proxyrouter/internal/tunnel"
 )
 
 // Server represents the HTTP proxy server
@@ -20,55 +26,90 @@ type Server struct {
 	acl           *acl.ACL
 	router        *router.Router
 	dialerFactory *router.DialerFactory
+	users         *auth.ProxyUsers
+	requireAuth   bool
+	metrics       *metrics.Metrics
 	timeout       time.Duration
+	tracker       *conntrack.Tracker
+	shaper        *shaping.Shaper
+	timeouts      tunnel.Timeouts
+	proxyProtocol *proxyproto.Policy
 }
 
-// New creates a new HTTP proxy server
-func New(listenAddr string, acl *acl.ACL, router *router.Router, dialerFactory *router.DialerFactory, timeout time.Duration) *Server {
+// New creates a new HTTP proxy server. Clients log in with Basic
+// Proxy-Authorization against users; with requireAuth, anonymous clients are
+// refused. metrics may be nil. Accepted connections are recorded in tracker,
+// and their upstream connections are limited by shaper, which may be nil.
+// Upstream connections close after the idle and lifetime timeouts of their
+// route, or timeouts if it sets none. timeout limits how long the proxy waits
+// for a request. Peers trusted by proxyProtocol, which may be nil, pass on the
+// client address in a PROXY protocol header.
+func New(listenAddr string, acl *acl.ACL, router *router.Router, dialerFactory *router.DialerFactory, users *auth.ProxyUsers, requireAuth bool, metrics *metrics.Metrics, timeout time.Duration, tracker *conntrack.Tracker, shaper *shaping.Shaper, timeouts tunnel.Timeouts, proxyProtocol *proxyproto.Policy) *Server {
 	return &Server{
 		listenAddr:    listenAddr,
 		acl:           acl,
 		router:        router,
 		dialerFactory: dialerFactory,
+		users:         users,
+		requireAuth:   requireAuth,
+		metrics:       metrics,
 		timeout:       timeout,
+		tracker:       tracker,
+		shaper:        shaper,
+		timeouts:      timeouts,
+		proxyProtocol: proxyProtocol,
 	}
 }
 
-// Start starts the HTTP proxy server
+// Start starts the HTTP proxy server. It stops accepting when ctx is done;
+// connections already accepted keep running until they finish or the
+// tracker closes them.
 func (s *Server) Start(ctx context.Context) error {
-	listener, err := net.Listen("tcp", s.listenAddr)
+	listener, err := s.proxyProtocol.Listen(s.listenAddr)
 	if err != nil {
 		return fmt.Errorf("failed to listen on %s: %w", s.listenAddr, err)
 	}
-	defer listener.Close()
 
 	fmt.Printf("HTTP proxy server listening on %s\n", s.listenAddr)
 
+	stop := context.AfterFunc(ctx, func() {
+		fmt.Println("HTTP proxy server shutting down...")
+		listener.Close()
+	})
+	defer stop()
+
 	for {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		default:
-			conn, err := listener.Accept()
-			if err != nil {
-				fmt.Printf("Failed to accept connection: %v\n", err)
-				continue
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
 			}
-
-			go s.handleConnection(ctx, conn)
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			fmt.Printf("Failed to accept connection: %v\n", err)
+			continue
 		}
+
+		go func() {
+			c := s.tracker.Track("http", conn)
+			defer c.Done()
+			s.ServeConn(conntrack.NewContext(ctx, c), c)
+		}()
 	}
 }
 
-// handleConnection handles a single client connection
-func (s *Server) handleConnection(ctx context.Context, clientConn net.Conn) {
+// ServeConn serves a client accepted by this or another listener and closes
+// the connection. Plain HTTP clients may send any number of requests on one
+// connection, and each request is routed on its own. Once ctx is cancelled
+// the connection closes after its current request.
+func (s *Server) ServeConn(ctx context.Context, clientConn net.Conn) {
 	defer clientConn.Close()
-
-	// Set connection deadline
-	clientConn.SetDeadline(time.Now().Add(s.timeout))
+	shutdown := ctx
+	ctx = context.WithoutCancel(ctx)
 
 	// Extract client IP
-	clientIP := acl.ExtractClientIP(clientConn.RemoteAddr().String(), nil)
+	clientIP := acl.ExtractClientIP(clientConn.RemoteAddr().String(), nil, nil)
 
 	// Check ACL
 	allowed, err := s.acl.IsAllowed(ctx, clientIP)
@@ -83,34 +124,132 @@ func (s *Server) handleConnection(ctx context.Context, clientConn net.Conn) {
 		return
 	}
 
-	// Read the first line to determine the request type
-	reader := bufio.NewReader(clientConn)
-	firstLine, err := reader.ReadString('\n')
-	if err != nil {
-		fmt.Printf("Failed to read request: %v\n", err)
-		return
+	c := newClient(clientConn, clientIP, conntrack.FromContext(ctx))
+	defer c.close()
+	ctx = router.WithProxyObserver(ctx, c.entry.SetProxy)
+
+	// Stop a connection that is waiting for its next request on shutdown
+	stop := context.AfterFunc(shutdown, c.interruptIdle)
+	defer stop()
+
+	for {
+		// Wait for the next request for at most the read timeout. Once it is
+		// read, the route's timeouts apply to the upstream connection.
+		clientConn.SetReadDeadline(time.Now().Add(s.timeout))
+
+		if !c.startIdle(shutdown) {
+			return
+		}
+		req, err := http.ReadRequest(c.reader)
+		c.stopIdle()
+		clientConn.SetReadDeadline(time.Time{})
+		if err != nil {
+			if err != io.EOF && shutdown.Err() == nil {
+				fmt.Printf("Failed to read request from %s: %v\n", clientIP, err)
+				s.sendErrorResponse(clientConn, "400 Bad Request")
+			}
+			return
+		}
+
+		// Authenticate the client
+		user, sessionID, ok := s.login(ctx, c, req.Header)
+		if !ok {
+			fmt.Printf("Proxy authentication required for %s\n", clientIP)
+			s.sendProxyAuthRequired(clientConn)
+			return
+		}
+		c.entry.SetUser(user)
+
+		// A session username pins the upstream
+		reqCtx := ctx
+		if sessionID != "" {
+			reqCtx = router.WithSessionID(ctx, sessionID)
+		}
+
+		// Handle CONNECT method for HTTPS tunneling
+		if req.Method == http.MethodConnect {
+			s.handleCONNECT(reqCtx, c, user, req)
+			return
+		}
+
+		// Handle regular HTTP requests
+		if !s.handleHTTPRequest(reqCtx, c, user, sessionID, req) {
+			return
+		}
 	}
+}
 
-	// Parse the request line
-	method, target, version, err := s.parseRequestLine(firstLine)
-	if err != nil {
-		fmt.Printf("Failed to parse request line: %v\n", err)
-		return
+// authenticate checks a client's login and returns the account name, or ""
+// for an anonymous client. It returns false if the client must log in first.
+// Unless logins are required, a username that is not an account is served
+// anonymously, so it can still carry a session ID; a wrong password for an
+// account is refused either way.
+func (s *Server) authenticate(ctx context.Context, user, password string, hasCredentials bool) (string, bool) {
+	if hasCredentials && s.users != nil {
+		valid, err := s.users.Authenticate(ctx, user, password)
+		switch {
+		case err != nil:
+			fmt.Printf("Authentication failed for %s: %v\n", user, err)
+		case valid:
+			return user, true
+		case !s.requireAuth:
+			exists, err := s.users.Exists(ctx, user)
+			if err != nil {
+				fmt.Printf("Authentication failed for %s: %v\n", user, err)
+				return "", false
+			}
+			if exists {
+				return "", false
+			}
+		}
 	}
+	return "", !s.requireAuth
+}
 
-	// Handle CONNECT method for HTTPS tunneling
-	if method == "CONNECT" {
-		s.handleCONNECT(ctx, clientConn, target, version, reader)
-		return
+// proxyCredentials returns the username and password of a Basic
+// Proxy-Authorization header
+func proxyCredentials(header http.Header) (username, password string, ok bool) {
+	value := header.Get("Proxy-Authorization")
+	if value == "" {
+		return "", "", false
+	}
+
+	req := http.Request{Header: http.Header{"Authorization": {value}}}
+	return req.BasicAuth()
+}
+
+// recordRoute counts a routed request of an authenticated user
+func (s *Server) recordRoute(user string, route *router.Route) {
+	if s.metrics != nil && user != "" {
+		s.metrics.RecordUserRequest(user, string(route.Group))
 	}
+}
 
-	// Handle regular HTTP requests
-	s.handleHTTPRequest(ctx, clientConn, method, target, version, reader)
+// matchRoute finds the route for a request, answering the client with 502
+// when there is none
+func (s *Server) matchRoute(ctx context.Context, c *client, user string, req router.Request) (*router.Route, bool) {
+	req.ClientIP = c.clientIP
+	req.Username = user
+	route, err := s.router.MatchRoute(ctx, req)
+	if err != nil {
+		fmt.Printf("Failed to find route for %s: %v\n", req.Host, err)
+		s.sendErrorResponse(c.conn, "502 Bad Gateway")
+		return nil, false
+	}
+	if route == nil {
+		fmt.Printf("No route for %s from %s\n", req.Host, c.clientIP)
+		s.sendErrorResponse(c.conn, "502 Bad Gateway")
+		return nil, false
+	}
+	s.recordRoute(user, route)
+	c.entry.SetRoute(route.ID, string(route.Group), route.ProxyID)
+	return route, true
 }
 
 // handleCONNECT handles HTTPS CONNECT tunneling
-func (s *Server) handleCONNECT(ctx context.Context, clientConn net.Conn, target, version string, reader *bufio.Reader) {
+func (s *Server) handleCONNECT(ctx context.Context, c *client, user string, req *http.Request) {
 	// Extract host and port from target
+	target := req.RequestURI
 	host, port, err := net.SplitHostPort(target)
 	if err != nil {
 		// Default to port 443 if not specified
@@ -119,19 +258,24 @@ func (s *Server) handleCONNECT(ctx context.Context, clientConn net.Conn, target,
 		target = net.JoinHostPort(host, port)
 	}
 
+	c.entry.SetTarget("connect", target)
+
 	// Find route for this target
-	route, err := s.router.FindRoute(ctx, acl.ExtractClientIP(clientConn.RemoteAddr().String(), nil), host)
-	if err != nil {
-		fmt.Printf("Failed to find route for %s: %v\n", host, err)
-		s.sendErrorResponse(clientConn, "502 Bad Gateway")
+	portNum, _ := strconv.Atoi(port)
+	route, ok := s.matchRoute(ctx, c, user, router.Request{
+		Host:   host,
+		Port:   portNum,
+		Method: http.MethodConnect,
+	})
+	if !ok {
 		return
 	}
 
 	// Create dialer for the route
-	dialer, err := s.dialerFactory.CreateDialer(ctx, route)
+	dialer, err := s.dialerFactory.CreateDialer(ctx, route, c.clientIP, host)
 	if err != nil {
 		fmt.Printf("Failed to create dialer for route %s: %v\n", route.Group, err)
-		s.sendErrorResponse(clientConn, "502 Bad Gateway")
+		s.sendErrorResponse(c.conn, "502 Bad Gateway")
 		return
 	}
 
@@ -139,160 +283,52 @@ func (s *Server) handleCONNECT(ctx context.Context, clientConn net.Conn, target,
 	targetConn, err := dialer.DialContext(ctx, "tcp", target)
 	if err != nil {
 		fmt.Printf("Failed to connect to %s: %v\n", target, err)
-		s.sendErrorResponse(clientConn, "502 Bad Gateway")
+		s.sendDialErrorResponse(c.conn, err)
 		return
 	}
+	targetConn = s.upstream(ctx, targetConn, c.clientIP, user, route)
 	defer targetConn.Close()
 
 	// Send success response to client
-	response := fmt.Sprintf("%s 200 Connection established\r\n\r\n", version)
-	if _, err := clientConn.Write([]byte(response)); err != nil {
+	response := fmt.Sprintf("%s 200 Connection established\r\n\r\n", req.Proto)
+	if _, err := c.conn.Write([]byte(response)); err != nil {
 		fmt.Printf("Failed to send CONNECT response: %v\n", err)
 		return
 	}
 
 	// Tunnel data between client and target
-	s.tunnelData(clientConn, targetConn)
-}
-
-// handleHTTPRequest handles regular HTTP requests
-func (s *Server) handleHTTPRequest(ctx context.Context, clientConn net.Conn, method, target, version string, reader *bufio.Reader) {
-	// Parse the target URL - for HTTP proxy, target is a full URL
-	parsedURL, err := url.Parse(target)
-	if err != nil {
-		fmt.Printf("Failed to parse target URL %s: %v\n", target, err)
-		s.sendErrorResponse(clientConn, "400 Bad Request")
-		return
+	if err := tunnel.Relay(c.conn, c.reader, targetConn); err != nil {
+		fmt.Printf("Tunnel to %s closed: %v\n", target, err)
 	}
-
-	// Extract host and port
-	host := parsedURL.Hostname()
-	port := parsedURL.Port()
-	if port == "" {
-		if parsedURL.Scheme == "https" {
-			port = "443"
-		} else {
-			port = "80"
-		}
-	}
-	targetHostPort := net.JoinHostPort(host, port)
-
-	// Find route for this target
-	route, err := s.router.FindRoute(ctx, acl.ExtractClientIP(clientConn.RemoteAddr().String(), nil), host)
-	if err != nil {
-		fmt.Printf("Failed to find route for %s: %v\n", host, err)
-		s.sendErrorResponse(clientConn, "502 Bad Gateway")
-		return
-	}
-
-	// Create dialer for the route
-	dialer, err := s.dialerFactory.CreateDialer(ctx, route)
-	if err != nil {
-		fmt.Printf("Failed to create dialer for route %s: %v\n", route.Group, err)
-		s.sendErrorResponse(clientConn, "502 Bad Gateway")
-		return
-	}
-
-	// Connect to target
-	targetConn, err := dialer.DialContext(ctx, "tcp", targetHostPort)
-	if err != nil {
-		fmt.Printf("Failed to connect to %s: %v\n", targetHostPort, err)
-		s.sendErrorResponse(clientConn, "502 Bad Gateway")
-		return
-	}
-	defer targetConn.Close()
-
-	// Forward the request - use the path from the parsed URL
-	if err := s.forwardHTTPRequest(targetConn, method, parsedURL.Path, version, reader); err != nil {
-		fmt.Printf("Failed to forward HTTP request: %v\n", err)
-		return
-	}
-
-	// Forward the response
-	if err := s.forwardHTTPResponse(clientConn, targetConn); err != nil {
-		fmt.Printf("Failed to forward HTTP response: %v\n", err)
-		return
-	}
-}
-
-// parseRequestLine parses the HTTP request line
-func (s *Server) parseRequestLine(line string) (method, target, version string, err error) {
-	parts := strings.Fields(strings.TrimSpace(line))
-	if len(parts) != 3 {
-		return "", "", "", fmt.Errorf("invalid request line: %s", line)
-	}
-	return parts[0], parts[1], parts[2], nil
 }
 
-// forwardHTTPRequest forwards an HTTP request to the target
-func (s *Server) forwardHTTPRequest(targetConn net.Conn, method, target, version string, reader *bufio.Reader) error {
-	// Write the request line - use only the path for the target
-	// The target should be just the path, not the full URL
-	requestLine := fmt.Sprintf("%s %s %s\r\n", method, target, version)
-	if _, err := targetConn.Write([]byte(requestLine)); err != nil {
-		return err
-	}
-
-	// Forward headers
-	for {
-		line, err := reader.ReadString('\n')
-		if err != nil {
-			return err
-		}
-
-		if _, err := targetConn.Write([]byte(line)); err != nil {
-			return err
-		}
-
-		// Empty line indicates end of headers
-		if line == "\r\n" || line == "\n" {
-			break
-		}
-	}
-
-	// Forward body if present
-	if _, err := io.Copy(targetConn, reader); err != nil {
-		return err
-	}
-
-	return nil
+// upstream applies the bandwidth limits and timeouts of a route to a
+// connection dialled for it
+func (s *Server) upstream(ctx context.Context, conn net.Conn, clientIP, user string, route *router.Route) net.Conn {
+	conn = s.shaper.Shape(ctx, conn, clientIP, user, route)
+	return tunnel.Watch(conn, s.timeouts.ForRoute(route))
 }
 
-// forwardHTTPResponse forwards an HTTP response to the client
-func (s *Server) forwardHTTPResponse(clientConn net.Conn, targetConn net.Conn) error {
-	_, err := io.Copy(clientConn, targetConn)
-	return err
+// sendForbiddenResponse sends a 403 Forbidden response
+func (s *Server) sendForbiddenResponse(conn net.Conn) {
+	response := "HTTP/1.1 403 Forbidden\r\nContent-Length: 0\r\nConnection: close\r\n\r\n"
+	conn.Write([]byte(response))
 }
 
-// tunnelData tunnels data between two connections
-func (s *Server) tunnelData(conn1, conn2 net.Conn) {
-	// Create channels for coordination
-	done := make(chan bool, 2)
-
-	// Copy from conn1 to conn2
-	go func() {
-		io.Copy(conn2, conn1)
-		done <- true
-	}()
-
-	// Copy from conn2 to conn1
-	go func() {
-		io.Copy(conn1, conn2)
-		done <- true
-	}()
-
-	// Wait for either direction to finish
-	<-done
+// sendProxyAuthRequired asks the client to log in with Basic credentials
+func (s *Server) sendProxyAuthRequired(conn net.Conn) {
+	response := "HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: Basic realm=\"proxyrouter\"\r\nContent-Length: 0\r\nConnection: close\r\n\r\n"
+	conn.Write([]byte(response))
 }
 
-// sendForbiddenResponse sends a 403 Forbidden response
-func (s *Server) sendForbiddenResponse(conn net.Conn) {
-	response := "HTTP/1.1 403 Forbidden\r\nContent-Length: 0\r\n\r\n"
-	conn.Write([]byte(response))
+// sendDialErrorResponse sends a 502 or 504 response depending on why the dial failed
+func (s *Server) sendDialErrorResponse(conn net.Conn, err error) {
+	status := router.DialErrorStatus(err)
+	s.sendErrorResponse(conn, fmt.Sprintf("%d %s", status, http.StatusText(status)))
 }
 
-// sendErrorResponse sends an error response
+// sendErrorResponse sends an error response; the connection closes after it
 func (s *Server) sendErrorResponse(conn net.Conn, status string) {
-	response := fmt.Sprintf("HTTP/1.1 %s\r\nContent-Length: 0\r\n\r\n", status)
+	response := fmt.Sprintf("HTTP/1.1 %s\r\nContent-Length: 0\r\nConnection: close\r\n\r\n", status)
 	conn.Write([]byte(response))
 }
@@ -0,0 +1,407 @@
+package proxyhttp
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"proxyrouter/internal/acl"
+	"proxyrouter/internal/auth"
+	"proxyrouter/internal/conntrack"
+	"proxyrouter/internal/db"
+	"proxyrouter/internal/proxyproto"
+	"proxyrouter/internal/router"
+	"proxyrouter/internal/tunnel"
+)
+
+// startTestServer serves the HTTP proxy to loopback clients on a local port
+// backed by a migrated database
+func startTestServer(t *testing.T, requireAuth bool) (string, *db.Database, *router.Router, *auth.ProxyUsers) {
+	t.Helper()
+
+	s, database, routerEngine, users := newTestServer(t, requireAuth)
+	return serveTest(t, context.Background(), s), database, routerEngine, users
+}
+
+// newTestServer creates an HTTP proxy that allows loopback clients
+func newTestServer(t *testing.T, requireAuth bool) (*Server, *db.Database, *router.Router, *auth.ProxyUsers) {
+	t.Helper()
+
+	database, err := db.New(filepath.Join(t.TempDir(), "test.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { database.Close() })
+	require.NoError(t, database.RunMigrations(filepath.Join("..", "..", "migrations")))
+	_, err = database.GetDB().Exec("INSERT INTO acl_subnets (cidr) VALUES ('127.0.0.0/8')")
+	require.NoError(t, err)
+
+	routerEngine := router.New(database.GetDB())
+	dialerFactory := router.NewDialerFactory(database.GetDB(), "127.0.0.1:9050", time.Second, nil, router.FailoverPolicy{})
+	users := auth.NewProxyUsers(database.GetDB(), "bcrypt")
+	s := New("127.0.0.1:0", acl.New(database.GetDB()), routerEngine, dialerFactory, users, requireAuth, nil, 5*time.Second, conntrack.New(), nil, tunnel.Timeouts{}, nil)
+
+	return s, database, routerEngine, users
+}
+
+// serveTest serves s on a local port until the test ends, passing ctx to
+// every connection and tracking it like Start
+func serveTest(t *testing.T, ctx context.Context, s *Server) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	return serveListener(t, ctx, s, listener)
+}
+
+// serveListener serves s on listener until the test ends
+func serveListener(t *testing.T, ctx context.Context, s *Server, listener net.Listener) string {
+	t.Helper()
+
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				c := s.tracker.Track("http", conn)
+				defer c.Done()
+				s.ServeConn(conntrack.NewContext(ctx, c), c)
+			}()
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+// startTargetServer serves HTTP and reports the Proxy-Authorization header
+// it received in the response body
+func startTargetServer(t *testing.T) string {
+	t.Helper()
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "proxy-authorization=%q", r.Header.Get("Proxy-Authorization"))
+	}))
+	t.Cleanup(target.Close)
+	return target.URL
+}
+
+// proxyGet sends a GET for url through the proxy with an optional Basic login
+func proxyGet(t *testing.T, proxyAddr, url, username, password string) (*http.Response, string) {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", proxyAddr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	request := fmt.Sprintf("GET %s HTTP/1.1\r\nHost: example.test\r\nConnection: close\r\n", url)
+	if username != "" {
+		credentials := base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+		request += "Proxy-Authorization: Basic " + credentials + "\r\n"
+	}
+	_, err = conn.Write([]byte(request + "\r\n"))
+	require.NoError(t, err)
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	var body []byte
+	if resp.ContentLength != 0 {
+		body = make([]byte, 256)
+		n, _ := resp.Body.Read(body)
+		body = body[:n]
+	}
+	return resp, string(body)
+}
+
+func TestProxyAuthorizationRequired(t *testing.T) {
+	proxyAddr, _, routerEngine, users := startTestServer(t, true)
+	require.NoError(t, routerEngine.CreateRoute(&router.Route{Group: router.RouteGroupLocal, Precedence: 100, Enabled: true}))
+	_, err := users.Create(context.Background(), "alice", "secret")
+	require.NoError(t, err)
+	targetURL := startTargetServer(t)
+
+	resp, _ := proxyGet(t, proxyAddr, targetURL, "", "")
+	assert.Equal(t, http.StatusProxyAuthRequired, resp.StatusCode)
+	assert.Equal(t, `Basic realm="proxyrouter"`, resp.Header.Get("Proxy-Authenticate"))
+
+	resp, _ = proxyGet(t, proxyAddr, targetURL, "alice", "wrong")
+	assert.Equal(t, http.StatusProxyAuthRequired, resp.StatusCode)
+
+	resp, body := proxyGet(t, proxyAddr, targetURL, "alice-session-abc", "secret")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, `proxy-authorization=""`, body)
+}
+
+func TestProxyAuthorizationCheckedAgainAfterUserChange(t *testing.T) {
+	proxyAddr, _, routerEngine, users := startTestServer(t, true)
+	require.NoError(t, routerEngine.CreateRoute(&router.Route{Group: router.RouteGroupLocal, Precedence: 100, Enabled: true}))
+	alice, err := users.Create(context.Background(), "alice", "secret")
+	require.NoError(t, err)
+	targetURL := startTargetServer(t)
+
+	conn, err := net.Dial("tcp", proxyAddr)
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+	request := fmt.Sprintf("GET %s HTTP/1.1\r\nHost: example.test\r\nProxy-Authorization: Basic %s\r\n\r\n",
+		targetURL, base64.StdEncoding.EncodeToString([]byte("alice:secret")))
+
+	_, err = conn.Write([]byte(request))
+	require.NoError(t, err)
+	resp, err := http.ReadResponse(reader, nil)
+	require.NoError(t, err)
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// Disabling alice locks out her open keep-alive connection too
+	disabled := false
+	_, err = users.Update(context.Background(), alice.ID, nil, &disabled, nil)
+	require.NoError(t, err)
+
+	_, err = conn.Write([]byte(request))
+	require.NoError(t, err)
+	resp, err = http.ReadResponse(reader, nil)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusProxyAuthRequired, resp.StatusCode)
+}
+
+func TestProxyAuthorizationRoutesByUser(t *testing.T) {
+	proxyAddr, _, routerEngine, users := startTestServer(t, false)
+	alice := "alice"
+	require.NoError(t, routerEngine.CreateRoute(&router.Route{Group: router.RouteGroupLocal, ClientUser: &alice, Precedence: 100, Enabled: true}))
+	_, err := users.Create(context.Background(), "alice", "secret")
+	require.NoError(t, err)
+	targetURL := startTargetServer(t)
+
+	// Anonymous clients, and logins that are not accounts, skip alice's route
+	resp, _ := proxyGet(t, proxyAddr, targetURL, "", "")
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+	resp, _ = proxyGet(t, proxyAddr, targetURL, "scraper-session-abc", "x")
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+
+	// A wrong password for alice is a failed login, not an anonymous client
+	resp, _ = proxyGet(t, proxyAddr, targetURL, "alice", "wrong")
+	assert.Equal(t, http.StatusProxyAuthRequired, resp.StatusCode)
+	assert.Equal(t, `Basic realm="proxyrouter"`, resp.Header.Get("Proxy-Authenticate"))
+	resp, _ = proxyGet(t, proxyAddr, targetURL, "alice-session-abc", "wrong")
+	assert.Equal(t, http.StatusProxyAuthRequired, resp.StatusCode)
+
+	resp, body := proxyGet(t, proxyAddr, targetURL, "alice", "secret")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, `proxy-authorization=""`, body)
+}
+
+func TestServeConnBehindLoadBalancer(t *testing.T) {
+	s, _, routerEngine, _ := newTestServer(t, false)
+	require.NoError(t, routerEngine.CreateRoute(&router.Route{Group: router.RouteGroupLocal, Precedence: 100, Enabled: true}))
+	targetURL := startTargetServer(t)
+
+	trusted, err := acl.NewTrustedProxies([]string{"127.0.0.0/8"})
+	require.NoError(t, err)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	proxyAddr := serveListener(t, context.Background(), s, proxyproto.NewListener(listener, trusted, time.Second))
+
+	get := func(header string) *http.Response {
+		conn, err := net.Dial("tcp", proxyAddr)
+		require.NoError(t, err)
+		defer conn.Close()
+		_, err = fmt.Fprintf(conn, "%sGET %s HTTP/1.1\r\nHost: example.test\r\nConnection: close\r\n\r\n", header, targetURL)
+		require.NoError(t, err)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp
+	}
+
+	// The ACL applies to the client named by the load balancer
+	assert.Equal(t, http.StatusForbidden, get("PROXY TCP4 198.51.100.7 127.0.0.1 51234 8080\r\n").StatusCode)
+	assert.Equal(t, http.StatusOK, get("PROXY TCP4 127.0.0.9 127.0.0.1 51234 8080\r\n").StatusCode)
+}
+
+func TestServeConnDrainsOnShutdown(t *testing.T) {
+	s, _, routerEngine, _ := newTestServer(t, false)
+	require.NoError(t, routerEngine.CreateRoute(&router.Route{Group: router.RouteGroupLocal, Precedence: 100, Enabled: true}))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	proxyAddr := serveTest(t, ctx, s)
+	targetURL := startTargetServer(t)
+
+	// An idle keep-alive connection
+	idle, err := net.Dial("tcp", proxyAddr)
+	require.NoError(t, err)
+	defer idle.Close()
+	idle.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = fmt.Fprintf(idle, "GET %s HTTP/1.1\r\nHost: example.test\r\n\r\n", targetURL)
+	require.NoError(t, err)
+	idleReader := bufio.NewReader(idle)
+	resp, err := http.ReadResponse(idleReader, nil)
+	require.NoError(t, err)
+	_, err = io.Copy(io.Discard, resp.Body)
+	require.NoError(t, err)
+
+	// An open tunnel
+	tunnel, err := net.Dial("tcp", proxyAddr)
+	require.NoError(t, err)
+	defer tunnel.Close()
+	tunnel.SetDeadline(time.Now().Add(5 * time.Second))
+	targetHost := strings.TrimPrefix(targetURL, "http://")
+	_, err = fmt.Fprintf(tunnel, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", targetHost, targetHost)
+	require.NoError(t, err)
+	tunnelReader := bufio.NewReader(tunnel)
+	resp, err = http.ReadResponse(tunnelReader, &http.Request{Method: http.MethodConnect})
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	cancel()
+
+	// The idle connection is closed, the tunnel keeps working
+	_, err = idleReader.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+
+	_, err = fmt.Fprintf(tunnel, "GET / HTTP/1.1\r\nHost: %s\r\n\r\n", targetHost)
+	require.NoError(t, err)
+	resp, err = http.ReadResponse(tunnelReader, nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestServeConnTracksRequests(t *testing.T) {
+	s, _, routerEngine, _ := newTestServer(t, false)
+	route := &router.Route{Group: router.RouteGroupLocal, Precedence: 100, Enabled: true}
+	require.NoError(t, routerEngine.CreateRoute(route))
+	proxyAddr := serveTest(t, context.Background(), s)
+	targetURL := startTargetServer(t)
+	targetHost := strings.TrimPrefix(targetURL, "http://")
+
+	conn, err := net.Dial("tcp", proxyAddr)
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", targetHost, targetHost)
+	require.NoError(t, err)
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, &http.Request{Method: http.MethodConnect})
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	conns := s.tracker.List()
+	require.Len(t, conns, 1)
+	assert.Equal(t, "connect", conns[0].Protocol)
+	assert.Equal(t, targetHost, conns[0].Target)
+	assert.Equal(t, "127.0.0.1", conns[0].ClientIP)
+	require.NotNil(t, conns[0].RouteID)
+	assert.Equal(t, route.ID, *conns[0].RouteID)
+	assert.Equal(t, string(router.RouteGroupLocal), conns[0].Group)
+	assert.Positive(t, conns[0].BytesIn)
+	assert.Positive(t, conns[0].BytesOut)
+
+	// Closing the session ends the tunnel
+	require.True(t, s.tracker.Close(conns[0].ID))
+	_, err = reader.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+	assert.Eventually(t, func() bool { return s.tracker.Len() == 0 }, time.Second, 10*time.Millisecond)
+}
+
+// startTCPTarget serves each connection with handle on a local port
+func startTCPTarget(t *testing.T, handle func(net.Conn)) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handle(conn)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// openTunnel sends CONNECT for target through the proxy
+func openTunnel(t *testing.T, proxyAddr, target string) (*net.TCPConn, *bufio.Reader) {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", proxyAddr)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target)
+	require.NoError(t, err)
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, &http.Request{Method: http.MethodConnect})
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	return conn.(*net.TCPConn), reader
+}
+
+func TestCONNECTHalfClose(t *testing.T) {
+	s, _, routerEngine, _ := newTestServer(t, false)
+	require.NoError(t, routerEngine.CreateRoute(&router.Route{Group: router.RouteGroupLocal, Precedence: 100, Enabled: true}))
+	proxyAddr := serveTest(t, context.Background(), s)
+
+	// The target answers once the client has sent everything
+	target := startTCPTarget(t, func(conn net.Conn) {
+		request, _ := io.ReadAll(conn)
+		fmt.Fprintf(conn, "got %s", request)
+	})
+
+	conn, reader := openTunnel(t, proxyAddr, target)
+	_, err := conn.Write([]byte("ping"))
+	require.NoError(t, err)
+	require.NoError(t, conn.CloseWrite())
+
+	response, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "got ping", string(response))
+}
+
+func TestCONNECTRouteTimeouts(t *testing.T) {
+	s, _, routerEngine, _ := newTestServer(t, false)
+	s.timeouts = tunnel.Timeouts{Idle: time.Minute}
+	idle := 1
+	require.NoError(t, routerEngine.CreateRoute(&router.Route{Group: router.RouteGroupLocal, Precedence: 100, Enabled: true, IdleTimeoutSec: &idle}))
+	proxyAddr := serveTest(t, context.Background(), s)
+
+	// The target echoes, so traffic keeps the tunnel open past its idle timeout
+	target := startTCPTarget(t, func(conn net.Conn) { io.Copy(conn, conn) })
+	conn, reader := openTunnel(t, proxyAddr, target)
+	buf := make([]byte, 1)
+	for i := 0; i < 6; i++ {
+		_, err := conn.Write([]byte("x"))
+		require.NoError(t, err)
+		_, err = io.ReadFull(reader, buf)
+		require.NoError(t, err)
+		time.Sleep(300 * time.Millisecond)
+	}
+
+	// Without traffic it closes after the route's idle timeout
+	start := time.Now()
+	_, err := reader.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+	assert.InDelta(t, time.Second, time.Since(start), float64(500*time.Millisecond))
+}
@@ -0,0 +1,157 @@
+package proxymixed
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"proxyrouter/internal/conntrack"
+	"proxyrouter/internal/halfclose"
+	"proxyrouter/internal/proxyhttp"
+	"proxyrouter/internal/proxyproto"
+	"proxyrouter/internal/proxysocks"
+)
+
+// maxAcceptDelay is the longest wait before accepting again after an error
+const maxAcceptDelay = time.Second
+
+// Server serves HTTP, SOCKS4 and SOCKS5 clients on one port, telling them
+// apart by the first byte each client sends
+type Server struct {
+	listenAddr    string
+	socks         *proxysocks.Server
+	http          *proxyhttp.Server
+	timeout       time.Duration
+	tracker       *conntrack.Tracker
+	proxyProtocol *proxyproto.Policy
+}
+
+// New creates a mixed listener that hands each connection to the SOCKS or
+// HTTP proxy server. Clients that send nothing within timeout are dropped.
+// Accepted connections are recorded in tracker. Peers trusted by
+// proxyProtocol, which may be nil, pass on the client address in a PROXY
+// protocol header.
+func New(listenAddr string, socks *proxysocks.Server, http *proxyhttp.Server, timeout time.Duration, tracker *conntrack.Tracker, proxyProtocol *proxyproto.Policy) *Server {
+	return &Server{
+		listenAddr:    listenAddr,
+		socks:         socks,
+		http:          http,
+		timeout:       timeout,
+		tracker:       tracker,
+		proxyProtocol: proxyProtocol,
+	}
+}
+
+// Start starts the mixed listener. It stops accepting when ctx is done;
+// connections already accepted keep running until they finish or the
+// tracker closes them.
+func (s *Server) Start(ctx context.Context) error {
+	listener, err := s.proxyProtocol.Listen(s.listenAddr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", s.listenAddr, err)
+	}
+
+	fmt.Printf("Mixed proxy server listening on %s\n", s.listenAddr)
+
+	stop := context.AfterFunc(ctx, func() {
+		fmt.Println("Mixed proxy server shutting down...")
+		listener.Close()
+	})
+	defer stop()
+
+	return s.serve(ctx, listener)
+}
+
+// serve accepts connections until ctx is done or the listener is closed.
+// Other accept errors, such as running out of file descriptors, are logged
+// and retried after a delay that grows up to maxAcceptDelay.
+func (s *Server) serve(ctx context.Context, listener net.Listener) error {
+	var delay time.Duration
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			delay = min(max(2*delay, 5*time.Millisecond), maxAcceptDelay)
+			fmt.Printf("Failed to accept connection: %v\n", err)
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(delay):
+			}
+			continue
+		}
+		delay = 0
+
+		go func() {
+			c := s.tracker.Track("mixed", conn)
+			defer c.Done()
+			s.serveConn(conntrack.NewContext(ctx, c), c)
+		}()
+	}
+}
+
+// serveConn peeks at the first byte and passes the connection on
+func (s *Server) serveConn(ctx context.Context, conn net.Conn) {
+	reader := bufio.NewReader(conn)
+
+	conn.SetReadDeadline(time.Now().Add(s.timeout))
+	first, err := reader.Peek(1)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	peeked := &peekedConn{Conn: conn, reader: reader}
+	switch protocol(first[0]) {
+	case "SOCKS5":
+		s.socks.ServeSOCKS5(ctx, peeked)
+	case "SOCKS4":
+		s.socks.ServeSOCKS4(ctx, peeked)
+	case "HTTP":
+		s.http.ServeConn(ctx, peeked)
+	default:
+		fmt.Printf("Unknown protocol from %s (first byte 0x%02x)\n", conn.RemoteAddr(), first[0])
+		conn.Close()
+	}
+}
+
+// protocol names the protocol a connection starting with b speaks, or ""
+func protocol(b byte) string {
+	switch {
+	case b == 0x05:
+		return "SOCKS5"
+	case b == 0x04:
+		return "SOCKS4"
+	case b >= 'A' && b <= 'Z':
+		// Request lines start with an upper-case method name
+		return "HTTP"
+	default:
+		return ""
+	}
+}
+
+// peekedConn is a connection whose reads start with the bytes buffered
+// while sniffing the protocol
+type peekedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+// Read implements net.Conn
+func (c *peekedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+// CloseWrite half-closes the wrapped connection
+func (c *peekedConn) CloseWrite() error {
+	return halfclose.CloseWrite(c.Conn)
+}
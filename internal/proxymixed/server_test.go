@@ -0,0 +1,237 @@
+package proxymixed
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"proxyrouter/internal/acl"
+	"proxyrouter/internal/auth"
+	"proxyrouter/internal/conntrack"
+	"proxyrouter/internal/db"
+	"proxyrouter/internal/proxyhttp"
+	"proxyrouter/internal/proxysocks"
+	"proxyrouter/internal/router"
+	"proxyrouter/internal/tunnel"
+)
+
+// startTestServer serves the mixed listener to loopback clients on a local
+// port, routing everything directly
+func startTestServer(t *testing.T) string {
+	t.Helper()
+
+	database, err := db.New(filepath.Join(t.TempDir(), "test.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { database.Close() })
+	require.NoError(t, database.RunMigrations(filepath.Join("..", "..", "migrations")))
+	_, err = database.GetDB().Exec("INSERT INTO acl_subnets (cidr) VALUES ('127.0.0.0/8')")
+	require.NoError(t, err)
+
+	routerEngine := router.New(database.GetDB())
+	require.NoError(t, routerEngine.CreateRoute(&router.Route{Group: router.RouteGroupLocal, Precedence: 100, Enabled: true}))
+	dialerFactory := router.NewDialerFactory(database.GetDB(), "127.0.0.1:9050", time.Second, nil, router.FailoverPolicy{})
+	users := auth.NewProxyUsers(database.GetDB(), "bcrypt")
+	accessList := acl.New(database.GetDB())
+	tracker := conntrack.New()
+
+	socks := proxysocks.New("127.0.0.1:0", accessList, routerEngine, dialerFactory, users, false, 5*time.Second, time.Second, tracker, nil, tunnel.Timeouts{}, nil)
+	httpProxy := proxyhttp.New("127.0.0.1:0", accessList, routerEngine, dialerFactory, users, false, nil, 5*time.Second, tracker, nil, tunnel.Timeouts{}, nil)
+	s := New("127.0.0.1:0", socks, httpProxy, time.Second, tracker, nil)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serveConn(context.Background(), conn)
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+// startEchoServer accepts connections and echoes what it reads
+func startEchoServer(t *testing.T) int {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+// dial opens a connection to the mixed listener
+func dial(t *testing.T, addr string) net.Conn {
+	t.Helper()
+
+	conn, err := net.DialTimeout("tcp", addr, time.Second)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return conn
+}
+
+// exchange writes request, reads a reply of len(reply) bytes and returns it
+func exchange(t *testing.T, conn net.Conn, request []byte, n int) []byte {
+	t.Helper()
+
+	_, err := conn.Write(request)
+	require.NoError(t, err)
+	reply := make([]byte, n)
+	_, err = io.ReadFull(conn, reply)
+	require.NoError(t, err)
+	return reply
+}
+
+// assertEcho checks that conn is connected to an echo server
+func assertEcho(t *testing.T, conn net.Conn) {
+	t.Helper()
+
+	assert.Equal(t, "ping", string(exchange(t, conn, []byte("ping"), 4)))
+}
+
+func TestMixedServesSOCKS5(t *testing.T) {
+	addr := startTestServer(t)
+	conn := dial(t, addr)
+
+	require.Equal(t, []byte{5, 0}, exchange(t, conn, []byte{5, 1, 0}, 2))
+	request := binary.BigEndian.AppendUint16([]byte{5, 1, 0, 1, 127, 0, 0, 1}, uint16(startEchoServer(t)))
+	reply := exchange(t, conn, request, 10)
+	require.Equal(t, byte(0), reply[1])
+	assertEcho(t, conn)
+}
+
+func TestMixedServesSOCKS4(t *testing.T) {
+	addr := startTestServer(t)
+	conn := dial(t, addr)
+
+	request := binary.BigEndian.AppendUint16([]byte{4, 1}, uint16(startEchoServer(t)))
+	request = append(request, 127, 0, 0, 1, 0)
+	reply := exchange(t, conn, request, 8)
+	require.Equal(t, byte(0x5A), reply[1])
+	assertEcho(t, conn)
+}
+
+func TestMixedServesHTTP(t *testing.T) {
+	addr := startTestServer(t)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "hello")
+	}))
+	t.Cleanup(target.Close)
+
+	conn := dial(t, addr)
+	_, err := fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: example.test\r\nConnection: close\r\n\r\n", target.URL)
+	require.NoError(t, err)
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "hello", string(body))
+
+	// CONNECT tunnels share the port too
+	conn = dial(t, addr)
+	echoAddr := net.JoinHostPort("127.0.0.1", strconv.Itoa(startEchoServer(t)))
+	_, err = fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", echoAddr, echoAddr)
+	require.NoError(t, err)
+	reader := bufio.NewReader(conn)
+	resp, err = http.ReadResponse(reader, &http.Request{Method: http.MethodConnect})
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	_, err = conn.Write([]byte("ping"))
+	require.NoError(t, err)
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(reader, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "ping", string(buf))
+}
+
+func TestMixedClosesUnknownProtocols(t *testing.T) {
+	conn := dial(t, startTestServer(t))
+
+	_, err := conn.Write([]byte{0x16, 0x03, 0x01})
+	require.NoError(t, err)
+	_, err = conn.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+// flakyListener fails the first accepts with a temporary error, as accept
+// does when the process runs out of file descriptors
+type flakyListener struct {
+	net.Listener
+	failures int
+}
+
+// Accept implements net.Listener
+func (l *flakyListener) Accept() (net.Conn, error) {
+	if l.failures > 0 {
+		l.failures--
+		return nil, fmt.Errorf("accept: too many open files")
+	}
+	return l.Listener.Accept()
+}
+
+func TestMixedKeepsAcceptingAfterErrors(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := New("127.0.0.1:0", nil, nil, time.Second, conntrack.New(), nil)
+
+	serving := make(chan error, 1)
+	go func() {
+		serving <- s.serve(context.Background(), &flakyListener{Listener: listener, failures: 3})
+	}()
+
+	// The connection is served once the failed accepts have been retried
+	conn := dial(t, listener.Addr().String())
+	_, err = conn.Write([]byte{0x16, 0x03, 0x01})
+	require.NoError(t, err)
+	_, err = conn.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+
+	select {
+	case err := <-serving:
+		t.Fatalf("serve() stopped after a temporary error: %v", err)
+	default:
+	}
+
+	// Closing the listener stops the loop
+	listener.Close()
+	select {
+	case err := <-serving:
+		assert.ErrorIs(t, err, net.ErrClosed)
+	case <-time.After(2 * time.Second):
+		t.Fatal("serve() did not stop after the listener was closed")
+	}
+}
@@ -0,0 +1,152 @@
+// Package proxyproto reads the PROXY protocol headers load balancers such as
+// HAProxy put in front of a connection to pass on the client's address.
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// ErrNoHeader is returned for a connection that does not start with a PROXY
+// protocol header
+var ErrNoHeader = errors.New("no PROXY protocol header")
+
+// v2Signature starts every version 2 header
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// maxV1Length is the longest version 1 header, "\r\n" included
+const maxV1Length = 107
+
+// ReadHeader reads a version 1 or 2 PROXY protocol header and returns the
+// source and destination addresses it carries. Both are nil for headers
+// without addresses, such as those of health checks.
+func ReadHeader(r *bufio.Reader) (source, destination net.Addr, err error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch first[0] {
+	case 'P':
+		return readV1(r)
+	case v2Signature[0]:
+		return readV2(r)
+	default:
+		return nil, nil, ErrNoHeader
+	}
+}
+
+// readV1 reads a text header such as "PROXY TCP4 1.2.3.4 5.6.7.8 1234 80\r\n"
+func readV1(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) == maxV1Length {
+			return nil, nil, fmt.Errorf("PROXY header longer than %d bytes", maxV1Length)
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, b)
+	}
+
+	fields := strings.Split(strings.TrimSuffix(string(line), "\r\n"), " ")
+	if fields[0] != "PROXY" {
+		return nil, nil, ErrNoHeader
+	}
+	if len(fields) < 2 {
+		return nil, nil, fmt.Errorf("PROXY header without a protocol")
+	}
+	if fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if fields[1] != "TCP4" && fields[1] != "TCP6" {
+		return nil, nil, fmt.Errorf("unsupported PROXY protocol %q", fields[1])
+	}
+	if len(fields) != 6 {
+		return nil, nil, fmt.Errorf("PROXY header has %d fields, want 6", len(fields))
+	}
+
+	source, err := parseV1Addr(fields[1], fields[2], fields[4])
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid source address: %w", err)
+	}
+	destination, err := parseV1Addr(fields[1], fields[3], fields[5])
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid destination address: %w", err)
+	}
+	return source, destination, nil
+}
+
+// parseV1Addr parses an address of a version 1 header of protocol TCP4 or
+// TCP6
+func parseV1Addr(protocol, ip, port string) (*net.TCPAddr, error) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return nil, err
+	}
+	if addr.Is4() != (protocol == "TCP4") || addr.Zone() != "" {
+		return nil, fmt.Errorf("%s is not a %s address", ip, protocol)
+	}
+	portNum, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", port)
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, uint16(portNum))), nil
+}
+
+// readV2 reads a binary header
+func readV2(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, nil, err
+	}
+	if !bytes.Equal(header[:12], v2Signature) {
+		return nil, nil, ErrNoHeader
+	}
+	if version := header[12] >> 4; version != 2 {
+		return nil, nil, fmt.Errorf("unsupported PROXY protocol version %d", version)
+	}
+	command := header[12] & 0x0f
+	if command > 1 {
+		return nil, nil, fmt.Errorf("unsupported PROXY command %d", command)
+	}
+
+	body := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, nil, err
+	}
+
+	// LOCAL connections come from the load balancer itself
+	if command == 0 {
+		return nil, nil, nil
+	}
+
+	var size int
+	switch header[13] >> 4 {
+	case 1: // AF_INET
+		size = 4
+	case 2: // AF_INET6
+		size = 16
+	default:
+		// Unix sockets and unspecified families carry no IP address
+		return nil, nil, nil
+	}
+	if len(body) < 2*size+4 {
+		return nil, nil, fmt.Errorf("PROXY header addresses truncated")
+	}
+
+	sourceIP, _ := netip.AddrFromSlice(body[:size])
+	destinationIP, _ := netip.AddrFromSlice(body[size : 2*size])
+	sourcePort := binary.BigEndian.Uint16(body[2*size:])
+	destinationPort := binary.BigEndian.Uint16(body[2*size+2:])
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(sourceIP, sourcePort)),
+		net.TCPAddrFromAddrPort(netip.AddrPortFrom(destinationIP, destinationPort)), nil
+}
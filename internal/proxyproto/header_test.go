@@ -0,0 +1,147 @@
+package proxyproto
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// v2Header builds a version 2 header with the command, family and address
+// block given
+func v2Header(command, family byte, addresses []byte) []byte {
+	header := append([]byte{}, v2Signature...)
+	header = append(header, 0x20|command, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(addresses)))
+	return append(header, addresses...)
+}
+
+func TestReadHeaderV1(t *testing.T) {
+	tests := []struct {
+		name        string
+		input       string
+		source      string
+		destination string
+		wantErr     bool
+	}{
+		{
+			name:        "TCP4",
+			input:       "PROXY TCP4 203.0.113.7 10.0.0.1 51234 8080\r\n",
+			source:      "203.0.113.7:51234",
+			destination: "10.0.0.1:8080",
+		},
+		{
+			name:        "TCP6",
+			input:       "PROXY TCP6 2001:db8::7 2001:db8::1 51234 8080\r\n",
+			source:      "[2001:db8::7]:51234",
+			destination: "[2001:db8::1]:8080",
+		},
+		{
+			name:  "UNKNOWN",
+			input: "PROXY UNKNOWN\r\n",
+		},
+		{
+			name:    "family mismatch",
+			input:   "PROXY TCP4 2001:db8::7 10.0.0.1 51234 8080\r\n",
+			wantErr: true,
+		},
+		{
+			name:    "invalid port",
+			input:   "PROXY TCP4 203.0.113.7 10.0.0.1 70000 8080\r\n",
+			wantErr: true,
+		},
+		{
+			name:    "missing fields",
+			input:   "PROXY TCP4 203.0.113.7\r\n",
+			wantErr: true,
+		},
+		{
+			name:    "too long",
+			input:   "PROXY TCP4 " + strings.Repeat("1", 200) + "\r\n",
+			wantErr: true,
+		},
+		{
+			name:    "HTTP request",
+			input:   "POST / HTTP/1.1\r\n",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reader := bufio.NewReader(strings.NewReader(tt.input + "payload"))
+			source, destination, err := ReadHeader(reader)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			if tt.source == "" {
+				assert.Nil(t, source)
+				assert.Nil(t, destination)
+			} else {
+				assert.Equal(t, tt.source, source.String())
+				assert.Equal(t, tt.destination, destination.String())
+			}
+
+			rest, _ := io.ReadAll(reader)
+			assert.Equal(t, "payload", string(rest))
+		})
+	}
+}
+
+func TestReadHeaderV2(t *testing.T) {
+	ipv4 := []byte{203, 0, 113, 7, 10, 0, 0, 1, 0xc8, 0x22, 0x1f, 0x90}
+	ipv6 := append(append(net.ParseIP("2001:db8::7").To16(), net.ParseIP("2001:db8::1").To16()...), 0xc8, 0x22, 0x1f, 0x90)
+	// A TLV after the addresses is skipped
+	withTLV := append(append([]byte{}, ipv4...), 0x04, 0x00, 0x01, 0x00)
+
+	tests := []struct {
+		name        string
+		input       []byte
+		source      string
+		destination string
+		wantErr     bool
+	}{
+		{name: "TCP4", input: v2Header(1, 0x11, ipv4), source: "203.0.113.7:51234", destination: "10.0.0.1:8080"},
+		{name: "TCP6", input: v2Header(1, 0x21, ipv6), source: "[2001:db8::7]:51234", destination: "[2001:db8::1]:8080"},
+		{name: "TLV", input: v2Header(1, 0x11, withTLV), source: "203.0.113.7:51234", destination: "10.0.0.1:8080"},
+		{name: "LOCAL", input: v2Header(0, 0x00, nil)},
+		{name: "unix socket", input: v2Header(1, 0x31, make([]byte, 216))},
+		{name: "truncated addresses", input: v2Header(1, 0x11, ipv4[:8]), wantErr: true},
+		{name: "unknown command", input: v2Header(2, 0x11, ipv4), wantErr: true},
+		{name: "bad signature", input: append([]byte("\r\n\r\nGARBAGE!"), v2Header(1, 0x11, ipv4)[12:]...), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reader := bufio.NewReader(strings.NewReader(string(tt.input) + "payload"))
+			source, destination, err := ReadHeader(reader)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			if tt.source == "" {
+				assert.Nil(t, source)
+				assert.Nil(t, destination)
+			} else {
+				assert.Equal(t, tt.source, source.String())
+				assert.Equal(t, tt.destination, destination.String())
+			}
+
+			rest, _ := io.ReadAll(reader)
+			assert.Equal(t, "payload", string(rest))
+		})
+	}
+}
+
+func TestReadHeaderWithoutHeader(t *testing.T) {
+	_, _, err := ReadHeader(bufio.NewReader(strings.NewReader("\x05\x01\x00")))
+	assert.ErrorIs(t, err, ErrNoHeader)
+}
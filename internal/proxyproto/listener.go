@@ -0,0 +1,116 @@
+package proxyproto
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"proxyrouter/internal/acl"
+	"proxyrouter/internal/halfclose"
+)
+
+// Policy decides which connections start with a PROXY protocol header. A nil
+// *Policy expects none.
+type Policy struct {
+	Trusted *acl.TrustedProxies // peers that must send a header
+	Timeout time.Duration       // how long to wait for the header, zero waits forever
+}
+
+// Listen listens for TCP connections on addr. Connections from trusted peers
+// report the client address of their PROXY protocol header.
+func (p *Policy) Listen(addr string) (net.Listener, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if p == nil || p.Trusted.Len() == 0 {
+		return listener, nil
+	}
+	return NewListener(listener, p.Trusted, p.Timeout), nil
+}
+
+// Listener reads a PROXY protocol header from each connection of a trusted
+// peer. Connections from other peers are passed on untouched, so a header
+// they send is never believed.
+type Listener struct {
+	net.Listener
+	trusted *acl.TrustedProxies
+	timeout time.Duration
+}
+
+// NewListener wraps listener so connections from trusted peers must start
+// with a PROXY protocol header, which has to arrive within timeout
+func NewListener(listener net.Listener, trusted *acl.TrustedProxies, timeout time.Duration) *Listener {
+	return &Listener{Listener: listener, trusted: trusted, timeout: timeout}
+}
+
+// Accept implements net.Listener. The header is read on the connection's
+// first read or address lookup, so a slow peer does not hold up the accept
+// loop.
+func (l *Listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !l.trusted.Contains(conn.RemoteAddr().String()) {
+		return conn, nil
+	}
+	return &Conn{Conn: conn, reader: bufio.NewReader(conn), timeout: l.timeout}, nil
+}
+
+// Conn is a connection from a trusted peer whose remote address is the client
+// address of its PROXY protocol header. The local address stays that of the
+// socket, so replies that name it point at this host. Reads fail if the
+// header is missing or invalid.
+type Conn struct {
+	net.Conn
+	reader  *bufio.Reader
+	timeout time.Duration
+
+	once   sync.Once
+	source net.Addr
+	err    error
+}
+
+// readHeader reads the PROXY protocol header once
+func (c *Conn) readHeader() {
+	c.once.Do(func() {
+		if c.timeout > 0 {
+			c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+		}
+		source, _, err := ReadHeader(c.reader)
+		c.Conn.SetReadDeadline(time.Time{})
+		if err != nil {
+			fmt.Printf("Invalid PROXY protocol header from %s: %v\n", c.Conn.RemoteAddr(), err)
+			c.err = fmt.Errorf("failed to read PROXY protocol header: %w", err)
+			return
+		}
+		c.source = source
+	})
+}
+
+// Read implements net.Conn
+func (c *Conn) Read(p []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(p)
+}
+
+// RemoteAddr returns the client address of the header, or the peer's
+// address if the header carries none
+func (c *Conn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.source != nil {
+		return c.source
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// CloseWrite half-closes the wrapped connection
+func (c *Conn) CloseWrite() error {
+	return halfclose.CloseWrite(c.Conn)
+}
@@ -0,0 +1,84 @@
+package proxyproto
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"proxyrouter/internal/acl"
+)
+
+// listen starts a listener on a free local port that reads PROXY headers
+// from the trusted CIDRs
+func listen(t *testing.T, trusted ...string) net.Listener {
+	t.Helper()
+	trustedProxies, err := acl.NewTrustedProxies(trusted)
+	require.NoError(t, err)
+	policy := &Policy{Trusted: trustedProxies, Timeout: time.Second}
+	listener, err := policy.Listen("127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	return listener
+}
+
+// connect sends data to the listener and returns the connection it accepts
+func connect(t *testing.T, listener net.Listener, data string) net.Conn {
+	t.Helper()
+	client, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() { client.Close() })
+	_, err = client.Write([]byte(data))
+	require.NoError(t, err)
+
+	conn, err := listener.Accept()
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestListenerTrustedPeer(t *testing.T) {
+	listener := listen(t, "127.0.0.0/8")
+	conn := connect(t, listener, "PROXY TCP4 203.0.113.7 127.0.0.1 51234 8080\r\nhello")
+
+	assert.Equal(t, "203.0.113.7:51234", conn.RemoteAddr().String())
+	assert.Equal(t, listener.Addr().String(), conn.LocalAddr().String())
+
+	buf := make([]byte, 5)
+	_, err := io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(buf))
+}
+
+func TestListenerTrustedPeerWithoutHeader(t *testing.T) {
+	listener := listen(t, "127.0.0.0/8")
+	conn := connect(t, listener, "\x05\x01\x00")
+
+	_, err := conn.Read(make([]byte, 3))
+	assert.ErrorIs(t, err, ErrNoHeader)
+	assert.Equal(t, "127.0.0.1", conn.RemoteAddr().(*net.TCPAddr).IP.String())
+}
+
+func TestListenerUntrustedPeer(t *testing.T) {
+	listener := listen(t, "10.0.0.0/8")
+	conn := connect(t, listener, "PROXY TCP4 203.0.113.7 127.0.0.1 51234 8080\r\n")
+
+	// The header of an untrusted peer is just data
+	assert.Equal(t, "127.0.0.1", conn.RemoteAddr().(*net.TCPAddr).IP.String())
+	buf := make([]byte, 6)
+	_, err := io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "PROXY ", string(buf))
+}
+
+func TestPolicyWithoutTrustedProxies(t *testing.T) {
+	var policy *Policy
+	listener, err := policy.Listen("127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	_, ok := listener.(*Listener)
+	assert.False(t, ok)
+}
@@ -1,124 +1,460 @@
 package proxysocks
 
 import (
+	"bufio"
 	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
 	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/armon/go-socks5"
 
 	"proxyrouter/internal/acl"
+	"proxyrouter/internal/auth"
+	"proxyrouter/internal/conntrack"
+	"proxyrouter/internal/proxyproto"
 	"proxyrouter/internal/router"
+	"proxyrouter/internal/shaping"
+	"proxyrouter/internal/tunnel"
+)
+
+// SOCKS5 protocol constants (RFC 1928)
+const (
+	socks5Version = 0x05
+
+	socks5MethodNoAcceptable = 0xFF
+
+	replySucceeded           = 0x00
+	replyGeneralFailure      = 0x01
+	replyNotAllowed          = 0x02
+	replyNetworkUnreachable  = 0x03
+	replyHostUnreachable     = 0x04
+	replyConnectionRefused   = 0x05
+	replyTTLExpired          = 0x06
+	replyCommandNotSupported = 0x07
+	replyAddressNotSupported = 0x08
 )
 
 // Server represents the SOCKS5 proxy server
 type Server struct {
-	listenAddr   string
-	acl          *acl.ACL
-	router       *router.Router
-	dialerFactory *router.DialerFactory
-	timeout      time.Duration
+	listenAddr     string
+	acl            *acl.ACL
+	router         *router.Router
+	dialerFactory  *router.DialerFactory
+	users          *auth.ProxyUsers
+	requireAuth    bool
+	timeout        time.Duration
+	udpIdleTimeout time.Duration
+	dialer         *RouterDialer
+	authMethods    map[uint8]socks5.Authenticator
+	tracker        *conntrack.Tracker
+	proxyProtocol  *proxyproto.Policy
 }
 
-// New creates a new SOCKS5 server
-func New(listenAddr string, acl *acl.ACL, router *router.Router, dialerFactory *router.DialerFactory, timeout time.Duration) *Server {
-	return &Server{
-		listenAddr:    listenAddr,
-		acl:           acl,
+// New creates a new SOCKS5 server. Clients may log in as a proxy user, and
+// must when requireAuth is set. UDP associations end after udpIdleTimeout
+// without traffic. Accepted connections are recorded in tracker, and their
+// tunnels are limited by shaper, which may be nil. Tunnels close after the
+// idle and lifetime timeouts of their route, or timeouts if it sets none.
+// Peers trusted by proxyProtocol, which may be nil, pass on the client
+// address in a PROXY protocol header.
+func New(listenAddr string, acl *acl.ACL, router *router.Router, dialerFactory *router.DialerFactory, users *auth.ProxyUsers, requireAuth bool, timeout, udpIdleTimeout time.Duration, tracker *conntrack.Tracker, shaper *shaping.Shaper, timeouts tunnel.Timeouts, proxyProtocol *proxyproto.Policy) *Server {
+	s := &Server{
+		listenAddr:     listenAddr,
+		acl:            acl,
+		router:         router,
+		dialerFactory:  dialerFactory,
+		users:          users,
+		requireAuth:    requireAuth,
+		timeout:        timeout,
+		udpIdleTimeout: udpIdleTimeout,
+		authMethods:    make(map[uint8]socks5.Authenticator),
+		tracker:        tracker,
+		proxyProtocol:  proxyProtocol,
+	}
+
+	// Create custom dialer that uses our routing engine
+	s.dialer = &RouterDialer{
 		router:        router,
 		dialerFactory: dialerFactory,
+		shaper:        shaper,
 		timeout:       timeout,
+		timeouts:      timeouts,
 	}
+
+	if !requireAuth {
+		s.authMethods[socks5.NoAuth] = socks5.NoAuthAuthenticator{}
+	}
+	if users != nil {
+		s.authMethods[socks5.UserPassAuth] = socks5.UserPassAuthenticator{
+			Credentials: userCredentials{users: users},
+		}
+	}
+
+	return s
 }
 
 // Start starts the SOCKS5 server
 func (s *Server) Start(ctx context.Context) error {
-	// Create custom dialer that uses our routing engine
-	dialer := &RouterDialer{
-		acl:           s.acl,
-		router:        s.router,
-		dialerFactory: s.dialerFactory,
-		timeout:       s.timeout,
-	}
+	return s.listenAndServe(ctx, "SOCKS5", s.listenAddr, s.ServeSOCKS5)
+}
 
-	// Create SOCKS5 server configuration
-	conf := &socks5.Config{
-		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
-			return dialer.Dial(network, addr)
-		},
-		AuthMethods: []socks5.Authenticator{
-			&socks5.NoAuthAuthenticator{}, // Auth off by default
-		},
-	}
+// StartSOCKS4 serves SOCKS4 and SOCKS4a clients on listenAddr with the same
+// ACL, routes and dialers as the SOCKS5 server
+func (s *Server) StartSOCKS4(ctx context.Context, listenAddr string) error {
+	return s.listenAndServe(ctx, "SOCKS4", listenAddr, s.ServeSOCKS4)
+}
 
-	// Create SOCKS5 server
-	server, err := socks5.New(conf)
+// listenAndServe accepts connections on listenAddr and passes them to handle
+// until ctx is done. Connections already accepted keep running until they
+// finish or the tracker closes them.
+func (s *Server) listenAndServe(ctx context.Context, name, listenAddr string, handle func(context.Context, net.Conn)) error {
+	listener, err := s.proxyProtocol.Listen(listenAddr)
 	if err != nil {
-		return fmt.Errorf("failed to create SOCKS5 server: %w", err)
+		return fmt.Errorf("failed to listen on %s: %w", listenAddr, err)
 	}
 
-	fmt.Printf("SOCKS5 server listening on %s\n", s.listenAddr)
+	fmt.Printf("%s server listening on %s\n", name, listenAddr)
 
 	// Start server in a goroutine
 	go func() {
-		if err := server.ListenAndServe("tcp", s.listenAddr); err != nil {
-			fmt.Printf("SOCKS5 server error: %v\n", err)
+		if err := serve(ctx, listener, s.track(strings.ToLower(name), handle)); err != nil && ctx.Err() == nil {
+			fmt.Printf("%s server error: %v\n", name, err)
 		}
 	}()
 
 	// Wait for context cancellation
 	<-ctx.Done()
 
-	fmt.Println("SOCKS5 server shutting down...")
+	fmt.Printf("%s server shutting down...\n", name)
+	listener.Close()
 	return nil
 }
 
+// track wraps handle so each connection it serves is recorded in the tracker
+// under listener
+func (s *Server) track(listener string, handle func(context.Context, net.Conn)) func(context.Context, net.Conn) {
+	return func(ctx context.Context, conn net.Conn) {
+		c := s.tracker.Track(listener, conn)
+		defer c.Done()
+		handle(conntrack.NewContext(ctx, c), c)
+	}
+}
+
+// serve accepts connections until the listener is closed
+func serve(ctx context.Context, listener net.Listener, handle func(context.Context, net.Conn)) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go handle(ctx, conn)
+	}
+}
+
+// ServeSOCKS5 serves a SOCKS5 client accepted by this or another listener
+// and closes the connection. The client is served to the end even if ctx is
+// cancelled, so shutdown can drain it.
+func (s *Server) ServeSOCKS5(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+	ctx = context.WithoutCancel(ctx)
+	s.serveSOCKS5(ctx, conn, bufio.NewReader(conn))
+}
+
+// serveSOCKS5 checks a client against the ACL, negotiates authentication and
+// serves its request. Clients the ACL denies are closed before anything is
+// read, so they cannot make the server check passwords.
+func (s *Server) serveSOCKS5(ctx context.Context, conn net.Conn, reader *bufio.Reader) {
+	clientIP, ok := s.allow(ctx, conn)
+	if !ok {
+		return
+	}
+
+	// The handshake must finish within the timeout, so a silent client does
+	// not hold its goroutine
+	conn.SetReadDeadline(time.Now().Add(s.timeout))
+
+	version, err := reader.ReadByte()
+	if err != nil {
+		return
+	}
+	if version != socks5Version {
+		fmt.Printf("Unsupported SOCKS version %d from %s\n", version, conn.RemoteAddr())
+		return
+	}
+
+	authContext, err := s.authenticate(conn, reader)
+	if err != nil {
+		fmt.Printf("SOCKS5 authentication failed for %s: %v\n", conn.RemoteAddr(), err)
+		return
+	}
+
+	req, err := socks5.NewRequest(reader)
+	if err != nil {
+		fmt.Printf("Failed to read SOCKS5 request: %v\n", err)
+		writeReply(conn, replyGeneralFailure, nil)
+		return
+	}
+
+	conn.SetReadDeadline(time.Time{})
+
+	ctx = withClient(ctx, s.identify(ctx, clientIP, authContext))
+
+	entry := conntrack.FromContext(ctx)
+	switch req.Command {
+	case socks5.ConnectCommand:
+		entry.SetTarget("socks5", req.DestAddr.Address())
+		s.handleConnect(ctx, conn, reader, req.DestAddr.Address(), socks5ConnectReply)
+	case socks5.AssociateCommand:
+		entry.SetTarget("socks5-udp", "")
+		s.handleAssociate(ctx, conn, reader, req.DestAddr)
+	default:
+		writeReply(conn, replyCommandNotSupported, nil)
+	}
+}
+
+// authenticate runs the first authentication method offered by the client
+// that the server supports
+func (s *Server) authenticate(conn net.Conn, reader *bufio.Reader) (*socks5.AuthContext, error) {
+	count, err := reader.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	methods := make([]byte, count)
+	if _, err := io.ReadFull(reader, methods); err != nil {
+		return nil, err
+	}
+
+	for _, method := range methods {
+		if authenticator, ok := s.authMethods[method]; ok {
+			return authenticator.Authenticate(reader, conn)
+		}
+	}
+
+	conn.Write([]byte{socks5Version, socks5MethodNoAcceptable})
+	return nil, socks5.NoSupportedAuth
+}
+
+// allow checks the client against the ACL and returns its IP
+func (s *Server) allow(ctx context.Context, conn net.Conn) (string, bool) {
+	clientIP := acl.ExtractClientIP(conn.RemoteAddr().String(), nil, nil)
+	allowed, err := s.acl.IsAllowed(ctx, clientIP)
+	if err != nil {
+		fmt.Printf("ACL check failed for %s: %v\n", clientIP, err)
+		return "", false
+	}
+	if !allowed {
+		fmt.Printf("Access denied for %s\n", clientIP)
+		return "", false
+	}
+	return clientIP, true
+}
+
+// identify returns who an allowed client is and records its user
+func (s *Server) identify(ctx context.Context, clientIP string, authContext *socks5.AuthContext) client {
+	c := client{ip: clientIP}
+	if authContext != nil && authContext.Method == socks5.UserPassAuth {
+		c.username = authContext.Payload["Username"]
+	}
+	user, _ := router.SplitSessionUsername(c.username)
+	conntrack.FromContext(ctx).SetUser(user)
+	return c
+}
+
+// connectReply tells a client whether its CONNECT request succeeded
+type connectReply func(w io.Writer, err error, bound net.Addr) error
+
+// socks5ConnectReply sends the SOCKS5 reply to a CONNECT request
+func socks5ConnectReply(w io.Writer, err error, bound net.Addr) error {
+	if err != nil {
+		return writeReply(w, dialErrorReply(err), nil)
+	}
+	return writeReply(w, replySucceeded, bound)
+}
+
+// handleConnect dials addr through the router and tunnels the connection.
+// reader may hold bytes the client sent right after the request.
+func (s *Server) handleConnect(ctx context.Context, conn net.Conn, reader *bufio.Reader, addr string, reply connectReply) {
+	target, err := s.dialer.Dial(ctx, "tcp", addr)
+	if err != nil {
+		fmt.Printf("Failed to connect to %s: %v\n", addr, err)
+		reply(conn, err, nil)
+		return
+	}
+	defer target.Close()
+
+	if err := reply(conn, nil, target.LocalAddr()); err != nil {
+		return
+	}
+
+	if err := tunnel.Relay(conn, reader, target); err != nil {
+		fmt.Printf("Tunnel to %s closed: %v\n", addr, err)
+	}
+}
+
+// dialErrorReply picks the reply code for a failed dial. The reply of an
+// upstream SOCKS5 proxy is passed on, and timeouts are told apart the way
+// router.DialErrorStatus does.
+func dialErrorReply(err error) byte {
+	var socksErr *router.SOCKS5Error
+	if errors.As(err, &socksErr) && socksErr.Code != replySucceeded && socksErr.Code <= replyAddressNotSupported {
+		return socksErr.Code
+	}
+
+	var upstreamErr *router.UpstreamError
+	if errors.As(err, &upstreamErr) {
+		switch upstreamErr.StatusCode {
+		case http.StatusForbidden, http.StatusProxyAuthRequired:
+			return replyConnectionRefused
+		}
+	}
+
+	switch {
+	case router.DialErrorStatus(err) == http.StatusGatewayTimeout:
+		return replyTTLExpired
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return replyConnectionRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return replyNetworkUnreachable
+	default:
+		return replyHostUnreachable
+	}
+}
+
+// writeReply sends a reply with the bound address, or 0.0.0.0:0 when addr is
+// nil
+func writeReply(w io.Writer, reply byte, addr net.Addr) error {
+	ip, port := net.IPv4zero, 0
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip, port = a.IP, a.Port
+	case *net.UDPAddr:
+		ip, port = a.IP, a.Port
+	}
+
+	msg := []byte{socks5Version, reply, 0x00}
+	if ip4 := ip.To4(); ip4 != nil {
+		msg = append(append(msg, 0x01), ip4...)
+	} else {
+		msg = append(append(msg, 0x04), ip.To16()...)
+	}
+	msg = binary.BigEndian.AppendUint16(msg, uint16(port))
+
+	_, err := w.Write(msg)
+	return err
+}
+
+// userCredentials checks SOCKS5 logins against the proxy users. A session
+// suffix like "alice-session-abc" is not part of the account name.
+type userCredentials struct {
+	users *auth.ProxyUsers
+}
+
+// Valid implements socks5.CredentialStore
+func (c userCredentials) Valid(username, password string) bool {
+	user, _ := router.SplitSessionUsername(username)
+	valid, err := c.users.Authenticate(context.Background(), user, password)
+	if err != nil {
+		fmt.Printf("Authentication failed for %s: %v\n", user, err)
+		return false
+	}
+	return valid
+}
+
+// client identifies the SOCKS5 client behind a request
+type client struct {
+	ip       string
+	username string // login name including any session suffix, "" without auth
+}
+
+// request returns the routing request for a target of the client, along with
+// a context carrying the session ID of its login
+func (c client) request(ctx context.Context, host string, port int) (context.Context, router.Request) {
+	// The session suffix of a login pins the client like the HTTP proxy does
+	username, sessionID := router.SplitSessionUsername(c.username)
+	if sessionID != "" {
+		ctx = router.WithSessionID(ctx, sessionID)
+	}
+	return ctx, router.Request{
+		ClientIP: c.ip,
+		Username: username,
+		Host:     host,
+		Port:     port,
+	}
+}
+
+type clientKey struct{}
+
+// withClient returns a context carrying the SOCKS5 client
+func withClient(ctx context.Context, c client) context.Context {
+	return context.WithValue(ctx, clientKey{}, c)
+}
+
+// clientFromContext returns the client set by serveSOCKS5 or serveSOCKS4
+func clientFromContext(ctx context.Context) (client, bool) {
+	c, ok := ctx.Value(clientKey{}).(client)
+	return c, ok
+}
+
 // RouterDialer implements the dialer interface for SOCKS5
 type RouterDialer struct {
-	acl           *acl.ACL
 	router        *router.Router
 	dialerFactory *router.DialerFactory
+	shaper        *shaping.Shaper
 	timeout       time.Duration
+	timeouts      tunnel.Timeouts
 }
 
-// Dial implements the dialer interface
-func (d *RouterDialer) Dial(network, addr string) (net.Conn, error) {
-	// Extract client IP from context (SOCKS5 doesn't provide this directly)
-	// For now, we'll use a placeholder - in a real implementation, you'd need to
-	// pass this through the SOCKS5 context or use connection tracking
-	clientIP := "127.0.0.1" // Placeholder - would need connection tracking
-
-	// Check ACL
-	allowed, err := d.acl.IsAllowed(context.Background(), clientIP)
-	if err != nil {
-		return nil, fmt.Errorf("ACL check failed: %w", err)
-	}
-	if !allowed {
-		return nil, fmt.Errorf("access denied for client %s", clientIP)
+// Dial dials addr through the route for the client recorded in ctx and
+// applies the bandwidth limits of the client, its user and the route, and
+// the route's tunnel timeouts
+func (d *RouterDialer) Dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	c, ok := clientFromContext(ctx)
+	if !ok {
+		return nil, fmt.Errorf("client missing from request context")
 	}
 
 	// Parse target address
-	host, _, err := net.SplitHostPort(addr)
+	host, portStr, err := net.SplitHostPort(addr)
 	if err != nil {
 		return nil, fmt.Errorf("invalid address format: %w", err)
 	}
+	port, _ := strconv.Atoi(portStr)
 
 	// Find route using routing engine
-	route, err := d.router.FindRoute(context.Background(), clientIP, host)
+	ctx, req := c.request(ctx, host, port)
+	route, err := d.router.MatchRoute(ctx, req)
 	if err != nil {
 		return nil, fmt.Errorf("failed to find route: %w", err)
 	}
+	if route == nil {
+		return nil, fmt.Errorf("no route for %s from %s", host, c.ip)
+	}
+	entry := conntrack.FromContext(ctx)
+	entry.SetRoute(route.ID, string(route.Group), route.ProxyID)
+	ctx = router.WithProxyObserver(ctx, entry.SetProxy)
 
 	// Create dialer based on route
-	dialer, err := d.dialerFactory.CreateDialer(context.Background(), route)
+	dialer, err := d.dialerFactory.CreateDialer(ctx, route, c.ip, host)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create dialer: %w", err)
 	}
 
 	// Dial with timeout
-	dialCtx, cancel := context.WithTimeout(context.Background(), d.timeout)
+	dialCtx, cancel := context.WithTimeout(ctx, d.timeout)
 	defer cancel()
 
-	return dialer.DialContext(dialCtx, network, addr)
+	conn, err := dialer.DialContext(dialCtx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	conn = d.shaper.Shape(ctx, conn, c.ip, req.Username, route)
+	return tunnel.Watch(conn, d.timeouts.ForRoute(route)), nil
 }
@@ -0,0 +1,339 @@
+package proxysocks
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"proxyrouter/internal/acl"
+	"proxyrouter/internal/auth"
+	"proxyrouter/internal/conntrack"
+	"proxyrouter/internal/db"
+	"proxyrouter/internal/router"
+	"proxyrouter/internal/tunnel"
+)
+
+// startTestServer serves SOCKS5 on a local port backed by a migrated database
+func startTestServer(t *testing.T, requireAuth bool) (string, *db.Database, *router.Router, *auth.ProxyUsers) {
+	t.Helper()
+
+	s, database, routerEngine, users := newTestServer(t, requireAuth)
+	return serveTest(t, s.ServeSOCKS5), database, routerEngine, users
+}
+
+// newTestServer creates a server backed by a migrated database
+func newTestServer(t *testing.T, requireAuth bool) (*Server, *db.Database, *router.Router, *auth.ProxyUsers) {
+	t.Helper()
+
+	database, err := db.New(filepath.Join(t.TempDir(), "test.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { database.Close() })
+	require.NoError(t, database.RunMigrations(filepath.Join("..", "..", "migrations")))
+
+	routerEngine := router.New(database.GetDB())
+	dialerFactory := router.NewDialerFactory(database.GetDB(), "127.0.0.1:9050", time.Second, nil, router.FailoverPolicy{})
+	users := auth.NewProxyUsers(database.GetDB(), "bcrypt")
+	s := New("127.0.0.1:0", acl.New(database.GetDB()), routerEngine, dialerFactory, users, requireAuth, 5*time.Second, time.Second, conntrack.New(), nil, tunnel.Timeouts{}, nil)
+
+	return s, database, routerEngine, users
+}
+
+// serveTest serves connections on a local port with handle
+func serveTest(t *testing.T, handle func(context.Context, net.Conn)) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	go serve(context.Background(), listener, handle)
+
+	return listener.Addr().String()
+}
+
+// startEchoServer accepts connections and echoes what it reads
+func startEchoServer(t *testing.T) int {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+// socksConnect sends a SOCKS5 CONNECT for host:port without authentication
+// and returns the reply code
+func socksConnect(t *testing.T, proxyAddr, host string, port int) (net.Conn, byte) {
+	t.Helper()
+
+	conn := dialSOCKS(t, proxyAddr)
+	_, err := conn.Write([]byte{5, 1, 0})
+	require.NoError(t, err)
+	greeting := make([]byte, 2)
+	_, err = io.ReadFull(conn, greeting)
+	require.NoError(t, err)
+	require.Equal(t, []byte{5, 0}, greeting)
+
+	return conn, sendConnect(t, conn, host, port)
+}
+
+// socksLogin negotiates username/password authentication and returns the
+// status of the login
+func socksLogin(t *testing.T, proxyAddr, username, password string) (net.Conn, byte) {
+	t.Helper()
+
+	conn := dialSOCKS(t, proxyAddr)
+	_, err := conn.Write([]byte{5, 1, 2})
+	require.NoError(t, err)
+	greeting := make([]byte, 2)
+	_, err = io.ReadFull(conn, greeting)
+	require.NoError(t, err)
+	require.Equal(t, []byte{5, 2}, greeting)
+
+	login := []byte{1, byte(len(username))}
+	login = append(login, username...)
+	login = append(login, byte(len(password)))
+	login = append(login, password...)
+	_, err = conn.Write(login)
+	require.NoError(t, err)
+
+	status := make([]byte, 2)
+	_, err = io.ReadFull(conn, status)
+	require.NoError(t, err)
+	return conn, status[1]
+}
+
+// dialSOCKS opens a connection to the SOCKS5 server
+func dialSOCKS(t *testing.T, proxyAddr string) net.Conn {
+	t.Helper()
+
+	conn, err := net.DialTimeout("tcp", proxyAddr, time.Second)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return conn
+}
+
+// sendConnect sends a CONNECT request and returns the reply code
+func sendConnect(t *testing.T, conn net.Conn, host string, port int) byte {
+	t.Helper()
+
+	request := []byte{5, 1, 0, 3, byte(len(host))}
+	request = append(request, host...)
+	request = binary.BigEndian.AppendUint16(request, uint16(port))
+	_, err := conn.Write(request)
+	require.NoError(t, err)
+
+	// Version, reply, reserved and an IPv4 bind address
+	reply := make([]byte, 10)
+	_, err = io.ReadFull(conn, reply)
+	require.NoError(t, err)
+	return reply[1]
+}
+
+// assertEcho checks that conn is connected to an echo server
+func assertEcho(t *testing.T, conn net.Conn) {
+	t.Helper()
+
+	_, err := conn.Write([]byte("ping"))
+	require.NoError(t, err)
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "ping", string(buf))
+}
+
+func TestSOCKS5RejectsDeniedClients(t *testing.T) {
+	proxyAddr, _, routerEngine, _ := startTestServer(t, false)
+	require.NoError(t, routerEngine.CreateRoute(&router.Route{Group: router.RouteGroupLocal, Precedence: 100, Enabled: true}))
+
+	// The seeded ACL only allows 192.168.10.0/24 and 192.168.11.0/24, so the
+	// connection is closed before the greeting is answered
+	conn := dialSOCKS(t, proxyAddr)
+	conn.Write([]byte{5, 1, 0})
+	_, err := conn.Read(make([]byte, 2))
+	assert.Error(t, err, "expected the connection to be closed")
+}
+
+func TestSOCKS5HandshakeTimeout(t *testing.T) {
+	s, database, _, _ := newTestServer(t, false)
+	_, err := database.GetDB().Exec("INSERT INTO acl_subnets (cidr) VALUES ('127.0.0.0/8')")
+	require.NoError(t, err)
+	s.timeout = 100 * time.Millisecond
+
+	// A client that sends nothing is closed once the timeout passes
+	conn := dialSOCKS(t, serveTest(t, s.ServeSOCKS5))
+	start := time.Now()
+	_, err = conn.Read(make([]byte, 1))
+	assert.Error(t, err)
+	assert.Less(t, time.Since(start), 2*time.Second)
+}
+
+func TestSOCKS5RoutesByClientIP(t *testing.T) {
+	proxyAddr, database, routerEngine, _ := startTestServer(t, false)
+	_, err := database.GetDB().Exec("INSERT INTO acl_subnets (cidr) VALUES ('127.0.0.0/8')")
+	require.NoError(t, err)
+
+	// Only the client_cidr route dials directly, anything else goes to a
+	// proxy that does not exist
+	require.NoError(t, routerEngine.CreateRoute(&router.Route{
+		Group:      router.RouteGroupLocal,
+		ClientCIDR: stringPtr("127.0.0.0/8"),
+		HostGlob:   stringPtr("localhost"),
+		Precedence: 10,
+		Enabled:    true,
+	}))
+	missing := 999
+	require.NoError(t, routerEngine.CreateRoute(&router.Route{Group: router.RouteGroupUpstream, ProxyID: &missing, Precedence: 100, Enabled: true}))
+
+	conn, reply := socksConnect(t, proxyAddr, "localhost", startEchoServer(t))
+	require.Equal(t, byte(0), reply)
+	assertEcho(t, conn)
+
+	// Another host falls through to the catch-all route
+	_, reply = socksConnect(t, proxyAddr, "127.0.0.1", startEchoServer(t))
+	assert.NotEqual(t, byte(0), reply)
+}
+
+func TestSOCKS5RoutesByUser(t *testing.T) {
+	proxyAddr, database, routerEngine, users := startTestServer(t, false)
+	_, err := database.GetDB().Exec("INSERT INTO acl_subnets (cidr) VALUES ('127.0.0.0/8')")
+	require.NoError(t, err)
+
+	_, err = users.Create(context.Background(), "alice", "secret")
+	require.NoError(t, err)
+
+	require.NoError(t, routerEngine.CreateRoute(&router.Route{
+		Group:      router.RouteGroupLocal,
+		ClientUser: stringPtr("alice"),
+		Precedence: 10,
+		Enabled:    true,
+	}))
+	missing := 999
+	require.NoError(t, routerEngine.CreateRoute(&router.Route{Group: router.RouteGroupUpstream, ProxyID: &missing, Precedence: 100, Enabled: true}))
+
+	echoPort := startEchoServer(t)
+
+	conn, status := socksLogin(t, proxyAddr, "alice", "secret")
+	require.Equal(t, byte(0), status)
+	require.Equal(t, byte(0), sendConnect(t, conn, "localhost", echoPort))
+	assertEcho(t, conn)
+
+	// A session suffix is not part of the account name
+	conn, status = socksLogin(t, proxyAddr, "alice-session-abc", "secret")
+	require.Equal(t, byte(0), status)
+	require.Equal(t, byte(0), sendConnect(t, conn, "localhost", echoPort))
+
+	_, status = socksLogin(t, proxyAddr, "alice", "wrong")
+	assert.NotEqual(t, byte(0), status)
+
+	// Anonymous clients do not match the user's route
+	_, reply := socksConnect(t, proxyAddr, "localhost", echoPort)
+	assert.NotEqual(t, byte(0), reply)
+}
+
+func TestSOCKS5RequireAuth(t *testing.T) {
+	proxyAddr, database, _, _ := startTestServer(t, true)
+	_, err := database.GetDB().Exec("INSERT INTO acl_subnets (cidr) VALUES ('127.0.0.0/8')")
+	require.NoError(t, err)
+
+	conn := dialSOCKS(t, proxyAddr)
+	_, err = conn.Write([]byte{5, 1, 0})
+	require.NoError(t, err)
+	greeting := make([]byte, 2)
+	_, err = io.ReadFull(conn, greeting)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{5, 0xff}, greeting, "expected no acceptable methods")
+}
+
+func TestSOCKS5DialRequiresClient(t *testing.T) {
+	dialer := &RouterDialer{timeout: time.Second}
+	_, err := dialer.Dial(context.Background(), "tcp", "localhost:80")
+	assert.ErrorContains(t, err, "client missing")
+}
+
+func TestSOCKS5TracksSessions(t *testing.T) {
+	s, database, routerEngine, users := newTestServer(t, false)
+	proxyAddr := serveTest(t, s.track("socks5", s.ServeSOCKS5))
+	_, err := database.GetDB().Exec("INSERT INTO acl_subnets (cidr) VALUES ('127.0.0.0/8')")
+	require.NoError(t, err)
+	_, err = users.Create(context.Background(), "alice", "secret")
+	require.NoError(t, err)
+	route := &router.Route{Group: router.RouteGroupLocal, Precedence: 100, Enabled: true}
+	require.NoError(t, routerEngine.CreateRoute(route))
+	echoPort := startEchoServer(t)
+
+	conn, status := socksLogin(t, proxyAddr, "alice-session-abc", "secret")
+	require.Equal(t, byte(0), status)
+	require.Equal(t, byte(0), sendConnect(t, conn, "localhost", echoPort))
+	assertEcho(t, conn)
+
+	conns := s.tracker.List()
+	require.Len(t, conns, 1)
+	assert.Equal(t, "socks5", conns[0].Listener)
+	assert.Equal(t, "socks5", conns[0].Protocol)
+	assert.Equal(t, "alice", conns[0].User)
+	assert.Equal(t, fmt.Sprintf("localhost:%d", echoPort), conns[0].Target)
+	require.NotNil(t, conns[0].RouteID)
+	assert.Equal(t, route.ID, *conns[0].RouteID)
+
+	// Closing the session ends the tunnel
+	require.True(t, s.tracker.Close(conns[0].ID))
+	_, err = conn.Read(make([]byte, 1))
+	assert.Error(t, err)
+}
+
+func stringPtr(s string) *string {
+	return &s
+}
+
+func TestDialErrorReply(t *testing.T) {
+	connectErr := func(errno syscall.Errno) error {
+		return &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", errno)}
+	}
+
+	tests := map[string]struct {
+		err  error
+		want byte
+	}{
+		"upstream SOCKS5 reply":     {fmt.Errorf("hop 1: %w", &router.SOCKS5Error{Proxy: "p:1080", Code: replyNetworkUnreachable}), replyNetworkUnreachable},
+		"upstream SOCKS5 timeout":   {&router.SOCKS5Error{Proxy: "p:1080", Code: replyTTLExpired}, replyTTLExpired},
+		"upstream HTTP forbidden":   {&router.UpstreamError{Proxy: "p:8080", StatusCode: http.StatusForbidden}, replyConnectionRefused},
+		"upstream HTTP timeout":     {&router.UpstreamError{Proxy: "p:8080", StatusCode: http.StatusGatewayTimeout}, replyTTLExpired},
+		"upstream HTTP bad gateway": {&router.UpstreamError{Proxy: "p:8080", StatusCode: http.StatusBadGateway}, replyHostUnreachable},
+		"deadline":                  {fmt.Errorf("failed to connect: %w", context.DeadlineExceeded), replyTTLExpired},
+		"connect timeout":           {connectErr(syscall.ETIMEDOUT), replyTTLExpired},
+		"connection refused":        {connectErr(syscall.ECONNREFUSED), replyConnectionRefused},
+		"network unreachable":       {connectErr(syscall.ENETUNREACH), replyNetworkUnreachable},
+		"other":                     {fmt.Errorf("no proxies available"), replyHostUnreachable},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tt.want, dialErrorReply(tt.err))
+		})
+	}
+}
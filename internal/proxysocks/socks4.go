@@ -0,0 +1,155 @@
+package proxysocks
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"proxyrouter/internal/conntrack"
+)
+
+// SOCKS4 protocol constants
+const (
+	socks4Version    = 0x04
+	socks4CmdConnect = 0x01
+
+	socks4ReplyGranted  = 0x5A
+	socks4ReplyRejected = 0x5B
+
+	// socks4MaxField bounds the null-terminated user ID and domain name
+	socks4MaxField = 255
+)
+
+// socks4Request is a parsed SOCKS4 or SOCKS4a request
+type socks4Request struct {
+	command byte
+	addr    string // host:port, with a domain name for SOCKS4a
+	userID  string
+}
+
+// ServeSOCKS4 serves a SOCKS4 client accepted by this or another listener
+// and closes the connection. Like ServeSOCKS5, it ignores cancellation of
+// ctx.
+func (s *Server) ServeSOCKS4(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+	ctx = context.WithoutCancel(ctx)
+	s.serveSOCKS4(ctx, conn, bufio.NewReader(conn))
+}
+
+// serveSOCKS4 serves a SOCKS4 or SOCKS4a CONNECT request. SOCKS4 has no
+// passwords, so its clients are anonymous and refused when logins are
+// required.
+func (s *Server) serveSOCKS4(ctx context.Context, conn net.Conn, reader *bufio.Reader) {
+	conn.SetReadDeadline(time.Now().Add(s.timeout))
+	req, err := readSOCKS4Request(reader)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		fmt.Printf("Failed to read SOCKS4 request from %s: %v\n", conn.RemoteAddr(), err)
+		writeSOCKS4Reply(conn, socks4ReplyRejected, nil)
+		return
+	}
+
+	if req.command != socks4CmdConnect {
+		writeSOCKS4Reply(conn, socks4ReplyRejected, nil)
+		return
+	}
+	if s.requireAuth {
+		fmt.Printf("SOCKS4 client %s refused, proxy logins are required\n", conn.RemoteAddr())
+		writeSOCKS4Reply(conn, socks4ReplyRejected, nil)
+		return
+	}
+
+	clientIP, ok := s.allow(ctx, conn)
+	if !ok {
+		writeSOCKS4Reply(conn, socks4ReplyRejected, nil)
+		return
+	}
+
+	conntrack.FromContext(ctx).SetTarget("socks4", req.addr)
+	s.handleConnect(withClient(ctx, s.identify(ctx, clientIP, nil)), conn, reader, req.addr, socks4ConnectReply)
+}
+
+// readSOCKS4Request reads a request starting at the version byte
+func readSOCKS4Request(r *bufio.Reader) (*socks4Request, error) {
+	// Version, command, port and address
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if header[0] != socks4Version {
+		return nil, fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+
+	userID, err := readNullTerminated(r)
+	if err != nil {
+		return nil, fmt.Errorf("invalid user ID: %w", err)
+	}
+
+	port := binary.BigEndian.Uint16(header[2:4])
+	ip := net.IP(header[4:8])
+	host := ip.String()
+
+	// SOCKS4a: an address of 0.0.0.x announces a domain name after the user ID
+	if ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0 {
+		host, err = readNullTerminated(r)
+		if err != nil {
+			return nil, fmt.Errorf("invalid domain name: %w", err)
+		}
+		if host == "" {
+			return nil, fmt.Errorf("empty domain name")
+		}
+	}
+
+	return &socks4Request{
+		command: header[1],
+		addr:    net.JoinHostPort(host, strconv.Itoa(int(port))),
+		userID:  userID,
+	}, nil
+}
+
+// readNullTerminated reads a string ending in a zero byte
+func readNullTerminated(r *bufio.Reader) (string, error) {
+	var b []byte
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		if c == 0 {
+			return string(b), nil
+		}
+		if len(b) == socks4MaxField {
+			return "", fmt.Errorf("longer than %d bytes", socks4MaxField)
+		}
+		b = append(b, c)
+	}
+}
+
+// socks4ConnectReply sends the SOCKS4 reply to a CONNECT request
+func socks4ConnectReply(w io.Writer, err error, bound net.Addr) error {
+	if err != nil {
+		return writeSOCKS4Reply(w, socks4ReplyRejected, nil)
+	}
+	return writeSOCKS4Reply(w, socks4ReplyGranted, bound)
+}
+
+// writeSOCKS4Reply sends a reply with the bound IPv4 address, or zeros when
+// there is none
+func writeSOCKS4Reply(w io.Writer, reply byte, bound net.Addr) error {
+	msg := make([]byte, 8)
+	msg[1] = reply
+	if tcpAddr, ok := bound.(*net.TCPAddr); ok {
+		if ip4 := tcpAddr.IP.To4(); ip4 != nil {
+			binary.BigEndian.PutUint16(msg[2:4], uint16(tcpAddr.Port))
+			copy(msg[4:], ip4)
+		}
+	}
+
+	_, err := w.Write(msg)
+	return err
+}
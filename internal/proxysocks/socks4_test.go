@@ -0,0 +1,99 @@
+package proxysocks
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"proxyrouter/internal/router"
+)
+
+// startSOCKS4TestServer serves SOCKS4 on a local port and allows loopback
+// clients through the ACL
+func startSOCKS4TestServer(t *testing.T, requireAuth bool) (string, *router.Router) {
+	t.Helper()
+
+	s, database, routerEngine, _ := newTestServer(t, requireAuth)
+	_, err := database.GetDB().Exec("INSERT INTO acl_subnets (cidr) VALUES ('127.0.0.0/8')")
+	require.NoError(t, err)
+	return serveTest(t, s.ServeSOCKS4), routerEngine
+}
+
+// socks4Connect sends a SOCKS4 CONNECT for 127.0.0.1:port and returns the
+// reply code
+func socks4Connect(t *testing.T, proxyAddr string, port int) (net.Conn, byte) {
+	t.Helper()
+
+	conn := dialSOCKS(t, proxyAddr)
+	request := []byte{4, 1}
+	request = binary.BigEndian.AppendUint16(request, uint16(port))
+	request = append(request, 127, 0, 0, 1)
+	request = append(request, "user"...)
+	_, err := conn.Write(append(request, 0))
+	require.NoError(t, err)
+
+	reply := make([]byte, 8)
+	_, err = io.ReadFull(conn, reply)
+	require.NoError(t, err)
+	return conn, reply[1]
+}
+
+func TestSOCKS4Connect(t *testing.T) {
+	proxyAddr, routerEngine := startSOCKS4TestServer(t, false)
+	require.NoError(t, routerEngine.CreateRoute(&router.Route{Group: router.RouteGroupLocal, Precedence: 100, Enabled: true}))
+
+	conn, reply := socks4Connect(t, proxyAddr, startEchoServer(t))
+	require.Equal(t, byte(socks4ReplyGranted), reply)
+	assertEcho(t, conn)
+}
+
+func TestSOCKS4aConnectThroughDialer(t *testing.T) {
+	proxyAddr, routerEngine := startSOCKS4TestServer(t, false)
+	require.NoError(t, routerEngine.CreateRoute(&router.Route{Group: router.RouteGroupLocal, Precedence: 100, Enabled: true}))
+
+	// The dialer sends domain names with SOCKS4a
+	dialer := router.NewSOCKS4Dialer(proxyAddr, "user", time.Second)
+	conn, err := dialer.DialContext(context.Background(), "tcp", net.JoinHostPort("localhost", strconv.Itoa(startEchoServer(t))))
+	require.NoError(t, err)
+	defer conn.Close()
+	assertEcho(t, conn)
+}
+
+func TestSOCKS4RejectsUnroutable(t *testing.T) {
+	proxyAddr, routerEngine := startSOCKS4TestServer(t, false)
+	echoPort := startEchoServer(t)
+	require.NoError(t, routerEngine.CreateRoute(&router.Route{
+		Group:      router.RouteGroupLocal,
+		DstPorts:   stringPtr(strconv.Itoa(echoPort + 1)),
+		Precedence: 100,
+		Enabled:    true,
+	}))
+
+	_, reply := socks4Connect(t, proxyAddr, echoPort)
+	assert.Equal(t, byte(socks4ReplyRejected), reply)
+}
+
+func TestSOCKS4RejectsDeniedClients(t *testing.T) {
+	s, _, routerEngine, _ := newTestServer(t, false)
+	require.NoError(t, routerEngine.CreateRoute(&router.Route{Group: router.RouteGroupLocal, Precedence: 100, Enabled: true}))
+
+	// The seeded ACL only allows 192.168.10.0/24 and 192.168.11.0/24
+	_, reply := socks4Connect(t, serveTest(t, s.ServeSOCKS4), startEchoServer(t))
+	assert.Equal(t, byte(socks4ReplyRejected), reply)
+}
+
+func TestSOCKS4RequireAuth(t *testing.T) {
+	proxyAddr, routerEngine := startSOCKS4TestServer(t, true)
+	require.NoError(t, routerEngine.CreateRoute(&router.Route{Group: router.RouteGroupLocal, Precedence: 100, Enabled: true}))
+
+	// SOCKS4 cannot carry a password
+	_, reply := socks4Connect(t, proxyAddr, startEchoServer(t))
+	assert.Equal(t, byte(socks4ReplyRejected), reply)
+}
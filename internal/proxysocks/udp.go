@@ -0,0 +1,225 @@
+package proxysocks
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/armon/go-socks5"
+
+	"proxyrouter/internal/conntrack"
+	"proxyrouter/internal/router"
+)
+
+// maxDatagram is the largest UDP payload relayed
+const maxDatagram = 65535
+
+// handleAssociate opens a UDP relay for the client and serves it until the
+// client closes the control connection or the association goes idle
+func (s *Server) handleAssociate(ctx context.Context, conn net.Conn, reader *bufio.Reader, dest *socks5.AddrSpec) {
+	c, _ := clientFromContext(ctx)
+
+	// Relay on the address the client reached us on
+	var localIP net.IP
+	if tcpAddr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		localIP = tcpAddr.IP
+	}
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: localIP})
+	if err != nil {
+		fmt.Printf("Failed to open UDP relay for %s: %v\n", c.ip, err)
+		writeReply(conn, replyGeneralFailure, nil)
+		return
+	}
+	defer relay.Close()
+
+	if err := writeReply(conn, replySucceeded, relay.LocalAddr()); err != nil {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		// The association ends when the client closes the control connection
+		io.Copy(io.Discard, reader)
+		cancel()
+	}()
+
+	a := &association{
+		router:        s.router,
+		dialerFactory: s.dialerFactory,
+		client:        c,
+		relay:         relay,
+		idleTimeout:   s.udpIdleTimeout,
+		conns:         make(map[int]router.PacketConn),
+	}
+	// A client that names its UDP port may only send from that port
+	if dest != nil && dest.Port != 0 {
+		a.expectedPort = dest.Port
+	}
+	a.run(ctx)
+}
+
+// association relays datagrams between one SOCKS5 client and its targets,
+// routing each datagram on its own
+type association struct {
+	router        *router.Router
+	dialerFactory *router.DialerFactory
+	client        client
+	relay         *net.UDPConn
+	idleTimeout   time.Duration
+	expectedPort  int
+
+	clientAddr atomic.Pointer[net.UDPAddr] // learned from the first datagram
+	lastActive atomic.Int64                // unix nanoseconds
+
+	mu    sync.Mutex
+	conns map[int]router.PacketConn // by route ID
+}
+
+// run reads datagrams from the client until ctx is done or no datagram has
+// passed in either direction for the idle timeout
+func (a *association) run(ctx context.Context) {
+	stop := context.AfterFunc(ctx, func() {
+		a.relay.SetReadDeadline(time.Unix(1, 0))
+	})
+	defer stop()
+	defer a.close()
+
+	clientIP := net.ParseIP(a.client.ip)
+	a.touch()
+	buf := make([]byte, maxDatagram)
+	for {
+		if a.idleTimeout > 0 {
+			a.relay.SetReadDeadline(time.Unix(0, a.lastActive.Load()).Add(a.idleTimeout))
+		}
+		n, from, err := a.relay.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) && ctx.Err() == nil && !a.idle() {
+				// Replies kept the association alive
+				continue
+			}
+			return
+		}
+
+		// Only the client that opened the association may use the relay
+		if !from.IP.Equal(clientIP) || (a.expectedPort != 0 && from.Port != a.expectedPort) {
+			continue
+		}
+		if known := a.clientAddr.Load(); known == nil {
+			a.clientAddr.Store(from)
+		} else if known.Port != from.Port {
+			continue
+		}
+
+		a.touch()
+		a.forward(ctx, buf[:n])
+	}
+}
+
+// forward sends one client datagram to its target through the matching route
+func (a *association) forward(ctx context.Context, datagram []byte) {
+	addr, payload, err := router.ParseSOCKS5Datagram(datagram)
+	if err != nil {
+		return
+	}
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return
+	}
+	port, _ := strconv.Atoi(portStr)
+
+	ctx, req := a.client.request(ctx, host, port)
+	route, err := a.router.MatchRoute(ctx, req)
+	if err != nil {
+		fmt.Printf("Failed to find route for %s: %v\n", host, err)
+		return
+	}
+	if route == nil {
+		return
+	}
+	entry := conntrack.FromContext(ctx)
+	entry.SetTarget("socks5-udp", addr)
+	entry.SetRoute(route.ID, string(route.Group), route.ProxyID)
+
+	conn, err := a.packetConn(ctx, route)
+	if err != nil {
+		fmt.Printf("Dropping UDP datagram to %s from %s: %v\n", addr, a.client.ip, err)
+		return
+	}
+	if _, err := conn.WriteTo(payload, addr); err != nil {
+		fmt.Printf("Failed to send UDP datagram to %s: %v\n", addr, err)
+	}
+}
+
+// packetConn returns the packet connection of a route, opening it and
+// starting its replies on first use
+func (a *association) packetConn(ctx context.Context, route *router.Route) (router.PacketConn, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.conns == nil {
+		return nil, net.ErrClosed
+	}
+	if conn, ok := a.conns[route.ID]; ok {
+		return conn, nil
+	}
+
+	conn, err := a.dialerFactory.ListenPacket(ctx, route)
+	if err != nil {
+		return nil, err
+	}
+	a.conns[route.ID] = conn
+	go a.reply(conn)
+	return conn, nil
+}
+
+// reply sends datagrams arriving on conn back to the client
+func (a *association) reply(conn router.PacketConn) {
+	buf := make([]byte, maxDatagram)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		clientAddr := a.clientAddr.Load()
+		if clientAddr == nil {
+			continue
+		}
+
+		datagram, err := router.AppendSOCKS5Datagram(nil, from, buf[:n])
+		if err != nil {
+			continue
+		}
+		a.touch()
+		a.relay.WriteToUDP(datagram, clientAddr)
+	}
+}
+
+// touch records traffic on the association
+func (a *association) touch() {
+	a.lastActive.Store(time.Now().UnixNano())
+}
+
+// idle reports whether the association has had no traffic for the idle timeout
+func (a *association) idle() bool {
+	return time.Since(time.Unix(0, a.lastActive.Load())) >= a.idleTimeout
+}
+
+// close closes the packet connections of all routes
+func (a *association) close() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for _, conn := range a.conns {
+		conn.Close()
+	}
+	a.conns = nil
+}
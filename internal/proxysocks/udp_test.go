@@ -0,0 +1,154 @@
+package proxysocks
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"proxyrouter/internal/router"
+)
+
+// startUDPEchoServer echoes every datagram back to its sender
+func startUDPEchoServer(t *testing.T) int {
+	t.Helper()
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteToUDP(buf[:n], from)
+		}
+	}()
+
+	return conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+// socksAssociate sends a UDP ASSOCIATE without authentication and returns
+// the control connection and a UDP socket connected to the relay
+func socksAssociate(t *testing.T, proxyAddr string) (net.Conn, *net.UDPConn) {
+	t.Helper()
+
+	conn := dialSOCKS(t, proxyAddr)
+	_, err := conn.Write([]byte{5, 1, 0})
+	require.NoError(t, err)
+	greeting := make([]byte, 2)
+	_, err = io.ReadFull(conn, greeting)
+	require.NoError(t, err)
+	require.Equal(t, []byte{5, 0}, greeting)
+
+	_, err = conn.Write([]byte{5, 3, 0, 1, 0, 0, 0, 0, 0, 0})
+	require.NoError(t, err)
+	reply := make([]byte, 10)
+	_, err = io.ReadFull(conn, reply)
+	require.NoError(t, err)
+	require.Equal(t, byte(0), reply[1])
+
+	relayAddr := &net.UDPAddr{IP: net.IP(reply[4:8]), Port: int(reply[8])<<8 | int(reply[9])}
+	udp, err := net.DialUDP("udp", nil, relayAddr)
+	require.NoError(t, err)
+	t.Cleanup(func() { udp.Close() })
+	return conn, udp
+}
+
+// udpExchange sends payload to 127.0.0.1:port through the relay and returns
+// the reply, or false if none arrives
+func udpExchange(t *testing.T, udp *net.UDPConn, port int, payload string) (string, string, bool) {
+	t.Helper()
+
+	datagram, err := router.AppendSOCKS5Datagram(nil, net.JoinHostPort("127.0.0.1", strconv.Itoa(port)), []byte(payload))
+	require.NoError(t, err)
+	_, err = udp.Write(datagram)
+	require.NoError(t, err)
+
+	udp.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	buf := make([]byte, 2048)
+	n, err := udp.Read(buf)
+	if err != nil {
+		return "", "", false
+	}
+	addr, reply, err := router.ParseSOCKS5Datagram(buf[:n])
+	require.NoError(t, err)
+	return addr, string(reply), true
+}
+
+func TestSOCKS5UDPAssociateRoutesEachDatagram(t *testing.T) {
+	proxyAddr, database, routerEngine, _ := startTestServer(t, false)
+	_, err := database.GetDB().Exec("INSERT INTO acl_subnets (cidr) VALUES ('127.0.0.0/8')")
+	require.NoError(t, err)
+
+	echoPort := startUDPEchoServer(t)
+	otherPort := startUDPEchoServer(t)
+
+	// Only the echo port goes direct, Tor cannot carry UDP
+	require.NoError(t, routerEngine.CreateRoute(&router.Route{
+		Group:      router.RouteGroupLocal,
+		DstPorts:   stringPtr(strconv.Itoa(echoPort)),
+		Precedence: 10,
+		Enabled:    true,
+	}))
+	require.NoError(t, routerEngine.CreateRoute(&router.Route{Group: router.RouteGroupTor, Precedence: 100, Enabled: true}))
+
+	_, udp := socksAssociate(t, proxyAddr)
+
+	addr, reply, ok := udpExchange(t, udp, echoPort, "ping")
+	require.True(t, ok)
+	assert.Equal(t, net.JoinHostPort("127.0.0.1", strconv.Itoa(echoPort)), addr)
+	assert.Equal(t, "ping", reply)
+
+	_, _, ok = udpExchange(t, udp, otherPort, "ping")
+	assert.False(t, ok, "datagram routed to TOR should be dropped")
+}
+
+func TestSOCKS5UDPAssociateThroughUpstream(t *testing.T) {
+	upstreamAddr, upstreamDB, upstreamRouter, _ := startTestServer(t, false)
+	_, err := upstreamDB.GetDB().Exec("INSERT INTO acl_subnets (cidr) VALUES ('127.0.0.0/8')")
+	require.NoError(t, err)
+	require.NoError(t, upstreamRouter.CreateRoute(&router.Route{Group: router.RouteGroupLocal, Precedence: 100, Enabled: true}))
+
+	proxyAddr, database, routerEngine, _ := startTestServer(t, false)
+	_, err = database.GetDB().Exec("INSERT INTO acl_subnets (cidr) VALUES ('127.0.0.0/8')")
+	require.NoError(t, err)
+	host, port, err := net.SplitHostPort(upstreamAddr)
+	require.NoError(t, err)
+	_, err = database.GetDB().Exec("INSERT INTO proxies (id, proxy_type, ip, port) VALUES (1, 'socks5', ?, ?)", host, port)
+	require.NoError(t, err)
+	proxyID := 1
+	require.NoError(t, routerEngine.CreateRoute(&router.Route{Group: router.RouteGroupUpstream, ProxyID: &proxyID, Precedence: 100, Enabled: true}))
+
+	echoPort := startUDPEchoServer(t)
+	_, udp := socksAssociate(t, proxyAddr)
+
+	addr, reply, ok := udpExchange(t, udp, echoPort, "through upstream")
+	require.True(t, ok)
+	assert.Equal(t, net.JoinHostPort("127.0.0.1", strconv.Itoa(echoPort)), addr)
+	assert.Equal(t, "through upstream", reply)
+}
+
+func TestSOCKS5UDPAssociateIdleTimeout(t *testing.T) {
+	proxyAddr, database, routerEngine, _ := startTestServer(t, false)
+	_, err := database.GetDB().Exec("INSERT INTO acl_subnets (cidr) VALUES ('127.0.0.0/8')")
+	require.NoError(t, err)
+	require.NoError(t, routerEngine.CreateRoute(&router.Route{Group: router.RouteGroupLocal, Precedence: 100, Enabled: true}))
+
+	control, udp := socksAssociate(t, proxyAddr)
+	_, _, ok := udpExchange(t, udp, startUDPEchoServer(t), "ping")
+	require.True(t, ok)
+
+	// The test server closes associations after a second without traffic
+	start := time.Now()
+	_, err = control.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+	assert.Less(t, time.Since(start), 3*time.Second)
+}
@@ -13,10 +13,13 @@ import (
 // JobManager manages refresh jobs
 type JobManager struct {
 	refresher *Refresher
-	config    *config.Config
 	logger    *slog.Logger
 	stopChan  chan struct{}
 	wg        sync.WaitGroup
+
+	mu      sync.Mutex
+	config  *config.Config
+	changed chan struct{} // closed when the config is replaced
 }
 
 // NewJobManager creates a new job manager
@@ -26,27 +29,30 @@ func NewJobManager(refresher *Refresher, config *config.Config, logger *slog.Log
 		config:    config,
 		logger:    logger,
 		stopChan:  make(chan struct{}),
+		changed:   make(chan struct{}),
 	}
 }
 
-// Start starts the job manager
+// Start starts the job manager. The jobs wait while general sources are
+// disabled and start once a new config enables them.
 func (jm *JobManager) Start(ctx context.Context) error {
-	if !jm.config.Refresh.EnableGeneralSources {
+	cfg, _ := jm.current()
+	if !cfg.Refresh.EnableGeneralSources {
 		jm.logger.Info("Refresh jobs disabled - general sources not enabled")
-		return nil
+	} else {
+		jm.logger.Info("Starting refresh job manager",
+			"interval_sec", cfg.Refresh.IntervalSec,
+			"health_check_interval_sec", int(cfg.GetHealthCheckInterval().Seconds()),
+			"healthcheck_concurrency", cfg.Refresh.HealthcheckConcurrency)
 	}
 
-	jm.logger.Info("Starting refresh job manager", 
-		"interval_sec", jm.config.Refresh.IntervalSec,
-		"healthcheck_concurrency", jm.config.Refresh.HealthcheckConcurrency)
-
 	// Start ingest job
 	jm.wg.Add(1)
-	go jm.runIngestJob(ctx)
+	go jm.runJob(ctx, "ingest", (*config.Config).GetRefreshInterval, jm.ingestProxies)
 
 	// Start health check job
 	jm.wg.Add(1)
-	go jm.runHealthJob(ctx)
+	go jm.runJob(ctx, "health check", (*config.Config).GetHealthCheckInterval, jm.healthCheckProxies)
 
 	return nil
 }
@@ -58,42 +64,39 @@ func (jm *JobManager) Stop() {
 	jm.logger.Info("Refresh job manager stopped")
 }
 
-// runIngestJob runs the ingest job periodically
-func (jm *JobManager) runIngestJob(ctx context.Context) {
-	defer jm.wg.Done()
-
-	ticker := time.NewTicker(jm.config.GetRefreshInterval())
-	defer ticker.Stop()
-
-	// Run immediately on start
-	if err := jm.ingestProxies(ctx); err != nil {
-		jm.logger.Error("Initial ingest job failed", "error", err)
-	}
+// Reconfigure replaces the config the jobs run with. A new interval applies
+// from the next tick, and enabling general sources runs the jobs at once.
+func (jm *JobManager) Reconfigure(cfg *config.Config) {
+	jm.mu.Lock()
+	defer jm.mu.Unlock()
+	jm.config = cfg
+	close(jm.changed)
+	jm.changed = make(chan struct{})
+}
 
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case <-jm.stopChan:
-			return
-		case <-ticker.C:
-			if err := jm.ingestProxies(ctx); err != nil {
-				jm.logger.Error("Ingest job failed", "error", err)
-			}
-		}
-	}
+// current returns the config and a channel closed when it is replaced
+func (jm *JobManager) current() (*config.Config, <-chan struct{}) {
+	jm.mu.Lock()
+	defer jm.mu.Unlock()
+	return jm.config, jm.changed
 }
 
-// runHealthJob runs the health check job periodically
-func (jm *JobManager) runHealthJob(ctx context.Context) {
+// runJob runs job once every interval of the config while general sources are
+// enabled, and at once when it starts or they are enabled
+func (jm *JobManager) runJob(ctx context.Context, name string, interval func(*config.Config) time.Duration, job func(context.Context) error) {
 	defer jm.wg.Done()
 
-	ticker := time.NewTicker(jm.config.GetRefreshInterval())
+	cfg, changed := jm.current()
+	enabled := cfg.Refresh.EnableGeneralSources
+
+	ticker := time.NewTicker(interval(cfg))
 	defer ticker.Stop()
 
 	// Run immediately on start
-	if err := jm.healthCheckProxies(ctx); err != nil {
-		jm.logger.Error("Initial health check job failed", "error", err)
+	if enabled {
+		if err := job(ctx); err != nil {
+			jm.logger.Error("Initial job failed", "job", name, "error", err)
+		}
 	}
 
 	for {
@@ -102,9 +105,22 @@ func (jm *JobManager) runHealthJob(ctx context.Context) {
 			return
 		case <-jm.stopChan:
 			return
+		case <-changed:
+			cfg, changed = jm.current()
+			ticker.Reset(interval(cfg))
+			wasEnabled := enabled
+			enabled = cfg.Refresh.EnableGeneralSources
+			if enabled && !wasEnabled {
+				if err := job(ctx); err != nil {
+					jm.logger.Error("Job failed", "job", name, "error", err)
+				}
+			}
 		case <-ticker.C:
-			if err := jm.healthCheckProxies(ctx); err != nil {
-				jm.logger.Error("Health check job failed", "error", err)
+			if !enabled {
+				continue
+			}
+			if err := job(ctx); err != nil {
+				jm.logger.Error("Job failed", "job", name, "error", err)
 			}
 		}
 	}
@@ -0,0 +1,56 @@
+package refresh
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"proxyrouter/internal/config"
+)
+
+func TestJobManagerReconfigure(t *testing.T) {
+	var downloads atomic.Int32
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		downloads.Add(1)
+	}))
+	defer source.Close()
+
+	r, _ := newTestRefresher(t, nil)
+	refreshConfig := config.RefreshConfig{
+		EnableGeneralSources:   true,
+		IntervalSec:            3600,
+		HealthcheckConcurrency: 1,
+		Sources:                []config.SourceConfig{{Name: "test", URL: source.URL, Type: "raw"}},
+	}
+	r.Reconfigure(refreshConfig)
+
+	disabled := &config.Config{Refresh: refreshConfig}
+	disabled.Refresh.EnableGeneralSources = false
+	jm := NewJobManager(r, disabled, slog.Default())
+	if err := jm.Start(context.Background()); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer jm.Stop()
+
+	time.Sleep(100 * time.Millisecond)
+	if n := downloads.Load(); n != 0 {
+		t.Fatalf("disabled jobs downloaded %d times", n)
+	}
+
+	// Enabling the sources runs the jobs at once, then on the new interval
+	enabled := &config.Config{Refresh: refreshConfig}
+	enabled.Refresh.IntervalSec = 1
+	jm.Reconfigure(enabled)
+
+	deadline := time.Now().Add(3 * time.Second)
+	for downloads.Load() < 2 && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if n := downloads.Load(); n < 2 {
+		t.Errorf("downloads = %d after enabling with a 1s interval, want at least 2", n)
+	}
+}
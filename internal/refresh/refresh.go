@@ -13,39 +13,52 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"proxyrouter/internal/config"
+	"proxyrouter/internal/router"
+	"proxyrouter/internal/secrets"
 )
 
 // Refresher handles proxy refresh operations
 type Refresher struct {
-	db     *sql.DB
-	config *config.RefreshConfig
-	client *http.Client
+	db      *sql.DB
+	config  atomic.Pointer[config.RefreshConfig]
+	secrets *secrets.Box
+	client  *http.Client
 }
 
 // New creates a new refresher instance
-func New(db *sql.DB, refreshConfig *config.RefreshConfig) *Refresher {
-	return &Refresher{
-		db:     db,
-		config: refreshConfig,
+func New(db *sql.DB, refreshConfig *config.RefreshConfig, secretBox *secrets.Box) *Refresher {
+	r := &Refresher{
+		db:      db,
+		secrets: secretBox,
 		client: &http.Client{
 			Timeout: 30 * time.Second,
 		},
 	}
+	r.Reconfigure(*refreshConfig)
+	return r
+}
+
+// Reconfigure changes the sources and health check concurrency used by the
+// next refresh and health check
+func (r *Refresher) Reconfigure(refreshConfig config.RefreshConfig) {
+	r.config.Store(&refreshConfig)
 }
 
 // RefreshAll refreshes proxies from all configured sources
 func (r *Refresher) RefreshAll(ctx context.Context) error {
-	if !r.config.EnableGeneralSources {
+	refreshConfig := r.config.Load()
+	if !refreshConfig.EnableGeneralSources {
 		return nil
 	}
 
 	var wg sync.WaitGroup
-	errChan := make(chan error, len(r.config.Sources))
+	errChan := make(chan error, len(refreshConfig.Sources))
 
-	for _, source := range r.config.Sources {
+	for _, source := range refreshConfig.Sources {
 		wg.Add(1)
 		go func(s config.SourceConfig) {
 			defer wg.Done()
@@ -191,6 +204,15 @@ func (r *Refresher) parseRawSource(content, sourceName string) ([]Proxy, error)
 	return proxies, nil
 }
 
+// credentialsPattern matches an optional "user:pass@" prefix, capturing the
+// username and password
+const credentialsPattern = `(?:([^:@/\s]+):([^@/\s]*)@)?`
+
+// userIDPattern matches an optional "user@" prefix, capturing the user ID a
+// SOCKS4 proxy takes instead of a login. A stray ":" before the "@" is
+// allowed.
+const userIDPattern = `(?:([^:@/\s]+):?@)?`
+
 // ParseProxyLine parses a single proxy line (exported for API handlers)
 func (r *Refresher) ParseProxyLine(line, sourceName string) (Proxy, error) {
 	return r.parseProxyLine(line, sourceName)
@@ -198,25 +220,28 @@ func (r *Refresher) ParseProxyLine(line, sourceName string) (Proxy, error) {
 
 // parseProxyLine parses a single proxy line
 func (r *Refresher) parseProxyLine(line, sourceName string) (Proxy, error) {
-	// Try different patterns
+	// Try different patterns, each with optional credentials
 	patterns := []*regexp.Regexp{
-		// socks5://ip:port
-		regexp.MustCompile(`socks5://(\d{1,3}\.\d{1,3}\.\d{1,3}\.\d{1,3}):(\d{2,5})`),
-		// http://ip:port
-		regexp.MustCompile(`http://(\d{1,3}\.\d{1,3}\.\d{1,3}\.\d{1,3}):(\d{2,5})`),
-		// https://ip:port
-		regexp.MustCompile(`https://(\d{1,3}\.\d{1,3}\.\d{1,3}\.\d{1,3}):(\d{2,5})`),
-		// ip:port (default to socks5)
-		regexp.MustCompile(`^(\d{1,3}\.\d{1,3}\.\d{1,3}\.\d{1,3}):(\d{2,5})$`),
+		// socks5://[user:pass@]ip:port
+		regexp.MustCompile(`socks5://` + credentialsPattern + `(\d{1,3}\.\d{1,3}\.\d{1,3}\.\d{1,3}):(\d{2,5})`),
+		// socks4://[user@]ip:port or socks4a://[user@]ip:port
+		regexp.MustCompile(`socks4a?://` + userIDPattern + `(\d{1,3}\.\d{1,3}\.\d{1,3}\.\d{1,3}):(\d{2,5})`),
+		// http://[user:pass@]ip:port
+		regexp.MustCompile(`http://` + credentialsPattern + `(\d{1,3}\.\d{1,3}\.\d{1,3}\.\d{1,3}):(\d{2,5})`),
+		// https://[user:pass@]ip:port
+		regexp.MustCompile(`https://` + credentialsPattern + `(\d{1,3}\.\d{1,3}\.\d{1,3}\.\d{1,3}):(\d{2,5})`),
+		// [user:pass@]ip:port (default to socks5)
+		regexp.MustCompile(`^` + credentialsPattern + `(\d{1,3}\.\d{1,3}\.\d{1,3}\.\d{1,3}):(\d{2,5})$`),
 	}
 
-	schemes := []string{"socks5", "http", "https", "socks5"}
+	schemes := []string{"socks5", "socks4", "http", "https", "socks5"}
 
 	for i, pattern := range patterns {
 		match := pattern.FindStringSubmatch(line)
-		if len(match) == 3 {
-			ip := match[1]
-			portStr := match[2]
+		if match != nil {
+			// The address follows the credentials, which SOCKS4 has no password in
+			ip := match[len(match)-2]
+			portStr := match[len(match)-1]
 			port, err := strconv.Atoi(portStr)
 			if err != nil {
 				continue
@@ -226,14 +251,33 @@ func (r *Refresher) parseProxyLine(line, sourceName string) (Proxy, error) {
 				continue
 			}
 
-			proxyURL := fmt.Sprintf("%s://%s:%d", schemes[i], ip, port)
-			return Proxy{
+			proxy := Proxy{
 				ProxyType: schemes[i],
 				IP:        ip,
 				Port:      port,
 				Source:    sourceName,
-				ProxyURL:  &proxyURL,
-			}, nil
+			}
+
+			// Credentials may be percent-encoded like any URL userinfo
+			if match[1] != "" {
+				username, err := url.PathUnescape(match[1])
+				if err != nil {
+					continue
+				}
+				proxy.Username = &username
+			}
+			if match[1] != "" && len(match) == 5 {
+				password, err := url.PathUnescape(match[2])
+				if err != nil {
+					continue
+				}
+				proxy.Password = &password
+			}
+
+			// The stored URL never carries the password
+			proxyURL := proxy.redactedURL()
+			proxy.ProxyURL = &proxyURL
+			return proxy, nil
 		}
 	}
 
@@ -258,10 +302,15 @@ func (r *Refresher) importProxies(ctx context.Context, proxies []Proxy) error {
 	}
 	defer tx.Rollback()
 
-	// Prepare insert statement
+	// Prepare insert statement; re-importing a known proxy only refreshes its credentials
 	stmt, err := tx.PrepareContext(ctx, `
-		INSERT OR IGNORE INTO proxies (proxy_type, ip, port, source, working, created_at, proxy_url)
-		VALUES (?, ?, ?, ?, 0, CURRENT_TIMESTAMP, ?)
+		INSERT INTO proxies (proxy_type, ip, port, source, working, created_at, proxy_url, username, password_enc)
+		VALUES (?, ?, ?, ?, 0, CURRENT_TIMESTAMP, ?, ?, ?)
+		ON CONFLICT(ip, port) DO UPDATE SET
+			username = excluded.username,
+			password_enc = excluded.password_enc,
+			proxy_url = excluded.proxy_url
+		WHERE excluded.username IS NOT NULL
 	`)
 	if err != nil {
 		return fmt.Errorf("failed to prepare statement: %w", err)
@@ -270,7 +319,12 @@ func (r *Refresher) importProxies(ctx context.Context, proxies []Proxy) error {
 
 	// Insert proxies
 	for _, proxy := range proxies {
-		_, err := stmt.ExecContext(ctx, proxy.ProxyType, proxy.IP, proxy.Port, proxy.Source, proxy.ProxyURL)
+		passwordEnc, err := r.sealPassword(proxy.Password)
+		if err != nil {
+			return fmt.Errorf("failed to encrypt credentials for proxy %s:%d: %w", proxy.IP, proxy.Port, err)
+		}
+
+		_, err = stmt.ExecContext(ctx, proxy.ProxyType, proxy.IP, proxy.Port, proxy.Source, proxy.ProxyURL, proxy.Username, passwordEnc)
 		if err != nil {
 			return fmt.Errorf("failed to insert proxy %s:%d: %w", proxy.IP, proxy.Port, err)
 		}
@@ -288,7 +342,7 @@ func (r *Refresher) importProxies(ctx context.Context, proxies []Proxy) error {
 func (r *Refresher) HealthCheck(ctx context.Context) error {
 	// Get proxies that need health checking
 	query := `
-		SELECT id, proxy_type, ip, port
+		SELECT id, proxy_type, ip, port, username, password_enc
 		FROM proxies
 		WHERE working = 0
 		   OR tested_timestamp IS NULL
@@ -296,7 +350,8 @@ func (r *Refresher) HealthCheck(ctx context.Context) error {
 		LIMIT ?
 	`
 
-	rows, err := r.db.QueryContext(ctx, query, r.config.HealthcheckConcurrency)
+	concurrency := r.config.Load().HealthcheckConcurrency
+	rows, err := r.db.QueryContext(ctx, query, concurrency)
 	if err != nil {
 		return fmt.Errorf("failed to query proxies for health check: %w", err)
 	}
@@ -305,10 +360,15 @@ func (r *Refresher) HealthCheck(ctx context.Context) error {
 	var proxies []Proxy
 	for rows.Next() {
 		var proxy Proxy
-		err := rows.Scan(&proxy.ID, &proxy.ProxyType, &proxy.IP, &proxy.Port)
+		var passwordEnc sql.NullString
+		err := rows.Scan(&proxy.ID, &proxy.ProxyType, &proxy.IP, &proxy.Port, &proxy.Username, &passwordEnc)
 		if err != nil {
 			continue
 		}
+		if err := r.openPassword(&proxy, passwordEnc); err != nil {
+			slog.Error("Failed to decrypt proxy credentials", "proxy_id", proxy.ID, "error", err)
+			continue
+		}
 		proxies = append(proxies, proxy)
 	}
 
@@ -317,11 +377,11 @@ func (r *Refresher) HealthCheck(ctx context.Context) error {
 		return nil
 	}
 
-	fmt.Printf("Starting health check for %d proxies with %d concurrent workers...\n", len(proxies), r.config.HealthcheckConcurrency)
+	fmt.Printf("Starting health check for %d proxies with %d concurrent workers...\n", len(proxies), concurrency)
 
 	// Perform health checks concurrently
 	var wg sync.WaitGroup
-	semaphore := make(chan struct{}, r.config.HealthcheckConcurrency)
+	semaphore := make(chan struct{}, concurrency)
 	results := make(chan HealthCheckResult, len(proxies))
 
 	// Start a goroutine to print progress like tqdm
@@ -367,6 +427,24 @@ func (r *Refresher) HealthCheck(ctx context.Context) error {
 	return r.updateHealthCheckResults(ctx, results)
 }
 
+// LoadProxy loads a single proxy with its decrypted credentials (exported for API handlers)
+func (r *Refresher) LoadProxy(ctx context.Context, id int) (Proxy, error) {
+	query := `SELECT id, proxy_type, ip, port, username, password_enc FROM proxies WHERE id = ?`
+
+	var proxy Proxy
+	var passwordEnc sql.NullString
+	err := r.db.QueryRowContext(ctx, query, id).Scan(&proxy.ID, &proxy.ProxyType, &proxy.IP, &proxy.Port, &proxy.Username, &passwordEnc)
+	if err != nil {
+		return Proxy{}, err
+	}
+
+	if err := r.openPassword(&proxy, passwordEnc); err != nil {
+		return Proxy{}, fmt.Errorf("failed to decrypt proxy credentials: %w", err)
+	}
+
+	return proxy, nil
+}
+
 // CheckProxyHealth checks the health of a single proxy (exported for API handlers)
 func (r *Refresher) CheckProxyHealth(ctx context.Context, proxy Proxy) HealthCheckResult {
 	return r.checkProxyHealth(ctx, proxy)
@@ -412,18 +490,35 @@ func (r *Refresher) testProxyWithProtocol(ctx context.Context, proxy Proxy, prot
 	// Use our test server to avoid getting banned by external providers
 	testURL := "http://ip.knws.co.uk"
 
+	proxyAddr := fmt.Sprintf("%s:%d", proxy.IP, proxy.Port)
+
 	// Create HTTP client with proxy
-	client := &http.Client{
-		Timeout: 10 * time.Second, // 10 second timeout for faster health checks
-		Transport: &http.Transport{
-			Proxy: func(req *http.Request) (*url.URL, error) {
-				proxyURL := fmt.Sprintf("%s://%s:%d", protocol, proxy.IP, proxy.Port)
-				return url.Parse(proxyURL)
-			},
+	transport := &http.Transport{
+		Proxy: func(req *http.Request) (*url.URL, error) {
+			proxyURL, err := url.Parse(fmt.Sprintf("%s://%s:%d", protocol, proxy.IP, proxy.Port))
+			if err != nil {
+				return nil, err
+			}
+			if proxy.Username != nil {
+				proxyURL.User = url.UserPassword(*proxy.Username, proxy.password())
+			}
+			return proxyURL, nil
 		},
 	}
+	if protocol == "socks4" {
+		// net/http has no SOCKS4 support, so dial through the router's dialer
+		var userID string
+		if proxy.Username != nil {
+			userID = *proxy.Username
+		}
+		transport.Proxy = nil
+		transport.DialContext = router.NewSOCKS4Dialer(proxyAddr, userID, 10*time.Second).DialContext
+	}
+	client := &http.Client{
+		Timeout:   10 * time.Second, // 10 second timeout for faster health checks
+		Transport: transport,
+	}
 
-	proxyAddr := fmt.Sprintf("%s:%d", proxy.IP, proxy.Port)
 	fmt.Printf("Testing %s -> %s...\n", proxyAddr, testURL)
 
 	// Make test request with browser-like headers
@@ -552,6 +647,40 @@ func (r *Refresher) updateHealthCheckResults(ctx context.Context, results <-chan
 	return nil
 }
 
+// sealPassword encrypts a proxy password for storage, returning nil when
+// there is no password
+func (r *Refresher) sealPassword(password *string) (*string, error) {
+	if password == nil {
+		return nil, nil
+	}
+	if r.secrets == nil {
+		return nil, fmt.Errorf("no credential key configured")
+	}
+
+	sealed, err := r.secrets.Seal(*password)
+	if err != nil {
+		return nil, err
+	}
+	return &sealed, nil
+}
+
+// openPassword decrypts a stored proxy password into proxy.Password
+func (r *Refresher) openPassword(proxy *Proxy, passwordEnc sql.NullString) error {
+	if !passwordEnc.Valid {
+		return nil
+	}
+	if r.secrets == nil {
+		return fmt.Errorf("no credential key configured")
+	}
+
+	password, err := r.secrets.Open(passwordEnc.String)
+	if err != nil {
+		return err
+	}
+	proxy.Password = &password
+	return nil
+}
+
 // isValidIP validates an IP address
 func (r *Refresher) isValidIP(ip string) bool {
 	parts := strings.Split(ip, ".")
@@ -582,6 +711,24 @@ type Proxy struct {
 	Port      int     `json:"port"`
 	Source    string  `json:"source"`
 	ProxyURL  *string `json:"proxy_url,omitempty"`
+	Username  *string `json:"username,omitempty"`
+	Password  *string `json:"-"` // plain text, only held in memory
+}
+
+// password returns the plain text password or an empty string
+func (p Proxy) password() string {
+	if p.Password == nil {
+		return ""
+	}
+	return *p.Password
+}
+
+// redactedURL returns the proxy URL with the username but without the password
+func (p Proxy) redactedURL() string {
+	if p.Username != nil {
+		return fmt.Sprintf("%s://%s@%s:%d", p.ProxyType, url.User(*p.Username).String(), p.IP, p.Port)
+	}
+	return fmt.Sprintf("%s://%s:%d", p.ProxyType, p.IP, p.Port)
 }
 
 // HealthCheckResult represents the result of a health check
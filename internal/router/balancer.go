@@ -0,0 +1,194 @@
+package router
+
+import (
+	"hash/fnv"
+	"math/rand/v2"
+	"sort"
+	"strconv"
+	"sync/atomic"
+)
+
+// Strategy selects how GENERAL routes spread connections over the pool
+type Strategy string
+
+const (
+	StrategyLatency         Strategy = "latency"          // lowest latency first (default)
+	StrategyRoundRobin      Strategy = "round_robin"      // rotate through the pool
+	StrategyWeightedLatency Strategy = "weighted_latency" // random, weighted by inverse latency
+	StrategyLeastConn       Strategy = "least_conn"       // fewest active connections
+	StrategyPowerOfTwo      Strategy = "p2c"              // better of two random picks
+	StrategyHashClientIP    Strategy = "hash_client_ip"   // consistent hashing on the client IP
+	StrategyHashTargetHost  Strategy = "hash_target_host" // consistent hashing on the target host
+)
+
+// defaultLatencyMs is assumed for proxies that have not been measured yet
+const defaultLatencyMs = 1000
+
+// ValidStrategy reports whether name is a known strategy; empty selects the default
+func ValidStrategy(name Strategy) bool {
+	if name == "" {
+		return true
+	}
+	_, ok := newBalancers()[name]
+	return ok
+}
+
+// selection describes the request a balancer picks proxies for
+type selection struct {
+	clientIP   string
+	targetHost string
+	sessionID  string
+}
+
+// balancer orders pool proxies for a request
+type balancer interface {
+	// order returns up to n proxies in the order they should be tried
+	order(pool *proxyPool, proxies []*Proxy, req selection, n int) []*Proxy
+}
+
+// newBalancers creates one balancer per strategy
+func newBalancers() map[Strategy]balancer {
+	return map[Strategy]balancer{
+		StrategyLatency:         latencyBalancer{},
+		StrategyRoundRobin:      &roundRobinBalancer{},
+		StrategyWeightedLatency: weightedLatencyBalancer{},
+		StrategyLeastConn:       leastConnBalancer{},
+		StrategyPowerOfTwo:      powerOfTwoBalancer{},
+		StrategyHashClientIP:    hashBalancer{key: func(req selection) string { return req.clientIP }},
+		StrategyHashTargetHost:  hashBalancer{key: func(req selection) string { return req.targetHost }},
+	}
+}
+
+// latencyBalancer keeps the pool's latency order
+type latencyBalancer struct{}
+
+func (latencyBalancer) order(pool *proxyPool, proxies []*Proxy, req selection, n int) []*Proxy {
+	return proxies[:min(n, len(proxies))]
+}
+
+// roundRobinBalancer starts each request one proxy further along the pool
+type roundRobinBalancer struct {
+	next atomic.Uint64
+}
+
+func (b *roundRobinBalancer) order(pool *proxyPool, proxies []*Proxy, req selection, n int) []*Proxy {
+	if len(proxies) == 0 {
+		return nil
+	}
+
+	start := int((b.next.Add(1) - 1) % uint64(len(proxies)))
+	ordered := make([]*Proxy, 0, min(n, len(proxies)))
+	for i := 0; i < cap(ordered); i++ {
+		ordered = append(ordered, proxies[(start+i)%len(proxies)])
+	}
+	return ordered
+}
+
+// weightedLatencyBalancer draws proxies at random without replacement, with
+// a probability proportional to the inverse of their latency
+type weightedLatencyBalancer struct{}
+
+func (weightedLatencyBalancer) order(pool *proxyPool, proxies []*Proxy, req selection, n int) []*Proxy {
+	remaining := append([]*Proxy(nil), proxies...)
+	weights := make([]float64, len(remaining))
+	total := 0.0
+	for i, p := range remaining {
+		weights[i] = 1 / float64(max(latencyOf(p), 1))
+		total += weights[i]
+	}
+
+	ordered := make([]*Proxy, 0, min(n, len(proxies)))
+	for len(ordered) < cap(ordered) {
+		pick := rand.Float64() * total
+		i := 0
+		for ; i < len(remaining)-1; i++ {
+			pick -= weights[i]
+			if pick < 0 {
+				break
+			}
+		}
+
+		ordered = append(ordered, remaining[i])
+		total -= weights[i]
+		remaining = append(remaining[:i], remaining[i+1:]...)
+		weights = append(weights[:i], weights[i+1:]...)
+	}
+	return ordered
+}
+
+// leastConnBalancer prefers proxies with the fewest active connections,
+// breaking ties by latency
+type leastConnBalancer struct{}
+
+func (leastConnBalancer) order(pool *proxyPool, proxies []*Proxy, req selection, n int) []*Proxy {
+	ordered := append([]*Proxy(nil), proxies...)
+	// The pool is already in latency order, so a stable sort keeps ties fast
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return pool.activeConns(ordered[i].ID) < pool.activeConns(ordered[j].ID)
+	})
+	return ordered[:min(n, len(ordered))]
+}
+
+// powerOfTwoBalancer repeatedly picks two random proxies and keeps the one
+// with fewer active connections
+type powerOfTwoBalancer struct{}
+
+func (powerOfTwoBalancer) order(pool *proxyPool, proxies []*Proxy, req selection, n int) []*Proxy {
+	remaining := append([]*Proxy(nil), proxies...)
+	ordered := make([]*Proxy, 0, min(n, len(proxies)))
+
+	for len(ordered) < cap(ordered) {
+		i := rand.IntN(len(remaining))
+		if len(remaining) > 1 {
+			j := rand.IntN(len(remaining) - 1)
+			if j >= i {
+				j++
+			}
+			if pool.activeConns(remaining[j].ID) < pool.activeConns(remaining[i].ID) {
+				i = j
+			}
+		}
+
+		ordered = append(ordered, remaining[i])
+		remaining = append(remaining[:i], remaining[i+1:]...)
+	}
+	return ordered
+}
+
+// hashBalancer maps a request key to the same proxies every time using
+// rendezvous hashing, so only keys on a removed proxy move elsewhere
+type hashBalancer struct {
+	key func(req selection) string
+}
+
+func (b hashBalancer) order(pool *proxyPool, proxies []*Proxy, req selection, n int) []*Proxy {
+	key := b.key(req)
+
+	type scored struct {
+		proxy *Proxy
+		score uint64
+	}
+	scores := make([]scored, len(proxies))
+	for i, p := range proxies {
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		h.Write([]byte{0})
+		h.Write([]byte(strconv.Itoa(p.ID)))
+		scores[i] = scored{proxy: p, score: h.Sum64()}
+	}
+	sort.Slice(scores, func(i, j int) bool { return scores[i].score > scores[j].score })
+
+	ordered := make([]*Proxy, 0, min(n, len(proxies)))
+	for i := 0; i < cap(ordered); i++ {
+		ordered = append(ordered, scores[i].proxy)
+	}
+	return ordered
+}
+
+// latencyOf returns the measured latency of a proxy or a pessimistic default
+func latencyOf(p *Proxy) int {
+	if p.Latency == nil {
+		return defaultLatencyMs
+	}
+	return *p.Latency
+}
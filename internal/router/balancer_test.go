@@ -0,0 +1,172 @@
+package router
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testPool returns n proxies with IDs from 1 and latencies of 10ms * ID
+func testPool(n int) []*Proxy {
+	proxies := make([]*Proxy, n)
+	for i := range proxies {
+		proxies[i] = &Proxy{ID: i + 1, Latency: intPtr((i + 1) * 10), Working: true}
+	}
+	return proxies
+}
+
+func proxyIDs(proxies []*Proxy) []int {
+	ids := make([]int, len(proxies))
+	for i, p := range proxies {
+		ids[i] = p.ID
+	}
+	return ids
+}
+
+func TestBalancersReturnDistinctProxies(t *testing.T) {
+	pool := newProxyPool(nil)
+	proxies := testPool(5)
+
+	for strategy, b := range newBalancers() {
+		t.Run(string(strategy), func(t *testing.T) {
+			ordered := b.order(pool, proxies, selection{clientIP: "192.168.10.5", targetHost: "example.com"}, 3)
+			require.Len(t, ordered, 3)
+			assert.Len(t, map[int]bool{ordered[0].ID: true, ordered[1].ID: true, ordered[2].ID: true}, 3)
+
+			assert.Len(t, b.order(pool, proxies, selection{}, 10), 5)
+			assert.Empty(t, b.order(pool, nil, selection{}, 3))
+		})
+	}
+}
+
+func TestRoundRobinBalancer(t *testing.T) {
+	b := &roundRobinBalancer{}
+	proxies := testPool(3)
+
+	assert.Equal(t, []int{1, 2}, proxyIDs(b.order(nil, proxies, selection{}, 2)))
+	assert.Equal(t, []int{2, 3}, proxyIDs(b.order(nil, proxies, selection{}, 2)))
+	assert.Equal(t, []int{3, 1}, proxyIDs(b.order(nil, proxies, selection{}, 2)))
+	assert.Equal(t, []int{1, 2}, proxyIDs(b.order(nil, proxies, selection{}, 2)))
+}
+
+func TestWeightedLatencyBalancer(t *testing.T) {
+	proxies := []*Proxy{
+		{ID: 1, Latency: intPtr(10)},
+		{ID: 2, Latency: intPtr(1000)},
+	}
+
+	firsts := map[int]int{}
+	for i := 0; i < 1000; i++ {
+		firsts[weightedLatencyBalancer{}.order(nil, proxies, selection{}, 1)[0].ID]++
+	}
+
+	// The fast proxy is a hundred times more likely to be picked first
+	assert.Greater(t, firsts[1], 900)
+	assert.Greater(t, firsts[2], 0)
+}
+
+func TestLeastConnBalancer(t *testing.T) {
+	pool := newProxyPool(nil)
+	proxies := testPool(3)
+
+	client, server := net.Pipe()
+	defer server.Close()
+	conn := pool.track(1, client)
+	pool.track(2, client)
+	pool.track(2, client)
+
+	assert.Equal(t, []int{3, 1, 2}, proxyIDs(leastConnBalancer{}.order(pool, proxies, selection{}, 3)))
+
+	conn.Close()
+	conn.Close()
+	assert.Equal(t, int64(0), pool.activeConns(1))
+	assert.Equal(t, []int{1, 3, 2}, proxyIDs(leastConnBalancer{}.order(pool, proxies, selection{}, 3)))
+}
+
+func TestPowerOfTwoBalancer(t *testing.T) {
+	pool := newProxyPool(nil)
+	proxies := testPool(2)
+
+	client, server := net.Pipe()
+	defer server.Close()
+	pool.track(1, client)
+
+	// With two proxies both are always compared, so the idle one wins
+	for i := 0; i < 20; i++ {
+		assert.Equal(t, 2, powerOfTwoBalancer{}.order(pool, proxies, selection{}, 1)[0].ID)
+	}
+}
+
+func TestHashBalancerIsConsistent(t *testing.T) {
+	b := newBalancers()[StrategyHashClientIP]
+	proxies := testPool(5)
+
+	picks := map[string]int{}
+	for i := 0; i < 100; i++ {
+		clientIP := fmt.Sprintf("192.168.10.%d", i)
+		picks[clientIP] = b.order(nil, proxies, selection{clientIP: clientIP}, 1)[0].ID
+		assert.Equal(t, picks[clientIP], b.order(nil, proxies, selection{clientIP: clientIP}, 1)[0].ID)
+	}
+
+	// Removing a proxy only moves the clients that were using it
+	remaining := append(append([]*Proxy(nil), proxies[:2]...), proxies[3:]...)
+	moved := 0
+	for clientIP, id := range picks {
+		newID := b.order(nil, remaining, selection{clientIP: clientIP}, 1)[0].ID
+		if id != 3 {
+			assert.Equal(t, id, newID, clientIP)
+		} else {
+			moved++
+		}
+	}
+	assert.Greater(t, moved, 0)
+
+	// The target host strategy keys on the host instead
+	byHost := newBalancers()[StrategyHashTargetHost]
+	first := byHost.order(nil, proxies, selection{clientIP: "10.0.0.1", targetHost: "example.com"}, 1)[0].ID
+	assert.Equal(t, first, byHost.order(nil, proxies, selection{clientIP: "10.0.0.2", targetHost: "example.com"}, 1)[0].ID)
+}
+
+func TestValidStrategy(t *testing.T) {
+	assert.True(t, ValidStrategy(""))
+	assert.True(t, ValidStrategy(StrategyLeastConn))
+	assert.False(t, ValidStrategy("random"))
+}
+
+func TestGeneralDialerUsesRouteStrategy(t *testing.T) {
+	db := newTestProxyDB(t)
+	insertTestProxy(t, db, 1, "socks5", "127.0.0.1:1001", 10)
+	insertTestProxy(t, db, 2, "socks5", "127.0.0.1:1002", 20)
+	insertTestProxy(t, db, 3, "socks5", "127.0.0.1:1003", 30)
+
+	factory := NewDialerFactory(db, "127.0.0.1:9050", time.Second, nil, FailoverPolicy{Candidates: 2})
+	route := &Route{Group: RouteGroupGeneral, Strategy: StrategyRoundRobin}
+
+	var firsts []int
+	for i := 0; i < 3; i++ {
+		dialer, err := factory.CreateDialer(context.Background(), route, "", "")
+		require.NoError(t, err)
+		firsts = append(firsts, dialer.(*FailoverDialer).candidates[0].proxyID)
+	}
+	assert.Equal(t, []int{1, 2, 3}, firsts)
+
+	// The pool is served from the snapshot until it is invalidated
+	_, err := db.Exec("DELETE FROM proxies WHERE id = 1")
+	require.NoError(t, err)
+	dialer, err := factory.CreateDialer(context.Background(), &Route{Group: RouteGroupGeneral}, "", "")
+	require.NoError(t, err)
+	assert.Equal(t, 1, dialer.(*FailoverDialer).candidates[0].proxyID)
+
+	factory.pool.invalidate()
+	dialer, err = factory.CreateDialer(context.Background(), &Route{Group: RouteGroupGeneral}, "", "")
+	require.NoError(t, err)
+	assert.Equal(t, 2, dialer.(*FailoverDialer).candidates[0].proxyID)
+
+	_, err = factory.CreateDialer(context.Background(), &Route{Group: RouteGroupGeneral, Strategy: "random"}, "", "")
+	assert.ErrorContains(t, err, "unknown load-balancing strategy")
+}
@@ -0,0 +1,124 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+// HopError attributes a chain failure to the hop that caused it
+type HopError struct {
+	Position int
+	Group    RouteGroup
+	Proxy    string
+	Err      error
+}
+
+// Error implements the error interface
+func (e *HopError) Error() string {
+	if e.Proxy == "" {
+		return fmt.Sprintf("chain hop %d (%s): %v", e.Position, e.Group, e.Err)
+	}
+	return fmt.Sprintf("chain hop %d (%s %s): %v", e.Position, e.Group, e.Proxy, e.Err)
+}
+
+// Unwrap returns the underlying error
+func (e *HopError) Unwrap() error {
+	return e.Err
+}
+
+// hopDialer wraps the dialer of one chain hop so its failures are attributed
+// to that hop
+type hopDialer struct {
+	hop    Hop
+	proxy  string
+	dialer Dialer
+}
+
+// DialContext implements Dialer
+func (h *hopDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := h.dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		// An earlier hop already failed, report that hop rather than this one
+		var hopErr *HopError
+		if errors.As(err, &hopErr) {
+			return nil, hopErr
+		}
+		return nil, &HopError{Position: h.hop.Position, Group: h.hop.Group, Proxy: h.proxy, Err: err}
+	}
+	return conn, nil
+}
+
+// createChainDialer creates a dialer that tunnels each hop through the
+// previous one, so the last hop connects to the target
+func (f *DialerFactory) createChainDialer(ctx context.Context, hops []Hop) (Dialer, error) {
+	if len(hops) == 0 {
+		return nil, fmt.Errorf("CHAIN route has no hops")
+	}
+
+	var forward Dialer
+	for _, hop := range hops {
+		timeout := f.current().dialTimeout
+		if hop.TimeoutMS != nil {
+			timeout = time.Duration(*hop.TimeoutMS) * time.Millisecond
+		}
+
+		dialer, proxy, err := f.createHopDialer(ctx, hop, forward, timeout)
+		if err != nil {
+			return nil, &HopError{Position: hop.Position, Group: hop.Group, Proxy: proxy, Err: err}
+		}
+
+		forward = &hopDialer{hop: hop, proxy: proxy, dialer: dialer}
+	}
+
+	return forward, nil
+}
+
+// createHopDialer creates the dialer for one chain hop and returns the
+// address of the proxy it connects to
+func (f *DialerFactory) createHopDialer(ctx context.Context, hop Hop, forward Dialer, timeout time.Duration) (Dialer, string, error) {
+	switch hop.Group {
+	case RouteGroupTor:
+		torAddress := f.current().torAddress
+		return &SOCKS5Dialer{
+			proxyHost:  torAddress,
+			timeout:    timeout,
+			domainOnly: true,
+			forward:    forward,
+		}, torAddress, nil
+	case RouteGroupGeneral:
+		proxy, err := f.getBestGeneralProxy(ctx)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to get general proxy: %w", err)
+		}
+		// Unlike a GENERAL route, a chain must not silently fall back to direct
+		if proxy == nil {
+			return nil, "", fmt.Errorf("no working proxy in the general pool")
+		}
+		return f.createChainedProxyDialer(proxy, forward, timeout)
+	case RouteGroupUpstream:
+		if hop.ProxyID == nil {
+			return nil, "", fmt.Errorf("proxy_id is required for UPSTREAM hop")
+		}
+		proxy, err := f.getProxyByID(ctx, *hop.ProxyID)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to get upstream proxy: %w", err)
+		}
+		if proxy == nil {
+			return nil, "", fmt.Errorf("proxy with id %d not found", *hop.ProxyID)
+		}
+		return f.createChainedProxyDialer(proxy, forward, timeout)
+	default:
+		return nil, "", fmt.Errorf("unsupported hop group: %s", hop.Group)
+	}
+}
+
+// createChainedProxyDialer creates a proxy dialer and returns its address
+func (f *DialerFactory) createChainedProxyDialer(proxy *Proxy, forward Dialer, timeout time.Duration) (Dialer, string, error) {
+	addr := net.JoinHostPort(proxy.IP, strconv.Itoa(proxy.Port))
+	dialer, err := f.createProxyDialerVia(proxy, forward, timeout)
+	return dialer, addr, err
+}
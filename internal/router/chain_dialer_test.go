@@ -0,0 +1,276 @@
+package router
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/armon/go-socks5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	_ "modernc.org/sqlite"
+)
+
+// startForwardingHTTPProxy starts an upstream HTTP proxy that really connects
+// to the CONNECT target and reports each target it is asked for
+func startForwardingHTTPProxy(t *testing.T, connects chan<- string) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func(conn net.Conn) {
+				defer conn.Close()
+
+				reader := bufio.NewReader(conn)
+				req, err := http.ReadRequest(reader)
+				if err != nil {
+					return
+				}
+				connects <- req.Host
+
+				target, err := net.Dial("tcp", req.Host)
+				if err != nil {
+					fmt.Fprintf(conn, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+					return
+				}
+				defer target.Close()
+
+				fmt.Fprintf(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+				go io.Copy(target, reader)
+				io.Copy(conn, target)
+			}(conn)
+		}
+	}()
+
+	return listener
+}
+
+// startForwardingSOCKS5Server starts a SOCKS5 server that dials real targets
+func startForwardingSOCKS5Server(t *testing.T) net.Listener {
+	server, err := socks5.New(&socks5.Config{
+		Logger: log.New(io.Discard, "", 0),
+	})
+	require.NoError(t, err)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	go server.Serve(listener)
+
+	return listener
+}
+
+// newTestProxyDB creates an in-memory database with a proxies table
+func newTestProxyDB(t *testing.T) *sql.DB {
+	db, err := sql.Open("sqlite", ":memory:")
+	require.NoError(t, err)
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+
+	_, err = db.Exec(`
+		CREATE TABLE proxies (
+			id INTEGER PRIMARY KEY,
+			proxy_type TEXT NOT NULL,
+			ip TEXT NOT NULL,
+			port INTEGER NOT NULL,
+			latency INTEGER,
+			working INTEGER NOT NULL DEFAULT 1,
+			tested_timestamp DATETIME,
+			expires_at DATETIME,
+			username TEXT,
+			password_enc TEXT
+		)
+	`)
+	require.NoError(t, err)
+
+	return db
+}
+
+// insertTestProxy adds a working proxy with the given latency
+func insertTestProxy(t *testing.T, db *sql.DB, id int, proxyType, addr string, latency int) {
+	host, portStr, err := net.SplitHostPort(addr)
+	require.NoError(t, err)
+	port, err := strconv.Atoi(portStr)
+	require.NoError(t, err)
+
+	_, err = db.Exec("INSERT INTO proxies (id, proxy_type, ip, port, latency) VALUES (?, ?, ?, ?, ?)", id, proxyType, host, port, latency)
+	require.NoError(t, err)
+}
+
+// newChainTestFactory creates a dialer factory whose proxies table holds the
+// given http and socks5 proxies, numbered from 1 in that order
+func newChainTestFactory(t *testing.T, proxies map[string]string) *DialerFactory {
+	db := newTestProxyDB(t)
+
+	id := 1
+	for _, proxyType := range []string{"http", "socks5"} {
+		addr, ok := proxies[proxyType]
+		if !ok {
+			continue
+		}
+		insertTestProxy(t, db, id, proxyType, addr, 0)
+		id++
+	}
+
+	return NewDialerFactory(db, "127.0.0.1:9050", 2*time.Second, nil, FailoverPolicy{})
+}
+
+func TestChainDialerHTTPThenSOCKS5(t *testing.T) {
+	echo := startEchoServer(t)
+	connects := make(chan string, 1)
+	httpProxy := startForwardingHTTPProxy(t, connects)
+	socksProxy := startForwardingSOCKS5Server(t)
+
+	factory := newChainTestFactory(t, map[string]string{
+		"http":   httpProxy.Addr().String(),
+		"socks5": socksProxy.Addr().String(),
+	})
+
+	route := &Route{
+		Group: RouteGroupChain,
+		Hops: []Hop{
+			{Position: 0, Group: RouteGroupUpstream, ProxyID: intPtr(1)},
+			{Position: 1, Group: RouteGroupUpstream, ProxyID: intPtr(2)},
+		},
+	}
+
+	dialer, err := factory.CreateDialer(context.Background(), route, "", "")
+	require.NoError(t, err)
+
+	conn, err := dialer.DialContext(context.Background(), "tcp", echo.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// The first hop must be asked for the second hop, not the target
+	assert.Equal(t, socksProxy.Addr().String(), <-connects)
+
+	_, err = conn.Write([]byte("chain"))
+	require.NoError(t, err)
+
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "chain", string(buf))
+}
+
+func TestChainDialerErrorAttribution(t *testing.T) {
+	connects := make(chan string, 1)
+	httpProxy := startForwardingHTTPProxy(t, connects)
+	socksProxy := startForwardingSOCKS5Server(t)
+
+	factory := newChainTestFactory(t, map[string]string{
+		"http":   httpProxy.Addr().String(),
+		"socks5": socksProxy.Addr().String(),
+	})
+
+	// A hop that points at a missing proxy fails in CreateDialer
+	_, err := factory.CreateDialer(context.Background(), &Route{
+		Group: RouteGroupChain,
+		Hops: []Hop{
+			{Position: 0, Group: RouteGroupUpstream, ProxyID: intPtr(1)},
+			{Position: 1, Group: RouteGroupUpstream, ProxyID: intPtr(99)},
+		},
+	}, "", "")
+	var hopErr *HopError
+	require.True(t, errors.As(err, &hopErr))
+	assert.Equal(t, 1, hopErr.Position)
+	assert.Contains(t, err.Error(), "not found")
+
+	// The last hop reports a refused target
+	deadAddr := closedAddr(t)
+
+	dialer, err := factory.CreateDialer(context.Background(), &Route{
+		Group: RouteGroupChain,
+		Hops: []Hop{
+			{Position: 0, Group: RouteGroupUpstream, ProxyID: intPtr(1)},
+			{Position: 1, Group: RouteGroupUpstream, ProxyID: intPtr(2)},
+		},
+	}, "", "")
+	require.NoError(t, err)
+
+	_, err = dialer.DialContext(context.Background(), "tcp", deadAddr)
+	require.True(t, errors.As(err, &hopErr))
+	assert.Equal(t, 1, hopErr.Position)
+	assert.Equal(t, socksProxy.Addr().String(), hopErr.Proxy)
+	<-connects
+
+	// A first hop that cannot reach the second hop is blamed instead
+	factory = newChainTestFactory(t, map[string]string{
+		"http":   httpProxy.Addr().String(),
+		"socks5": deadAddr,
+	})
+	dialer, err = factory.CreateDialer(context.Background(), &Route{
+		Group: RouteGroupChain,
+		Hops: []Hop{
+			{Position: 0, Group: RouteGroupUpstream, ProxyID: intPtr(1)},
+			{Position: 1, Group: RouteGroupUpstream, ProxyID: intPtr(2)},
+		},
+	}, "", "")
+	require.NoError(t, err)
+
+	_, err = dialer.DialContext(context.Background(), "tcp", "example.com:80")
+	require.True(t, errors.As(err, &hopErr))
+	assert.Equal(t, 0, hopErr.Position)
+	assert.Equal(t, httpProxy.Addr().String(), hopErr.Proxy)
+
+	var upstreamErr *UpstreamError
+	require.True(t, errors.As(err, &upstreamErr))
+	assert.Equal(t, http.StatusBadGateway, upstreamErr.StatusCode)
+}
+
+func TestChainDialerHopTimeout(t *testing.T) {
+	// A proxy that accepts connections but never answers
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	factory := newChainTestFactory(t, map[string]string{
+		"socks5": listener.Addr().String(),
+	})
+
+	dialer, err := factory.CreateDialer(context.Background(), &Route{
+		Group: RouteGroupChain,
+		Hops:  []Hop{{Position: 0, Group: RouteGroupUpstream, ProxyID: intPtr(1), TimeoutMS: intPtr(50)}},
+	}, "", "")
+	require.NoError(t, err)
+
+	start := time.Now()
+	_, err = dialer.DialContext(context.Background(), "tcp", "example.com:80")
+	require.Error(t, err)
+	assert.Less(t, time.Since(start), time.Second)
+	assert.Equal(t, http.StatusGatewayTimeout, DialErrorStatus(err))
+
+	var hopErr *HopError
+	require.True(t, errors.As(err, &hopErr))
+	assert.Equal(t, 0, hopErr.Position)
+}
+
+func intPtr(i int) *int {
+	return &i
+}
@@ -2,10 +2,15 @@ package router
 
 import (
 	"context"
+	"crypto/tls"
 	"database/sql"
 	"fmt"
 	"net"
+	"strconv"
+	"sync/atomic"
 	"time"
+
+	"proxyrouter/internal/secrets"
 )
 
 // Dialer represents a network dialer
@@ -15,31 +20,73 @@ type Dialer interface {
 
 // DialerFactory creates dialers based on route groups
 type DialerFactory struct {
-	db          *sql.DB
+	db        *sql.DB
+	settings  atomic.Pointer[dialerSettings]
+	secrets   *secrets.Box
+	health    *proxyHealth
+	pool      *proxyPool
+	balancers map[Strategy]balancer
+	sessions  *sessionTable
+}
+
+// dialerSettings are the options of a DialerFactory that can change while it
+// runs. Each dialer keeps the settings it was created with.
+type dialerSettings struct {
 	torAddress  string
 	dialTimeout time.Duration
+	failover    FailoverPolicy
 }
 
 // NewDialerFactory creates a new dialer factory
-func NewDialerFactory(db *sql.DB, torAddress string, dialTimeout time.Duration) *DialerFactory {
-	return &DialerFactory{
-		db:          db,
+func NewDialerFactory(db *sql.DB, torAddress string, dialTimeout time.Duration, secretBox *secrets.Box, failover FailoverPolicy) *DialerFactory {
+	f := &DialerFactory{
+		db:        db,
+		secrets:   secretBox,
+		health:    newProxyHealth(0),
+		balancers: newBalancers(),
+		sessions:  newSessionTable(),
+	}
+	f.pool = newProxyPool(f.loadGeneralPool)
+	f.Reconfigure(torAddress, dialTimeout, failover)
+	return f
+}
+
+// Reconfigure changes the Tor address, dial timeout and failover policy used
+// by dialers created from now on
+func (f *DialerFactory) Reconfigure(torAddress string, dialTimeout time.Duration, failover FailoverPolicy) {
+	failover = failover.withDefaults(dialTimeout)
+	f.health.setThreshold(failover.FailureThreshold)
+	f.settings.Store(&dialerSettings{
 		torAddress:  torAddress,
 		dialTimeout: dialTimeout,
-	}
+		failover:    failover,
+	})
 }
 
-// CreateDialer creates a dialer for the given route group
-func (f *DialerFactory) CreateDialer(ctx context.Context, route *Route) (Dialer, error) {
+// current returns the settings for a new dialer
+func (f *DialerFactory) current() *dialerSettings {
+	return f.settings.Load()
+}
+
+// CreateDialer creates a dialer for the given route group. The client IP,
+// target host and any session ID set with WithSessionID feed the hashing
+// strategies and sticky sessions of GENERAL routes.
+func (f *DialerFactory) CreateDialer(ctx context.Context, route *Route, clientIP, targetHost string) (Dialer, error) {
 	switch route.Group {
 	case RouteGroupLocal:
 		return f.createLocalDialer()
 	case RouteGroupTor:
 		return f.createTorDialer()
 	case RouteGroupGeneral:
-		return f.createGeneralDialer(ctx)
+		return f.createGeneralDialer(ctx, route, selection{
+			clientIP:   clientIP,
+			targetHost: targetHost,
+			sessionID:  sessionIDFromContext(ctx),
+		})
 	case RouteGroupUpstream:
 		return f.createUpstreamDialer(ctx, route.ProxyID)
+	case RouteGroupChain:
+		return f.createChainDialer(ctx, route.Hops)
 	default:
 		return nil, fmt.Errorf("unknown route group: %s", route.Group)
 	}
@@ -48,33 +95,77 @@ func (f *DialerFactory) CreateDialer(ctx context.Context, route *Route) (Dialer,
 // createLocalDialer creates a direct connection dialer
 func (f *DialerFactory) createLocalDialer() (Dialer, error) {
 	return &net.Dialer{
-		Timeout: f.dialTimeout,
+		Timeout: f.current().dialTimeout,
 	}, nil
 }
 
+// dialProxy opens a TCP connection to a proxy, tunnelled through forward when
+// the proxy is not the first hop of a chain
+func dialProxy(ctx context.Context, forward Dialer, timeout time.Duration, addr string) (net.Conn, error) {
+	if forward != nil {
+		return forward.DialContext(ctx, "tcp", addr)
+	}
+
+	dialer := &net.Dialer{
+		Timeout: timeout,
+	}
+	return dialer.DialContext(ctx, "tcp", addr)
+}
+
 // createTorDialer creates a Tor SOCKS5 dialer
 func (f *DialerFactory) createTorDialer() (Dialer, error) {
-	// Use the go-socks5 library for Tor connections
-	return &GoSocks5Dialer{
-		proxyHost: f.torAddress,
-		timeout:   f.dialTimeout,
+	// Tor resolves names itself, so targets are always sent as domain names
+	settings := f.current()
+	return &SOCKS5Dialer{
+		proxyHost:  settings.torAddress,
+		timeout:    settings.dialTimeout,
+		domainOnly: true,
 	}, nil
 }
 
-// createGeneralDialer creates a dialer that selects from the general proxy pool
-func (f *DialerFactory) createGeneralDialer(ctx context.Context) (Dialer, error) {
-	// Get the best available proxy from the general pool
-	proxy, err := f.getBestGeneralProxy(ctx)
+// createGeneralDialer creates a dialer that fails over across proxies of the
+// general pool picked by the route's strategy, starting with the proxy the
+// request is pinned to
+func (f *DialerFactory) createGeneralDialer(ctx context.Context, route *Route, req selection) (Dialer, error) {
+	key := affinityKey(route, req)
+	failover := f.current().failover
+	proxies, skipped, err := f.getGeneralCandidates(ctx, route.Strategy, req, key, failover.Candidates)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get general proxy: %w", err)
 	}
 
-	if proxy == nil {
+	if len(proxies) == 0 {
+		if skipped > 0 {
+			return nil, fmt.Errorf("all %d general proxies are marked as failing", skipped)
+		}
 		// Fallback to direct connection if no proxy available
 		return f.createLocalDialer()
 	}
 
-	return f.createProxyDialer(proxy)
+	dialer := &FailoverDialer{
+		budget: failover.Budget,
+		health: f.health,
+		pool:   f.pool,
+	}
+	if key != "" {
+		ttl := route.affinityTTL()
+		dialer.onConnect = func(proxyID int) {
+			f.sessions.pin(key, route, proxyID, ttl)
+		}
+	}
+	for _, proxy := range proxies {
+		proxyDialer, err := f.createProxyDialer(proxy)
+		if err != nil {
+			return nil, err
+		}
+		dialer.candidates = append(dialer.candidates, failoverCandidate{
+			proxyID:   proxy.ID,
+			proxyHost: net.JoinHostPort(proxy.IP, strconv.Itoa(proxy.Port)),
+			dialer:    proxyDialer,
+		})
+	}
+
+	return dialer, nil
 }
 
 // createUpstreamDialer creates a dialer for a specific upstream proxy
@@ -97,391 +188,182 @@ func (f *DialerFactory) createUpstreamDialer(ctx context.Context, proxyID *int)
 
 // createProxyDialer creates a dialer for a specific proxy
 func (f *DialerFactory) createProxyDialer(proxy *Proxy) (Dialer, error) {
+	return f.createProxyDialerVia(proxy, nil, f.current().dialTimeout)
+}
+
+// createProxyDialerVia creates a dialer for a specific proxy that is reached
+// through forward, or directly when forward is nil
+func (f *DialerFactory) createProxyDialerVia(proxy *Proxy, forward Dialer, timeout time.Duration) (Dialer, error) {
 	switch proxy.ProxyType {
 	case "socks5":
-		return f.createSOCKS5Dialer(proxy)
+		return f.createSOCKS5Dialer(proxy, forward, timeout)
+	case "socks4":
+		return f.createSOCKS4Dialer(proxy, forward, timeout)
 	case "http", "https":
-		return f.createHTTPDialer(proxy)
+		return f.createHTTPDialer(proxy, forward, timeout)
 	default:
 		return nil, fmt.Errorf("unsupported proxy type: %s", proxy.ProxyType)
 	}
 }
 
-// SOCKS5Dialer implements a SOCKS5 proxy dialer
-type SOCKS5Dialer struct {
-	proxyHost string
-	timeout   time.Duration
+// createSOCKS5Dialer creates a SOCKS5 dialer
+func (f *DialerFactory) createSOCKS5Dialer(proxy *Proxy, forward Dialer, timeout time.Duration) (Dialer, error) {
+	return &SOCKS5Dialer{
+		proxyHost: net.JoinHostPort(proxy.IP, strconv.Itoa(proxy.Port)),
+		timeout:   timeout,
+		username:  proxy.Username,
+		password:  proxy.Password,
+		forward:   forward,
+	}, nil
 }
 
-// GoSocks5Dialer implements a SOCKS5 proxy dialer using go-socks5 library
-type GoSocks5Dialer struct {
-	proxyHost string
-	timeout   time.Duration
+// createSOCKS4Dialer creates a SOCKS4 dialer. The proxy username, if any, is
+// sent as the SOCKS4 user ID.
+func (f *DialerFactory) createSOCKS4Dialer(proxy *Proxy, forward Dialer, timeout time.Duration) (Dialer, error) {
+	dialer := NewSOCKS4Dialer(net.JoinHostPort(proxy.IP, strconv.Itoa(proxy.Port)), proxy.Username, timeout)
+	dialer.forward = forward
+	return dialer, nil
 }
 
-// DialContext implements the Dialer interface for GoSocks5Dialer
-func (d *GoSocks5Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
-	// For now, use the same implementation as SOCKS5Dialer
-	// TODO: Implement using go-socks5 library
-	proxyConn, err := net.DialTimeout("tcp", d.proxyHost, d.timeout)
-	if err != nil {
-		return nil, fmt.Errorf("failed to connect to SOCKS5 proxy %s: %w", d.proxyHost, err)
+// createHTTPDialer creates an HTTP proxy dialer
+func (f *DialerFactory) createHTTPDialer(proxy *Proxy, forward Dialer, timeout time.Duration) (Dialer, error) {
+	// For HTTP proxies, we'll use a custom dialer that handles CONNECT
+	dialer := &HTTPProxyDialer{
+		proxyHost: net.JoinHostPort(proxy.IP, strconv.Itoa(proxy.Port)),
+		timeout:   timeout,
+		username:  proxy.Username,
+		password:  proxy.Password,
+		forward:   forward,
 	}
 
-	// Perform SOCKS5 handshake with context timeout
-	handshakeCtx, cancel := context.WithTimeout(ctx, d.timeout)
-	defer cancel()
-
-	// Use a channel to handle the handshake asynchronously
-	handshakeDone := make(chan error, 1)
-	go func() {
-		handshakeDone <- d.performSOCKS5Handshake(proxyConn, addr)
-	}()
-
-	select {
-	case err := <-handshakeDone:
-		if err != nil {
-			proxyConn.Close()
-			return nil, fmt.Errorf("SOCKS5 handshake failed: %w", err)
-		}
-	case <-handshakeCtx.Done():
-		proxyConn.Close()
-		return nil, fmt.Errorf("SOCKS5 handshake timeout: %w", handshakeCtx.Err())
+	// https proxies expect TLS before the CONNECT request
+	if proxy.ProxyType == "https" {
+		dialer.tlsConfig = &tls.Config{}
 	}
 
-	return proxyConn, nil
+	return dialer, nil
 }
 
-// performSOCKS5Handshake performs the SOCKS5 protocol handshake for GoSocks5Dialer
-func (d *GoSocks5Dialer) performSOCKS5Handshake(conn net.Conn, targetAddr string) error {
-	// Set a timeout for the handshake
-	conn.SetDeadline(time.Now().Add(d.timeout))
-	defer conn.SetDeadline(time.Time{}) // Clear deadline
-
-	// SOCKS5 greeting: version 5, 1 method (no authentication)
-	greeting := []byte{0x05, 0x01, 0x00}
-	if _, err := conn.Write(greeting); err != nil {
-		return fmt.Errorf("failed to write SOCKS5 greeting: %w", err)
-	}
-
-	// Read server response
-	response := make([]byte, 2)
-	n, err := conn.Read(response)
+// getBestGeneralProxy gets the best available proxy from the general pool
+func (f *DialerFactory) getBestGeneralProxy(ctx context.Context) (*Proxy, error) {
+	proxies, _, err := f.getGeneralCandidates(ctx, StrategyLatency, selection{}, "", 1)
 	if err != nil {
-		return fmt.Errorf("failed to read SOCKS5 greeting response: %w", err)
+		return nil, err
 	}
-	if n != 2 {
-		return fmt.Errorf("incomplete SOCKS5 greeting response: got %d bytes, expected 2", n)
-	}
-
-	if response[0] != 0x05 || response[1] != 0x00 {
-		return fmt.Errorf("SOCKS5 greeting failed: version=%d, method=%d", response[0], response[1])
+	if len(proxies) == 0 {
+		return nil, nil
 	}
+	return proxies[0], nil
+}
 
-	// Parse target address
-	host, port, err := net.SplitHostPort(targetAddr)
-	if err != nil {
-		return fmt.Errorf("invalid target address: %w", err)
+// getGeneralCandidates returns up to limit general proxies that are not
+// marked as failing, ordered by strategy after the proxy pinned to
+// affinityKey, along with the number of failing proxies skipped
+func (f *DialerFactory) getGeneralCandidates(ctx context.Context, strategy Strategy, req selection, affinityKey string, limit int) ([]*Proxy, int, error) {
+	if strategy == "" {
+		strategy = StrategyLatency
 	}
-
-	// Build connect request - always use domain name for Tor
-	addrType := byte(0x03) // Domain name
-	addrBytes := []byte(host)
-
-	// Build request packet
-	portNum := uint16(0)
-	if _, err := fmt.Sscanf(port, "%d", &portNum); err != nil {
-		return fmt.Errorf("invalid port: %w", err)
+	b, ok := f.balancers[strategy]
+	if !ok {
+		return nil, 0, fmt.Errorf("unknown load-balancing strategy: %s", strategy)
 	}
 
-	request := []byte{0x05, 0x01, 0x00, addrType, byte(len(addrBytes))}
-	request = append(request, addrBytes...)
-	request = append(request, byte(portNum>>8), byte(portNum&0xFF))
-
-	if _, err := conn.Write(request); err != nil {
-		return fmt.Errorf("failed to write SOCKS5 connect request: %w", err)
-	}
-
-	// Read response header (first 4 bytes)
-	response = make([]byte, 4)
-	n, err = conn.Read(response)
+	snapshot, err := f.pool.snapshot(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to read SOCKS5 connect response: %w", err)
-	}
-	if n != 4 {
-		return fmt.Errorf("incomplete SOCKS5 connect response header: got %d bytes, expected 4", n)
-	}
-
-	if response[0] != 0x05 || response[1] != 0x00 {
-		return fmt.Errorf("SOCKS5 connect failed: version=%d, status=%d", response[0], response[1])
+		return nil, 0, err
 	}
 
-	// Skip the rest of the response (bound address) based on address type
-	addrType = response[3]
-	switch addrType {
-	case 0x01: // IPv4
-		boundAddr := make([]byte, 4+2) // IPv4 + port
-		n, err := conn.Read(boundAddr)
-		if err != nil {
-			return fmt.Errorf("failed to read bound IPv4 address: %w", err)
-		}
-		if n != len(boundAddr) {
-			return fmt.Errorf("incomplete bound IPv4 address: got %d bytes, expected %d", n, len(boundAddr))
-		}
-	case 0x03: // Domain name
-		// Read domain name length
-		length := make([]byte, 1)
-		n, err := conn.Read(length)
-		if err != nil {
-			return fmt.Errorf("failed to read domain name length: %w", err)
-		}
-		if n != 1 {
-			return fmt.Errorf("incomplete domain name length: got %d bytes, expected 1", n)
+	healthy := make([]*Proxy, 0, len(snapshot))
+	skipped := 0
+	for _, p := range snapshot {
+		if f.health.isFailing(p) {
+			skipped++
+			continue
 		}
-
-		// Read domain name + port
-		boundAddr := make([]byte, int(length[0])+2)
-		n, err = conn.Read(boundAddr)
-		if err != nil {
-			return fmt.Errorf("failed to read bound domain name: %w", err)
-		}
-		if n != len(boundAddr) {
-			return fmt.Errorf("incomplete bound domain name: got %d bytes, expected %d", n, len(boundAddr))
-		}
-	case 0x04: // IPv6
-		boundAddr := make([]byte, 16+2) // IPv6 + port
-		n, err := conn.Read(boundAddr)
-		if err != nil {
-			return fmt.Errorf("failed to read bound IPv6 address: %w", err)
-		}
-		if n != len(boundAddr) {
-			return fmt.Errorf("incomplete bound IPv6 address: got %d bytes, expected %d", n, len(boundAddr))
-		}
-	default:
-		return fmt.Errorf("unsupported address type: %d", addrType)
-	}
-
-	return nil
-}
-
-// DialContext implements the Dialer interface for SOCKS5
-func (d *SOCKS5Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
-	// Connect to the SOCKS5 proxy
-	proxyConn, err := net.DialTimeout("tcp", d.proxyHost, d.timeout)
-	if err != nil {
-		return nil, fmt.Errorf("failed to connect to SOCKS5 proxy %s: %w", d.proxyHost, err)
+		healthy = append(healthy, p)
 	}
 
-	// Perform SOCKS5 handshake with context timeout
-	handshakeCtx, cancel := context.WithTimeout(ctx, d.timeout)
-	defer cancel()
-
-	// Use a channel to handle the handshake asynchronously
-	handshakeDone := make(chan error, 1)
-	go func() {
-		handshakeDone <- d.performSOCKS5Handshake(proxyConn, addr)
-	}()
-
-	select {
-	case err := <-handshakeDone:
-		if err != nil {
-			proxyConn.Close()
-			return nil, fmt.Errorf("SOCKS5 handshake failed: %w", err)
-		}
-	case <-handshakeCtx.Done():
-		proxyConn.Close()
-		return nil, fmt.Errorf("SOCKS5 handshake timeout: %w", handshakeCtx.Err())
+	ordered := b.order(f.pool, healthy, req, limit)
+	if affinityKey != "" {
+		ordered = f.pinnedFirst(affinityKey, healthy, ordered, limit)
 	}
 
-	return proxyConn, nil
+	return ordered, skipped, nil
 }
 
-// performSOCKS5Handshake performs the SOCKS5 protocol handshake
-func (d *SOCKS5Dialer) performSOCKS5Handshake(conn net.Conn, targetAddr string) error {
-	// Set a timeout for the handshake
-	conn.SetDeadline(time.Now().Add(d.timeout))
-	defer conn.SetDeadline(time.Time{}) // Clear deadline
-
-	// SOCKS5 greeting: version 5, 1 method (no authentication)
-	greeting := []byte{0x05, 0x01, 0x00}
-	if _, err := conn.Write(greeting); err != nil {
-		return fmt.Errorf("failed to write SOCKS5 greeting: %w", err)
-	}
-
-	// Read server response
-	response := make([]byte, 2)
-	n, err := conn.Read(response)
-	if err != nil {
-		return fmt.Errorf("failed to read SOCKS5 greeting response: %w", err)
-	}
-	if n != 2 {
-		return fmt.Errorf("incomplete SOCKS5 greeting response: got %d bytes, expected 2", n)
-	}
-
-	if response[0] != 0x05 || response[1] != 0x00 {
-		return fmt.Errorf("SOCKS5 greeting failed: version=%d, method=%d", response[0], response[1])
+// pinnedFirst moves the proxy pinned to key to the front of ordered. A pin to
+// a proxy that is no longer healthy is dropped so the request is pinned anew.
+func (f *DialerFactory) pinnedFirst(key string, healthy, ordered []*Proxy, limit int) []*Proxy {
+	proxyID, ok := f.sessions.lookup(key)
+	if !ok {
+		return ordered
 	}
 
-	// Parse target address
-	host, port, err := net.SplitHostPort(targetAddr)
-	if err != nil {
-		return fmt.Errorf("invalid target address: %w", err)
-	}
-
-	// Build connect request
-	ip := net.ParseIP(host)
-	var addrType byte
-	var addrBytes []byte
-
-	if ip != nil {
-		if ip.To4() != nil {
-			addrType = 0x01 // IPv4
-			addrBytes = ip.To4()
-		} else {
-			addrType = 0x04 // IPv6
-			addrBytes = ip.To16()
+	var pinned *Proxy
+	for _, p := range healthy {
+		if p.ID == proxyID {
+			pinned = p
+			break
 		}
-	} else {
-		addrType = 0x03 // Domain name
-		addrBytes = []byte(host)
 	}
-
-	// Build request packet
-	portNum := uint16(0)
-	if _, err := fmt.Sscanf(port, "%d", &portNum); err != nil {
-		return fmt.Errorf("invalid port: %w", err)
+	if pinned == nil {
+		f.sessions.unpin(key)
+		return ordered
 	}
 
-	request := []byte{0x05, 0x01, 0x00, addrType}
-	request = append(request, addrBytes...)
-	request = append(request, byte(portNum>>8), byte(portNum&0xFF))
-
-	if _, err := conn.Write(request); err != nil {
-		return fmt.Errorf("failed to write SOCKS5 connect request: %w", err)
-	}
-
-	// Read response header (first 4 bytes)
-	response = make([]byte, 4)
-	n, err = conn.Read(response)
-	if err != nil {
-		return fmt.Errorf("failed to read SOCKS5 connect response: %w", err)
-	}
-	if n != 4 {
-		return fmt.Errorf("incomplete SOCKS5 connect response header: got %d bytes, expected 4", n)
-	}
-
-	if response[0] != 0x05 || response[1] != 0x00 {
-		return fmt.Errorf("SOCKS5 connect failed: version=%d, status=%d", response[0], response[1])
-	}
-
-	// Skip the rest of the response (bound address) based on address type
-	addrType = response[3]
-	switch addrType {
-	case 0x01: // IPv4
-		boundAddr := make([]byte, 4+2) // IPv4 + port
-		n, err := conn.Read(boundAddr)
-		if err != nil {
-			return fmt.Errorf("failed to read bound IPv4 address: %w", err)
-		}
-		if n != len(boundAddr) {
-			return fmt.Errorf("incomplete bound IPv4 address: got %d bytes, expected %d", n, len(boundAddr))
+	result := []*Proxy{pinned}
+	for _, p := range ordered {
+		if len(result) == limit {
+			break
 		}
-	case 0x03: // Domain name
-		// Read domain name length
-		length := make([]byte, 1)
-		n, err := conn.Read(length)
-		if err != nil {
-			return fmt.Errorf("failed to read domain name length: %w", err)
-		}
-		if n != 1 {
-			return fmt.Errorf("incomplete domain name length: got %d bytes, expected 1", n)
-		}
-
-		// Read domain name + port
-		boundAddr := make([]byte, int(length[0])+2)
-		n, err = conn.Read(boundAddr)
-		if err != nil {
-			return fmt.Errorf("failed to read bound domain name: %w", err)
+		if p.ID != pinned.ID {
+			result = append(result, p)
 		}
-		if n != len(boundAddr) {
-			return fmt.Errorf("incomplete bound domain name: got %d bytes, expected %d", n, len(boundAddr))
-		}
-	case 0x04: // IPv6
-		boundAddr := make([]byte, 16+2) // IPv6 + port
-		n, err := conn.Read(boundAddr)
-		if err != nil {
-			return fmt.Errorf("failed to read bound IPv6 address: %w", err)
-		}
-		if n != len(boundAddr) {
-			return fmt.Errorf("incomplete bound IPv6 address: got %d bytes, expected %d", n, len(boundAddr))
-		}
-	default:
-		return fmt.Errorf("unsupported address type: %d", addrType)
 	}
-
-	return nil
-}
-
-// createSOCKS5Dialer creates a SOCKS5 dialer
-func (f *DialerFactory) createSOCKS5Dialer(proxy *Proxy) (Dialer, error) {
-	// TODO: Implement SOCKS5 dialer when go-socks5 dependency is fixed
-	return &net.Dialer{
-		Timeout: f.dialTimeout,
-	}, nil
-}
-
-// createHTTPDialer creates an HTTP proxy dialer
-func (f *DialerFactory) createHTTPDialer(proxy *Proxy) (Dialer, error) {
-	// For HTTP proxies, we'll use a custom dialer that handles CONNECT
-	return &HTTPProxyDialer{
-		proxyHost: fmt.Sprintf("%s:%d", proxy.IP, proxy.Port),
-		timeout:   f.dialTimeout,
-	}, nil
+	return result
 }
 
-// getBestGeneralProxy gets the best available proxy from the general pool
-func (f *DialerFactory) getBestGeneralProxy(ctx context.Context) (*Proxy, error) {
+// getProxyByID gets a proxy by its ID
+func (f *DialerFactory) getProxyByID(ctx context.Context, id int) (*Proxy, error) {
 	query := `
-		SELECT id, proxy_type, ip, port, latency, working, tested_timestamp
+		SELECT id, proxy_type, ip, port, latency, working, tested_timestamp, username, password_enc
 		FROM proxies
-		WHERE working = 1
-		  AND (expires_at IS NULL OR expires_at > datetime('now'))
-		  AND (tested_timestamp IS NULL OR tested_timestamp > datetime('now', '-1 hour'))
-		ORDER BY latency ASC NULLS LAST, tested_timestamp DESC
-		LIMIT 1
+		WHERE id = ?
 	`
 
-	var p Proxy
-	err := f.db.QueryRowContext(ctx, query).Scan(
-		&p.ID,
-		&p.ProxyType,
-		&p.IP,
-		&p.Port,
-		&p.Latency,
-		&p.Working,
-		&p.TestedTimestamp,
-	)
-
+	p, err := f.scanProxy(f.db.QueryRowContext(ctx, query, id))
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
 	if err != nil {
-		return nil, fmt.Errorf("failed to query general proxy: %w", err)
+		return nil, fmt.Errorf("failed to query proxy: %w", err)
 	}
 
-	return &p, nil
+	return p, nil
 }
 
-// getProxyByID gets a proxy by its ID
-func (f *DialerFactory) getProxyByID(ctx context.Context, id int) (*Proxy, error) {
-	query := `
-		SELECT id, proxy_type, ip, port, latency, working, tested_timestamp
-		FROM proxies
-		WHERE id = ?
-	`
+// rowScanner is implemented by *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
 
+// scanProxy scans a proxy row and decrypts its credentials
+func (f *DialerFactory) scanProxy(row rowScanner) (*Proxy, error) {
+	p, passwordEnc, err := scanProxyRow(row)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.openCredentials(p, passwordEnc); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// scanProxyRow scans a proxy row, leaving its password encrypted
+func scanProxyRow(row rowScanner) (*Proxy, sql.NullString, error) {
 	var p Proxy
-	err := f.db.QueryRowContext(ctx, query, id).Scan(
+	var username, passwordEnc sql.NullString
+	err := row.Scan(
 		&p.ID,
 		&p.ProxyType,
 		&p.IP,
@@ -489,16 +371,30 @@ func (f *DialerFactory) getProxyByID(ctx context.Context, id int) (*Proxy, error
 		&p.Latency,
 		&p.Working,
 		&p.TestedTimestamp,
+		&username,
+		&passwordEnc,
 	)
+	if err != nil {
+		return nil, passwordEnc, err
+	}
+	p.Username = username.String
+	return &p, passwordEnc, nil
+}
 
-	if err == sql.ErrNoRows {
-		return nil, nil
+// openCredentials decrypts the stored password of p
+func (f *DialerFactory) openCredentials(p *Proxy, passwordEnc sql.NullString) error {
+	if !passwordEnc.Valid {
+		return nil
+	}
+	if f.secrets == nil {
+		return fmt.Errorf("proxy %d has credentials but no credential key is configured", p.ID)
 	}
+	password, err := f.secrets.Open(passwordEnc.String)
 	if err != nil {
-		return nil, fmt.Errorf("failed to query proxy: %w", err)
+		return fmt.Errorf("failed to decrypt credentials for proxy %d: %w", p.ID, err)
 	}
-
-	return &p, nil
+	p.Password = password
+	return nil
 }
 
 // Proxy represents a proxy entry
@@ -510,23 +406,6 @@ type Proxy struct {
 	Latency         *int       `json:"latency,omitempty"`
 	Working         bool       `json:"working"`
 	TestedTimestamp *time.Time `json:"tested_timestamp,omitempty"`
-}
-
-// HTTPProxyDialer implements Dialer for HTTP proxies
-type HTTPProxyDialer struct {
-	proxyHost string
-	timeout   time.Duration
-}
-
-// DialContext implements Dialer for HTTP proxies
-func (h *HTTPProxyDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
-	// For HTTP proxies, we need to establish a CONNECT tunnel
-	// This is a simplified implementation - in practice, you'd want to handle
-	// the full HTTP CONNECT protocol
-
-	// For now, we'll use a direct connection as a fallback
-	dialer := &net.Dialer{
-		Timeout: h.timeout,
-	}
-	return dialer.DialContext(ctx, network, addr)
+	Username        string     `json:"username,omitempty"`
+	Password        string     `json:"-"`
 }
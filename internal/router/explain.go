@@ -0,0 +1,210 @@
+package router
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// RouteEvaluation records why a route did not match a request
+type RouteEvaluation struct {
+	Route     *Route `json:"route"`
+	Condition string `json:"condition"` // the column that failed, or "invalid"
+	Reason    string `json:"reason"`
+}
+
+// Explanation describes how the router resolves a request
+type Explanation struct {
+	Route     *Route            `json:"route"`     // nil when no route matches
+	Evaluated []RouteEvaluation `json:"evaluated"` // earlier routes in precedence order
+}
+
+// Explain evaluates the enabled routes in precedence order against a request,
+// recording why each route before the match was skipped. A draft route, if
+// given, is evaluated as if it had just been created, so rules can be tried
+// before saving them; it has ID 0 in the explanation.
+func (r *Router) Explain(ctx context.Context, req Request, draft *Route) (*Explanation, error) {
+	table, err := r.routeTable(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	routes := table.routes
+	if draft != nil {
+		compiled, err := compileRoute(draft)
+		if err != nil {
+			return nil, err
+		}
+		// A new route sorts after existing routes of the same precedence
+		at := sort.Search(len(routes), func(i int) bool {
+			return routes[i].route.Precedence > draft.Precedence
+		})
+		routes = append(append(append([]*compiledRoute(nil), routes[:at]...), compiled), routes[at:]...)
+	}
+
+	if req.Time.IsZero() {
+		req.Time = time.Now()
+	}
+	addr, addrOK := parseClientAddr(req.ClientIP)
+
+	explanation := &Explanation{Evaluated: []RouteEvaluation{}}
+	for _, c := range routes {
+		route := *c.route
+		condition := c.mismatch(req, addr, addrOK, true)
+		if condition == "" {
+			explanation.Route = &route
+			break
+		}
+		explanation.Evaluated = append(explanation.Evaluated, RouteEvaluation{
+			Route:     &route,
+			Condition: condition,
+			Reason:    c.mismatchReason(condition, req),
+		})
+	}
+
+	return explanation, nil
+}
+
+// mismatchReason describes a failed condition for operators
+func (c *compiledRoute) mismatchReason(condition string, req Request) string {
+	route := c.route
+	switch condition {
+	case "invalid":
+		return c.err.Error()
+	case "client_cidr":
+		return fmt.Sprintf("client %q is not in %s", req.ClientIP, *route.ClientCIDR)
+	case "client_user":
+		if req.Username == "" {
+			return fmt.Sprintf("client is not authenticated, route needs user %q", *route.ClientUser)
+		}
+		return fmt.Sprintf("user %q is not %q", req.Username, *route.ClientUser)
+	case "host_glob":
+		return fmt.Sprintf("host %q does not match glob %q", req.Host, *route.HostGlob)
+	case "host_regex":
+		return fmt.Sprintf("host %q does not match regex %q", req.Host, *route.HostRegex)
+	case "dst_ports":
+		if req.Port == 0 {
+			return fmt.Sprintf("destination port is unknown, route needs %s", *route.DstPorts)
+		}
+		return fmt.Sprintf("port %d is not in %s", req.Port, *route.DstPorts)
+	case "schemes":
+		if req.Scheme == "" {
+			return fmt.Sprintf("scheme is unknown, route needs %s", *route.Schemes)
+		}
+		return fmt.Sprintf("scheme %q is not in %s", req.Scheme, *route.Schemes)
+	case "methods":
+		if req.Method == "" {
+			return fmt.Sprintf("method is unknown, route needs %s", *route.Methods)
+		}
+		return fmt.Sprintf("method %q is not in %s", req.Method, *route.Methods)
+	case "path_prefix":
+		if req.Path == "" {
+			return fmt.Sprintf("path is unknown, route needs prefix %q", *route.PathPrefix)
+		}
+		return fmt.Sprintf("path %q does not start with %q", req.Path, *route.PathPrefix)
+	case "time_window":
+		return fmt.Sprintf("%s is outside time window %q", req.Time.Format(time.RFC3339), *route.TimeWindow)
+	default:
+		return condition
+	}
+}
+
+// PlannedProxy is a proxy a dial plan would connect through
+type PlannedProxy struct {
+	Group     RouteGroup `json:"group"`
+	ProxyID   *int       `json:"proxy_id,omitempty"`
+	ProxyType string     `json:"proxy_type,omitempty"`
+	Address   string     `json:"address"`
+	Latency   *int       `json:"latency,omitempty"`
+}
+
+// DialPlan describes the dialer a route would get, without dialing
+type DialPlan struct {
+	Group RouteGroup `json:"group"`
+	// Direct is set when the connection would not use a proxy, including a
+	// GENERAL route falling back because the pool is empty
+	Direct bool `json:"direct"`
+	// Proxies are the GENERAL candidates in the order they would be tried,
+	// or the hops of a CHAIN from first to last
+	Proxies []PlannedProxy `json:"proxies"`
+	// Pinned is set when the first GENERAL candidate comes from a sticky session
+	Pinned bool `json:"pinned"`
+}
+
+// Plan reports the proxies CreateDialer would pick for a route, using the
+// same pool snapshot, strategy and sticky sessions, without dialing
+func (f *DialerFactory) Plan(ctx context.Context, route *Route, clientIP, targetHost string) (*DialPlan, error) {
+	plan := &DialPlan{Group: route.Group, Proxies: []PlannedProxy{}}
+
+	switch route.Group {
+	case RouteGroupLocal:
+		plan.Direct = true
+	case RouteGroupTor:
+		plan.Proxies = append(plan.Proxies, PlannedProxy{Group: RouteGroupTor, ProxyType: "socks5", Address: f.current().torAddress})
+	case RouteGroupGeneral:
+		req := selection{clientIP: clientIP, targetHost: targetHost, sessionID: sessionIDFromContext(ctx)}
+		key := affinityKey(route, req)
+		proxies, skipped, err := f.getGeneralCandidates(ctx, route.Strategy, req, key, f.current().failover.Candidates)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get general proxy: %w", err)
+		}
+		if len(proxies) == 0 {
+			if skipped > 0 {
+				return nil, fmt.Errorf("all %d general proxies are marked as failing", skipped)
+			}
+			plan.Direct = true
+			break
+		}
+		if key != "" {
+			if pinned, ok := f.sessions.lookup(key); ok && pinned == proxies[0].ID {
+				plan.Pinned = true
+			}
+		}
+		for _, proxy := range proxies {
+			plan.Proxies = append(plan.Proxies, plannedProxy(RouteGroupGeneral, proxy))
+		}
+	case RouteGroupUpstream:
+		if route.ProxyID == nil {
+			return nil, fmt.Errorf("proxy_id is required for UPSTREAM route")
+		}
+		proxy, err := f.getProxyByID(ctx, *route.ProxyID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get upstream proxy: %w", err)
+		}
+		if proxy == nil {
+			return nil, fmt.Errorf("proxy with id %d not found", *route.ProxyID)
+		}
+		plan.Proxies = append(plan.Proxies, plannedProxy(RouteGroupUpstream, proxy))
+	case RouteGroupChain:
+		if len(route.Hops) == 0 {
+			return nil, fmt.Errorf("CHAIN route has no hops")
+		}
+		for _, hop := range route.Hops {
+			// The hop dialer only resolves its proxy, nothing is dialed
+			_, addr, err := f.createHopDialer(ctx, hop, nil, f.current().dialTimeout)
+			if err != nil {
+				return nil, &HopError{Position: hop.Position, Group: hop.Group, Proxy: addr, Err: err}
+			}
+			plan.Proxies = append(plan.Proxies, PlannedProxy{Group: hop.Group, ProxyID: hop.ProxyID, Address: addr})
+		}
+	default:
+		return nil, fmt.Errorf("unknown route group: %s", route.Group)
+	}
+
+	return plan, nil
+}
+
+// plannedProxy describes a proxy of the general pool or an upstream
+func plannedProxy(group RouteGroup, proxy *Proxy) PlannedProxy {
+	id := proxy.ID
+	return PlannedProxy{
+		Group:     group,
+		ProxyID:   &id,
+		ProxyType: proxy.ProxyType,
+		Address:   net.JoinHostPort(proxy.IP, strconv.Itoa(proxy.Port)),
+		Latency:   proxy.Latency,
+	}
+}
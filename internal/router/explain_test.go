@@ -0,0 +1,105 @@
+package router
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExplain(t *testing.T) {
+	db := newTestRouteDB(t)
+	router := New(db)
+	ctx := context.Background()
+
+	require.NoError(t, router.CreateRoute(&Route{Group: RouteGroupLocal, ClientCIDR: stringPtr("10.0.0.0/8"), Precedence: 10, Enabled: true}))
+	require.NoError(t, router.CreateRoute(&Route{Group: RouteGroupLocal, HostGlob: stringPtr("*.example.org"), Precedence: 20, Enabled: true}))
+	require.NoError(t, router.CreateRoute(&Route{Group: RouteGroupTor, DstPorts: stringPtr("80"), Precedence: 30, Enabled: true}))
+	require.NoError(t, router.CreateRoute(&Route{Group: RouteGroupGeneral, Precedence: 40, Enabled: true}))
+	require.NoError(t, router.CreateRoute(&Route{Group: RouteGroupTor, Precedence: 50, Enabled: true}))
+
+	req := Request{ClientIP: "192.168.1.10", Host: "www.example.com", Port: 443}
+	explanation, err := router.Explain(ctx, req, nil)
+	require.NoError(t, err)
+	require.NotNil(t, explanation.Route)
+	assert.Equal(t, RouteGroupGeneral, explanation.Route.Group)
+
+	require.Len(t, explanation.Evaluated, 3)
+	assert.Equal(t, "client_cidr", explanation.Evaluated[0].Condition)
+	assert.Equal(t, "host_glob", explanation.Evaluated[1].Condition)
+	assert.Equal(t, "dst_ports", explanation.Evaluated[2].Condition)
+	assert.Equal(t, `port 443 is not in 80`, explanation.Evaluated[2].Reason)
+
+	// Explain agrees with MatchRoute
+	route, err := router.MatchRoute(ctx, req)
+	require.NoError(t, err)
+	assert.Equal(t, route.ID, explanation.Route.ID)
+
+	// A draft route is evaluated after saved routes of the same precedence
+	draft := &Route{Group: RouteGroupLocal, HostGlob: stringPtr("*.example.com"), TimeWindow: stringPtr("* 9-16 * * 1-5"), Precedence: 30, Enabled: true}
+	req.Time = time.Date(2024, 6, 3, 10, 0, 0, 0, time.Local)
+	explanation, err = router.Explain(ctx, req, draft)
+	require.NoError(t, err)
+	assert.Equal(t, 0, explanation.Route.ID)
+	assert.Len(t, explanation.Evaluated, 3)
+
+	req.Time = time.Date(2024, 6, 8, 10, 0, 0, 0, time.Local)
+	explanation, err = router.Explain(ctx, req, draft)
+	require.NoError(t, err)
+	assert.Equal(t, RouteGroupGeneral, explanation.Route.Group)
+	require.Len(t, explanation.Evaluated, 4)
+	assert.Equal(t, 0, explanation.Evaluated[3].Route.ID)
+	assert.Equal(t, "time_window", explanation.Evaluated[3].Condition)
+
+	_, err = router.Explain(ctx, req, &Route{Group: RouteGroupLocal, DstPorts: stringPtr("x")})
+	assert.Error(t, err)
+
+	// Nothing matches an empty table
+	explanation, err = New(newTestRouteDB(t)).Explain(ctx, req, nil)
+	require.NoError(t, err)
+	assert.Nil(t, explanation.Route)
+	assert.Empty(t, explanation.Evaluated)
+}
+
+func TestPlan(t *testing.T) {
+	db := newTestProxyDB(t)
+	insertTestProxy(t, db, 1, "socks5", "127.0.0.1:1081", 30)
+	insertTestProxy(t, db, 2, "http", "127.0.0.1:8081", 10)
+
+	factory := NewDialerFactory(db, "127.0.0.1:9050", time.Second, nil, FailoverPolicy{})
+	ctx := context.Background()
+
+	plan, err := factory.Plan(ctx, &Route{Group: RouteGroupLocal}, "10.0.0.1", "example.com")
+	require.NoError(t, err)
+	assert.True(t, plan.Direct)
+
+	plan, err = factory.Plan(ctx, &Route{Group: RouteGroupGeneral}, "10.0.0.1", "example.com")
+	require.NoError(t, err)
+	require.Len(t, plan.Proxies, 2)
+	assert.Equal(t, 2, *plan.Proxies[0].ProxyID)
+	assert.Equal(t, "127.0.0.1:8081", plan.Proxies[0].Address)
+	assert.False(t, plan.Pinned)
+
+	// A sticky session puts the pinned proxy first
+	route := &Route{ID: 3, Group: RouteGroupGeneral, Affinity: AffinityClientIP}
+	factory.sessions.pin(affinityKey(route, selection{clientIP: "10.0.0.1"}), route, 1, time.Hour)
+	plan, err = factory.Plan(ctx, route, "10.0.0.1", "example.com")
+	require.NoError(t, err)
+	assert.Equal(t, 1, *plan.Proxies[0].ProxyID)
+	assert.True(t, plan.Pinned)
+
+	plan, err = factory.Plan(ctx, &Route{Group: RouteGroupUpstream, ProxyID: intPtr(1)}, "10.0.0.1", "example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "socks5", plan.Proxies[0].ProxyType)
+
+	plan, err = factory.Plan(ctx, &Route{Group: RouteGroupChain, Hops: []Hop{{Position: 1, Group: RouteGroupTor}, {Position: 2, Group: RouteGroupUpstream, ProxyID: intPtr(2)}}}, "10.0.0.1", "example.com")
+	require.NoError(t, err)
+	require.Len(t, plan.Proxies, 2)
+	assert.Equal(t, "127.0.0.1:9050", plan.Proxies[0].Address)
+	assert.Equal(t, "127.0.0.1:8081", plan.Proxies[1].Address)
+
+	_, err = factory.Plan(ctx, &Route{Group: RouteGroupUpstream, ProxyID: intPtr(9)}, "10.0.0.1", "example.com")
+	assert.Error(t, err)
+}
@@ -0,0 +1,211 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FailoverPolicy controls how GENERAL routes fail over across pool proxies
+type FailoverPolicy struct {
+	Candidates       int           // number of pool proxies to try per request
+	Budget           time.Duration // total time allowed for all attempts
+	FailureThreshold int           // consecutive dial errors before a proxy is skipped
+}
+
+// withDefaults fills in unset fields
+func (p FailoverPolicy) withDefaults(dialTimeout time.Duration) FailoverPolicy {
+	if p.Candidates <= 0 {
+		p.Candidates = 3
+	}
+	if p.Budget <= 0 {
+		p.Budget = time.Duration(p.Candidates) * dialTimeout
+	}
+	if p.FailureThreshold <= 0 {
+		p.FailureThreshold = 2
+	}
+	return p
+}
+
+// FailoverError is returned when every candidate proxy failed
+type FailoverError struct {
+	Attempts []error
+}
+
+// Error implements the error interface
+func (e *FailoverError) Error() string {
+	messages := make([]string, 0, len(e.Attempts))
+	for _, err := range e.Attempts {
+		messages = append(messages, err.Error())
+	}
+	return fmt.Sprintf("all %d general proxies failed: %s", len(e.Attempts), strings.Join(messages, "; "))
+}
+
+// failoverCandidate is one pool proxy a FailoverDialer may use
+type failoverCandidate struct {
+	proxyID   int
+	proxyHost string
+	dialer    Dialer
+}
+
+// FailoverDialer tries pool proxies in order until one of them connects
+type FailoverDialer struct {
+	candidates []failoverCandidate
+	budget     time.Duration
+	health     *proxyHealth
+	pool       *proxyPool
+	onConnect  func(proxyID int) // called with the proxy that connected
+}
+
+// proxyObserverKey is the context key of the function told which pool proxy
+// a dial went through
+type proxyObserverKey struct{}
+
+// WithProxyObserver returns a context in which pool dials report the proxy
+// that connected to observe
+func WithProxyObserver(ctx context.Context, observe func(proxyID int)) context.Context {
+	return context.WithValue(ctx, proxyObserverKey{}, observe)
+}
+
+// DialContext implements Dialer
+func (d *FailoverDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	budgetCtx, cancel := context.WithTimeout(ctx, d.budget)
+	defer cancel()
+
+	var attempts []error
+	for _, candidate := range d.candidates {
+		conn, err := candidate.dialer.DialContext(budgetCtx, network, addr)
+		if err == nil {
+			d.health.recordSuccess(candidate.proxyID)
+			if d.pool != nil {
+				conn = d.pool.track(candidate.proxyID, conn)
+			}
+			if d.onConnect != nil {
+				d.onConnect(candidate.proxyID)
+			}
+			if observe, ok := ctx.Value(proxyObserverKey{}).(func(int)); ok {
+				observe(candidate.proxyID)
+			}
+			return conn, nil
+		}
+
+		// The client went away, none of this is the proxy's fault
+		if ctx.Err() != nil {
+			return nil, err
+		}
+
+		if proxyAnswered(err) {
+			// The proxy is up and reported a problem with the target
+			d.health.recordSuccess(candidate.proxyID)
+		} else {
+			d.health.recordFailure(candidate.proxyID)
+		}
+		attempts = append(attempts, fmt.Errorf("proxy %s: %w", candidate.proxyHost, err))
+
+		if budgetCtx.Err() != nil {
+			return nil, fmt.Errorf("failover budget of %v exhausted after %d attempts: %w", d.budget, len(attempts), budgetCtx.Err())
+		}
+	}
+
+	return nil, &FailoverError{Attempts: attempts}
+}
+
+// proxyAnswered reports whether err is a reply from a working proxy rather
+// than a failure to reach or talk to the proxy itself
+func proxyAnswered(err error) bool {
+	var socksErr *SOCKS5Error
+	if errors.As(err, &socksErr) {
+		return true
+	}
+
+	// Identd failures mean the proxy would refuse every request, like a bad login
+	var socks4Err *SOCKS4Error
+	if errors.As(err, &socks4Err) {
+		return socks4Err.Code == socks4ReplyRejected
+	}
+
+	var upstreamErr *UpstreamError
+	return errors.As(err, &upstreamErr) && upstreamErr.StatusCode != http.StatusProxyAuthRequired
+}
+
+// proxyHealth remembers pool proxies that keep failing to dial, so requests
+// skip them until the health checker has tested them again
+type proxyHealth struct {
+	mu        sync.Mutex
+	threshold int
+	failures  map[int]int
+	failing   map[int]time.Time // proxy ID -> when it was marked as failing
+}
+
+// newProxyHealth creates a new proxy health tracker
+func newProxyHealth(threshold int) *proxyHealth {
+	return &proxyHealth{
+		threshold: threshold,
+		failures:  make(map[int]int),
+		failing:   make(map[int]time.Time),
+	}
+}
+
+// setThreshold changes how many consecutive errors mark a proxy as failing
+func (h *proxyHealth) setThreshold(threshold int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.threshold = threshold
+}
+
+// recordFailure counts a dial error and marks the proxy as failing once the
+// threshold of consecutive errors is reached
+func (h *proxyHealth) recordFailure(proxyID int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.failures[proxyID]++
+	if h.failures[proxyID] >= h.threshold {
+		if _, ok := h.failing[proxyID]; !ok {
+			h.failing[proxyID] = time.Now()
+		}
+	}
+}
+
+// recordSuccess resets the consecutive error count of a proxy
+func (h *proxyHealth) recordSuccess(proxyID int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(h.failures, proxyID)
+	delete(h.failing, proxyID)
+}
+
+// isFailing reports whether a proxy should be skipped. A health check that
+// passed after the proxy was marked clears the mark.
+func (h *proxyHealth) isFailing(proxy *Proxy) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	markedAt, ok := h.failing[proxy.ID]
+	if !ok {
+		return false
+	}
+
+	// tested_timestamp has second precision
+	if proxy.Working && proxy.TestedTimestamp != nil && !proxy.TestedTimestamp.Before(markedAt.Truncate(time.Second)) {
+		delete(h.failures, proxy.ID)
+		delete(h.failing, proxy.ID)
+		return false
+	}
+
+	return true
+}
+
+// failingCount returns the number of proxies currently marked as failing
+func (h *proxyHealth) failingCount() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return len(h.failing)
+}
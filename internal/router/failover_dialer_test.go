@@ -0,0 +1,178 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"proxyrouter/internal/secrets"
+)
+
+// closedAddr returns the address of a port nothing listens on
+func closedAddr(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := listener.Addr().String()
+	listener.Close()
+	return addr
+}
+
+func TestFailoverDialerSkipsDeadProxies(t *testing.T) {
+	echo := startEchoServer(t)
+	socksProxy := startForwardingSOCKS5Server(t)
+
+	db := newTestProxyDB(t)
+	insertTestProxy(t, db, 1, "socks5", closedAddr(t), 10)
+	insertTestProxy(t, db, 2, "http", closedAddr(t), 20)
+	insertTestProxy(t, db, 3, "socks5", socksProxy.Addr().String(), 30)
+
+	factory := NewDialerFactory(db, "127.0.0.1:9050", time.Second, nil, FailoverPolicy{Candidates: 3, FailureThreshold: 2})
+	route := &Route{Group: RouteGroupGeneral}
+
+	for i := 0; i < 3; i++ {
+		dialer, err := factory.CreateDialer(context.Background(), route, "", "")
+		require.NoError(t, err)
+
+		conn, err := dialer.DialContext(context.Background(), "tcp", echo.Addr().String())
+		require.NoError(t, err)
+
+		_, err = conn.Write([]byte("ping"))
+		require.NoError(t, err)
+		buf := make([]byte, 4)
+		_, err = io.ReadFull(conn, buf)
+		require.NoError(t, err)
+		assert.Equal(t, "ping", string(buf))
+		conn.Close()
+	}
+
+	// After two consecutive errors the dead proxies are skipped
+	assert.Equal(t, 2, factory.health.failingCount())
+	dialer, err := factory.CreateDialer(context.Background(), route, "", "")
+	require.NoError(t, err)
+	require.Len(t, dialer.(*FailoverDialer).candidates, 1)
+	assert.Equal(t, 3, dialer.(*FailoverDialer).candidates[0].proxyID)
+
+	// A passing health check after the mark clears it
+	_, err = db.Exec("UPDATE proxies SET tested_timestamp = datetime('now', '+1 second') WHERE id = 1")
+	require.NoError(t, err)
+	factory.pool.invalidate()
+	dialer, err = factory.CreateDialer(context.Background(), route, "", "")
+	require.NoError(t, err)
+	require.Len(t, dialer.(*FailoverDialer).candidates, 2)
+	assert.Equal(t, 1, dialer.(*FailoverDialer).candidates[0].proxyID)
+}
+
+func TestFailoverDialerExhausted(t *testing.T) {
+	db := newTestProxyDB(t)
+	insertTestProxy(t, db, 1, "socks5", closedAddr(t), 10)
+	insertTestProxy(t, db, 2, "socks5", closedAddr(t), 20)
+
+	factory := NewDialerFactory(db, "127.0.0.1:9050", time.Second, nil, FailoverPolicy{Candidates: 3})
+
+	dialer, err := factory.CreateDialer(context.Background(), &Route{Group: RouteGroupGeneral}, "", "")
+	require.NoError(t, err)
+
+	_, err = dialer.DialContext(context.Background(), "tcp", "example.com:80")
+	var failoverErr *FailoverError
+	require.True(t, errors.As(err, &failoverErr))
+	assert.Len(t, failoverErr.Attempts, 2)
+	assert.Equal(t, http.StatusBadGateway, DialErrorStatus(err))
+
+	// Once every pool proxy is marked as failing there is nothing left to try
+	_, err = dialer.DialContext(context.Background(), "tcp", "example.com:80")
+	require.Error(t, err)
+	_, err = factory.CreateDialer(context.Background(), &Route{Group: RouteGroupGeneral}, "", "")
+	assert.ErrorContains(t, err, "marked as failing")
+}
+
+func TestFailoverDialerBudget(t *testing.T) {
+	// Proxies that accept connections but never answer
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	db := newTestProxyDB(t)
+	insertTestProxy(t, db, 1, "socks5", listener.Addr().String(), 10)
+	insertTestProxy(t, db, 2, "http", listener.Addr().String(), 20)
+
+	factory := NewDialerFactory(db, "127.0.0.1:9050", 2*time.Second, nil, FailoverPolicy{Budget: 100 * time.Millisecond})
+
+	dialer, err := factory.CreateDialer(context.Background(), &Route{Group: RouteGroupGeneral}, "", "")
+	require.NoError(t, err)
+
+	start := time.Now()
+	_, err = dialer.DialContext(context.Background(), "tcp", "example.com:80")
+	require.Error(t, err)
+	assert.Less(t, time.Since(start), time.Second)
+	assert.Equal(t, http.StatusGatewayTimeout, DialErrorStatus(err))
+}
+
+func TestDialerFactoryReconfigure(t *testing.T) {
+	db := newTestProxyDB(t)
+	insertTestProxy(t, db, 1, "socks5", "127.0.0.1:1081", 30)
+	insertTestProxy(t, db, 2, "http", "127.0.0.1:8081", 10)
+
+	factory := NewDialerFactory(db, "127.0.0.1:9050", time.Second, nil, FailoverPolicy{Candidates: 3})
+	factory.Reconfigure("127.0.0.1:9150", 2*time.Second, FailoverPolicy{Candidates: 1, FailureThreshold: 5})
+	ctx := context.Background()
+
+	plan, err := factory.Plan(ctx, &Route{Group: RouteGroupTor}, "10.0.0.1", "example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "127.0.0.1:9150", plan.Proxies[0].Address)
+
+	plan, err = factory.Plan(ctx, &Route{Group: RouteGroupGeneral}, "10.0.0.1", "example.com")
+	require.NoError(t, err)
+	assert.Len(t, plan.Proxies, 1)
+
+	dialer, err := factory.CreateDialer(ctx, &Route{Group: RouteGroupLocal}, "10.0.0.1", "example.com")
+	require.NoError(t, err)
+	assert.Equal(t, 2*time.Second, dialer.(*net.Dialer).Timeout)
+	assert.Equal(t, 5, factory.health.threshold)
+	assert.Equal(t, 2*time.Second, factory.current().failover.Budget, "the budget default follows the new dial timeout")
+}
+
+func TestLoadGeneralPoolSkipsUndecryptableProxies(t *testing.T) {
+	db := newTestProxyDB(t)
+	insertTestProxy(t, db, 1, "http", "127.0.0.1:8001", 10)
+	insertTestProxy(t, db, 2, "http", "127.0.0.1:8002", 20)
+	insertTestProxy(t, db, 3, "http", "127.0.0.1:8003", 30)
+
+	box, err := secrets.New(make([]byte, 32))
+	require.NoError(t, err)
+	sealed, err := box.Seal("secret")
+	require.NoError(t, err)
+	_, err = db.Exec("UPDATE proxies SET username = 'alice', password_enc = ? WHERE id = 1", sealed)
+	require.NoError(t, err)
+
+	// Sealed with another key, as after a key change
+	_, err = db.Exec("UPDATE proxies SET username = 'bob', password_enc = 'not-sealed-with-this-key' WHERE id = 2")
+	require.NoError(t, err)
+
+	f := NewDialerFactory(db, "127.0.0.1:9050", time.Second, box, FailoverPolicy{})
+	proxies, err := f.loadGeneralPool(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []int{1, 3}, proxyIDs(proxies))
+	assert.Equal(t, "secret", proxies[0].Password)
+
+	// Without a credential key only the proxies without credentials remain
+	f = NewDialerFactory(db, "127.0.0.1:9050", time.Second, nil, FailoverPolicy{})
+	proxies, err = f.loadGeneralPool(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []int{3}, proxyIDs(proxies))
+}
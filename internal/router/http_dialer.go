@@ -0,0 +1,182 @@
+package router
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"proxyrouter/internal/halfclose"
+)
+
+// UpstreamError is returned when an upstream proxy answers a tunnel request
+// with anything other than a success reply
+type UpstreamError struct {
+	Proxy      string
+	StatusCode int
+	Status     string
+}
+
+// Error implements the error interface
+func (e *UpstreamError) Error() string {
+	if e.StatusCode == http.StatusForbidden || e.StatusCode == http.StatusProxyAuthRequired {
+		// The proxy turned the request down rather than failing to reach the target
+		return fmt.Sprintf("upstream proxy %s refused CONNECT: %s", e.Proxy, e.Status)
+	}
+	return fmt.Sprintf("upstream proxy %s CONNECT failed: %s", e.Proxy, e.Status)
+}
+
+// Timeout reports whether the upstream gave up waiting for the target
+func (e *UpstreamError) Timeout() bool {
+	return e.StatusCode == http.StatusGatewayTimeout || e.StatusCode == http.StatusRequestTimeout
+}
+
+// DialErrorStatus maps a dial error to the HTTP status code a front-end
+// should send back to its client
+func DialErrorStatus(err error) int {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return http.StatusGatewayTimeout
+	}
+
+	// Covers net.Error as well as UpstreamError and SOCKS5Error replies
+	var timeoutErr interface{ Timeout() bool }
+	if errors.As(err, &timeoutErr) && timeoutErr.Timeout() {
+		return http.StatusGatewayTimeout
+	}
+
+	return http.StatusBadGateway
+}
+
+// HTTPProxyDialer implements Dialer for HTTP proxies
+type HTTPProxyDialer struct {
+	proxyHost string
+	timeout   time.Duration
+	tlsConfig *tls.Config // non-nil for https proxies
+	username  string
+	password  string
+	forward   Dialer // reaches the proxy through a previous chain hop when set
+}
+
+// DialContext implements Dialer for HTTP proxies by opening a CONNECT tunnel
+func (h *HTTPProxyDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("HTTP proxy %s does not support network %s", h.proxyHost, network)
+	}
+
+	proxyConn, err := dialProxy(ctx, h.forward, h.timeout, h.proxyHost)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to HTTP proxy %s: %w", h.proxyHost, err)
+	}
+
+	conn, err := h.connect(ctx, proxyConn, addr)
+	if err != nil {
+		proxyConn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// connect performs the optional TLS handshake and the CONNECT exchange on an
+// already established connection to the proxy
+func (h *HTTPProxyDialer) connect(ctx context.Context, conn net.Conn, addr string) (net.Conn, error) {
+	// Bound the handshake by both the dial timeout and the caller's context
+	deadline := time.Now().Add(h.timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+	defer conn.SetDeadline(time.Time{}) // Clear deadline
+
+	// Abort blocked reads and writes as soon as the context is cancelled
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Unix(1, 0))
+	})
+	defer stop()
+
+	if h.tlsConfig != nil {
+		tlsConn := tls.Client(conn, h.proxyTLSConfig())
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			return nil, fmt.Errorf("TLS handshake with HTTP proxy %s failed: %w", h.proxyHost, err)
+		}
+		conn = tlsConn
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if h.username != "" {
+		credentials := base64.StdEncoding.EncodeToString([]byte(h.username + ":" + h.password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, fmt.Errorf("failed to write CONNECT request to %s: %w", h.proxyHost, err)
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("CONNECT to %s via %s aborted: %w", addr, h.proxyHost, ctx.Err())
+		}
+		return nil, fmt.Errorf("failed to read CONNECT response from %s: %w", h.proxyHost, err)
+	}
+	// A CONNECT response has no body, the tunnel starts right after the headers
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, &UpstreamError{
+			Proxy:      h.proxyHost,
+			StatusCode: resp.StatusCode,
+			Status:     resp.Status,
+		}
+	}
+
+	// Keep any bytes the target sent along with the proxy's reply
+	if reader.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+
+	return conn, nil
+}
+
+// proxyTLSConfig returns the TLS config used for the proxy connection,
+// defaulting the server name to the proxy host
+func (h *HTTPProxyDialer) proxyTLSConfig() *tls.Config {
+	config := h.tlsConfig.Clone()
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(h.proxyHost)
+		if err != nil {
+			host = h.proxyHost
+		}
+		config.ServerName = host
+	}
+	return config
+}
+
+// bufferedConn is a net.Conn whose reads drain a bufio.Reader first
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+// Read reads from the buffered reader, which falls through to the conn
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// CloseWrite half-closes the wrapped connection
+func (c *bufferedConn) CloseWrite() error {
+	return halfclose.CloseWrite(c.Conn)
+}
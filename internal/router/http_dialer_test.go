@@ -0,0 +1,245 @@
+package router
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startFakeHTTPProxy starts an in-process upstream HTTP proxy that answers
+// CONNECT requests with the given status and then echoes tunnelled bytes
+func startFakeHTTPProxy(t *testing.T, status int, connects chan<- string) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func(conn net.Conn) {
+				defer conn.Close()
+
+				reader := bufio.NewReader(conn)
+				req, err := http.ReadRequest(reader)
+				if err != nil {
+					return
+				}
+				if connects != nil {
+					connects <- req.Method + " " + req.Host
+				}
+
+				fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\n\r\n", status, http.StatusText(status))
+				if status != http.StatusOK {
+					return
+				}
+
+				io.Copy(conn, reader)
+			}(conn)
+		}
+	}()
+
+	return listener
+}
+
+func TestHTTPProxyDialerConnect(t *testing.T) {
+	connects := make(chan string, 1)
+	listener := startFakeHTTPProxy(t, http.StatusOK, connects)
+
+	dialer := &HTTPProxyDialer{
+		proxyHost: listener.Addr().String(),
+		timeout:   2 * time.Second,
+	}
+
+	conn, err := dialer.DialContext(context.Background(), "tcp", "example.com:443")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	assert.Equal(t, "CONNECT example.com:443", <-connects)
+
+	// Bytes written to the tunnel must come back through the fake upstream
+	_, err = conn.Write([]byte("ping"))
+	require.NoError(t, err)
+
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "ping", string(buf))
+}
+
+func TestHTTPProxyDialerErrorStatus(t *testing.T) {
+	tests := []struct {
+		name           string
+		status         int
+		expectedStatus int
+	}{
+		{"forbidden", http.StatusForbidden, http.StatusBadGateway},
+		{"auth required", http.StatusProxyAuthRequired, http.StatusBadGateway},
+		{"bad gateway", http.StatusBadGateway, http.StatusBadGateway},
+		{"gateway timeout", http.StatusGatewayTimeout, http.StatusGatewayTimeout},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			listener := startFakeHTTPProxy(t, tt.status, nil)
+
+			dialer := &HTTPProxyDialer{
+				proxyHost: listener.Addr().String(),
+				timeout:   2 * time.Second,
+			}
+
+			_, err := dialer.DialContext(context.Background(), "tcp", "example.com:443")
+			require.Error(t, err)
+
+			var upstreamErr *UpstreamError
+			require.True(t, errors.As(err, &upstreamErr))
+			assert.Equal(t, tt.status, upstreamErr.StatusCode)
+			assert.Equal(t, tt.expectedStatus, DialErrorStatus(err))
+		})
+	}
+}
+
+func TestHTTPProxyDialerContextCancel(t *testing.T) {
+	// An upstream that accepts but never answers the CONNECT request
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(io.Discard, conn)
+	}()
+
+	dialer := &HTTPProxyDialer{
+		proxyHost: listener.Addr().String(),
+		timeout:   10 * time.Second,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err = dialer.DialContext(ctx, "tcp", "example.com:443")
+	require.Error(t, err)
+	assert.Less(t, time.Since(start), 5*time.Second)
+	assert.Equal(t, http.StatusGatewayTimeout, DialErrorStatus(err))
+}
+
+func TestHTTPProxyDialerTLS(t *testing.T) {
+	connects := make(chan string, 1)
+
+	// An https proxy: TLS to the proxy, then a hijacked CONNECT tunnel
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		connects <- r.Method + " " + r.Host
+
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		rw.WriteString("HTTP/1.1 200 Connection established\r\n\r\n")
+		rw.Flush()
+		io.Copy(conn, rw)
+	}))
+	server.StartTLS()
+	defer server.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(server.Certificate())
+
+	dialer := &HTTPProxyDialer{
+		proxyHost: server.Listener.Addr().String(),
+		timeout:   2 * time.Second,
+		tlsConfig: &tls.Config{RootCAs: pool},
+	}
+
+	conn, err := dialer.DialContext(context.Background(), "tcp", "example.com:443")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	assert.Equal(t, "CONNECT example.com:443", <-connects)
+
+	_, err = conn.Write([]byte("pong"))
+	require.NoError(t, err)
+
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "pong", string(buf))
+}
+
+func TestCreateHTTPDialer(t *testing.T) {
+	factory := NewDialerFactory(nil, "127.0.0.1:9050", time.Second, nil, FailoverPolicy{})
+
+	dialer, err := factory.createProxyDialer(&Proxy{ProxyType: "https", IP: "10.0.0.1", Port: 3128})
+	require.NoError(t, err)
+
+	httpDialer, ok := dialer.(*HTTPProxyDialer)
+	require.True(t, ok)
+	assert.Equal(t, "10.0.0.1:3128", httpDialer.proxyHost)
+	assert.NotNil(t, httpDialer.tlsConfig)
+
+	dialer, err = factory.createProxyDialer(&Proxy{ProxyType: "http", IP: "10.0.0.1", Port: 8080})
+	require.NoError(t, err)
+	assert.Nil(t, dialer.(*HTTPProxyDialer).tlsConfig)
+}
+
+func TestHTTPProxyDialerProxyAuthorization(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	auth := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		req, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil {
+			return
+		}
+		auth <- req.Header.Get("Proxy-Authorization")
+		fmt.Fprintf(conn, "HTTP/1.1 200 OK\r\n\r\n")
+	}()
+
+	dialer := &HTTPProxyDialer{
+		proxyHost: listener.Addr().String(),
+		timeout:   2 * time.Second,
+		username:  "alice",
+		password:  "s3cret",
+	}
+
+	conn, err := dialer.DialContext(context.Background(), "tcp", "example.com:443")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// base64("alice:s3cret")
+	assert.Equal(t, "Basic YWxpY2U6czNjcmV0", <-auth)
+}
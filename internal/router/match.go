@@ -0,0 +1,397 @@
+package router
+
+import (
+	"fmt"
+	"net/netip"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Request describes a connection being routed. Fields the listener cannot
+// know are left empty, and routes that need them do not match.
+type Request struct {
+	ClientIP string
+	Username string // authenticated proxy user, without any session suffix
+	Host     string
+	Port     int       // destination port, 0 when unknown
+	Scheme   string    // URL scheme, plain HTTP requests only
+	Method   string    // HTTP method, including CONNECT
+	Path     string    // URL path, plain HTTP requests only
+	Time     time.Time // when the request arrived, zero means now
+}
+
+// portRange is an inclusive range of destination ports
+type portRange struct {
+	low, high int
+}
+
+// compiledRoute is a route with its conditions parsed once
+type compiledRoute struct {
+	route     *Route
+	err       error // the first condition that does not parse; the route never matches
+	hasCIDR   bool
+	prefix    netip.Prefix
+	checkGlob bool // the host glob is not indexed by the route table
+	hostRegex *regexp.Regexp
+	ports     []portRange
+	schemes   []string
+	methods   []string
+	window    *timeWindow
+}
+
+// compileRoute parses the conditions of a route. It reports the first
+// condition that does not parse, in which case the route never matches.
+func compileRoute(route *Route) (*compiledRoute, error) {
+	c := &compiledRoute{route: route}
+
+	fail := func(err error) (*compiledRoute, error) {
+		c.err = err
+		return c, err
+	}
+
+	if route.ClientCIDR != nil {
+		c.hasCIDR = true
+		prefix, err := netip.ParsePrefix(*route.ClientCIDR)
+		if err != nil {
+			return fail(fmt.Errorf("invalid client_cidr %q: %w", *route.ClientCIDR, err))
+		}
+		c.prefix = prefix.Masked()
+	}
+
+	if route.HostRegex != nil {
+		re, err := regexp.Compile(*route.HostRegex)
+		if err != nil {
+			return fail(fmt.Errorf("invalid host_regex: %w", err))
+		}
+		c.hostRegex = re
+	}
+
+	if route.DstPorts != nil {
+		ports, err := parsePorts(*route.DstPorts)
+		if err != nil {
+			return fail(err)
+		}
+		c.ports = ports
+	}
+
+	if route.Schemes != nil {
+		c.schemes = parseList(*route.Schemes, strings.ToLower)
+		if len(c.schemes) == 0 {
+			return fail(fmt.Errorf("schemes must list at least one scheme"))
+		}
+	}
+
+	if route.Methods != nil {
+		c.methods = parseList(*route.Methods, strings.ToUpper)
+		if len(c.methods) == 0 {
+			return fail(fmt.Errorf("methods must list at least one method"))
+		}
+	}
+
+	if route.TimeWindow != nil {
+		window, err := parseTimeWindow(*route.TimeWindow)
+		if err != nil {
+			return fail(err)
+		}
+		c.window = window
+	}
+
+	return c, nil
+}
+
+// ValidateRoute checks that every condition of a route parses and that its
+// bandwidth limit and timeouts are positive
+func ValidateRoute(route *Route) error {
+	limits := []struct {
+		column string
+		value  *int
+	}{
+		{"bandwidth_limit", route.BandwidthLimit},
+		{"idle_timeout_sec", route.IdleTimeoutSec},
+		{"max_lifetime_sec", route.MaxLifetimeSec},
+	}
+	for _, limit := range limits {
+		if limit.value != nil && *limit.value <= 0 {
+			return fmt.Errorf("%s must be positive", limit.column)
+		}
+	}
+	_, err := compileRoute(route)
+	return err
+}
+
+// matches checks every condition of the route except a host glob that the
+// route table has already matched
+func (c *compiledRoute) matches(req Request, addr netip.Addr, addrOK bool) bool {
+	return c.mismatch(req, addr, addrOK, c.checkGlob) == ""
+}
+
+// mismatch returns the column of the first condition the request fails, or
+// "" when every condition holds. The host glob is only checked with checkGlob.
+func (c *compiledRoute) mismatch(req Request, addr netip.Addr, addrOK, checkGlob bool) string {
+	route := c.route
+	switch {
+	case c.err != nil:
+		return "invalid"
+	case c.hasCIDR && !(addrOK && c.prefix.Contains(addr)):
+		return "client_cidr"
+	case route.ClientUser != nil && req.Username != *route.ClientUser:
+		return "client_user"
+	case checkGlob && route.HostGlob != nil && !hostMatchesGlob(req.Host, *route.HostGlob):
+		return "host_glob"
+	case c.hostRegex != nil && !c.hostRegex.MatchString(req.Host):
+		return "host_regex"
+	case c.ports != nil && !portInRanges(req.Port, c.ports):
+		return "dst_ports"
+	case c.schemes != nil && !containsFold(c.schemes, req.Scheme):
+		return "schemes"
+	case c.methods != nil && !containsFold(c.methods, req.Method):
+		return "methods"
+	case route.PathPrefix != nil && (req.Path == "" || !strings.HasPrefix(req.Path, *route.PathPrefix)):
+		return "path_prefix"
+	case c.window != nil && !c.window.contains(req.Time):
+		return "time_window"
+	}
+	return ""
+}
+
+// parseClientAddr parses a client IP, unmapping IPv4-mapped IPv6 addresses
+func parseClientAddr(clientIP string) (netip.Addr, bool) {
+	addr, err := netip.ParseAddr(clientIP)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
+
+// parsePorts parses a port list like "80,443,8000-8999"
+func parsePorts(value string) ([]portRange, error) {
+	var ports []portRange
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		lowPart, highPart, isRange := strings.Cut(part, "-")
+		low, err := strconv.Atoi(strings.TrimSpace(lowPart))
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %q in dst_ports", part)
+		}
+		high := low
+		if isRange {
+			if high, err = strconv.Atoi(strings.TrimSpace(highPart)); err != nil {
+				return nil, fmt.Errorf("invalid port %q in dst_ports", part)
+			}
+		}
+		if low < 1 || high > 65535 || low > high {
+			return nil, fmt.Errorf("port range %q in dst_ports is out of range 1-65535", part)
+		}
+		ports = append(ports, portRange{low: low, high: high})
+	}
+
+	if len(ports) == 0 {
+		return nil, fmt.Errorf("dst_ports must list at least one port")
+	}
+	return ports, nil
+}
+
+// portInRanges reports whether port falls in any of the ranges
+func portInRanges(port int, ports []portRange) bool {
+	for _, r := range ports {
+		if port >= r.low && port <= r.high {
+			return true
+		}
+	}
+	return false
+}
+
+// parseList splits a comma-separated list, normalising each entry
+func parseList(value string, normalize func(string) string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, normalize(item))
+		}
+	}
+	return items
+}
+
+// containsFold reports whether value is in items, ignoring case
+func containsFold(items []string, value string) bool {
+	for _, item := range items {
+		if strings.EqualFold(item, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// isSimpleGlob reports whether a glob is one of the forms the route table
+// indexes: an exact host, "*", "*.suffix" or "prefix.*"
+func isSimpleGlob(glob string) bool {
+	switch strings.Count(glob, "*") {
+	case 0:
+		return true
+	case 1:
+		return glob == "*" || strings.HasPrefix(glob, "*.") || strings.HasSuffix(glob, ".*")
+	default:
+		return false
+	}
+}
+
+// wildcardMatch matches host against a glob in which each "*" stands for any
+// run of characters, dots included
+func wildcardMatch(glob, host string) bool {
+	g, h := 0, 0
+	star, mark := -1, 0
+	for h < len(host) {
+		switch {
+		case g < len(glob) && glob[g] == '*':
+			star, mark = g, h
+			g++
+		case g < len(glob) && glob[g] == host[h]:
+			g++
+			h++
+		case star >= 0:
+			// Let the last star swallow one more character
+			mark++
+			g, h = star+1, mark
+		default:
+			return false
+		}
+	}
+	for g < len(glob) && glob[g] == '*' {
+		g++
+	}
+	return g == len(glob)
+}
+
+// routeColumnValidators validates values for the columns UpdateRoute accepts.
+// A nil value clears a nullable column.
+var routeColumnValidators = map[string]func(value interface{}) error{
+	"group":            validateGroup,
+	"precedence":       validateIntColumn(false, nil),
+	"enabled":          nil,
+	"proxy_id":         validateIntColumn(true, nil),
+	"client_cidr":      validateStringColumn(func(v string) error { _, err := netip.ParsePrefix(v); return err }),
+	"client_user":      nil,
+	"host_glob":        nil,
+	"host_regex":       validateStringColumn(func(v string) error { _, err := regexp.Compile(v); return err }),
+	"dst_ports":        validateStringColumn(func(v string) error { _, err := parsePorts(v); return err }),
+	"schemes":          validateStringColumn(func(v string) error { return requireList(v, "schemes") }),
+	"methods":          validateStringColumn(func(v string) error { return requireList(v, "methods") }),
+	"path_prefix":      nil,
+	"time_window":      validateStringColumn(func(v string) error { _, err := parseTimeWindow(v); return err }),
+	"strategy":         validateStringColumn(func(v string) error { return checkValid(ValidStrategy(Strategy(v)), "strategy", v) }),
+	"affinity":         validateStringColumn(func(v string) error { return checkValid(ValidAffinity(Affinity(v)), "affinity", v) }),
+	"affinity_ttl_sec": validateIntColumn(true, nil),
+	"bandwidth_limit":  validateIntColumn(true, requirePositive),
+	"idle_timeout_sec": validateIntColumn(true, requirePositive),
+	"max_lifetime_sec": validateIntColumn(true, requirePositive),
+}
+
+// validateGroup checks that a route group is known. The column cannot be
+// cleared.
+func validateGroup(value interface{}) error {
+	group, ok := value.(string)
+	if !ok {
+		return fmt.Errorf("expected a route group, got %T", value)
+	}
+	switch RouteGroup(group) {
+	case RouteGroupLocal, RouteGroupGeneral, RouteGroupTor, RouteGroupUpstream, RouteGroupChain:
+		return nil
+	default:
+		return fmt.Errorf("unknown route group: %s", group)
+	}
+}
+
+// validateIntColumn adapts an optional whole number check to a column
+// validator. Only a nullable column can be cleared with nil.
+func validateIntColumn(nullable bool, check func(value int) error) func(value interface{}) error {
+	return func(value interface{}) error {
+		if v, ok := value.(*int); ok {
+			if v == nil {
+				value = nil
+			} else {
+				value = *v
+			}
+		}
+
+		switch v := value.(type) {
+		case nil:
+			if !nullable {
+				return fmt.Errorf("cannot be cleared")
+			}
+			return nil
+		case int:
+			if check == nil {
+				return nil
+			}
+			return check(v)
+		default:
+			return fmt.Errorf("expected a whole number, got %T", value)
+		}
+	}
+}
+
+// requirePositive checks that a limit or timeout is above zero
+func requirePositive(value int) error {
+	if value <= 0 {
+		return fmt.Errorf("must be positive")
+	}
+	return nil
+}
+
+// validateStringColumn adapts a string check to a column validator
+func validateStringColumn(check func(value string) error) func(value interface{}) error {
+	return func(value interface{}) error {
+		switch v := value.(type) {
+		case nil:
+			return nil
+		case string:
+			return check(v)
+		case *string:
+			if v == nil {
+				return nil
+			}
+			return check(*v)
+		default:
+			return fmt.Errorf("expected a string, got %T", value)
+		}
+	}
+}
+
+// requireList checks that a comma-separated list is not empty
+func requireList(value, name string) error {
+	if len(parseList(value, strings.TrimSpace)) == 0 {
+		return fmt.Errorf("%s must list at least one entry", name)
+	}
+	return nil
+}
+
+// checkValid turns a validity check into an error
+func checkValid(ok bool, name, value string) error {
+	if !ok {
+		return fmt.Errorf("unknown %s: %s", name, value)
+	}
+	return nil
+}
+
+// ValidateRouteUpdates checks the columns and values passed to UpdateRoute
+func ValidateRouteUpdates(updates map[string]interface{}) error {
+	for column, value := range updates {
+		validate, ok := routeColumnValidators[column]
+		if !ok {
+			return fmt.Errorf("unknown route field: %s", column)
+		}
+		if validate == nil {
+			continue
+		}
+		if err := validate(value); err != nil {
+			return fmt.Errorf("invalid %s: %w", column, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package router
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// routeMatches reports whether route matches req on its own, checking the
+// host glob too since no route table has narrowed the candidates
+func routeMatches(route *Route, req Request) bool {
+	compiled, _ := compileRoute(route)
+	compiled.checkGlob = true
+	addr, addrOK := parseClientAddr(req.ClientIP)
+	return compiled.matches(req, addr, addrOK)
+}
+
+func TestWildcardGlobs(t *testing.T) {
+	tests := []struct {
+		host     string
+		glob     string
+		expected bool
+	}{
+		{"api-eu.example.com", "api-*.example.com", true},
+		{"api.example.com", "api-*.example.com", false},
+		{"www.example.co.uk", "*.example.*", true},
+		{"example.com", "*.example.*", false},
+		{"cdn1.static.example.com", "cdn*.*.example.com", true},
+		{"cdn1.example.com", "cdn*.*.example.com", false},
+		{"example.com", "**", true},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.expected, hostMatchesGlob(tt.host, tt.glob), "%s %s", tt.host, tt.glob)
+	}
+}
+
+func TestRouteConditions(t *testing.T) {
+	request := Request{
+		ClientIP: "192.168.10.5",
+		Username: "alice",
+		Host:     "api.example.com",
+		Port:     443,
+		Scheme:   "http",
+		Method:   "GET",
+		Path:     "/v1/users",
+		Time:     time.Date(2024, 6, 3, 10, 0, 0, 0, time.Local),
+	}
+
+	tests := []struct {
+		name     string
+		route    *Route
+		expected bool
+	}{
+		{"client user", &Route{ClientUser: stringPtr("alice")}, true},
+		{"client user mismatch", &Route{ClientUser: stringPtr("bob")}, false},
+		{"host regex", &Route{HostRegex: stringPtr(`^(api|www)\.example\.com$`)}, true},
+		{"host regex mismatch", &Route{HostRegex: stringPtr(`^www\.`)}, false},
+		{"port list", &Route{DstPorts: stringPtr("80, 443")}, true},
+		{"port range", &Route{DstPorts: stringPtr("400-500")}, true},
+		{"port mismatch", &Route{DstPorts: stringPtr("80,8000-8999")}, false},
+		{"scheme", &Route{Schemes: stringPtr("HTTP,ws")}, true},
+		{"scheme mismatch", &Route{Schemes: stringPtr("ws")}, false},
+		{"method", &Route{Methods: stringPtr("get,head")}, true},
+		{"method mismatch", &Route{Methods: stringPtr("CONNECT")}, false},
+		{"path prefix", &Route{PathPrefix: stringPtr("/v1/")}, true},
+		{"path prefix mismatch", &Route{PathPrefix: stringPtr("/v2/")}, false},
+		{"time window", &Route{TimeWindow: stringPtr("* 9-16 * * 1-5")}, true},
+		{"time window mismatch", &Route{TimeWindow: stringPtr("* 0-8 * * *")}, false},
+		{"all conditions", &Route{
+			ClientCIDR: stringPtr("192.168.10.0/24"),
+			HostGlob:   stringPtr("*.example.com"),
+			DstPorts:   stringPtr("443"),
+			Methods:    stringPtr("GET"),
+			TimeWindow: stringPtr("* 9-16 * * 1-5"),
+		}, true},
+		{"invalid condition never matches", &Route{DstPorts: stringPtr("http")}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, routeMatches(tt.route, request))
+		})
+	}
+
+	// Conditions on fields the listener does not know never match
+	socksRequest := Request{ClientIP: "192.168.10.5", Host: "api.example.com", Port: 443}
+	assert.False(t, routeMatches(&Route{Schemes: stringPtr("http")}, socksRequest))
+	assert.False(t, routeMatches(&Route{PathPrefix: stringPtr("/")}, socksRequest))
+	assert.False(t, routeMatches(&Route{ClientUser: stringPtr("alice")}, socksRequest))
+	assert.True(t, routeMatches(&Route{DstPorts: stringPtr("443")}, socksRequest))
+}
+
+func TestValidateRoute(t *testing.T) {
+	assert.NoError(t, ValidateRoute(&Route{DstPorts: stringPtr("1-65535"), TimeWindow: stringPtr("* * * * *")}))
+	assert.ErrorContains(t, ValidateRoute(&Route{ClientCIDR: stringPtr("10.0.0.0/33")}), "client_cidr")
+	assert.ErrorContains(t, ValidateRoute(&Route{HostRegex: stringPtr("(")}), "host_regex")
+	assert.ErrorContains(t, ValidateRoute(&Route{DstPorts: stringPtr("0")}), "dst_ports")
+	assert.ErrorContains(t, ValidateRoute(&Route{DstPorts: stringPtr(",")}), "dst_ports")
+	assert.ErrorContains(t, ValidateRoute(&Route{Methods: stringPtr(" , ")}), "methods")
+	assert.ErrorContains(t, ValidateRoute(&Route{TimeWindow: stringPtr("* * *")}), "time window")
+	assert.ErrorContains(t, ValidateRoute(&Route{BandwidthLimit: new(int)}), "bandwidth_limit")
+	assert.ErrorContains(t, ValidateRoute(&Route{IdleTimeoutSec: intPtr(-1)}), "idle_timeout_sec")
+
+	assert.NoError(t, ValidateRouteUpdates(map[string]interface{}{"dst_ports": "443", "time_window": nil, "group": "TOR"}))
+	assert.ErrorContains(t, ValidateRouteUpdates(map[string]interface{}{"dst_ports": "99999"}), "dst_ports")
+	assert.ErrorContains(t, ValidateRouteUpdates(map[string]interface{}{"id = 1; --": 1}), "unknown route field")
+	assert.ErrorContains(t, ValidateRouteUpdates(map[string]interface{}{"group": "DIRECT"}), "unknown route group")
+	assert.Error(t, ValidateRouteUpdates(map[string]interface{}{"group": nil}))
+	assert.NoError(t, ValidateRouteUpdates(map[string]interface{}{"precedence": -5, "bandwidth_limit": 1024, "idle_timeout_sec": nil, "proxy_id": nil}))
+	assert.ErrorContains(t, ValidateRouteUpdates(map[string]interface{}{"bandwidth_limit": 0}), "bandwidth_limit")
+	assert.ErrorContains(t, ValidateRouteUpdates(map[string]interface{}{"max_lifetime_sec": -1}), "max_lifetime_sec")
+	assert.ErrorContains(t, ValidateRouteUpdates(map[string]interface{}{"affinity_ttl_sec": "60"}), "affinity_ttl_sec")
+	assert.Error(t, ValidateRouteUpdates(map[string]interface{}{"precedence": nil}))
+}
+
+func TestMatchRouteConditions(t *testing.T) {
+	db := newTestRouteDB(t)
+	router := New(db)
+	ctx := context.Background()
+
+	require.NoError(t, router.CreateRoute(&Route{
+		Group:      RouteGroupLocal,
+		HostGlob:   stringPtr("*.bank.com"),
+		TimeWindow: stringPtr("* 9-16 * * 1-5"),
+		Precedence: 10,
+		Enabled:    true,
+	}))
+	require.NoError(t, router.CreateRoute(&Route{
+		Group:      RouteGroupUpstream,
+		ProxyID:    intPtr(1),
+		HostGlob:   stringPtr("api-*.example.*"),
+		DstPorts:   stringPtr("443"),
+		Precedence: 20,
+		Enabled:    true,
+	}))
+	require.NoError(t, router.CreateRoute(&Route{Group: RouteGroupTor, Precedence: 100, Enabled: true}))
+	assert.Error(t, router.CreateRoute(&Route{Group: RouteGroupTor, DstPorts: stringPtr("x"), Enabled: true}))
+
+	monday := time.Date(2024, 6, 3, 10, 0, 0, 0, time.Local)
+	saturday := time.Date(2024, 6, 8, 10, 0, 0, 0, time.Local)
+
+	route, err := router.MatchRoute(ctx, Request{ClientIP: "192.168.1.10", Host: "www.bank.com", Port: 443, Time: monday})
+	require.NoError(t, err)
+	assert.Equal(t, RouteGroupLocal, route.Group)
+
+	route, err = router.MatchRoute(ctx, Request{ClientIP: "192.168.1.10", Host: "www.bank.com", Port: 443, Time: saturday})
+	require.NoError(t, err)
+	assert.Equal(t, RouteGroupTor, route.Group)
+
+	route, err = router.MatchRoute(ctx, Request{ClientIP: "192.168.1.10", Host: "api-eu.example.net", Port: 443})
+	require.NoError(t, err)
+	assert.Equal(t, RouteGroupUpstream, route.Group)
+
+	route, err = router.MatchRoute(ctx, Request{ClientIP: "192.168.1.10", Host: "api-eu.example.net", Port: 80})
+	require.NoError(t, err)
+	assert.Equal(t, RouteGroupTor, route.Group)
+
+	// Updates are validated and may clear conditions
+	assert.Error(t, router.UpdateRoute(ctx, 2, map[string]interface{}{"dst_ports": "0-80"}, nil))
+	require.NoError(t, router.UpdateRoute(ctx, 2, map[string]interface{}{"dst_ports": nil, "group": "LOCAL"}, nil))
+	route, err = router.MatchRoute(ctx, Request{ClientIP: "192.168.1.10", Host: "api-eu.example.net", Port: 80})
+	require.NoError(t, err)
+	assert.Equal(t, RouteGroupLocal, route.Group)
+}
@@ -0,0 +1,86 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// ErrUDPUnsupported is returned for routes that cannot carry UDP
+var ErrUDPUnsupported = errors.New("route does not support UDP")
+
+// PacketConn exchanges datagrams with targets given in host:port form
+type PacketConn interface {
+	// WriteTo sends a datagram to addr
+	WriteTo(b []byte, addr string) (int, error)
+	// ReadFrom reads a datagram and returns the address it came from
+	ReadFrom(b []byte) (int, string, error)
+	Close() error
+}
+
+// ListenPacket opens a packet connection for a route. Only LOCAL routes and
+// UPSTREAM routes to SOCKS5 proxies carry UDP, other routes return an error
+// wrapping ErrUDPUnsupported.
+func (f *DialerFactory) ListenPacket(ctx context.Context, route *Route) (PacketConn, error) {
+	switch route.Group {
+	case RouteGroupLocal:
+		conn, err := net.ListenUDP("udp", nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open UDP socket: %w", err)
+		}
+		return &localPacketConn{conn: conn}, nil
+	case RouteGroupUpstream:
+		if route.ProxyID == nil {
+			return nil, fmt.Errorf("proxy_id is required for UPSTREAM route")
+		}
+		proxy, err := f.getProxyByID(ctx, *route.ProxyID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get upstream proxy: %w", err)
+		}
+		if proxy == nil {
+			return nil, fmt.Errorf("proxy with id %d not found", *route.ProxyID)
+		}
+		if proxy.ProxyType != "socks5" {
+			return nil, fmt.Errorf("%w: upstream proxy %d is %s", ErrUDPUnsupported, proxy.ID, proxy.ProxyType)
+		}
+		dialer := &SOCKS5Dialer{
+			proxyHost: net.JoinHostPort(proxy.IP, strconv.Itoa(proxy.Port)),
+			timeout:   f.current().dialTimeout,
+			username:  proxy.Username,
+			password:  proxy.Password,
+		}
+		return dialer.ListenPacket(ctx)
+	default:
+		return nil, fmt.Errorf("%w: %s routes", ErrUDPUnsupported, route.Group)
+	}
+}
+
+// localPacketConn sends datagrams directly from a local UDP socket
+type localPacketConn struct {
+	conn *net.UDPConn
+}
+
+// WriteTo implements PacketConn
+func (c *localPacketConn) WriteTo(b []byte, addr string) (int, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return 0, fmt.Errorf("failed to resolve %s: %w", addr, err)
+	}
+	return c.conn.WriteToUDP(b, udpAddr)
+}
+
+// ReadFrom implements PacketConn
+func (c *localPacketConn) ReadFrom(b []byte) (int, string, error) {
+	n, addr, err := c.conn.ReadFromUDP(b)
+	if err != nil {
+		return 0, "", err
+	}
+	return n, addr.String(), nil
+}
+
+// Close implements PacketConn
+func (c *localPacketConn) Close() error {
+	return c.conn.Close()
+}
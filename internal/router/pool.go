@@ -0,0 +1,142 @@
+package router
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"proxyrouter/internal/halfclose"
+)
+
+// defaultPoolTTL is how long a snapshot of the general pool is reused
+// before it is reloaded from the database
+const defaultPoolTTL = 5 * time.Second
+
+// proxyPool keeps an in-memory snapshot of the healthy general pool and the
+// number of active connections through each proxy
+type proxyPool struct {
+	load func(ctx context.Context) ([]*Proxy, error)
+	ttl  time.Duration
+
+	mu       sync.Mutex
+	proxies  []*Proxy // ordered by latency
+	loadedAt time.Time
+
+	active sync.Map // proxy ID -> *atomic.Int64
+}
+
+// newProxyPool creates a pool that refreshes its snapshot with load
+func newProxyPool(load func(ctx context.Context) ([]*Proxy, error)) *proxyPool {
+	return &proxyPool{
+		load: load,
+		ttl:  defaultPoolTTL,
+	}
+}
+
+// snapshot returns the current healthy proxies, reloading them when the
+// snapshot is older than the TTL. The returned slice must not be modified.
+func (p *proxyPool) snapshot(ctx context.Context) ([]*Proxy, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.proxies != nil && time.Since(p.loadedAt) < p.ttl {
+		return p.proxies, nil
+	}
+
+	proxies, err := p.load(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if proxies == nil {
+		proxies = []*Proxy{}
+	}
+
+	p.proxies = proxies
+	p.loadedAt = time.Now()
+	return p.proxies, nil
+}
+
+// invalidate forces the next snapshot to be reloaded
+func (p *proxyPool) invalidate() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.proxies = nil
+}
+
+// activeConns returns the number of open connections through a proxy
+func (p *proxyPool) activeConns(proxyID int) int64 {
+	if counter, ok := p.active.Load(proxyID); ok {
+		return counter.(*atomic.Int64).Load()
+	}
+	return 0
+}
+
+// track counts conn as active on a proxy until it is closed
+func (p *proxyPool) track(proxyID int, conn net.Conn) net.Conn {
+	value, _ := p.active.LoadOrStore(proxyID, new(atomic.Int64))
+	counter := value.(*atomic.Int64)
+	counter.Add(1)
+
+	return &trackedConn{Conn: conn, release: func() { counter.Add(-1) }}
+}
+
+// trackedConn runs release once when the connection is closed
+type trackedConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+// Close closes the connection and releases it from the active count
+func (c *trackedConn) Close() error {
+	c.once.Do(c.release)
+	return c.Conn.Close()
+}
+
+// CloseWrite half-closes the wrapped connection
+func (c *trackedConn) CloseWrite() error {
+	return halfclose.CloseWrite(c.Conn)
+}
+
+// loadGeneralPool loads every healthy proxy of the general pool. Proxies
+// whose credentials cannot be decrypted are skipped, so they do not take the
+// rest of the pool down.
+func (f *DialerFactory) loadGeneralPool(ctx context.Context) ([]*Proxy, error) {
+	query := `
+		SELECT id, proxy_type, ip, port, latency, working, tested_timestamp, username, password_enc
+		FROM proxies
+		WHERE working = 1
+		  AND (expires_at IS NULL OR expires_at > datetime('now'))
+		  AND (tested_timestamp IS NULL OR tested_timestamp > datetime('now', '-1 hour'))
+		ORDER BY latency ASC NULLS LAST, tested_timestamp DESC
+	`
+
+	rows, err := f.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query general proxies: %w", err)
+	}
+	defer rows.Close()
+
+	var proxies []*Proxy
+	for rows.Next() {
+		p, passwordEnc, err := scanProxyRow(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan general proxy: %w", err)
+		}
+		if err := f.openCredentials(p, passwordEnc); err != nil {
+			fmt.Printf("Skipping general proxy %d: %v\n", p.ID, err)
+			continue
+		}
+		proxies = append(proxies, p)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over general proxies: %w", err)
+	}
+
+	return proxies, nil
+}
@@ -0,0 +1,220 @@
+package router
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// routeTable is an immutable, pre-compiled view of the enabled routes. It is
+// built from the database when routes change and swapped in atomically, so
+// FindRoute never touches SQLite.
+type routeTable struct {
+	routes    []*compiledRoute // ordered by precedence, then id
+	unindexed []int            // routes without a host glob, with "*" or with a multi-wildcard glob
+	suffixes  *hostTrie        // exact and "*.suffix" globs by reversed host labels
+	prefixes  *hostTrie        // "prefix.*" globs by host labels
+}
+
+// hostTrie indexes host globs by domain labels. Each list holds route
+// indices in ascending order.
+type hostTrie struct {
+	children map[string]*hostTrie
+	exact    []int // globs that end here and match when no labels are left
+	wildcard []int // globs that end here and match when more labels are left
+}
+
+// newHostTrie creates an empty trie node
+func newHostTrie() *hostTrie {
+	return &hostTrie{children: make(map[string]*hostTrie)}
+}
+
+// insert walks labels, creating nodes as needed, and returns the last node
+func (t *hostTrie) insert(labels []string) *hostTrie {
+	node := t
+	for _, label := range labels {
+		child, ok := node.children[label]
+		if !ok {
+			child = newHostTrie()
+			node.children[label] = child
+		}
+		node = child
+	}
+	return node
+}
+
+// lookup calls collect with every list of routes whose glob matches labels
+func (t *hostTrie) lookup(labels []string, collect func(indices []int)) {
+	node := t
+	for i, label := range labels {
+		node = node.children[label]
+		if node == nil {
+			return
+		}
+		if i < len(labels)-1 {
+			collect(node.wildcard)
+		} else {
+			collect(node.exact)
+		}
+	}
+}
+
+// reversed returns labels in reverse order
+func reversed(labels []string) []string {
+	out := make([]string, len(labels))
+	for i, label := range labels {
+		out[len(labels)-1-i] = label
+	}
+	return out
+}
+
+// compileRouteTable builds a route table from routes in precedence order,
+// following the glob rules of hostMatchesGlob
+func compileRouteTable(routes []*Route) *routeTable {
+	t := &routeTable{
+		routes:   make([]*compiledRoute, len(routes)),
+		suffixes: newHostTrie(),
+		prefixes: newHostTrie(),
+	}
+
+	for i, route := range routes {
+		// Routes with conditions that do not parse are kept but never match
+		compiled, _ := compileRoute(route)
+		t.routes[i] = compiled
+
+		switch glob := route.HostGlob; {
+		case glob == nil || *glob == "*":
+			t.unindexed = append(t.unindexed, i)
+		case !isSimpleGlob(*glob):
+			compiled.checkGlob = true
+			t.unindexed = append(t.unindexed, i)
+		case strings.HasPrefix(*glob, "*."):
+			node := t.suffixes.insert(reversed(strings.Split((*glob)[2:], ".")))
+			node.wildcard = append(node.wildcard, i)
+		case strings.HasSuffix(*glob, ".*"):
+			node := t.prefixes.insert(strings.Split((*glob)[:len(*glob)-2], "."))
+			node.wildcard = append(node.wildcard, i)
+		default:
+			node := t.suffixes.insert(reversed(strings.Split(*glob, ".")))
+			node.exact = append(node.exact, i)
+		}
+	}
+
+	return t
+}
+
+// find returns the first route in precedence order that matches the
+// request, or nil
+func (t *routeTable) find(req Request) *Route {
+	addr, addrOK := parseClientAddr(req.ClientIP)
+
+	best := -1
+	collect := func(indices []int) {
+		for _, i := range indices {
+			// Later candidates cannot beat the best match so far
+			if best >= 0 && i >= best {
+				return
+			}
+			if t.routes[i].matches(req, addr, addrOK) {
+				best = i
+				return
+			}
+		}
+	}
+
+	collect(t.unindexed)
+	labels := strings.Split(req.Host, ".")
+	t.prefixes.lookup(labels, collect)
+	t.suffixes.lookup(reversed(labels), collect)
+
+	if best < 0 {
+		return nil
+	}
+	route := *t.routes[best].route
+	return &route
+}
+
+// Reload recompiles the route table from the database and swaps it in. Route
+// changes made through the Router reload it automatically; call Reload after
+// editing the routes table directly.
+func (r *Router) Reload(ctx context.Context) error {
+	r.reloadMu.Lock()
+	defer r.reloadMu.Unlock()
+
+	table, err := r.loadRouteTable(ctx)
+	if err != nil {
+		// Leave the table stale so the next lookup retries
+		r.table.Store(nil)
+		return err
+	}
+
+	r.table.Store(table)
+	return nil
+}
+
+// routesChanged reloads the route table after a mutation. A failed reload is
+// retried by the next lookup, the mutation itself has been committed.
+func (r *Router) routesChanged(ctx context.Context) {
+	r.Reload(ctx)
+}
+
+// routeTable returns the current route table, loading it on first use
+func (r *Router) routeTable(ctx context.Context) (*routeTable, error) {
+	if table := r.table.Load(); table != nil {
+		return table, nil
+	}
+
+	r.reloadMu.Lock()
+	defer r.reloadMu.Unlock()
+
+	// Another lookup may have loaded it while we waited
+	if table := r.table.Load(); table != nil {
+		return table, nil
+	}
+
+	table, err := r.loadRouteTable(ctx)
+	if err != nil {
+		return nil, err
+	}
+	r.table.Store(table)
+	return table, nil
+}
+
+// loadRouteTable reads the enabled routes with their hops and compiles them
+func (r *Router) loadRouteTable(ctx context.Context) (*routeTable, error) {
+	query := fmt.Sprintf(`
+		SELECT %s
+		FROM routes
+		WHERE enabled = 1
+		ORDER BY precedence ASC, id ASC
+	`, routeColumns)
+
+	rows, err := r.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query routes: %w", err)
+	}
+	defer rows.Close()
+
+	var routes []*Route
+	for rows.Next() {
+		route, err := scanRoute(rows)
+		if err != nil {
+			return nil, err
+		}
+		routes = append(routes, route)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over routes: %w", err)
+	}
+	// Release the connection before loading the chains
+	rows.Close()
+
+	for _, route := range routes {
+		if err := r.loadHops(ctx, route); err != nil {
+			return nil, err
+		}
+	}
+
+	return compileRouteTable(routes), nil
+}
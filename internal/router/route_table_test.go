@@ -0,0 +1,218 @@
+package router
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math/rand/v2"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestRouteDB creates an in-memory database with the routes tables
+func newTestRouteDB(t testing.TB) *sql.DB {
+	db, err := sql.Open("sqlite", ":memory:")
+	require.NoError(t, err)
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+
+	_, err = db.Exec(`
+		CREATE TABLE routes (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			client_cidr TEXT,
+			host_glob TEXT,
+			"group" TEXT NOT NULL,
+			proxy_id INTEGER,
+			precedence INTEGER NOT NULL DEFAULT 0,
+			enabled BOOLEAN NOT NULL DEFAULT 1,
+			strategy TEXT,
+			affinity TEXT,
+			affinity_ttl_sec INTEGER,
+			host_regex TEXT,
+			dst_ports TEXT,
+			schemes TEXT,
+			methods TEXT,
+			path_prefix TEXT,
+			time_window TEXT,
+			client_user TEXT,
+			bandwidth_limit INTEGER,
+			idle_timeout_sec INTEGER,
+			max_lifetime_sec INTEGER,
+			created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE TABLE route_hops (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			route_id INTEGER NOT NULL,
+			position INTEGER NOT NULL,
+			"group" TEXT NOT NULL,
+			proxy_id INTEGER,
+			timeout_ms INTEGER,
+			UNIQUE (route_id, position)
+		);
+	`)
+	require.NoError(t, err)
+
+	return db
+}
+
+// findRouteScan is the per-request SQL scan the route table replaced
+func findRouteScan(ctx context.Context, r *Router, clientIP, targetHost string) (*Route, error) {
+	rows, err := r.db.QueryContext(ctx, fmt.Sprintf(`
+		SELECT %s
+		FROM routes
+		WHERE enabled = 1
+		ORDER BY precedence ASC, id ASC
+	`, routeColumns))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		route, err := scanRoute(rows)
+		if err != nil {
+			return nil, err
+		}
+		if routeMatches(route, Request{ClientIP: clientIP, Host: targetHost}) {
+			return route, nil
+		}
+	}
+	return nil, rows.Err()
+}
+
+// randomRoutes returns n routes drawn from a small set of CIDRs and globs so
+// that lookups hit overlapping rules
+func randomRoutes(rng *rand.Rand, n int) []*Route {
+	cidrs := []string{"192.168.1.0/24", "192.168.0.0/16", "10.0.0.0/8", "10.1.2.3/32", "2001:db8::/32", "bogus"}
+	globs := []string{"*", "*.example.com", "example.com", "api.example.com", "*.com", "example.*", "api.*", "*.example.org", "a.b.c", "*.example.*", "api*.com", "*ample*"}
+
+	routes := make([]*Route, n)
+	for i := range routes {
+		route := &Route{ID: i + 1, Group: RouteGroupLocal, Precedence: rng.IntN(50), Enabled: true}
+		if rng.IntN(2) == 0 {
+			route.ClientCIDR = stringPtr(cidrs[rng.IntN(len(cidrs))])
+		}
+		if rng.IntN(4) != 0 {
+			route.HostGlob = stringPtr(globs[rng.IntN(len(globs))])
+		}
+		routes[i] = route
+	}
+	return routes
+}
+
+func TestRouteTableMatchesLinearScan(t *testing.T) {
+	rng := rand.New(rand.NewPCG(1, 2))
+	clients := []string{"192.168.1.10", "192.168.2.10", "10.1.2.3", "10.9.9.9", "::ffff:192.168.1.10", "2001:db8::1", "8.8.8.8", "not-an-ip"}
+	hosts := []string{"example.com", "api.example.com", "x.api.example.com", "example.org", "www.example.org", "api.test", "example.net", "a.b.c", "b.c", "com", ""}
+
+	for round := 0; round < 50; round++ {
+		routes := randomRoutes(rng, 1+rng.IntN(30))
+		sorted := append([]*Route(nil), routes...)
+		sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Precedence < sorted[j].Precedence })
+		table := compileRouteTable(sorted)
+
+		for _, client := range clients {
+			for _, host := range hosts {
+				var want *Route
+				for _, route := range sorted {
+					if routeMatches(route, Request{ClientIP: client, Host: host}) {
+						want = route
+						break
+					}
+				}
+
+				got := table.find(Request{ClientIP: client, Host: host})
+				if want == nil {
+					assert.Nil(t, got, "%s %s", client, host)
+				} else if assert.NotNil(t, got, "%s %s", client, host) {
+					assert.Equal(t, want.ID, got.ID, "%s %s", client, host)
+				}
+			}
+		}
+	}
+}
+
+func TestRouteTableReloadsOnChange(t *testing.T) {
+	db := newTestRouteDB(t)
+	router := New(db)
+	ctx := context.Background()
+
+	route, err := router.FindRoute(ctx, "192.168.1.10", "example.com")
+	require.NoError(t, err)
+	assert.Nil(t, route)
+
+	local := &Route{Group: RouteGroupLocal, HostGlob: stringPtr("*.example.com"), Precedence: 10, Enabled: true}
+	require.NoError(t, router.CreateRoute(local))
+	require.NoError(t, router.CreateRoute(&Route{Group: RouteGroupTor, Precedence: 20, Enabled: true}))
+
+	route, err = router.FindRoute(ctx, "192.168.1.10", "api.example.com")
+	require.NoError(t, err)
+	require.NotNil(t, route)
+	assert.Equal(t, RouteGroupLocal, route.Group)
+
+	require.NoError(t, router.UpdateRoute(ctx, local.ID, map[string]interface{}{"enabled": false}, nil))
+	route, err = router.FindRoute(ctx, "192.168.1.10", "api.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, RouteGroupTor, route.Group)
+
+	chain := &Route{Group: RouteGroupChain, Precedence: 1, Enabled: true, Hops: []Hop{{Group: RouteGroupTor}}}
+	require.NoError(t, router.CreateRoute(chain))
+	require.NoError(t, router.SetRouteHops(ctx, chain.ID, []Hop{{Group: RouteGroupTor}, {Group: RouteGroupGeneral}}))
+	route, err = router.FindRoute(ctx, "192.168.1.10", "example.com")
+	require.NoError(t, err)
+	assert.Len(t, route.Hops, 2)
+
+	require.NoError(t, router.DeleteRoute(chain.ID))
+	route, err = router.FindRoute(ctx, "192.168.1.10", "example.com")
+	require.NoError(t, err)
+	assert.Equal(t, RouteGroupTor, route.Group)
+}
+
+// benchmarkRouter creates a router with 10k routes, none of which match the
+// benchmark request before the catch-all at the end
+func benchmarkRouter(b *testing.B) *Router {
+	db := newTestRouteDB(b)
+
+	tx, err := db.Begin()
+	require.NoError(b, err)
+	for i := 0; i < 10000; i++ {
+		_, err := tx.Exec(`INSERT INTO routes (client_cidr, host_glob, "group", precedence) VALUES (?, ?, 'LOCAL', ?)`,
+			fmt.Sprintf("10.%d.%d.0/24", i/256, i%256), fmt.Sprintf("*.site%d.example", i), i)
+		require.NoError(b, err)
+	}
+	_, err = tx.Exec(`INSERT INTO routes ("group", precedence) VALUES ('GENERAL', 100000)`)
+	require.NoError(b, err)
+	require.NoError(b, tx.Commit())
+
+	return New(db)
+}
+
+func BenchmarkFindRoute(b *testing.B) {
+	ctx := context.Background()
+
+	b.Run("sql-scan", func(b *testing.B) {
+		router := benchmarkRouter(b)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			route, err := findRouteScan(ctx, router, "192.168.1.10", "www.example.com")
+			if err != nil || route == nil {
+				b.Fatal(route, err)
+			}
+		}
+	})
+
+	b.Run("compiled", func(b *testing.B) {
+		router := benchmarkRouter(b)
+		require.NoError(b, router.Reload(ctx))
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			route, err := router.FindRoute(ctx, "192.168.1.10", "www.example.com")
+			if err != nil || route == nil {
+				b.Fatal(route, err)
+			}
+		}
+	})
+}
@@ -4,8 +4,9 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
-	"net"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -13,27 +14,60 @@ import (
 type RouteGroup string
 
 const (
-	RouteGroupLocal     RouteGroup = "LOCAL"
-	RouteGroupGeneral   RouteGroup = "GENERAL"
-	RouteGroupTor       RouteGroup = "TOR"
-	RouteGroupUpstream  RouteGroup = "UPSTREAM"
+	RouteGroupLocal    RouteGroup = "LOCAL"
+	RouteGroupGeneral  RouteGroup = "GENERAL"
+	RouteGroupTor      RouteGroup = "TOR"
+	RouteGroupUpstream RouteGroup = "UPSTREAM"
+	RouteGroupChain    RouteGroup = "CHAIN"
 )
 
 // Route represents a routing rule
 type Route struct {
-	ID          int         `json:"id"`
-	ClientCIDR  *string     `json:"client_cidr,omitempty"`
-	HostGlob    *string     `json:"host_glob,omitempty"`
-	Group       RouteGroup  `json:"group"`
-	ProxyID     *int        `json:"proxy_id,omitempty"`
-	Precedence  int         `json:"precedence"`
-	Enabled     bool        `json:"enabled"`
-	CreatedAt   time.Time   `json:"created_at"`
+	ID             int        `json:"id"`
+	ClientCIDR     *string    `json:"client_cidr,omitempty"`
+	HostGlob       *string    `json:"host_glob,omitempty"`
+	Group          RouteGroup `json:"group"`
+	ProxyID        *int       `json:"proxy_id,omitempty"`
+	Precedence     int        `json:"precedence"`
+	Enabled        bool       `json:"enabled"`
+	CreatedAt      time.Time  `json:"created_at"`
+	Hops           []Hop      `json:"hops,omitempty"`     // only for CHAIN routes
+	Strategy       Strategy   `json:"strategy,omitempty"` // only for GENERAL routes
+	Affinity       Affinity   `json:"affinity,omitempty"` // only for GENERAL routes
+	AffinityTTLSec *int       `json:"affinity_ttl_sec,omitempty"`
+	HostRegex      *string    `json:"host_regex,omitempty"`       // e.g. "^(www|api)\.example\.com$"
+	DstPorts       *string    `json:"dst_ports,omitempty"`        // e.g. "80,443,8000-8999"
+	Schemes        *string    `json:"schemes,omitempty"`          // e.g. "http,ws", plain HTTP only
+	Methods        *string    `json:"methods,omitempty"`          // e.g. "GET,HEAD,CONNECT"
+	PathPrefix     *string    `json:"path_prefix,omitempty"`      // plain HTTP only
+	TimeWindow     *string    `json:"time_window,omitempty"`      // cron-style, e.g. "* 9-17 * * 1-5"
+	ClientUser     *string    `json:"client_user,omitempty"`      // authenticated proxy username
+	BandwidthLimit *int       `json:"bandwidth_limit,omitempty"`  // bytes per second, shared by the route's tunnels
+	IdleTimeoutSec *int       `json:"idle_timeout_sec,omitempty"` // closes tunnels without traffic for this long
+	MaxLifetimeSec *int       `json:"max_lifetime_sec,omitempty"` // closes tunnels open for this long
+}
+
+// affinityTTL returns how long the route pins requests to a proxy
+func (r *Route) affinityTTL() time.Duration {
+	if r.AffinityTTLSec == nil || *r.AffinityTTLSec <= 0 {
+		return DefaultAffinityTTL
+	}
+	return time.Duration(*r.AffinityTTLSec) * time.Second
+}
+
+// Hop represents one proxy in a CHAIN route, dialed through the hops before it
+type Hop struct {
+	Position  int        `json:"position"`
+	Group     RouteGroup `json:"group"`
+	ProxyID   *int       `json:"proxy_id,omitempty"`
+	TimeoutMS *int       `json:"timeout_ms,omitempty"`
 }
 
 // Router represents the routing engine
 type Router struct {
-	db *sql.DB
+	db       *sql.DB
+	table    atomic.Pointer[routeTable] // nil until loaded or after a failed reload
+	reloadMu sync.Mutex
 }
 
 // New creates a new router instance
@@ -41,107 +75,240 @@ func New(db *sql.DB) *Router {
 	return &Router{db: db}
 }
 
-// FindRoute finds the best matching route for a request
+// routeColumns are the routes columns read by scanRoute
+const routeColumns = `id, client_cidr, host_glob, "group", proxy_id, precedence, enabled, created_at, strategy, affinity, affinity_ttl_sec,
+	host_regex, dst_ports, schemes, methods, path_prefix, time_window, client_user, bandwidth_limit,
+	idle_timeout_sec, max_lifetime_sec`
+
+// scanRoute scans a route row selected with routeColumns
+func scanRoute(row rowScanner) (*Route, error) {
+	var route Route
+	var clientCIDR, hostGlob, strategy, affinity sql.NullString
+	var proxyID, affinityTTL, bandwidthLimit, idleTimeout, maxLifetime sql.NullInt64
+
+	err := row.Scan(
+		&route.ID,
+		&clientCIDR,
+		&hostGlob,
+		&route.Group,
+		&proxyID,
+		&route.Precedence,
+		&route.Enabled,
+		&route.CreatedAt,
+		&strategy,
+		&affinity,
+		&affinityTTL,
+		&route.HostRegex,
+		&route.DstPorts,
+		&route.Schemes,
+		&route.Methods,
+		&route.PathPrefix,
+		&route.TimeWindow,
+		&route.ClientUser,
+		&bandwidthLimit,
+		&idleTimeout,
+		&maxLifetime,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan route: %w", err)
+	}
+
+	// Set nullable fields
+	if clientCIDR.Valid {
+		route.ClientCIDR = &clientCIDR.String
+	}
+	if hostGlob.Valid {
+		route.HostGlob = &hostGlob.String
+	}
+	if proxyID.Valid {
+		id := int(proxyID.Int64)
+		route.ProxyID = &id
+	}
+	if affinityTTL.Valid {
+		ttl := int(affinityTTL.Int64)
+		route.AffinityTTLSec = &ttl
+	}
+	if bandwidthLimit.Valid {
+		limit := int(bandwidthLimit.Int64)
+		route.BandwidthLimit = &limit
+	}
+	if idleTimeout.Valid {
+		timeout := int(idleTimeout.Int64)
+		route.IdleTimeoutSec = &timeout
+	}
+	if maxLifetime.Valid {
+		lifetime := int(maxLifetime.Int64)
+		route.MaxLifetimeSec = &lifetime
+	}
+	route.Strategy = Strategy(strategy.String)
+	route.Affinity = Affinity(affinity.String)
+
+	return &route, nil
+}
+
+// FindRoute finds the best matching route for a client and target host
 func (r *Router) FindRoute(ctx context.Context, clientIP, targetHost string) (*Route, error) {
+	return r.MatchRoute(ctx, Request{ClientIP: clientIP, Host: targetHost})
+}
+
+// MatchRoute finds the best matching route for a request
+func (r *Router) MatchRoute(ctx context.Context, req Request) (*Route, error) {
+	table, err := r.routeTable(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.Time.IsZero() {
+		req.Time = time.Now()
+	}
+	return table.find(req), nil
+}
+
+// loadHops loads the hops of a CHAIN route
+func (r *Router) loadHops(ctx context.Context, route *Route) error {
+	if route.Group != RouteGroupChain {
+		return nil
+	}
+
+	hops, err := r.GetRouteHops(ctx, route.ID)
+	if err != nil {
+		return err
+	}
+	route.Hops = hops
+	return nil
+}
+
+// GetRouteHops returns the hops of a route in dialing order
+func (r *Router) GetRouteHops(ctx context.Context, routeID int) ([]Hop, error) {
 	query := `
-		SELECT id, client_cidr, host_glob, "group", proxy_id, precedence, enabled, created_at
-		FROM routes
-		WHERE enabled = 1
-		ORDER BY precedence ASC, id ASC
+		SELECT position, "group", proxy_id, timeout_ms
+		FROM route_hops
+		WHERE route_id = ?
+		ORDER BY position ASC
 	`
-	
-	rows, err := r.db.QueryContext(ctx, query)
+
+	rows, err := r.db.QueryContext(ctx, query, routeID)
 	if err != nil {
-		return nil, fmt.Errorf("failed to query routes: %w", err)
+		return nil, fmt.Errorf("failed to query route hops: %w", err)
 	}
 	defer rows.Close()
 
+	var hops []Hop
 	for rows.Next() {
-		var route Route
-		var clientCIDR, hostGlob sql.NullString
-		var proxyID sql.NullInt64
-		
-		err := rows.Scan(
-			&route.ID,
-			&clientCIDR,
-			&hostGlob,
-			&route.Group,
-			&proxyID,
-			&route.Precedence,
-			&route.Enabled,
-			&route.CreatedAt,
-		)
-		if err != nil {
-			return nil, fmt.Errorf("failed to scan route: %w", err)
-		}
-
-		// Set nullable fields
-		if clientCIDR.Valid {
-			route.ClientCIDR = &clientCIDR.String
-		}
-		if hostGlob.Valid {
-			route.HostGlob = &hostGlob.String
+		var hop Hop
+		var proxyID, timeoutMS sql.NullInt64
+		if err := rows.Scan(&hop.Position, &hop.Group, &proxyID, &timeoutMS); err != nil {
+			return nil, fmt.Errorf("failed to scan route hop: %w", err)
 		}
 		if proxyID.Valid {
 			id := int(proxyID.Int64)
-			route.ProxyID = &id
+			hop.ProxyID = &id
 		}
-
-		// Check if route matches
-		if r.matchesRoute(&route, clientIP, targetHost) {
-			return &route, nil
+		if timeoutMS.Valid {
+			ms := int(timeoutMS.Int64)
+			hop.TimeoutMS = &ms
 		}
+		hops = append(hops, hop)
 	}
 
 	if err := rows.Err(); err != nil {
-		return nil, fmt.Errorf("error iterating over routes: %w", err)
+		return nil, fmt.Errorf("error iterating over route hops: %w", err)
 	}
 
-	// No matching route found
-	return nil, nil
+	return hops, nil
 }
 
-// matchesRoute checks if a route matches the given client IP and target host
-func (r *Router) matchesRoute(route *Route, clientIP, targetHost string) bool {
-	// Check client CIDR if specified
-	if route.ClientCIDR != nil {
-		if !r.ipInCIDR(clientIP, *route.ClientCIDR) {
-			return false
-		}
+// SetRouteHops replaces the hops of a route, numbering them in slice order
+func (r *Router) SetRouteHops(ctx context.Context, routeID int, hops []Hop) error {
+	if err := ValidateHops(hops); err != nil {
+		return err
+	}
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var group RouteGroup
+	err = tx.QueryRowContext(ctx, `SELECT "group" FROM routes WHERE id = ?`, routeID).Scan(&group)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("route with id %d not found", routeID)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to query route: %w", err)
+	}
+	if group != RouteGroupChain {
+		return fmt.Errorf("route %d is a %s route, only CHAIN routes have hops", routeID, group)
+	}
+
+	if err := insertHops(ctx, tx, routeID, hops); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	r.routesChanged(ctx)
+	return nil
+}
+
+// insertHops replaces the hops of a route inside a transaction
+func insertHops(ctx context.Context, tx *sql.Tx, routeID int, hops []Hop) error {
+	if _, err := tx.ExecContext(ctx, "DELETE FROM route_hops WHERE route_id = ?", routeID); err != nil {
+		return fmt.Errorf("failed to delete route hops: %w", err)
 	}
 
-	// Check host glob if specified
-	if route.HostGlob != nil {
-		if !r.hostMatchesGlob(targetHost, *route.HostGlob) {
-			return false
+	for i := range hops {
+		hops[i].Position = i
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO route_hops (route_id, position, "group", proxy_id, timeout_ms)
+			VALUES (?, ?, ?, ?, ?)
+		`, routeID, i, hops[i].Group, hops[i].ProxyID, hops[i].TimeoutMS)
+		if err != nil {
+			return fmt.Errorf("failed to insert route hop %d: %w", i, err)
 		}
 	}
 
-	return true
+	return nil
 }
 
-// ipInCIDR checks if an IP is within a CIDR range
-func (r *Router) ipInCIDR(ipStr, cidr string) bool {
-	ip := net.ParseIP(ipStr)
-	if ip == nil {
-		return false
+// ValidateHops checks that a chain can be dialed
+func ValidateHops(hops []Hop) error {
+	if len(hops) == 0 {
+		return fmt.Errorf("a CHAIN route needs at least one hop")
 	}
 
-	_, network, err := net.ParseCIDR(cidr)
-	if err != nil {
-		return false
+	for i, hop := range hops {
+		switch hop.Group {
+		case RouteGroupTor, RouteGroupGeneral:
+		case RouteGroupUpstream:
+			if hop.ProxyID == nil {
+				return fmt.Errorf("hop %d: proxy_id is required for UPSTREAM hops", i)
+			}
+		default:
+			return fmt.Errorf("hop %d: unsupported hop group %q", i, hop.Group)
+		}
+		if hop.TimeoutMS != nil && *hop.TimeoutMS <= 0 {
+			return fmt.Errorf("hop %d: timeout_ms must be positive", i)
+		}
 	}
 
-	return network.Contains(ip)
+	return nil
 }
 
 // hostMatchesGlob checks if a host matches a glob pattern
-func (r *Router) hostMatchesGlob(host, glob string) bool {
-	// Simple glob matching - can be enhanced for more complex patterns
+func hostMatchesGlob(host, glob string) bool {
 	if glob == "*" {
 		return true
 	}
 
+	// Patterns like "api-*.example.*" match each "*" against any characters
+	if !isSimpleGlob(glob) {
+		return wildcardMatch(glob, host)
+	}
+
 	if strings.HasPrefix(glob, "*.") {
 		// Pattern like "*.example.com"
 		suffix := glob[1:] // Remove the "*"
@@ -165,12 +332,12 @@ func (r *Router) GetRoutes() ([]Route, error) {
 
 // GetRoutesWithContext returns all routes with context
 func (r *Router) GetRoutesWithContext(ctx context.Context) ([]Route, error) {
-	query := `
-		SELECT id, client_cidr, host_glob, "group", proxy_id, precedence, enabled, created_at
+	query := fmt.Sprintf(`
+		SELECT %s
 		FROM routes
 		ORDER BY precedence ASC, id ASC
-	`
-	
+	`, routeColumns)
+
 	rows, err := r.db.QueryContext(ctx, query)
 	if err != nil {
 		return nil, fmt.Errorf("failed to query routes: %w", err)
@@ -179,101 +346,212 @@ func (r *Router) GetRoutesWithContext(ctx context.Context) ([]Route, error) {
 
 	var routes []Route
 	for rows.Next() {
-		var route Route
-		var clientCIDR, hostGlob sql.NullString
-		var proxyID sql.NullInt64
-		
-		err := rows.Scan(
-			&route.ID,
-			&clientCIDR,
-			&hostGlob,
-			&route.Group,
-			&proxyID,
-			&route.Precedence,
-			&route.Enabled,
-			&route.CreatedAt,
-		)
+		route, err := scanRoute(rows)
 		if err != nil {
-			return nil, fmt.Errorf("failed to scan route: %w", err)
-		}
-
-		// Set nullable fields
-		if clientCIDR.Valid {
-			route.ClientCIDR = &clientCIDR.String
-		}
-		if hostGlob.Valid {
-			route.HostGlob = &hostGlob.String
-		}
-		if proxyID.Valid {
-			id := int(proxyID.Int64)
-			route.ProxyID = &id
+			return nil, err
 		}
 
-		routes = append(routes, route)
+		routes = append(routes, *route)
 	}
 
 	if err := rows.Err(); err != nil {
 		return nil, fmt.Errorf("error iterating over routes: %w", err)
 	}
+	rows.Close()
+
+	for i := range routes {
+		if err := r.loadHops(ctx, &routes[i]); err != nil {
+			return nil, err
+		}
+	}
 
 	return routes, nil
 }
 
 // CreateRouteWithContext creates a new route with context
 func (r *Router) CreateRouteWithContext(ctx context.Context, route *Route) error {
+	if route.Group == RouteGroupChain {
+		if err := ValidateHops(route.Hops); err != nil {
+			return err
+		}
+	}
+	if !ValidStrategy(route.Strategy) {
+		return fmt.Errorf("unknown load-balancing strategy: %s", route.Strategy)
+	}
+	if !ValidAffinity(route.Affinity) {
+		return fmt.Errorf("unknown affinity: %s", route.Affinity)
+	}
+	if err := ValidateRoute(route); err != nil {
+		return err
+	}
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
 	query := `
-		INSERT INTO routes (client_cidr, host_glob, "group", proxy_id, precedence, enabled)
-		VALUES (?, ?, ?, ?, ?, ?)
+		INSERT INTO routes (client_cidr, host_glob, "group", proxy_id, precedence, enabled, strategy, affinity, affinity_ttl_sec,
+			host_regex, dst_ports, schemes, methods, path_prefix, time_window, client_user, bandwidth_limit,
+			idle_timeout_sec, max_lifetime_sec)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 	`
-	
-	_, err := r.db.ExecContext(ctx, query,
+
+	result, err := tx.ExecContext(ctx, query,
 		route.ClientCIDR,
 		route.HostGlob,
 		route.Group,
 		route.ProxyID,
 		route.Precedence,
 		route.Enabled,
+		nullableString(string(route.Strategy)),
+		nullableString(string(route.Affinity)),
+		route.AffinityTTLSec,
+		route.HostRegex,
+		route.DstPorts,
+		route.Schemes,
+		route.Methods,
+		route.PathPrefix,
+		route.TimeWindow,
+		route.ClientUser,
+		route.BandwidthLimit,
+		route.IdleTimeoutSec,
+		route.MaxLifetimeSec,
 	)
-	
+
 	if err != nil {
 		return fmt.Errorf("failed to create route: %w", err)
 	}
 
+	id, err := result.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("failed to get route id: %w", err)
+	}
+	route.ID = int(id)
+
+	if route.Group == RouteGroupChain {
+		if err := insertHops(ctx, tx, route.ID, route.Hops); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	r.routesChanged(ctx)
 	return nil
 }
 
-// UpdateRoute updates an existing route
-func (r *Router) UpdateRoute(ctx context.Context, id int, updates map[string]interface{}) error {
-	if len(updates) == 0 {
+// nullableString stores an empty string as NULL
+func nullableString(value string) interface{} {
+	if value == "" {
 		return nil
 	}
+	return value
+}
 
-	// Build dynamic query
-	var setClauses []string
-	var args []interface{}
-	
-	for field, value := range updates {
-		setClauses = append(setClauses, field+" = ?")
-		args = append(args, value)
-	}
-	
-	args = append(args, id)
-	
-	query := fmt.Sprintf("UPDATE routes SET %s WHERE id = ?", strings.Join(setClauses, ", "))
-	
-	_, err := r.db.ExecContext(ctx, query, args...)
+// UpdateRoute updates an existing route. Non-nil hops replace the hops of a
+// CHAIN route. A route can only become a CHAIN route if it is given hops or
+// already has some, and its hops are deleted when it stops being one.
+func (r *Router) UpdateRoute(ctx context.Context, id int, updates map[string]interface{}, hops []Hop) error {
+	if len(updates) == 0 && hops == nil {
+		return nil
+	}
+	if err := ValidateRouteUpdates(updates); err != nil {
+		return err
+	}
+	if hops != nil {
+		if err := ValidateHops(hops); err != nil {
+			return err
+		}
+	}
+
+	tx, err := r.db.BeginTx(ctx, nil)
 	if err != nil {
-		return fmt.Errorf("failed to update route: %w", err)
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var current RouteGroup
+	err = tx.QueryRowContext(ctx, `SELECT "group" FROM routes WHERE id = ?`, id).Scan(&current)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("route with id %d not found", id)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to query route: %w", err)
+	}
+	group := current
+	if value, ok := updates["group"].(string); ok {
+		group = RouteGroup(value)
+	}
+
+	switch {
+	case hops != nil:
+		if group != RouteGroupChain {
+			return fmt.Errorf("route %d is a %s route, only CHAIN routes have hops", id, group)
+		}
+		if err := insertHops(ctx, tx, id, hops); err != nil {
+			return err
+		}
+	case group == RouteGroupChain && current != RouteGroupChain:
+		var count int
+		if err := tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM route_hops WHERE route_id = ?", id).Scan(&count); err != nil {
+			return fmt.Errorf("failed to count route hops: %w", err)
+		}
+		if count == 0 {
+			return fmt.Errorf("a CHAIN route needs at least one hop")
+		}
+	case group != RouteGroupChain && current == RouteGroupChain:
+		if _, err := tx.ExecContext(ctx, "DELETE FROM route_hops WHERE route_id = ?", id); err != nil {
+			return fmt.Errorf("failed to delete route hops: %w", err)
+		}
 	}
 
+	if len(updates) > 0 {
+		// Build dynamic query; ValidateRouteUpdates only lets known columns through
+		var setClauses []string
+		var args []interface{}
+
+		for field, value := range updates {
+			setClauses = append(setClauses, `"`+field+`" = ?`)
+			args = append(args, value)
+		}
+
+		args = append(args, id)
+
+		query := fmt.Sprintf("UPDATE routes SET %s WHERE id = ?", strings.Join(setClauses, ", "))
+
+		if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+			return fmt.Errorf("failed to update route: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	r.routesChanged(ctx)
 	return nil
 }
 
 // DeleteRouteWithContext deletes a route with context
 func (r *Router) DeleteRouteWithContext(ctx context.Context, id int) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Foreign keys are enabled per connection, so don't rely on the cascade
+	if _, err := tx.ExecContext(ctx, "DELETE FROM route_hops WHERE route_id = ?", id); err != nil {
+		return fmt.Errorf("failed to delete route hops: %w", err)
+	}
+
 	query := "DELETE FROM routes WHERE id = ?"
-	
-	result, err := r.db.ExecContext(ctx, query, id)
+
+	result, err := tx.ExecContext(ctx, query, id)
 	if err != nil {
 		return fmt.Errorf("failed to delete route: %w", err)
 	}
@@ -287,6 +565,11 @@ func (r *Router) DeleteRouteWithContext(ctx context.Context, id int) error {
 		return fmt.Errorf("route with id %d not found", id)
 	}
 
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	r.routesChanged(ctx)
 	return nil
 }
 
@@ -295,8 +578,6 @@ func (r *Router) CreateRoute(route *Route) error {
 	return r.CreateRouteWithContext(context.Background(), route)
 }
 
-
-
 // DeleteRoute deletes a route (without context for backward compatibility)
 func (r *Router) DeleteRoute(id int) error {
 	return r.DeleteRouteWithContext(context.Background(), id)
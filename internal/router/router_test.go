@@ -27,11 +27,9 @@ func TestHostMatchesGlob(t *testing.T) {
 		{"empty glob", "example.com", "", false},
 	}
 
-	router := &Router{}
-
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			result := router.hostMatchesGlob(tt.host, tt.glob)
+			result := hostMatchesGlob(tt.host, tt.glob)
 			if result != tt.expected {
 				t.Errorf("hostMatchesGlob(%q, %q) = %v, want %v", tt.host, tt.glob, result, tt.expected)
 			}
@@ -39,7 +37,7 @@ func TestHostMatchesGlob(t *testing.T) {
 	}
 }
 
-func TestIPInCIDR(t *testing.T) {
+func TestClientCIDR(t *testing.T) {
 	tests := []struct {
 		name     string
 		ip       string
@@ -53,13 +51,11 @@ func TestIPInCIDR(t *testing.T) {
 		{"invalid CIDR", "192.168.10.5", "invalid", false},
 	}
 
-	router := &Router{}
-
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			result := router.ipInCIDR(tt.ip, tt.cidr)
+			result := routeMatches(&Route{ClientCIDR: stringPtr(tt.cidr)}, Request{ClientIP: tt.ip})
 			if result != tt.expected {
-				t.Errorf("ipInCIDR(%q, %q) = %v, want %v", tt.ip, tt.cidr, result, tt.expected)
+				t.Errorf("client_cidr %q matching %q = %v, want %v", tt.cidr, tt.ip, result, tt.expected)
 			}
 		})
 	}
@@ -123,13 +119,11 @@ func TestMatchesRoute(t *testing.T) {
 		},
 	}
 
-	router := &Router{}
-
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			result := router.matchesRoute(tt.route, tt.clientIP, tt.targetHost)
+			result := routeMatches(tt.route, Request{ClientIP: tt.clientIP, Host: tt.targetHost})
 			if result != tt.expected {
-				t.Errorf("matchesRoute() = %v, want %v", result, tt.expected)
+				t.Errorf("routeMatches() = %v, want %v", result, tt.expected)
 			}
 		})
 	}
@@ -151,6 +145,19 @@ func TestFindRoute(t *testing.T) {
 			proxy_id INTEGER,
 			precedence INTEGER NOT NULL DEFAULT 0,
 			enabled BOOLEAN NOT NULL DEFAULT 1,
+			strategy TEXT,
+			affinity TEXT,
+			affinity_ttl_sec INTEGER,
+			host_regex TEXT,
+			dst_ports TEXT,
+			schemes TEXT,
+			methods TEXT,
+			path_prefix TEXT,
+			time_window TEXT,
+			client_user TEXT,
+			bandwidth_limit INTEGER,
+			idle_timeout_sec INTEGER,
+			max_lifetime_sec INTEGER,
 			created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
 		)
 	`)
@@ -249,6 +256,8 @@ func TestFindRoute(t *testing.T) {
 				`, route.ClientCIDR, route.HostGlob, route.Group, route.ProxyID, route.Precedence, route.Enabled)
 				require.NoError(t, err)
 			}
+			// The routes were edited behind the router's back
+			require.NoError(t, router.Reload(context.Background()))
 
 			// Test FindRoute
 			result, err := router.FindRoute(context.Background(), tt.clientIP, tt.targetHost)
@@ -292,6 +301,19 @@ func TestRoutePrecedence(t *testing.T) {
 			proxy_id INTEGER,
 			precedence INTEGER NOT NULL DEFAULT 0,
 			enabled BOOLEAN NOT NULL DEFAULT 1,
+			strategy TEXT,
+			affinity TEXT,
+			affinity_ttl_sec INTEGER,
+			host_regex TEXT,
+			dst_ports TEXT,
+			schemes TEXT,
+			methods TEXT,
+			path_prefix TEXT,
+			time_window TEXT,
+			client_user TEXT,
+			bandwidth_limit INTEGER,
+			idle_timeout_sec INTEGER,
+			max_lifetime_sec INTEGER,
 			created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
 		)
 	`)
@@ -337,7 +359,12 @@ func TestACLIntegration(t *testing.T) {
 		CREATE TABLE acl_subnets (
 			id INTEGER PRIMARY KEY AUTOINCREMENT,
 			cidr TEXT NOT NULL UNIQUE,
-			created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+			created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			bandwidth_limit INTEGER,
+			action TEXT NOT NULL DEFAULT 'allow',
+			priority INTEGER NOT NULL DEFAULT 100,
+			comment TEXT,
+			expires_at DATETIME
 		)
 	`)
 	require.NoError(t, err)
@@ -352,6 +379,19 @@ func TestACLIntegration(t *testing.T) {
 			proxy_id INTEGER,
 			precedence INTEGER NOT NULL DEFAULT 0,
 			enabled BOOLEAN NOT NULL DEFAULT 1,
+			strategy TEXT,
+			affinity TEXT,
+			affinity_ttl_sec INTEGER,
+			host_regex TEXT,
+			dst_ports TEXT,
+			schemes TEXT,
+			methods TEXT,
+			path_prefix TEXT,
+			time_window TEXT,
+			client_user TEXT,
+			bandwidth_limit INTEGER,
+			idle_timeout_sec INTEGER,
+			max_lifetime_sec INTEGER,
 			created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
 		)
 	`)
@@ -403,6 +443,108 @@ func TestACLIntegration(t *testing.T) {
 	}
 }
 
+func TestChainRouteHops(t *testing.T) {
+	db, err := sql.Open("sqlite", ":memory:")
+	require.NoError(t, err)
+	db.SetMaxOpenConns(1)
+	defer db.Close()
+
+	_, err = db.Exec(`
+		CREATE TABLE routes (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			client_cidr TEXT,
+			host_glob TEXT,
+			"group" TEXT NOT NULL,
+			proxy_id INTEGER,
+			precedence INTEGER NOT NULL DEFAULT 0,
+			enabled BOOLEAN NOT NULL DEFAULT 1,
+			strategy TEXT,
+			affinity TEXT,
+			affinity_ttl_sec INTEGER,
+			host_regex TEXT,
+			dst_ports TEXT,
+			schemes TEXT,
+			methods TEXT,
+			path_prefix TEXT,
+			time_window TEXT,
+			client_user TEXT,
+			bandwidth_limit INTEGER,
+			idle_timeout_sec INTEGER,
+			max_lifetime_sec INTEGER,
+			created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE TABLE route_hops (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			route_id INTEGER NOT NULL,
+			position INTEGER NOT NULL,
+			"group" TEXT NOT NULL,
+			proxy_id INTEGER,
+			timeout_ms INTEGER,
+			UNIQUE (route_id, position)
+		);
+	`)
+	require.NoError(t, err)
+
+	router := New(db)
+	ctx := context.Background()
+
+	// A chain without hops is rejected
+	err = router.CreateRoute(&Route{Group: RouteGroupChain, Precedence: 1, Enabled: true})
+	assert.Error(t, err)
+
+	chain := &Route{
+		Group:      RouteGroupChain,
+		HostGlob:   stringPtr("*.example.com"),
+		Precedence: 1,
+		Enabled:    true,
+		Hops: []Hop{
+			{Group: RouteGroupTor},
+			{Group: RouteGroupUpstream, ProxyID: intPtr(7), TimeoutMS: intPtr(5000)},
+		},
+	}
+	require.NoError(t, router.CreateRoute(chain))
+	require.NotZero(t, chain.ID)
+
+	route, err := router.FindRoute(ctx, "192.168.1.10", "api.example.com")
+	require.NoError(t, err)
+	require.NotNil(t, route)
+	require.Len(t, route.Hops, 2)
+	assert.Equal(t, RouteGroupTor, route.Hops[0].Group)
+	assert.Equal(t, 1, route.Hops[1].Position)
+	assert.Equal(t, 7, *route.Hops[1].ProxyID)
+	assert.Equal(t, 5000, *route.Hops[1].TimeoutMS)
+
+	// Replacing hops renumbers them and drops the old ones
+	require.NoError(t, router.SetRouteHops(ctx, chain.ID, []Hop{{Group: RouteGroupGeneral}}))
+	hops, err := router.GetRouteHops(ctx, chain.ID)
+	require.NoError(t, err)
+	require.Len(t, hops, 1)
+	assert.Equal(t, RouteGroupGeneral, hops[0].Group)
+
+	// UPSTREAM hops need a proxy and only CHAIN routes take hops
+	assert.Error(t, router.SetRouteHops(ctx, chain.ID, []Hop{{Group: RouteGroupUpstream}}))
+	local := &Route{Group: RouteGroupLocal, Precedence: 2, Enabled: true}
+	require.NoError(t, router.CreateRoute(local))
+	assert.Error(t, router.SetRouteHops(ctx, local.ID, []Hop{{Group: RouteGroupTor}}))
+
+	// A route only becomes a chain with hops, and loses them when it stops being one
+	assert.Error(t, router.UpdateRoute(ctx, local.ID, map[string]interface{}{"group": "CHAIN"}, nil))
+	assert.Error(t, router.UpdateRoute(ctx, local.ID, nil, []Hop{{Group: RouteGroupTor}}))
+	require.NoError(t, router.UpdateRoute(ctx, local.ID, map[string]interface{}{"group": "CHAIN"}, []Hop{{Group: RouteGroupTor}}))
+	hops, err = router.GetRouteHops(ctx, local.ID)
+	require.NoError(t, err)
+	require.Len(t, hops, 1)
+	require.NoError(t, router.UpdateRoute(ctx, local.ID, map[string]interface{}{"group": "LOCAL"}, nil))
+	hops, err = router.GetRouteHops(ctx, local.ID)
+	require.NoError(t, err)
+	assert.Empty(t, hops)
+
+	require.NoError(t, router.DeleteRoute(chain.ID))
+	hops, err = router.GetRouteHops(ctx, chain.ID)
+	require.NoError(t, err)
+	assert.Empty(t, hops)
+}
+
 // Helper function to create string pointers
 func stringPtr(s string) *string {
 	return &s
@@ -0,0 +1,212 @@
+package router
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Affinity selects what pins GENERAL route requests to the same pool proxy
+type Affinity string
+
+const (
+	AffinityNone       Affinity = ""            // every request is balanced anew
+	AffinityClientIP   Affinity = "client_ip"   // one proxy per client IP
+	AffinityTargetHost Affinity = "target_host" // one proxy per target host
+	AffinityClientHost Affinity = "client_host" // one proxy per client IP and target host
+	AffinitySession    Affinity = "session"     // one proxy per proxy username session suffix
+)
+
+// DefaultAffinityTTL is how long a pin lasts when the route does not set one
+const DefaultAffinityTTL = 10 * time.Minute
+
+// sessionSuffix separates the session ID in proxy usernames like "user-session-abc"
+const sessionSuffix = "-session-"
+
+// sessionSweepInterval is how often expired pins are dropped
+const sessionSweepInterval = time.Minute
+
+// ValidAffinity reports whether name is a known affinity mode
+func ValidAffinity(name Affinity) bool {
+	switch name {
+	case AffinityNone, AffinityClientIP, AffinityTargetHost, AffinityClientHost, AffinitySession:
+		return true
+	default:
+		return false
+	}
+}
+
+// SplitSessionUsername splits a proxy username like "user-session-abc" into
+// the account name and the session ID
+func SplitSessionUsername(username string) (user, sessionID string) {
+	i := strings.LastIndex(username, sessionSuffix)
+	if i < 0 {
+		return username, ""
+	}
+	return username[:i], username[i+len(sessionSuffix):]
+}
+
+type sessionIDKey struct{}
+
+// WithSessionID returns a context carrying the session ID of a request
+func WithSessionID(ctx context.Context, sessionID string) context.Context {
+	return context.WithValue(ctx, sessionIDKey{}, sessionID)
+}
+
+// sessionIDFromContext returns the session ID stored by WithSessionID
+func sessionIDFromContext(ctx context.Context) string {
+	sessionID, _ := ctx.Value(sessionIDKey{}).(string)
+	return sessionID
+}
+
+// Session is a request key pinned to a pool proxy
+type Session struct {
+	Key       string    `json:"key"`
+	RouteID   int       `json:"route_id"`
+	Affinity  Affinity  `json:"affinity"`
+	ProxyID   int       `json:"proxy_id"`
+	PinnedAt  time.Time `json:"pinned_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// sessionTable remembers which pool proxy each affinity key is pinned to
+type sessionTable struct {
+	mu        sync.Mutex
+	sessions  map[string]*Session
+	lastSweep time.Time
+}
+
+// newSessionTable creates an empty session table
+func newSessionTable() *sessionTable {
+	return &sessionTable{
+		sessions: make(map[string]*Session),
+	}
+}
+
+// affinityKey returns the key a request is pinned by, or "" when the route
+// has no affinity or the request lacks the value it keys on
+func affinityKey(route *Route, req selection) string {
+	var value string
+	switch route.Affinity {
+	case AffinityClientIP:
+		value = req.clientIP
+	case AffinityTargetHost:
+		value = req.targetHost
+	case AffinityClientHost:
+		if req.clientIP != "" && req.targetHost != "" {
+			value = req.clientIP + "|" + req.targetHost
+		}
+	case AffinitySession:
+		value = req.sessionID
+	}
+	if value == "" {
+		return ""
+	}
+	return strconv.Itoa(route.ID) + "|" + string(route.Affinity) + "|" + value
+}
+
+// lookup returns the proxy a key is pinned to
+func (t *sessionTable) lookup(key string) (int, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	session, ok := t.sessions[key]
+	if !ok {
+		return 0, false
+	}
+	if time.Now().After(session.ExpiresAt) {
+		delete(t.sessions, key)
+		return 0, false
+	}
+	return session.ProxyID, true
+}
+
+// pin pins a key to a proxy for ttl unless it is already pinned
+func (t *sessionTable) pin(key string, route *Route, proxyID int, ttl time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(t.lastSweep) >= sessionSweepInterval {
+		t.sweep(now)
+	}
+
+	if session, ok := t.sessions[key]; ok && now.Before(session.ExpiresAt) {
+		return
+	}
+	t.sessions[key] = &Session{
+		Key:       key,
+		RouteID:   route.ID,
+		Affinity:  route.Affinity,
+		ProxyID:   proxyID,
+		PinnedAt:  now,
+		ExpiresAt: now.Add(ttl),
+	}
+}
+
+// unpin drops the pin of a key
+func (t *sessionTable) unpin(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.sessions, key)
+}
+
+// sweep drops expired pins; the caller must hold the lock
+func (t *sessionTable) sweep(now time.Time) {
+	for key, session := range t.sessions {
+		if now.After(session.ExpiresAt) {
+			delete(t.sessions, key)
+		}
+	}
+	t.lastSweep = now
+}
+
+// list returns the live pins ordered by route and key
+func (t *sessionTable) list() []Session {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.sweep(time.Now())
+	sessions := make([]Session, 0, len(t.sessions))
+	for _, session := range t.sessions {
+		sessions = append(sessions, *session)
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		if sessions[i].RouteID != sessions[j].RouteID {
+			return sessions[i].RouteID < sessions[j].RouteID
+		}
+		return sessions[i].Key < sessions[j].Key
+	})
+	return sessions
+}
+
+// flush drops the pins of a route, or every pin when routeID is 0, and
+// returns how many were dropped
+func (t *sessionTable) flush(routeID int) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	flushed := 0
+	for key, session := range t.sessions {
+		if routeID == 0 || session.RouteID == routeID {
+			delete(t.sessions, key)
+			flushed++
+		}
+	}
+	return flushed
+}
+
+// Sessions returns the sticky sessions of GENERAL routes
+func (f *DialerFactory) Sessions() []Session {
+	return f.sessions.list()
+}
+
+// FlushSessions drops the sticky sessions of a route, or all of them when
+// routeID is 0, and returns how many were dropped
+func (f *DialerFactory) FlushSessions(routeID int) int {
+	return f.sessions.flush(routeID)
+}
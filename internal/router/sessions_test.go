@@ -0,0 +1,112 @@
+package router
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplitSessionUsername(t *testing.T) {
+	user, sessionID := SplitSessionUsername("alice-session-abc")
+	assert.Equal(t, "alice", user)
+	assert.Equal(t, "abc", sessionID)
+	user, sessionID = SplitSessionUsername("a-session-x-session-b")
+	assert.Equal(t, "a-session-x", user)
+	assert.Equal(t, "b", sessionID)
+	user, sessionID = SplitSessionUsername("alice")
+	assert.Equal(t, "alice", user)
+	assert.Equal(t, "", sessionID)
+}
+
+// firstCandidate returns the proxy a GENERAL dialer tries first
+func firstCandidate(t *testing.T, factory *DialerFactory, ctx context.Context, route *Route, clientIP string) (Dialer, int) {
+	dialer, err := factory.CreateDialer(ctx, route, clientIP, "example.com")
+	require.NoError(t, err)
+	return dialer, dialer.(*FailoverDialer).candidates[0].proxyID
+}
+
+func TestStickySessions(t *testing.T) {
+	echo := startEchoServer(t)
+
+	db := newTestProxyDB(t)
+	insertTestProxy(t, db, 1, "socks5", startForwardingSOCKS5Server(t).Addr().String(), 10)
+	insertTestProxy(t, db, 2, "socks5", startForwardingSOCKS5Server(t).Addr().String(), 20)
+	insertTestProxy(t, db, 3, "socks5", startForwardingSOCKS5Server(t).Addr().String(), 30)
+
+	factory := NewDialerFactory(db, "127.0.0.1:9050", time.Second, nil, FailoverPolicy{})
+	route := &Route{ID: 7, Group: RouteGroupGeneral, Strategy: StrategyRoundRobin, Affinity: AffinityClientIP}
+
+	// The first connection pins the client to the proxy it went through
+	dialer, pinned := firstCandidate(t, factory, context.Background(), route, "192.168.10.5")
+	conn, err := dialer.DialContext(context.Background(), "tcp", echo.Addr().String())
+	require.NoError(t, err)
+	conn.Close()
+
+	for i := 0; i < 3; i++ {
+		_, id := firstCandidate(t, factory, context.Background(), route, "192.168.10.5")
+		assert.Equal(t, pinned, id)
+	}
+
+	// Other clients are still balanced
+	_, other := firstCandidate(t, factory, context.Background(), route, "192.168.10.6")
+	_, another := firstCandidate(t, factory, context.Background(), route, "192.168.10.7")
+	assert.NotEqual(t, other, another)
+
+	sessions := factory.Sessions()
+	require.Len(t, sessions, 1)
+	assert.Equal(t, 7, sessions[0].RouteID)
+	assert.Equal(t, pinned, sessions[0].ProxyID)
+	assert.Equal(t, AffinityClientIP, sessions[0].Affinity)
+
+	// A failed health check moves the client to a new proxy
+	_, err = db.Exec("UPDATE proxies SET working = 0 WHERE id = ?", pinned)
+	require.NoError(t, err)
+	factory.pool.invalidate()
+
+	dialer, moved := firstCandidate(t, factory, context.Background(), route, "192.168.10.5")
+	assert.NotEqual(t, pinned, moved)
+	assert.Empty(t, factory.Sessions())
+
+	conn, err = dialer.DialContext(context.Background(), "tcp", echo.Addr().String())
+	require.NoError(t, err)
+	conn.Close()
+	_, id := firstCandidate(t, factory, context.Background(), route, "192.168.10.5")
+	assert.Equal(t, moved, id)
+
+	assert.Equal(t, 0, factory.FlushSessions(8))
+	assert.Equal(t, 1, factory.FlushSessions(7))
+	assert.Empty(t, factory.Sessions())
+}
+
+func TestStickySessionsBySessionID(t *testing.T) {
+	route := &Route{ID: 1, Affinity: AffinitySession}
+
+	// Requests without a session ID are not pinned
+	assert.Equal(t, "", affinityKey(route, selection{clientIP: "10.0.0.1"}))
+	assert.Equal(t, "1|session|abc", affinityKey(route, selection{clientIP: "10.0.0.1", sessionID: "abc"}))
+
+	ctx := WithSessionID(context.Background(), "abc")
+	assert.Equal(t, "abc", sessionIDFromContext(ctx))
+
+	route.Affinity = AffinityClientHost
+	assert.Equal(t, "1|client_host|10.0.0.1|example.com", affinityKey(route, selection{clientIP: "10.0.0.1", targetHost: "example.com"}))
+}
+
+func TestSessionTableExpiry(t *testing.T) {
+	table := newSessionTable()
+	route := &Route{ID: 1, Affinity: AffinityClientIP}
+
+	table.pin("a", route, 1, time.Hour)
+	table.pin("a", route, 2, time.Hour)
+	id, ok := table.lookup("a")
+	require.True(t, ok)
+	assert.Equal(t, 1, id)
+
+	table.pin("b", route, 3, -time.Second)
+	_, ok = table.lookup("b")
+	assert.False(t, ok)
+	assert.Len(t, table.list(), 1)
+}
@@ -0,0 +1,175 @@
+package router
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// SOCKS4 protocol constants
+const (
+	socks4Version    = 0x04
+	socks4CmdConnect = 0x01
+
+	socks4ReplyVersion  = 0x00
+	socks4ReplyGranted  = 0x5A
+	socks4ReplyRejected = 0x5B
+)
+
+// SOCKS4Error is returned when a SOCKS4 proxy rejects a CONNECT request
+type SOCKS4Error struct {
+	Proxy string
+	Code  byte
+}
+
+// Error implements the error interface
+func (e *SOCKS4Error) Error() string {
+	return fmt.Sprintf("SOCKS4 proxy %s connect failed: %s", e.Proxy, socks4ReplyText(e.Code))
+}
+
+// socks4ReplyText returns the description of a SOCKS4 reply code
+func socks4ReplyText(code byte) string {
+	switch code {
+	case socks4ReplyRejected:
+		return "request rejected or failed"
+	case 0x5C:
+		return "client is not running identd"
+	case 0x5D:
+		return "identd could not confirm the user ID"
+	default:
+		return fmt.Sprintf("unknown reply code %d", code)
+	}
+}
+
+// SOCKS4Dialer implements a SOCKS4 proxy dialer. Domain names are sent with
+// the SOCKS4a extension, so the proxy resolves them.
+type SOCKS4Dialer struct {
+	proxyHost string
+	timeout   time.Duration
+	userID    string
+	forward   Dialer // reaches the proxy through a previous chain hop when set
+}
+
+// NewSOCKS4Dialer creates a dialer for the SOCKS4 proxy at proxyHost
+func NewSOCKS4Dialer(proxyHost, userID string, timeout time.Duration) *SOCKS4Dialer {
+	return &SOCKS4Dialer{
+		proxyHost: proxyHost,
+		timeout:   timeout,
+		userID:    userID,
+	}
+}
+
+// DialContext implements the Dialer interface for SOCKS4
+func (d *SOCKS4Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4":
+	default:
+		return nil, fmt.Errorf("SOCKS4 proxy %s does not support network %s", d.proxyHost, network)
+	}
+
+	// Build the request first so a bad address fails before any I/O
+	request, err := d.buildConnectRequest(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	proxyConn, err := dialProxy(ctx, d.forward, d.timeout, d.proxyHost)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to SOCKS4 proxy %s: %w", d.proxyHost, err)
+	}
+
+	if err := d.handshake(ctx, proxyConn, request); err != nil {
+		proxyConn.Close()
+		return nil, err
+	}
+
+	return proxyConn, nil
+}
+
+// handshake sends the CONNECT request and reads the reply, bounded by the
+// dial timeout and the caller's context
+func (d *SOCKS4Dialer) handshake(ctx context.Context, conn net.Conn, request []byte) error {
+	deadline := time.Now().Add(d.timeout)
+	if dl, ok := ctx.Deadline(); ok && dl.Before(deadline) {
+		deadline = dl
+	}
+	conn.SetDeadline(deadline)
+	defer conn.SetDeadline(time.Time{}) // Clear deadline
+
+	// Abort blocked reads and writes as soon as the context is cancelled
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Unix(1, 0))
+	})
+	defer stop()
+
+	if err := d.performSOCKS4Handshake(conn, request); err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("SOCKS4 handshake with %s aborted: %w", d.proxyHost, ctx.Err())
+		}
+		return fmt.Errorf("SOCKS4 handshake with %s failed: %w", d.proxyHost, err)
+	}
+
+	return nil
+}
+
+// performSOCKS4Handshake performs the SOCKS4 CONNECT exchange
+func (d *SOCKS4Dialer) performSOCKS4Handshake(conn net.Conn, request []byte) error {
+	if _, err := conn.Write(request); err != nil {
+		return fmt.Errorf("failed to write SOCKS4 connect request: %w", err)
+	}
+
+	// Version, reply, port and address
+	reply := make([]byte, 8)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return fmt.Errorf("failed to read SOCKS4 connect response: %w", err)
+	}
+
+	if reply[0] != socks4ReplyVersion {
+		return fmt.Errorf("unexpected version %d in SOCKS4 connect response", reply[0])
+	}
+	if reply[1] != socks4ReplyGranted {
+		return &SOCKS4Error{Proxy: d.proxyHost, Code: reply[1]}
+	}
+
+	return nil
+}
+
+// buildConnectRequest encodes a SOCKS4 CONNECT request, or a SOCKS4a request
+// for a domain name
+func (d *SOCKS4Dialer) buildConnectRequest(targetAddr string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(targetAddr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid target address: %w", err)
+	}
+
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port: %w", err)
+	}
+
+	request := []byte{socks4Version, socks4CmdConnect}
+	request = binary.BigEndian.AppendUint16(request, uint16(port))
+
+	ip := net.ParseIP(host)
+	switch {
+	case ip != nil && ip.To4() != nil:
+		request = append(request, ip.To4()...)
+		request = append(append(request, d.userID...), 0)
+	case ip != nil:
+		return nil, fmt.Errorf("SOCKS4 does not support IPv6 target %s", host)
+	default:
+		if len(host) == 0 || len(host) > 255 {
+			return nil, fmt.Errorf("invalid domain name length: %d", len(host))
+		}
+		// SOCKS4a: an address of 0.0.0.x announces a domain name after the user ID
+		request = append(request, 0, 0, 0, 1)
+		request = append(append(request, d.userID...), 0)
+		request = append(append(request, host...), 0)
+	}
+
+	return request, nil
+}
@@ -0,0 +1,105 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startFakeSOCKS4Server starts a SOCKS4 server that records each raw request,
+// answers with reply and then echoes the connection
+func startFakeSOCKS4Server(t *testing.T, reply byte, requests chan<- []byte) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				buf := make([]byte, 512)
+				n, err := conn.Read(buf)
+				if err != nil {
+					return
+				}
+				requests <- buf[:n]
+				conn.Write([]byte{0, reply, 0, 0, 0, 0, 0, 0})
+				io.Copy(conn, conn)
+			}(conn)
+		}
+	}()
+
+	return listener
+}
+
+func TestSOCKS4DialerRequests(t *testing.T) {
+	requests := make(chan []byte, 1)
+	proxy := startFakeSOCKS4Server(t, socks4ReplyGranted, requests)
+	dialer := NewSOCKS4Dialer(proxy.Addr().String(), "alice", time.Second)
+
+	tests := []struct {
+		addr    string
+		request []byte
+	}{
+		{"192.0.2.1:80", []byte{4, 1, 0, 80, 192, 0, 2, 1, 'a', 'l', 'i', 'c', 'e', 0}},
+		{"example.com:443", append([]byte{4, 1, 1, 187, 0, 0, 0, 1, 'a', 'l', 'i', 'c', 'e', 0}, "example.com\x00"...)},
+	}
+
+	for _, tt := range tests {
+		conn, err := dialer.DialContext(context.Background(), "tcp", tt.addr)
+		require.NoError(t, err, tt.addr)
+		assert.Equal(t, tt.request, <-requests, tt.addr)
+
+		_, err = conn.Write([]byte("ping"))
+		require.NoError(t, err)
+		buf := make([]byte, 4)
+		_, err = io.ReadFull(conn, buf)
+		require.NoError(t, err)
+		assert.Equal(t, "ping", string(buf))
+		conn.Close()
+	}
+}
+
+func TestSOCKS4DialerRejected(t *testing.T) {
+	proxy := startFakeSOCKS4Server(t, socks4ReplyRejected, make(chan []byte, 1))
+	dialer := NewSOCKS4Dialer(proxy.Addr().String(), "", time.Second)
+
+	_, err := dialer.DialContext(context.Background(), "tcp", "192.0.2.1:80")
+	require.Error(t, err)
+
+	var socksErr *SOCKS4Error
+	require.True(t, errors.As(err, &socksErr))
+	assert.Equal(t, byte(socks4ReplyRejected), socksErr.Code)
+}
+
+func TestSOCKS4DialerRejectsIPv6(t *testing.T) {
+	dialer := NewSOCKS4Dialer("127.0.0.1:1", "", time.Second)
+
+	_, err := dialer.DialContext(context.Background(), "tcp", "[2001:db8::1]:80")
+	assert.ErrorContains(t, err, "IPv6")
+
+	_, err = dialer.DialContext(context.Background(), "udp", "192.0.2.1:53")
+	assert.ErrorContains(t, err, "does not support network")
+}
+
+func TestCreateSOCKS4Dialer(t *testing.T) {
+	factory := NewDialerFactory(nil, "127.0.0.1:9050", time.Second, nil, FailoverPolicy{})
+
+	dialer, err := factory.createProxyDialer(&Proxy{ProxyType: "socks4", IP: "10.0.0.1", Port: 1080, Username: "alice"})
+	require.NoError(t, err)
+
+	socksDialer, ok := dialer.(*SOCKS4Dialer)
+	require.True(t, ok)
+	assert.Equal(t, "10.0.0.1:1080", socksDialer.proxyHost)
+	assert.Equal(t, "alice", socksDialer.userID)
+}
@@ -0,0 +1,309 @@
+package router
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// SOCKS5 protocol constants (RFC 1928)
+const (
+	socks5Version = 0x05
+
+	socks5MethodNoAuth       = 0x00
+	socks5MethodUserPass     = 0x02
+	socks5MethodNoAcceptable = 0xFF
+
+	socks5UserPassVersion = 0x01
+
+	socks5CmdConnect      = 0x01
+	socks5CmdUDPAssociate = 0x03
+
+	socks5AddrIPv4   = 0x01
+	socks5AddrDomain = 0x03
+	socks5AddrIPv6   = 0x04
+
+	socks5ReplySucceeded = 0x00
+)
+
+// SOCKS5Error is returned when a SOCKS5 proxy rejects a CONNECT request
+type SOCKS5Error struct {
+	Proxy string
+	Code  byte
+}
+
+// Error implements the error interface
+func (e *SOCKS5Error) Error() string {
+	return fmt.Sprintf("SOCKS5 proxy %s connect failed: %s", e.Proxy, socks5ReplyText(e.Code))
+}
+
+// Timeout reports whether the proxy gave up waiting for the target
+func (e *SOCKS5Error) Timeout() bool {
+	return e.Code == 0x06
+}
+
+// socks5ReplyText returns the RFC 1928 description of a reply code
+func socks5ReplyText(code byte) string {
+	switch code {
+	case 0x01:
+		return "general SOCKS server failure"
+	case 0x02:
+		return "connection not allowed by ruleset"
+	case 0x03:
+		return "network is unreachable"
+	case 0x04:
+		return "host unreachable"
+	case 0x05:
+		return "connection refused"
+	case 0x06:
+		return "TTL expired"
+	case 0x07:
+		return "command not supported"
+	case 0x08:
+		return "address type not supported"
+	default:
+		return fmt.Sprintf("unknown reply code %d", code)
+	}
+}
+
+// SOCKS5Dialer implements a SOCKS5 proxy dialer
+type SOCKS5Dialer struct {
+	proxyHost  string
+	timeout    time.Duration
+	domainOnly bool // send every target as a domain name (used for Tor)
+	username   string
+	password   string
+	forward    Dialer // reaches the proxy through a previous chain hop when set
+}
+
+// DialContext implements the Dialer interface for SOCKS5
+func (d *SOCKS5Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("SOCKS5 proxy %s does not support network %s", d.proxyHost, network)
+	}
+
+	// Connect to the SOCKS5 proxy
+	proxyConn, err := dialProxy(ctx, d.forward, d.timeout, d.proxyHost)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to SOCKS5 proxy %s: %w", d.proxyHost, err)
+	}
+
+	if err := d.handshake(ctx, proxyConn, addr); err != nil {
+		proxyConn.Close()
+		return nil, err
+	}
+
+	return proxyConn, nil
+}
+
+// handshake performs the SOCKS5 greeting and CONNECT exchange, bounded by
+// the dial timeout and the caller's context
+func (d *SOCKS5Dialer) handshake(ctx context.Context, conn net.Conn, targetAddr string) error {
+	_, err := d.request(ctx, conn, socks5CmdConnect, targetAddr)
+	return err
+}
+
+// request performs the SOCKS5 greeting and a command exchange, bounded by the
+// dial timeout and the caller's context, and returns the bound address
+func (d *SOCKS5Dialer) request(ctx context.Context, conn net.Conn, command byte, targetAddr string) (string, error) {
+	deadline := time.Now().Add(d.timeout)
+	if dl, ok := ctx.Deadline(); ok && dl.Before(deadline) {
+		deadline = dl
+	}
+	conn.SetDeadline(deadline)
+	defer conn.SetDeadline(time.Time{}) // Clear deadline
+
+	// Abort blocked reads and writes as soon as the context is cancelled
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Unix(1, 0))
+	})
+	defer stop()
+
+	bound, err := d.performSOCKS5Handshake(conn, command, targetAddr)
+	if err != nil {
+		if ctx.Err() != nil {
+			return "", fmt.Errorf("SOCKS5 handshake with %s aborted: %w", d.proxyHost, ctx.Err())
+		}
+		return "", fmt.Errorf("SOCKS5 handshake with %s failed: %w", d.proxyHost, err)
+	}
+
+	return bound, nil
+}
+
+// performSOCKS5Handshake performs the SOCKS5 protocol handshake and returns
+// the bound address of the reply
+func (d *SOCKS5Dialer) performSOCKS5Handshake(conn net.Conn, command byte, targetAddr string) (string, error) {
+	// Build the request first so a bad address fails before any I/O
+	request, err := d.buildRequest(command, targetAddr)
+	if err != nil {
+		return "", err
+	}
+
+	// SOCKS5 greeting: offer username/password only when we have credentials
+	greeting := []byte{socks5Version, 0x01, socks5MethodNoAuth}
+	if d.username != "" {
+		greeting = []byte{socks5Version, 0x02, socks5MethodNoAuth, socks5MethodUserPass}
+	}
+	if _, err := conn.Write(greeting); err != nil {
+		return "", fmt.Errorf("failed to write SOCKS5 greeting: %w", err)
+	}
+
+	// Read server response
+	response := make([]byte, 2)
+	if _, err := io.ReadFull(conn, response); err != nil {
+		return "", fmt.Errorf("failed to read SOCKS5 greeting response: %w", err)
+	}
+
+	if response[0] != socks5Version {
+		return "", fmt.Errorf("unexpected SOCKS version %d in greeting response", response[0])
+	}
+	if response[1] == socks5MethodNoAcceptable {
+		return "", fmt.Errorf("SOCKS5 proxy accepted none of the offered auth methods")
+	}
+	switch {
+	case response[1] == socks5MethodNoAuth:
+	case response[1] == socks5MethodUserPass && d.username != "":
+		if err := d.authenticate(conn); err != nil {
+			return "", err
+		}
+	default:
+		return "", fmt.Errorf("SOCKS5 proxy selected unsupported auth method %d", response[1])
+	}
+
+	if _, err := conn.Write(request); err != nil {
+		return "", fmt.Errorf("failed to write SOCKS5 connect request: %w", err)
+	}
+
+	// Read response header: version, reply, reserved, address type
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", fmt.Errorf("failed to read SOCKS5 connect response: %w", err)
+	}
+
+	if header[0] != socks5Version {
+		return "", fmt.Errorf("unexpected SOCKS version %d in connect response", header[0])
+	}
+	if header[1] != socks5ReplySucceeded {
+		return "", &SOCKS5Error{Proxy: d.proxyHost, Code: header[1]}
+	}
+
+	// Read the bound address so a tunnel starts at the right byte
+	bound, err := readSOCKS5Addr(conn, header[3])
+	if err != nil {
+		return "", fmt.Errorf("failed to read bound address: %w", err)
+	}
+
+	return bound, nil
+}
+
+// authenticate performs username/password authentication (RFC 1929)
+func (d *SOCKS5Dialer) authenticate(conn net.Conn) error {
+	if len(d.username) > 255 || len(d.password) > 255 {
+		return fmt.Errorf("SOCKS5 username and password must be at most 255 bytes")
+	}
+
+	request := []byte{socks5UserPassVersion, byte(len(d.username))}
+	request = append(request, d.username...)
+	request = append(request, byte(len(d.password)))
+	request = append(request, d.password...)
+	if _, err := conn.Write(request); err != nil {
+		return fmt.Errorf("failed to write SOCKS5 auth request: %w", err)
+	}
+
+	response := make([]byte, 2)
+	if _, err := io.ReadFull(conn, response); err != nil {
+		return fmt.Errorf("failed to read SOCKS5 auth response: %w", err)
+	}
+	if response[0] != socks5UserPassVersion {
+		return fmt.Errorf("unexpected auth version %d in SOCKS5 auth response", response[0])
+	}
+	if response[1] != 0x00 {
+		return fmt.Errorf("SOCKS5 proxy %s refused credentials for user %s", d.proxyHost, d.username)
+	}
+
+	return nil
+}
+
+// buildRequest encodes a request with the given command for the target address
+func (d *SOCKS5Dialer) buildRequest(command byte, targetAddr string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(targetAddr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid target address: %w", err)
+	}
+
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port: %w", err)
+	}
+
+	request := []byte{socks5Version, command, 0x00}
+	return appendSOCKS5Addr(request, host, uint16(port), d.domainOnly)
+}
+
+// appendSOCKS5Addr appends a host and port in SOCKS5 address form. With
+// domainOnly, IP addresses are sent as domain names too.
+func appendSOCKS5Addr(request []byte, host string, port uint16, domainOnly bool) ([]byte, error) {
+	ip := net.ParseIP(host)
+	switch {
+	case ip != nil && !domainOnly && ip.To4() != nil:
+		request = append(request, socks5AddrIPv4)
+		request = append(request, ip.To4()...)
+	case ip != nil && !domainOnly:
+		request = append(request, socks5AddrIPv6)
+		request = append(request, ip.To16()...)
+	default:
+		if len(host) == 0 || len(host) > 255 {
+			return nil, fmt.Errorf("invalid domain name length: %d", len(host))
+		}
+		request = append(request, socks5AddrDomain, byte(len(host)))
+		request = append(request, host...)
+	}
+
+	return binary.BigEndian.AppendUint16(request, port), nil
+}
+
+// readSOCKS5Addr reads an address of the given type followed by a port and
+// returns it in host:port form
+func readSOCKS5Addr(r io.Reader, addrType byte) (string, error) {
+	var host string
+
+	switch addrType {
+	case socks5AddrIPv4:
+		addr := make([]byte, net.IPv4len)
+		if _, err := io.ReadFull(r, addr); err != nil {
+			return "", err
+		}
+		host = net.IP(addr).String()
+	case socks5AddrIPv6:
+		addr := make([]byte, net.IPv6len)
+		if _, err := io.ReadFull(r, addr); err != nil {
+			return "", err
+		}
+		host = net.IP(addr).String()
+	case socks5AddrDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(r, length); err != nil {
+			return "", err
+		}
+		addr := make([]byte, int(length[0]))
+		if _, err := io.ReadFull(r, addr); err != nil {
+			return "", err
+		}
+		host = string(addr)
+	default:
+		return "", fmt.Errorf("unsupported address type: %d", addrType)
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return "", err
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
@@ -0,0 +1,280 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/armon/go-socks5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startEchoServer starts a TCP server that echoes everything it receives
+func startEchoServer(t *testing.T) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}(conn)
+		}
+	}()
+
+	return listener
+}
+
+// staticResolver resolves every name to loopback without touching DNS
+type staticResolver struct{}
+
+func (staticResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	return ctx, net.IPv4(127, 0, 0, 1), nil
+}
+
+// startFakeSOCKS5Server starts an in-process SOCKS5 server that reports the
+// destination of each request and forwards every connection to target
+func startFakeSOCKS5Server(t *testing.T, target string, requests chan<- *socks5.AddrSpec) net.Listener {
+	server, err := socks5.New(&socks5.Config{
+		Resolver: staticResolver{},
+		Logger:   log.New(io.Discard, "", 0),
+		Rewriter: recordingRewriter{requests: requests},
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return net.Dial(network, target)
+		},
+	})
+	require.NoError(t, err)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	go server.Serve(listener)
+
+	return listener
+}
+
+// recordingRewriter passes requests through unchanged after recording them
+type recordingRewriter struct {
+	requests chan<- *socks5.AddrSpec
+}
+
+func (r recordingRewriter) Rewrite(ctx context.Context, request *socks5.Request) (context.Context, *socks5.AddrSpec) {
+	dest := *request.DestAddr
+	r.requests <- &dest
+	return ctx, request.DestAddr
+}
+
+func TestSOCKS5DialerAddressTypes(t *testing.T) {
+	echo := startEchoServer(t)
+
+	tests := []struct {
+		name       string
+		addr       string
+		domainOnly bool
+		expectFQDN string
+		expectIP   string
+	}{
+		{"IPv4", "192.0.2.10:443", false, "", "192.0.2.10"},
+		{"IPv6", "[2001:db8::1]:443", false, "", "2001:db8::1"},
+		{"domain", "example.com:443", false, "example.com", ""},
+		{"IPv4 as domain", "192.0.2.10:443", true, "192.0.2.10", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requests := make(chan *socks5.AddrSpec, 1)
+			proxy := startFakeSOCKS5Server(t, echo.Addr().String(), requests)
+
+			dialer := &SOCKS5Dialer{
+				proxyHost:  proxy.Addr().String(),
+				timeout:    2 * time.Second,
+				domainOnly: tt.domainOnly,
+			}
+
+			conn, err := dialer.DialContext(context.Background(), "tcp", tt.addr)
+			require.NoError(t, err)
+			defer conn.Close()
+
+			dest := <-requests
+			assert.Equal(t, 443, dest.Port)
+			assert.Equal(t, tt.expectFQDN, dest.FQDN)
+			if tt.expectIP != "" {
+				assert.Equal(t, tt.expectIP, dest.IP.String())
+			}
+
+			_, err = conn.Write([]byte("hello"))
+			require.NoError(t, err)
+
+			buf := make([]byte, 5)
+			_, err = io.ReadFull(conn, buf)
+			require.NoError(t, err)
+			assert.Equal(t, "hello", string(buf))
+		})
+	}
+}
+
+func TestSOCKS5DialerUserPassAuth(t *testing.T) {
+	echo := startEchoServer(t)
+
+	server, err := socks5.New(&socks5.Config{
+		Credentials: socks5.StaticCredentials{"alice": "s3cret"},
+		Resolver:    staticResolver{},
+		Logger:      log.New(io.Discard, "", 0),
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return net.Dial(network, echo.Addr().String())
+		},
+	})
+	require.NoError(t, err)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	go server.Serve(listener)
+
+	dialer := &SOCKS5Dialer{
+		proxyHost: listener.Addr().String(),
+		timeout:   2 * time.Second,
+		username:  "alice",
+		password:  "s3cret",
+	}
+
+	conn, err := dialer.DialContext(context.Background(), "tcp", "example.com:80")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(buf))
+
+	// Wrong credentials must be rejected
+	dialer.password = "wrong"
+	_, err = dialer.DialContext(context.Background(), "tcp", "example.com:80")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "refused credentials")
+}
+
+func TestSOCKS5DialerFragmentedReply(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	// A server that trickles its replies one byte at a time and binds to a
+	// domain name, then sends tunnel data straight after the reply
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		greeting := make([]byte, 3)
+		if _, err := io.ReadFull(conn, greeting); err != nil {
+			return
+		}
+		writeSlowly(conn, []byte{0x05, 0x00})
+
+		header := make([]byte, 4)
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+		if _, err := readSOCKS5Addr(conn, header[3]); err != nil {
+			return
+		}
+
+		reply := []byte{0x05, 0x00, 0x00, 0x03, 0x09}
+		reply = append(reply, "localhost"...)
+		reply = append(reply, 0x04, 0x38)
+		writeSlowly(conn, reply)
+		conn.Write([]byte("data"))
+	}()
+
+	dialer := &SOCKS5Dialer{
+		proxyHost: listener.Addr().String(),
+		timeout:   2 * time.Second,
+	}
+
+	conn, err := dialer.DialContext(context.Background(), "tcp", "example.com:80")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "data", string(buf))
+}
+
+func TestSOCKS5DialerReplyError(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		greeting := make([]byte, 3)
+		io.ReadFull(conn, greeting)
+		conn.Write([]byte{0x05, 0x00})
+
+		header := make([]byte, 4)
+		io.ReadFull(conn, header)
+		readSOCKS5Addr(conn, header[3])
+		conn.Write([]byte{0x05, 0x05, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+	}()
+
+	dialer := &SOCKS5Dialer{
+		proxyHost: listener.Addr().String(),
+		timeout:   2 * time.Second,
+	}
+
+	_, err = dialer.DialContext(context.Background(), "tcp", "example.com:80")
+	require.Error(t, err)
+
+	var socksErr *SOCKS5Error
+	require.True(t, errors.As(err, &socksErr))
+	assert.Equal(t, byte(0x05), socksErr.Code)
+	assert.Contains(t, err.Error(), "refused")
+}
+
+func TestCreateSOCKS5Dialer(t *testing.T) {
+	factory := NewDialerFactory(nil, "127.0.0.1:9050", time.Second, nil, FailoverPolicy{})
+
+	dialer, err := factory.createProxyDialer(&Proxy{ProxyType: "socks5", IP: "10.0.0.1", Port: 1080})
+	require.NoError(t, err)
+
+	socksDialer, ok := dialer.(*SOCKS5Dialer)
+	require.True(t, ok)
+	assert.Equal(t, "10.0.0.1:1080", socksDialer.proxyHost)
+	assert.False(t, socksDialer.domainOnly)
+
+	dialer, err = factory.createTorDialer()
+	require.NoError(t, err)
+	assert.True(t, dialer.(*SOCKS5Dialer).domainOnly)
+}
+
+// writeSlowly writes data one byte at a time to exercise partial reads
+func writeSlowly(conn net.Conn, data []byte) {
+	for _, b := range data {
+		conn.Write([]byte{b})
+		time.Sleep(time.Millisecond)
+	}
+}
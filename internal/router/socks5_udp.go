@@ -0,0 +1,144 @@
+package router
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+// maxSOCKS5UDPHeader is the size of the largest SOCKS5 UDP header, with a
+// 255 byte domain name
+const maxSOCKS5UDPHeader = 4 + 1 + 255 + 2
+
+// ParseSOCKS5Datagram splits a SOCKS5 UDP datagram (RFC 1928 section 7) into
+// its address and payload. Fragmented datagrams are rejected.
+func ParseSOCKS5Datagram(b []byte) (addr string, payload []byte, err error) {
+	if len(b) < 4 {
+		return "", nil, fmt.Errorf("SOCKS5 datagram too short")
+	}
+	if b[2] != 0 {
+		return "", nil, fmt.Errorf("fragmented SOCKS5 datagrams are not supported")
+	}
+
+	r := bytes.NewReader(b[4:])
+	addr, err = readSOCKS5Addr(r, b[3])
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid SOCKS5 datagram address: %w", err)
+	}
+	return addr, b[len(b)-r.Len():], nil
+}
+
+// AppendSOCKS5Datagram appends a SOCKS5 UDP datagram for addr carrying
+// payload to b
+func AppendSOCKS5Datagram(b []byte, addr string, payload []byte) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address: %w", err)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port: %w", err)
+	}
+
+	b, err = appendSOCKS5Addr(append(b, 0, 0, 0), host, uint16(port), false)
+	if err != nil {
+		return nil, err
+	}
+	return append(b, payload...), nil
+}
+
+// ListenPacket opens a UDP association through the SOCKS5 proxy. The
+// association lasts until the returned connection is closed or the proxy
+// drops the control connection.
+func (d *SOCKS5Dialer) ListenPacket(ctx context.Context) (PacketConn, error) {
+	control, err := dialProxy(ctx, d.forward, d.timeout, d.proxyHost)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to SOCKS5 proxy %s: %w", d.proxyHost, err)
+	}
+
+	bound, err := d.request(ctx, control, socks5CmdUDPAssociate, "0.0.0.0:0")
+	if err != nil {
+		control.Close()
+		return nil, err
+	}
+
+	relayAddr, err := net.ResolveUDPAddr("udp", bound)
+	if err != nil {
+		control.Close()
+		return nil, fmt.Errorf("invalid SOCKS5 relay address %s: %w", bound, err)
+	}
+	// A relay bound to the unspecified address listens where we reached the proxy
+	if relayAddr.IP == nil || relayAddr.IP.IsUnspecified() {
+		if tcpAddr, ok := control.RemoteAddr().(*net.TCPAddr); ok {
+			relayAddr.IP = tcpAddr.IP
+		}
+	}
+
+	relay, err := net.DialUDP("udp", nil, relayAddr)
+	if err != nil {
+		control.Close()
+		return nil, fmt.Errorf("failed to reach SOCKS5 relay %s: %w", relayAddr, err)
+	}
+
+	c := &socks5PacketConn{control: control, relay: relay, domainOnly: d.domainOnly}
+	go func() {
+		// The proxy ends the association by closing the control connection
+		io.Copy(io.Discard, control)
+		relay.Close()
+	}()
+	return c, nil
+}
+
+// socks5PacketConn relays datagrams through a SOCKS5 UDP association
+type socks5PacketConn struct {
+	control    net.Conn
+	relay      *net.UDPConn
+	domainOnly bool
+}
+
+// WriteTo implements PacketConn
+func (c *socks5PacketConn) WriteTo(b []byte, addr string) (int, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return 0, fmt.Errorf("invalid address: %w", err)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid port: %w", err)
+	}
+
+	datagram, err := appendSOCKS5Addr([]byte{0, 0, 0}, host, uint16(port), c.domainOnly)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := c.relay.Write(append(datagram, b...)); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// ReadFrom implements PacketConn
+func (c *socks5PacketConn) ReadFrom(b []byte) (int, string, error) {
+	buf := make([]byte, len(b)+maxSOCKS5UDPHeader)
+	for {
+		n, err := c.relay.Read(buf)
+		if err != nil {
+			return 0, "", err
+		}
+		addr, payload, err := ParseSOCKS5Datagram(buf[:n])
+		if err != nil {
+			// Skip datagrams we cannot parse rather than ending the association
+			continue
+		}
+		return copy(b, payload), addr, nil
+	}
+}
+
+// Close implements PacketConn
+func (c *socks5PacketConn) Close() error {
+	c.relay.Close()
+	return c.control.Close()
+}
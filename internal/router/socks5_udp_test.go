@@ -0,0 +1,45 @@
+package router
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSOCKS5DatagramRoundTrip(t *testing.T) {
+	for _, addr := range []string{"192.0.2.1:53", "[2001:db8::1]:443", "example.com:8443"} {
+		datagram, err := AppendSOCKS5Datagram(nil, addr, []byte("payload"))
+		require.NoError(t, err)
+
+		got, payload, err := ParseSOCKS5Datagram(datagram)
+		require.NoError(t, err, addr)
+		assert.Equal(t, addr, got)
+		assert.Equal(t, "payload", string(payload))
+	}
+}
+
+func TestParseSOCKS5DatagramRejectsInvalid(t *testing.T) {
+	_, _, err := ParseSOCKS5Datagram([]byte{0, 0, 1, 1, 192, 0, 2, 1, 0, 53})
+	assert.ErrorContains(t, err, "fragmented")
+
+	_, _, err = ParseSOCKS5Datagram([]byte{0, 0, 0, 1, 192, 0})
+	assert.Error(t, err)
+
+	_, _, err = ParseSOCKS5Datagram([]byte{0, 0})
+	assert.Error(t, err)
+}
+
+func TestListenPacketRequiresUDPRoute(t *testing.T) {
+	f := NewDialerFactory(nil, "127.0.0.1:9050", 0, nil, FailoverPolicy{})
+
+	for _, group := range []RouteGroup{RouteGroupTor, RouteGroupGeneral, RouteGroupChain} {
+		_, err := f.ListenPacket(context.Background(), &Route{Group: group})
+		assert.ErrorIs(t, err, ErrUDPUnsupported, group)
+	}
+
+	conn, err := f.ListenPacket(context.Background(), &Route{Group: RouteGroupLocal})
+	require.NoError(t, err)
+	conn.Close()
+}
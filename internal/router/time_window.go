@@ -0,0 +1,126 @@
+package router
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// timeWindow is a parsed cron-style expression of five fields: minute, hour,
+// day of month, month and day of week. A route with a time window only
+// matches during the minutes the expression selects, in server local time.
+type timeWindow struct {
+	minutes  uint64 // bit n set = minute n
+	hours    uint64
+	days     uint64
+	months   uint64
+	weekdays uint64 // 0 = Sunday
+	anyDay   bool   // the day of month field is "*"
+	anyWday  bool   // the day of week field is "*"
+}
+
+// cronField describes the allowed range of one cron field
+type cronField struct {
+	name     string
+	min, max int
+}
+
+var cronFields = [5]cronField{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7}, // 7 is also Sunday
+}
+
+// parseTimeWindow parses a cron-style expression like "* 9-17 * * 1-5"
+func parseTimeWindow(expr string) (*timeWindow, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != len(cronFields) {
+		return nil, fmt.Errorf("time window %q must have 5 fields (minute hour day month weekday)", expr)
+	}
+
+	var sets [5]uint64
+	for i, field := range fields {
+		set, err := parseCronField(field, cronFields[i])
+		if err != nil {
+			return nil, fmt.Errorf("invalid time window %q: %w", expr, err)
+		}
+		sets[i] = set
+	}
+
+	// Sunday may be written as 0 or 7
+	if sets[4]&(1<<7) != 0 {
+		sets[4] |= 1
+	}
+
+	return &timeWindow{
+		minutes:  sets[0],
+		hours:    sets[1],
+		days:     sets[2],
+		months:   sets[3],
+		weekdays: sets[4],
+		anyDay:   fields[2] == "*",
+		anyWday:  fields[4] == "*",
+	}, nil
+}
+
+// parseCronField parses a comma-separated list of "*", "n", "a-b" and any of
+// those with a "/step" into a bit set
+func parseCronField(field string, spec cronField) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(field, ",") {
+		rangePart, stepPart, hasStep := strings.Cut(part, "/")
+
+		step := 1
+		if hasStep {
+			n, err := strconv.Atoi(stepPart)
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid step %q in %s field", stepPart, spec.name)
+			}
+			step = n
+		}
+
+		low, high := spec.min, spec.max
+		if rangePart != "*" {
+			lowPart, highPart, isRange := strings.Cut(rangePart, "-")
+			n, err := strconv.Atoi(lowPart)
+			if err != nil {
+				return 0, fmt.Errorf("invalid value %q in %s field", part, spec.name)
+			}
+			low, high = n, n
+			if isRange {
+				if high, err = strconv.Atoi(highPart); err != nil {
+					return 0, fmt.Errorf("invalid value %q in %s field", part, spec.name)
+				}
+			} else if hasStep {
+				// "n/step" runs from n to the end of the range
+				high = spec.max
+			}
+		}
+
+		if low < spec.min || high > spec.max || low > high {
+			return 0, fmt.Errorf("%s field value %q is out of range %d-%d", spec.name, part, spec.min, spec.max)
+		}
+		for v := low; v <= high; v += step {
+			set |= 1 << v
+		}
+	}
+	return set, nil
+}
+
+// contains reports whether t falls in the window. Like cron, when both the day
+// of month and day of week are restricted either one may match.
+func (w *timeWindow) contains(t time.Time) bool {
+	if w.minutes&(1<<t.Minute()) == 0 || w.hours&(1<<t.Hour()) == 0 || w.months&(1<<int(t.Month())) == 0 {
+		return false
+	}
+
+	dayMatch := w.days&(1<<t.Day()) != 0
+	wdayMatch := w.weekdays&(1<<int(t.Weekday())) != 0
+	if w.anyDay || w.anyWday {
+		return dayMatch && wdayMatch
+	}
+	return dayMatch || wdayMatch
+}
@@ -0,0 +1,53 @@
+package router
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTimeWindowBusinessHours(t *testing.T) {
+	window, err := parseTimeWindow("* 9-16 * * 1-5")
+	require.NoError(t, err)
+
+	// 2024-06-03 is a Monday
+	assert.True(t, window.contains(time.Date(2024, 6, 3, 9, 0, 0, 0, time.Local)))
+	assert.True(t, window.contains(time.Date(2024, 6, 7, 16, 59, 0, 0, time.Local)))
+	assert.False(t, window.contains(time.Date(2024, 6, 3, 8, 59, 0, 0, time.Local)))
+	assert.False(t, window.contains(time.Date(2024, 6, 3, 17, 0, 0, 0, time.Local)))
+	assert.False(t, window.contains(time.Date(2024, 6, 8, 12, 0, 0, 0, time.Local)))
+}
+
+func TestTimeWindowFields(t *testing.T) {
+	tests := []struct {
+		expr     string
+		time     time.Time
+		expected bool
+	}{
+		{"*/15 * * * *", time.Date(2024, 6, 3, 10, 30, 0, 0, time.Local), true},
+		{"*/15 * * * *", time.Date(2024, 6, 3, 10, 31, 0, 0, time.Local), false},
+		{"5/20 * * * *", time.Date(2024, 6, 3, 10, 45, 0, 0, time.Local), true},
+		{"0,30 22-23,0-5 * * *", time.Date(2024, 6, 3, 23, 30, 0, 0, time.Local), true},
+		{"* * * 12 *", time.Date(2024, 6, 3, 0, 0, 0, 0, time.Local), false},
+		{"* * * * 7", time.Date(2024, 6, 9, 0, 0, 0, 0, time.Local), true},
+		// Restricted day of month and day of week match either one
+		{"* * 1 * 1", time.Date(2024, 6, 3, 0, 0, 0, 0, time.Local), true},
+		{"* * 1 * 1", time.Date(2024, 6, 1, 0, 0, 0, 0, time.Local), true},
+		{"* * 1 * 1", time.Date(2024, 6, 4, 0, 0, 0, 0, time.Local), false},
+	}
+
+	for _, tt := range tests {
+		window, err := parseTimeWindow(tt.expr)
+		require.NoError(t, err, tt.expr)
+		assert.Equal(t, tt.expected, window.contains(tt.time), "%s at %s", tt.expr, tt.time)
+	}
+}
+
+func TestParseTimeWindowErrors(t *testing.T) {
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "* * * 13 *", "* * * * 8", "5-1 * * * *", "*/0 * * * *", "a * * * *"} {
+		_, err := parseTimeWindow(expr)
+		assert.Error(t, err, expr)
+	}
+}
@@ -0,0 +1,128 @@
+package secrets
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// KeySize is the length of the AES-256 key used to seal secrets
+const KeySize = 32
+
+// sealedPrefix marks values produced by Box.Seal so the format can evolve
+const sealedPrefix = "v1:"
+
+// Box encrypts and decrypts small secrets such as upstream proxy passwords
+// before they are written to the database
+type Box struct {
+	aead cipher.AEAD
+}
+
+// New creates a new Box from a raw 32 byte key
+func New(key []byte) (*Box, error) {
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("invalid key length: got %d bytes, expected %d", len(key), KeySize)
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create GCM: %w", err)
+	}
+
+	return &Box{aead: aead}, nil
+}
+
+// NewFromBase64 creates a new Box from a base64 encoded key
+func NewFromBase64(encoded string) (*Box, error) {
+	key, err := DecodeKey(encoded)
+	if err != nil {
+		return nil, err
+	}
+	return New(key)
+}
+
+// DecodeKey decodes a base64 key and checks its length
+func DecodeKey(encoded string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode key: %w", err)
+	}
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("invalid key length: got %d bytes, expected %d", len(key), KeySize)
+	}
+	return key, nil
+}
+
+// LoadOrCreateKeyFile reads a base64 key from path, generating and saving a
+// new random key with owner-only permissions if the file does not exist
+func LoadOrCreateKeyFile(path string) (*Box, error) {
+	content, err := os.ReadFile(path)
+	if err == nil {
+		return NewFromBase64(string(content))
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read key file: %w", err)
+	}
+
+	key := make([]byte, KeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("failed to generate key: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create key directory: %w", err)
+	}
+
+	encoded := base64.StdEncoding.EncodeToString(key)
+	if err := os.WriteFile(path, []byte(encoded+"\n"), 0600); err != nil {
+		return nil, fmt.Errorf("failed to write key file: %w", err)
+	}
+
+	return New(key)
+}
+
+// Seal encrypts plaintext and returns a printable string safe to store
+func (b *Box) Seal(plaintext string) (string, error) {
+	nonce := make([]byte, b.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	sealed := b.aead.Seal(nonce, nonce, []byte(plaintext), nil)
+	return sealedPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Open decrypts a value produced by Seal
+func (b *Box) Open(sealed string) (string, error) {
+	if !strings.HasPrefix(sealed, sealedPrefix) {
+		return "", fmt.Errorf("unsupported secret format")
+	}
+
+	data, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(sealed, sealedPrefix))
+	if err != nil {
+		return "", fmt.Errorf("failed to decode secret: %w", err)
+	}
+
+	nonceSize := b.aead.NonceSize()
+	if len(data) < nonceSize {
+		return "", fmt.Errorf("secret is too short")
+	}
+
+	plaintext, err := b.aead.Open(nil, data[:nonceSize], data[nonceSize:], nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt secret: %w", err)
+	}
+
+	return string(plaintext), nil
+}
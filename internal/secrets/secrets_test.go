@@ -0,0 +1,87 @@
+package secrets
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSealOpen(t *testing.T) {
+	box, err := New(make([]byte, KeySize))
+	if err != nil {
+		t.Fatalf("Failed to create box: %v", err)
+	}
+
+	sealed, err := box.Seal("s3cret")
+	if err != nil {
+		t.Fatalf("Failed to seal: %v", err)
+	}
+
+	if strings.Contains(sealed, "s3cret") {
+		t.Error("Sealed value contains the plaintext")
+	}
+
+	opened, err := box.Open(sealed)
+	if err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+	if opened != "s3cret" {
+		t.Errorf("Open() = %q, want %q", opened, "s3cret")
+	}
+
+	// A different key must not be able to open the value
+	otherKey := make([]byte, KeySize)
+	otherKey[0] = 1
+	other, err := New(otherKey)
+	if err != nil {
+		t.Fatalf("Failed to create box: %v", err)
+	}
+	if _, err := other.Open(sealed); err == nil {
+		t.Error("Open() with the wrong key should fail")
+	}
+}
+
+func TestNewInvalidKey(t *testing.T) {
+	if _, err := New([]byte("short")); err == nil {
+		t.Error("New() with a short key should fail")
+	}
+	if _, err := NewFromBase64("not base64!"); err == nil {
+		t.Error("NewFromBase64() with invalid input should fail")
+	}
+}
+
+func TestLoadOrCreateKeyFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys", "credentials.key")
+
+	box, err := LoadOrCreateKeyFile(path)
+	if err != nil {
+		t.Fatalf("Failed to create key file: %v", err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Key file was not created: %v", err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("Key file mode = %v, want 0600", info.Mode().Perm())
+	}
+
+	sealed, err := box.Seal("password")
+	if err != nil {
+		t.Fatalf("Failed to seal: %v", err)
+	}
+
+	// Loading again must reuse the same key
+	reloaded, err := LoadOrCreateKeyFile(path)
+	if err != nil {
+		t.Fatalf("Failed to load key file: %v", err)
+	}
+	opened, err := reloaded.Open(sealed)
+	if err != nil {
+		t.Fatalf("Failed to open with reloaded key: %v", err)
+	}
+	if opened != "password" {
+		t.Errorf("Open() = %q, want %q", opened, "password")
+	}
+}
@@ -0,0 +1,320 @@
+// Package settings serves the runtime options that can be changed through the
+// API. A row in the settings table overrides the value from config.yaml, and
+// deleting the row falls back to the file.
+package settings
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"proxyrouter/internal/config"
+)
+
+// Sources of a setting's value
+const (
+	SourceConfig   = "config"
+	SourceDatabase = "database"
+)
+
+// Setting is the value a runtime option has and where it comes from
+type Setting struct {
+	Key    string `json:"key"`
+	Value  string `json:"value"`
+	Source string `json:"source"` // "config" or "database"
+}
+
+// option maps a key of the settings table onto the configuration
+type option struct {
+	get func(cfg *config.Config) string
+	set func(cfg *config.Config, value string) error
+}
+
+// options are the settings that can be overridden
+var options = map[string]option{
+	"refresh_interval_sec": {
+		get: func(cfg *config.Config) string { return strconv.Itoa(cfg.Refresh.IntervalSec) },
+		set: func(cfg *config.Config, value string) error {
+			seconds, err := parseInt(value, 1)
+			if err != nil {
+				return err
+			}
+			cfg.Refresh.IntervalSec = seconds
+			return nil
+		},
+	},
+	"health_check_interval_sec": {
+		get: func(cfg *config.Config) string { return strconv.Itoa(cfg.Refresh.HealthCheckIntervalSec) },
+		set: func(cfg *config.Config, value string) error {
+			seconds, err := parseInt(value, 0)
+			if err != nil {
+				return err
+			}
+			cfg.Refresh.HealthCheckIntervalSec = seconds
+			return nil
+		},
+	},
+	"proxy_sources": {
+		get: func(cfg *config.Config) string {
+			sources := cfg.Refresh.Sources
+			if sources == nil {
+				sources = []config.SourceConfig{}
+			}
+			encoded, _ := json.Marshal(sources)
+			return string(encoded)
+		},
+		set: func(cfg *config.Config, value string) error {
+			sources, err := parseSources(value)
+			if err != nil {
+				return err
+			}
+			cfg.Refresh.Sources = sources
+			return nil
+		},
+	},
+	"max_upload_size_mb": {
+		get: func(cfg *config.Config) string { return strconv.Itoa(cfg.Admin.MaxUploadSizeMB) },
+		set: func(cfg *config.Config, value string) error {
+			size, err := parseInt(value, 0)
+			if err != nil {
+				return err
+			}
+			cfg.Admin.MaxUploadSizeMB = size
+			return nil
+		},
+	},
+}
+
+// Known reports whether key is a setting
+func Known(key string) bool {
+	_, ok := options[key]
+	return ok
+}
+
+// parseInt parses a whole number of at least min
+func parseInt(value string, min int) (int, error) {
+	n, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a whole number", value)
+	}
+	if n < min {
+		return 0, fmt.Errorf("must be at least %d", min)
+	}
+	return n, nil
+}
+
+// parseSources parses a JSON list of proxy sources
+func parseSources(value string) ([]config.SourceConfig, error) {
+	var sources []config.SourceConfig
+	if err := json.Unmarshal([]byte(value), &sources); err != nil {
+		return nil, fmt.Errorf("must be a JSON list of sources: %w", err)
+	}
+	for i, source := range sources {
+		if source.Name == "" {
+			return nil, fmt.Errorf("source %d has no name", i+1)
+		}
+		if u, err := url.Parse(source.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("source %s needs an http or https URL", source.Name)
+		}
+		if source.Type != "html" && source.Type != "raw" {
+			return nil, fmt.Errorf("source %s has type %q, want html or raw", source.Name, source.Type)
+		}
+	}
+	return sources, nil
+}
+
+// Service merges config.yaml with the overrides in the settings table and
+// tells subscribers when the result changes
+type Service struct {
+	db     *sql.DB
+	logger *slog.Logger
+
+	mu          sync.Mutex
+	file        *config.Config
+	overrides   map[string]string
+	current     *config.Config
+	subscribers []func(*config.Config)
+}
+
+// New creates a settings service on top of the file configuration and loads
+// the overrides stored in db. Stored values that are no longer valid are
+// logged and ignored.
+func New(ctx context.Context, db *sql.DB, file *config.Config, logger *slog.Logger) (*Service, error) {
+	rows, err := db.QueryContext(ctx, `SELECT key, value FROM settings`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load settings: %w", err)
+	}
+	defer rows.Close()
+
+	overrides := make(map[string]string)
+	for rows.Next() {
+		var key, value string
+		if err := rows.Scan(&key, &value); err != nil {
+			return nil, fmt.Errorf("failed to scan setting: %w", err)
+		}
+		opt, ok := options[key]
+		if !ok {
+			continue
+		}
+		if err := opt.set(&config.Config{}, value); err != nil {
+			logger.Warn("Ignoring invalid setting", "key", key, "error", err)
+			continue
+		}
+		overrides[key] = value
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to load settings: %w", err)
+	}
+
+	s := &Service{
+		db:        db,
+		logger:    logger,
+		file:      file,
+		overrides: overrides,
+	}
+	s.current = s.merge()
+	return s, nil
+}
+
+// Config returns the configuration with the overrides applied
+func (s *Service) Config() *config.Config {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.current
+}
+
+// Subscribe registers apply to be called with the configuration each time a
+// setting or the config file changes it
+func (s *Service) Subscribe(apply func(*config.Config)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.subscribers = append(s.subscribers, apply)
+}
+
+// SetFileConfig replaces the configuration read from config.yaml. Overrides
+// keep winning over it.
+func (s *Service) SetFileConfig(cfg *config.Config) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.file = cfg
+	s.publish()
+}
+
+// List returns every setting with its current value
+func (s *Service) List() []Setting {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys := make([]string, 0, len(options))
+	for key := range options {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	settings := make([]Setting, 0, len(keys))
+	for _, key := range keys {
+		setting := Setting{Key: key, Value: options[key].get(s.current), Source: SourceConfig}
+		if _, ok := s.overrides[key]; ok {
+			setting.Source = SourceDatabase
+		}
+		settings = append(settings, setting)
+	}
+	return settings
+}
+
+// Validate checks that every key is a setting and every value valid for it
+func (s *Service) Validate(values map[string]string) error {
+	for key, value := range values {
+		opt, ok := options[key]
+		if !ok {
+			return fmt.Errorf("unknown setting %q", key)
+		}
+		if err := opt.set(&config.Config{}, value); err != nil {
+			return fmt.Errorf("invalid %s: %w", key, err)
+		}
+	}
+	return nil
+}
+
+// Update stores values as overrides and applies them. Nothing is stored
+// unless every value is valid.
+func (s *Service) Update(ctx context.Context, values map[string]string) error {
+	if err := s.Validate(values); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	for key, value := range values {
+		query := `INSERT OR REPLACE INTO settings (key, value, updated_at) VALUES (?, ?, CURRENT_TIMESTAMP)`
+		if _, err := tx.ExecContext(ctx, query, key, value); err != nil {
+			return fmt.Errorf("failed to update setting %s: %w", key, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit settings: %w", err)
+	}
+
+	for key, value := range values {
+		s.overrides[key] = value
+	}
+	s.publish()
+	return nil
+}
+
+// Reset deletes the override of key, so the value from config.yaml applies
+func (s *Service) Reset(ctx context.Context, key string) error {
+	if !Known(key) {
+		return fmt.Errorf("unknown setting %q", key)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.db.ExecContext(ctx, `DELETE FROM settings WHERE key = ?`, key); err != nil {
+		return fmt.Errorf("failed to reset setting %s: %w", key, err)
+	}
+	delete(s.overrides, key)
+	s.publish()
+	return nil
+}
+
+// merge returns the file configuration with the overrides applied
+func (s *Service) merge() *config.Config {
+	merged := *s.file
+	for key, value := range s.overrides {
+		// Overrides are validated before they are stored
+		options[key].set(&merged, value)
+	}
+	return &merged
+}
+
+// publish merges the configuration again and passes it to the subscribers if
+// it changed
+func (s *Service) publish() {
+	next := s.merge()
+	changed := config.Diff(s.current, next)
+	s.current = next
+	if len(changed) == 0 {
+		return
+	}
+
+	s.logger.Info("Runtime settings changed", "keys", changed)
+	for _, apply := range s.subscribers {
+		apply(next)
+	}
+}
@@ -0,0 +1,144 @@
+package settings
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"testing"
+
+	"proxyrouter/internal/config"
+	"proxyrouter/internal/db"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestDatabase creates a migrated database, so the settings table holds
+// what migration 004 seeded and later migrations kept
+func newTestDatabase(t *testing.T) *db.Database {
+	database, err := db.New(filepath.Join(t.TempDir(), "test.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { database.Close() })
+	require.NoError(t, database.RunMigrations(filepath.Join("..", "..", "migrations")))
+	return database
+}
+
+// newTestFileConfig returns a configuration as read from config.yaml
+func newTestFileConfig() *config.Config {
+	cfg := &config.Config{}
+	cfg.Refresh.EnableGeneralSources = true
+	cfg.Refresh.IntervalSec = 600
+	cfg.Refresh.HealthcheckConcurrency = 10
+	cfg.Refresh.Sources = []config.SourceConfig{{Name: "file", URL: "https://example.com/file.txt", Type: "raw"}}
+	cfg.Admin.MaxUploadSizeMB = 10
+	return cfg
+}
+
+func newTestService(t *testing.T, database *db.Database, file *config.Config) *Service {
+	service, err := New(context.Background(), database.GetDB(), file, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	require.NoError(t, err)
+	return service
+}
+
+func TestSeededDefaultsDoNotOverrideConfig(t *testing.T) {
+	service := newTestService(t, newTestDatabase(t), newTestFileConfig())
+
+	cfg := service.Config()
+	assert.Equal(t, 600, cfg.Refresh.IntervalSec)
+	assert.Len(t, cfg.Refresh.Sources, 1)
+	for _, setting := range service.List() {
+		assert.Equal(t, SourceConfig, setting.Source, setting.Key)
+	}
+}
+
+func TestUpdateOverridesConfig(t *testing.T) {
+	database := newTestDatabase(t)
+	service := newTestService(t, database, newTestFileConfig())
+
+	var published []*config.Config
+	service.Subscribe(func(c *config.Config) {
+		published = append(published, c)
+	})
+
+	err := service.Update(context.Background(), map[string]string{
+		"refresh_interval_sec":      "120",
+		"health_check_interval_sec": "30",
+		"proxy_sources":             `[{"name":"db","url":"https://example.com/db.txt","type":"html"}]`,
+	})
+	require.NoError(t, err)
+
+	require.Len(t, published, 1)
+	cfg := published[0]
+	assert.Equal(t, 120, cfg.Refresh.IntervalSec)
+	assert.Equal(t, 30, cfg.Refresh.HealthCheckIntervalSec)
+	assert.Equal(t, []config.SourceConfig{{Name: "db", URL: "https://example.com/db.txt", Type: "html"}}, cfg.Refresh.Sources)
+	assert.Equal(t, 10, cfg.Refresh.HealthcheckConcurrency, "settings that are not overridden come from the file")
+
+	// The overrides survive a restart
+	restarted := newTestService(t, database, newTestFileConfig())
+	assert.Equal(t, 120, restarted.Config().Refresh.IntervalSec)
+
+	// A new config file does not replace an override
+	file := newTestFileConfig()
+	file.Refresh.IntervalSec = 300
+	file.Refresh.HealthcheckConcurrency = 20
+	service.SetFileConfig(file)
+	require.Len(t, published, 2)
+	assert.Equal(t, 120, published[1].Refresh.IntervalSec)
+	assert.Equal(t, 20, published[1].Refresh.HealthcheckConcurrency)
+
+	// Resetting an override falls back to the file
+	require.NoError(t, service.Reset(context.Background(), "refresh_interval_sec"))
+	require.Len(t, published, 3)
+	assert.Equal(t, 300, published[2].Refresh.IntervalSec)
+
+	sources := map[string]string{}
+	for _, setting := range service.List() {
+		sources[setting.Key] = setting.Source
+	}
+	assert.Equal(t, map[string]string{
+		"health_check_interval_sec": SourceDatabase,
+		"max_upload_size_mb":        SourceConfig,
+		"proxy_sources":             SourceDatabase,
+		"refresh_interval_sec":      SourceConfig,
+	}, sources)
+}
+
+func TestUpdateRejectsInvalidValues(t *testing.T) {
+	database := newTestDatabase(t)
+	service := newTestService(t, database, newTestFileConfig())
+
+	tests := map[string]map[string]string{
+		"unknown key":       {"session_secret": "x"},
+		"not a number":      {"refresh_interval_sec": "soon"},
+		"zero interval":     {"refresh_interval_sec": "0"},
+		"negative size":     {"max_upload_size_mb": "-1"},
+		"sources not JSON":  {"proxy_sources": "https://example.com"},
+		"source type":       {"proxy_sources": `[{"name":"a","url":"https://example.com/a","type":"csv"}]`},
+		"source scheme":     {"proxy_sources": `[{"name":"a","url":"ftp://example.com/a","type":"raw"}]`},
+		"one bad of a pair": {"refresh_interval_sec": "60", "health_check_interval_sec": "-5"},
+	}
+	for name, values := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Error(t, service.Update(context.Background(), values))
+		})
+	}
+
+	// Nothing was stored or applied
+	assert.Equal(t, 600, service.Config().Refresh.IntervalSec)
+	var count int
+	require.NoError(t, database.GetDB().QueryRow(`SELECT COUNT(*) FROM settings WHERE key = 'refresh_interval_sec'`).Scan(&count))
+	assert.Zero(t, count)
+
+	assert.Error(t, service.Reset(context.Background(), "session_secret"))
+}
+
+func TestInvalidStoredValueIsIgnored(t *testing.T) {
+	database := newTestDatabase(t)
+	_, err := database.GetDB().Exec(`INSERT OR REPLACE INTO settings (key, value) VALUES ('refresh_interval_sec', 'often')`)
+	require.NoError(t, err)
+
+	service := newTestService(t, database, newTestFileConfig())
+	assert.Equal(t, 600, service.Config().Refresh.IntervalSec)
+}
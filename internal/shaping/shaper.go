@@ -0,0 +1,306 @@
+package shaping
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"proxyrouter/internal/acl"
+	"proxyrouter/internal/auth"
+	"proxyrouter/internal/halfclose"
+	"proxyrouter/internal/metrics"
+	"proxyrouter/internal/router"
+)
+
+// Directions of tunnelled traffic
+const (
+	DirectionUp   = "up"   // client to target
+	DirectionDown = "down" // target to client
+)
+
+// sampleInterval is how often Run reports the throughput of each limit
+const sampleInterval = 5 * time.Second
+
+// Limit is a bandwidth limit in bytes per second. Connections with the same
+// key share it.
+type Limit struct {
+	Key            string // e.g. "subnet:192.168.10.0/24", "user:alice" or "route:3"
+	BytesPerSecond int
+}
+
+// Shaper limits the bandwidth of tunnels per ACL subnet, proxy user and route
+// with token buckets shared by every connection a limit applies to
+type Shaper struct {
+	acl     *acl.ACL
+	users   *auth.ProxyUsers
+	metrics *metrics.Metrics
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+// bucket holds the token buckets of one limit, one for each direction
+type bucket struct {
+	key       string
+	up        *rate.Limiter
+	down      *rate.Limiter
+	upBytes   atomic.Int64
+	downBytes atomic.Int64
+
+	// Guarded by Shaper.mu
+	conns       int
+	sampledUp   int64
+	sampledDown int64
+}
+
+// New creates a shaper that looks up the limits of subnets in acl and of
+// users in users. metrics may be nil.
+func New(acl *acl.ACL, users *auth.ProxyUsers, metrics *metrics.Metrics) *Shaper {
+	return &Shaper{
+		acl:     acl,
+		users:   users,
+		metrics: metrics,
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// Shape returns conn limited by the bandwidth limits of the client's subnet,
+// its user and the route. It returns conn itself when no limit applies or s
+// is nil.
+func (s *Shaper) Shape(ctx context.Context, conn net.Conn, clientIP, user string, route *router.Route) net.Conn {
+	if s == nil {
+		return conn
+	}
+	return s.Wrap(conn, s.Limits(ctx, clientIP, user, route))
+}
+
+// Limits returns the bandwidth limits that apply to a connection. A limit
+// that cannot be looked up is skipped.
+func (s *Shaper) Limits(ctx context.Context, clientIP, user string, route *router.Route) []Limit {
+	var limits []Limit
+
+	if s.acl != nil {
+		subnet, limit, err := s.acl.BandwidthLimit(ctx, clientIP)
+		if err != nil {
+			fmt.Printf("Failed to look up bandwidth limit for %s: %v\n", clientIP, err)
+		} else if limit > 0 {
+			limits = append(limits, Limit{Key: "subnet:" + subnet, BytesPerSecond: limit})
+		}
+	}
+
+	if s.users != nil && user != "" {
+		limit, err := s.users.BandwidthLimit(ctx, user)
+		if err != nil {
+			fmt.Printf("Failed to look up bandwidth limit for user %s: %v\n", user, err)
+		} else if limit > 0 {
+			limits = append(limits, Limit{Key: "user:" + user, BytesPerSecond: limit})
+		}
+	}
+
+	if route != nil && route.BandwidthLimit != nil && *route.BandwidthLimit > 0 {
+		limits = append(limits, Limit{Key: "route:" + strconv.Itoa(route.ID), BytesPerSecond: *route.BandwidthLimit})
+	}
+
+	return limits
+}
+
+// Wrap returns conn limited by limits, or conn itself if there are none
+func (s *Shaper) Wrap(conn net.Conn, limits []Limit) net.Conn {
+	if len(limits) == 0 {
+		return conn
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &shapedConn{Conn: conn, shaper: s, ctx: ctx, cancel: cancel}
+	for _, limit := range limits {
+		c.buckets = append(c.buckets, s.acquire(limit))
+	}
+	return c
+}
+
+// acquire returns the bucket of a limit for a new connection, adjusting its
+// rate if the limit changed
+func (s *Shaper) acquire(limit Limit) *bucket {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, ok := s.buckets[limit.Key]
+	if !ok {
+		b = &bucket{
+			key:  limit.Key,
+			up:   rate.NewLimiter(rate.Limit(limit.BytesPerSecond), limit.BytesPerSecond),
+			down: rate.NewLimiter(rate.Limit(limit.BytesPerSecond), limit.BytesPerSecond),
+		}
+		s.buckets[limit.Key] = b
+	} else if b.up.Burst() != limit.BytesPerSecond {
+		for _, limiter := range []*rate.Limiter{b.up, b.down} {
+			limiter.SetLimit(rate.Limit(limit.BytesPerSecond))
+			limiter.SetBurst(limit.BytesPerSecond)
+		}
+	}
+	b.conns++
+	return b
+}
+
+// release drops a connection from its buckets
+func (s *Shaper) release(buckets []*bucket) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, b := range buckets {
+		b.conns--
+	}
+}
+
+// Run reports the throughput of each limit to the metrics until ctx is done
+func (s *Shaper) Run(ctx context.Context) {
+	ticker := time.NewTicker(sampleInterval)
+	defer ticker.Stop()
+
+	last := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.sample(now.Sub(last))
+			last = now
+		}
+	}
+}
+
+// sample reports the bytes each limit passed since the last sample and drops
+// buckets that no connection uses anymore
+func (s *Shaper) sample(interval time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, b := range s.buckets {
+		up, down := b.upBytes.Load(), b.downBytes.Load()
+		if s.metrics != nil {
+			s.metrics.RecordShapedTraffic(key, DirectionUp, up-b.sampledUp, interval)
+			s.metrics.RecordShapedTraffic(key, DirectionDown, down-b.sampledDown, interval)
+		}
+		b.sampledUp, b.sampledDown = up, down
+
+		if b.conns == 0 {
+			delete(s.buckets, key)
+			if s.metrics != nil {
+				s.metrics.ForgetShapedKey(key)
+			}
+		}
+	}
+}
+
+// shapedConn is an upstream connection whose reads and writes wait for
+// tokens from the buckets of its limits
+type shapedConn struct {
+	net.Conn
+	shaper  *Shaper
+	buckets []*bucket
+
+	// ctx is cancelled on Close, so waiting reads and writes give up
+	ctx       context.Context
+	cancel    context.CancelFunc
+	closeOnce sync.Once
+}
+
+// Read implements net.Conn. Bytes from the target are counted against the
+// download buckets once they are read.
+func (c *shapedConn) Read(p []byte) (int, error) {
+	if max := c.maxChunk(DirectionDown); len(p) > max {
+		p = p[:max]
+	}
+
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		for _, b := range c.buckets {
+			b.downBytes.Add(int64(n))
+			if waitErr := waitN(c.ctx, b.down, n); waitErr != nil && err == nil {
+				err = net.ErrClosed
+			}
+		}
+	}
+	return n, err
+}
+
+// Write implements net.Conn. Bytes to the target wait for the upload buckets
+// in chunks no larger than their burst.
+func (c *shapedConn) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if max := c.maxChunk(DirectionUp); len(chunk) > max {
+			chunk = chunk[:max]
+		}
+
+		for _, b := range c.buckets {
+			if err := waitN(c.ctx, b.up, len(chunk)); err != nil {
+				return written, net.ErrClosed
+			}
+		}
+
+		n, err := c.Conn.Write(chunk)
+		written += n
+		for _, b := range c.buckets {
+			b.upBytes.Add(int64(n))
+		}
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// waitN waits for n tokens in pieces no larger than the limiter's burst. The
+// burst shrinks when another connection lowers the limit, so it is read again
+// for each piece.
+func waitN(ctx context.Context, limiter *rate.Limiter, n int) error {
+	for n > 0 {
+		piece := min(n, limiter.Burst())
+		if err := limiter.WaitN(ctx, piece); err != nil {
+			if ctx.Err() == nil && piece > limiter.Burst() {
+				// The limit was lowered between reading the burst and waiting
+				continue
+			}
+			return err
+		}
+		n -= piece
+	}
+	return nil
+}
+
+// maxChunk returns the most bytes one wait can ask for in a direction
+func (c *shapedConn) maxChunk(direction string) int {
+	max := 0
+	for _, b := range c.buckets {
+		limiter := b.up
+		if direction == DirectionDown {
+			limiter = b.down
+		}
+		if burst := limiter.Burst(); max == 0 || burst < max {
+			max = burst
+		}
+	}
+	return max
+}
+
+// CloseWrite half-closes the wrapped connection
+func (c *shapedConn) CloseWrite() error {
+	return halfclose.CloseWrite(c.Conn)
+}
+
+// Close implements net.Conn
+func (c *shapedConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.cancel()
+		c.shaper.release(c.buckets)
+	})
+	return c.Conn.Close()
+}
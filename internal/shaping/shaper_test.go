@@ -0,0 +1,180 @@
+package shaping
+
+import (
+	"context"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"proxyrouter/internal/acl"
+	"proxyrouter/internal/auth"
+	"proxyrouter/internal/db"
+	"proxyrouter/internal/router"
+)
+
+func TestShaperLimits(t *testing.T) {
+	database, err := db.New(filepath.Join(t.TempDir(), "test.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { database.Close() })
+	require.NoError(t, database.RunMigrations(filepath.Join("..", "..", "migrations")))
+
+	ctx := context.Background()
+	accessList := acl.New(database.GetDB())
+	require.NoError(t, accessList.AddSubnet(ctx, "10.0.0.0/8"))
+	require.NoError(t, accessList.AddSubnet(ctx, "10.1.0.0/16"))
+	require.NoError(t, accessList.SetBandwidthLimit(ctx, "10.0.0.0/8", 1000))
+	require.NoError(t, accessList.SetBandwidthLimit(ctx, "10.1.0.0/16", 2000))
+
+	users := auth.NewProxyUsers(database.GetDB(), "bcrypt")
+	alice, err := users.Create(ctx, "alice", "secret")
+	require.NoError(t, err)
+	limit := 3000
+	_, err = users.Update(ctx, alice.ID, nil, nil, &limit)
+	require.NoError(t, err)
+
+	routeLimit := 4000
+	route := &router.Route{ID: 7, BandwidthLimit: &routeLimit}
+
+	s := New(accessList, users, nil)
+	assert.Equal(t, []Limit{
+		{Key: "subnet:10.1.0.0/16", BytesPerSecond: 2000},
+		{Key: "user:alice", BytesPerSecond: 3000},
+		{Key: "route:7", BytesPerSecond: 4000},
+	}, s.Limits(ctx, "10.1.2.3", "alice", route))
+
+	assert.Equal(t, []Limit{
+		{Key: "subnet:10.0.0.0/8", BytesPerSecond: 1000},
+	}, s.Limits(ctx, "10.2.0.1", "bob", &router.Route{ID: 8}))
+
+	assert.Empty(t, s.Limits(ctx, "192.168.1.1", "", nil))
+}
+
+func TestShapedConnLimitsWrites(t *testing.T) {
+	s := New(nil, nil, nil)
+	client, server := net.Pipe()
+	defer client.Close()
+	conn := s.Wrap(server, []Limit{{Key: "route:1", BytesPerSecond: 4000}})
+	defer conn.Close()
+
+	go io.Copy(io.Discard, client)
+
+	// The first second's worth of tokens is spent at once, the rest waits
+	start := time.Now()
+	n, err := conn.Write(make([]byte, 6000))
+	require.NoError(t, err)
+	assert.Equal(t, 6000, n)
+	assert.GreaterOrEqual(t, time.Since(start), 400*time.Millisecond)
+}
+
+func TestShapedConnLimitsReads(t *testing.T) {
+	s := New(nil, nil, nil)
+	client, server := net.Pipe()
+	defer client.Close()
+	conn := s.Wrap(server, []Limit{{Key: "user:alice", BytesPerSecond: 4000}})
+	defer conn.Close()
+
+	go client.Write(make([]byte, 6000))
+
+	start := time.Now()
+	n, err := io.ReadFull(conn, make([]byte, 6000))
+	require.NoError(t, err)
+	assert.Equal(t, 6000, n)
+	assert.GreaterOrEqual(t, time.Since(start), 400*time.Millisecond)
+}
+
+func TestShapedConnsShareLimit(t *testing.T) {
+	s := New(nil, nil, nil)
+	limits := []Limit{{Key: "subnet:10.0.0.0/8", BytesPerSecond: 1000}}
+
+	_, first := net.Pipe()
+	_, second := net.Pipe()
+	a := s.Wrap(first, limits).(*shapedConn)
+	b := s.Wrap(second, []Limit{{Key: "subnet:10.0.0.0/8", BytesPerSecond: 2000}}).(*shapedConn)
+	require.Same(t, a.buckets[0], b.buckets[0])
+	assert.Equal(t, 2000, a.buckets[0].up.Burst(), "a changed limit applies to the shared bucket")
+
+	// Buckets no connection uses are dropped when sampled
+	a.Close()
+	s.sample(time.Second)
+	assert.Len(t, s.buckets, 1)
+	b.Close()
+	s.sample(time.Second)
+	assert.Empty(t, s.buckets)
+}
+
+func TestShapedConnSurvivesLoweredLimit(t *testing.T) {
+	s := New(nil, nil, nil)
+	client, server := net.Pipe()
+	defer client.Close()
+	conn := s.Wrap(server, []Limit{{Key: "route:1", BytesPerSecond: 4000}})
+	defer conn.Close()
+
+	// The read is sized for the old burst before the limit is lowered
+	type result struct {
+		n   int
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		n, err := conn.Read(make([]byte, 4000))
+		done <- result{n, err}
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	_, other := net.Pipe()
+	lowered := s.Wrap(other, []Limit{{Key: "route:1", BytesPerSecond: 2000}})
+	defer lowered.Close()
+
+	_, err := client.Write(make([]byte, 4000))
+	require.NoError(t, err)
+
+	select {
+	case r := <-done:
+		require.NoError(t, r.err)
+		assert.Equal(t, 4000, r.n)
+	case <-time.After(5 * time.Second):
+		t.Fatal("read did not finish")
+	}
+
+	// Writes larger than the new burst keep going too
+	go io.Copy(io.Discard, client)
+	n, err := conn.Write(make([]byte, 3000))
+	require.NoError(t, err)
+	assert.Equal(t, 3000, n)
+}
+
+func TestShapedConnCloseStopsWaiting(t *testing.T) {
+	s := New(nil, nil, nil)
+	client, server := net.Pipe()
+	defer client.Close()
+	conn := s.Wrap(server, []Limit{{Key: "route:1", BytesPerSecond: 100}})
+
+	go io.Copy(io.Discard, client)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := conn.Write(make([]byte, 10000))
+		done <- err
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	conn.Close()
+	select {
+	case err := <-done:
+		assert.Error(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("write kept waiting after close")
+	}
+}
+
+func TestShapeWithoutLimits(t *testing.T) {
+	_, server := net.Pipe()
+	var s *Shaper
+	assert.Same(t, server, s.Shape(context.Background(), server, "10.0.0.1", "", nil))
+	assert.Same(t, server, New(nil, nil, nil).Wrap(server, nil))
+}
@@ -0,0 +1,67 @@
+package tunnel
+
+import (
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"proxyrouter/internal/halfclose"
+)
+
+// Relay copies data between a client and its target in both directions and
+// closes both once it is done. When one side stops sending, the write side
+// of the other is closed so the opposite direction can finish; if it cannot
+// be half-closed, the tunnel ends. An error in either direction ends the
+// tunnel and is returned. Bytes the client sent ahead are read from
+// clientReader.
+func Relay(client net.Conn, clientReader io.Reader, target io.ReadWriteCloser) error {
+	r := &relay{client: client, target: target}
+	defer r.close()
+
+	errCh := make(chan error, 2)
+	go r.copy(target, clientReader, errCh)
+	go r.copy(client, target, errCh)
+
+	var err error
+	for i := 0; i < 2; i++ {
+		if copyErr := <-errCh; copyErr != nil {
+			r.close()
+			if err == nil {
+				err = copyErr
+			}
+		}
+	}
+	return err
+}
+
+// relay is the state of one tunnel
+type relay struct {
+	client    net.Conn
+	target    io.ReadWriteCloser
+	closeOnce sync.Once
+	closed    atomic.Bool
+}
+
+// copy copies src to dst until src is done, then half-closes dst
+func (r *relay) copy(dst io.Writer, src io.Reader, errCh chan<- error) {
+	_, err := io.Copy(dst, src)
+	if err == nil && halfclose.CloseWrite(dst) != nil {
+		r.close()
+	}
+
+	// Errors caused by closing the tunnel on purpose are not reported
+	if r.closed.Load() {
+		err = nil
+	}
+	errCh <- err
+}
+
+// close closes both ends of the tunnel, which stops both directions
+func (r *relay) close() {
+	r.closeOnce.Do(func() {
+		r.closed.Store(true)
+		r.client.Close()
+		r.target.Close()
+	})
+}
@@ -0,0 +1,192 @@
+package tunnel
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"proxyrouter/internal/db"
+	"proxyrouter/internal/router"
+)
+
+// tcpPair returns both ends of a loopback TCP connection
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := listener.Accept()
+		accepted <- conn
+	}()
+
+	dialed, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	conn := <-accepted
+	require.NotNil(t, conn)
+	t.Cleanup(func() {
+		dialed.Close()
+		conn.Close()
+	})
+	return dialed, conn
+}
+
+// startRelay relays between the proxy ends of two connections and returns
+// the result of Relay
+func startRelay(client net.Conn, target io.ReadWriteCloser) <-chan error {
+	done := make(chan error, 1)
+	go func() { done <- Relay(client, client, target) }()
+	return done
+}
+
+func TestRelayHalfClose(t *testing.T) {
+	clientApp, clientSide := tcpPair(t)
+	targetSide, targetApp := tcpPair(t)
+	done := startRelay(clientSide, targetSide)
+
+	// The client finishes its request before the target answers
+	_, err := clientApp.Write([]byte("ping"))
+	require.NoError(t, err)
+	require.NoError(t, clientApp.(*net.TCPConn).CloseWrite())
+
+	request, err := io.ReadAll(targetApp)
+	require.NoError(t, err)
+	assert.Equal(t, "ping", string(request))
+
+	_, err = targetApp.Write([]byte("pong"))
+	require.NoError(t, err)
+	targetApp.Close()
+
+	response, err := io.ReadAll(clientApp)
+	require.NoError(t, err)
+	assert.Equal(t, "pong", string(response))
+
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("relay did not finish after both directions ended")
+	}
+}
+
+func TestRelayEndsWithoutHalfClose(t *testing.T) {
+	clientApp, clientSide := tcpPair(t)
+	targetSide, targetApp := net.Pipe()
+	defer targetApp.Close()
+	done := startRelay(clientSide, targetSide)
+
+	go io.Copy(io.Discard, targetApp)
+	require.NoError(t, clientApp.(*net.TCPConn).CloseWrite())
+
+	// The target cannot be told the client is done, so the tunnel ends
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("relay kept waiting for a target that cannot be half-closed")
+	}
+	_, err := clientApp.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestRelayReturnsTimeout(t *testing.T) {
+	_, clientSide := tcpPair(t)
+	targetSide, _ := tcpPair(t)
+	done := startRelay(clientSide, Watch(targetSide, Timeouts{Idle: 100 * time.Millisecond}))
+
+	select {
+	case err := <-done:
+		assert.ErrorIs(t, err, ErrIdleTimeout)
+	case <-time.After(2 * time.Second):
+		t.Fatal("idle tunnel was not closed")
+	}
+}
+
+// startConnectTarget serves one CONNECT request as an HTTP proxy that is its
+// own target: it sends greeting along with its reply, reads the request until
+// the tunnel half-closes and answers with response
+func startConnectTarget(t *testing.T, greeting, response string) (string, <-chan string) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	requests := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		reader := bufio.NewReader(conn)
+		if _, err := http.ReadRequest(reader); err != nil {
+			return
+		}
+		conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n" + greeting))
+
+		request, _ := io.ReadAll(reader)
+		requests <- string(request)
+		conn.Write([]byte(response))
+	}()
+
+	return listener.Addr().String(), requests
+}
+
+func TestRelayHalfClosesGeneralPoolConn(t *testing.T) {
+	proxyAddr, requests := startConnectTarget(t, "hi ", "pong")
+	host, port, err := net.SplitHostPort(proxyAddr)
+	require.NoError(t, err)
+
+	database, err := db.New(filepath.Join(t.TempDir(), "test.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { database.Close() })
+	require.NoError(t, database.RunMigrations(filepath.Join("..", "..", "migrations")))
+	_, err = database.GetDB().Exec("INSERT INTO proxies (proxy_type, ip, port, latency, working) VALUES ('http', ?, ?, 1, 1)", host, port)
+	require.NoError(t, err)
+
+	factory := router.NewDialerFactory(database.GetDB(), "127.0.0.1:9050", 2*time.Second, nil, router.FailoverPolicy{})
+	dialer, err := factory.CreateDialer(context.Background(), &router.Route{ID: 1, Group: router.RouteGroupGeneral}, "127.0.0.1", "example.com")
+	require.NoError(t, err)
+	targetSide, err := dialer.DialContext(context.Background(), "tcp", "example.com:80")
+	require.NoError(t, err)
+
+	clientApp, clientSide := tcpPair(t)
+	done := startRelay(clientSide, Watch(targetSide, Timeouts{Idle: time.Minute}))
+
+	// The client's half-close reaches the target through the pool's wrappers
+	_, err = clientApp.Write([]byte("ping"))
+	require.NoError(t, err)
+	require.NoError(t, clientApp.(*net.TCPConn).CloseWrite())
+
+	select {
+	case request := <-requests:
+		assert.Equal(t, "ping", request)
+	case <-time.After(2 * time.Second):
+		t.Fatal("target never saw the client finish its request")
+	}
+
+	clientApp.SetReadDeadline(time.Now().Add(2 * time.Second))
+	response, err := io.ReadAll(clientApp)
+	require.NoError(t, err)
+	assert.Equal(t, "hi pong", string(response))
+
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("relay did not finish after both directions ended")
+	}
+}
@@ -0,0 +1,163 @@
+package tunnel
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"proxyrouter/internal/halfclose"
+	"proxyrouter/internal/router"
+)
+
+var (
+	// ErrIdleTimeout is returned by a watched connection closed for lack of traffic
+	ErrIdleTimeout = errors.New("tunnel idle timeout")
+	// ErrMaxLifetime is returned by a watched connection closed for its age
+	ErrMaxLifetime = errors.New("tunnel max lifetime reached")
+)
+
+// Timeouts limit how long an upstream connection stays open. Zero disables
+// a limit.
+type Timeouts struct {
+	Idle        time.Duration // without traffic in either direction
+	MaxLifetime time.Duration // since the connection was opened
+}
+
+// ForRoute returns the timeouts of a route, with t for those it does not set
+func (t Timeouts) ForRoute(route *router.Route) Timeouts {
+	if route == nil {
+		return t
+	}
+	if route.IdleTimeoutSec != nil && *route.IdleTimeoutSec > 0 {
+		t.Idle = time.Duration(*route.IdleTimeoutSec) * time.Second
+	}
+	if route.MaxLifetimeSec != nil && *route.MaxLifetimeSec > 0 {
+		t.MaxLifetime = time.Duration(*route.MaxLifetimeSec) * time.Second
+	}
+	return t
+}
+
+// Watch returns conn closed once it has gone without reads and writes for
+// the idle timeout or has been open for the max lifetime. Reads and writes
+// of a connection closed that way fail with ErrIdleTimeout or ErrMaxLifetime.
+// It returns conn itself when there are no timeouts.
+func Watch(conn net.Conn, timeouts Timeouts) net.Conn {
+	if timeouts.Idle <= 0 && timeouts.MaxLifetime <= 0 {
+		return conn
+	}
+
+	c := &watchedConn{Conn: conn, timeouts: timeouts, openedAt: time.Now()}
+	c.lastActive.Store(c.openedAt.UnixNano())
+
+	deadline, _ := c.nextTimeout()
+	c.mu.Lock()
+	c.timer = time.AfterFunc(time.Until(deadline), c.check)
+	c.mu.Unlock()
+	return c
+}
+
+// watchedConn is a connection closed by a timer once one of its timeouts
+// expires
+type watchedConn struct {
+	net.Conn
+	timeouts   Timeouts
+	openedAt   time.Time
+	lastActive atomic.Int64 // Unix nanoseconds of the last read or write
+
+	mu      sync.Mutex
+	timer   *time.Timer
+	stopped bool
+	err     error // the timeout that closed the connection
+}
+
+// Read implements net.Conn
+func (c *watchedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.touch()
+	}
+	return n, c.expired(err)
+}
+
+// Write implements net.Conn
+func (c *watchedConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		c.touch()
+	}
+	return n, c.expired(err)
+}
+
+// CloseWrite half-closes the wrapped connection
+func (c *watchedConn) CloseWrite() error {
+	return halfclose.CloseWrite(c.Conn)
+}
+
+// Close implements net.Conn
+func (c *watchedConn) Close() error {
+	c.mu.Lock()
+	c.stopped = true
+	c.timer.Stop()
+	c.mu.Unlock()
+	return c.Conn.Close()
+}
+
+// touch records traffic on the connection
+func (c *watchedConn) touch() {
+	c.lastActive.Store(time.Now().UnixNano())
+}
+
+// nextTimeout returns when the connection expires unless there is more
+// traffic, and which timeout expires then
+func (c *watchedConn) nextTimeout() (time.Time, error) {
+	var deadline time.Time
+	var reason error
+	if c.timeouts.Idle > 0 {
+		deadline = time.Unix(0, c.lastActive.Load()).Add(c.timeouts.Idle)
+		reason = ErrIdleTimeout
+	}
+	if c.timeouts.MaxLifetime > 0 {
+		if end := c.openedAt.Add(c.timeouts.MaxLifetime); deadline.IsZero() || end.Before(deadline) {
+			deadline, reason = end, ErrMaxLifetime
+		}
+	}
+	return deadline, reason
+}
+
+// check closes the connection if a timeout has expired, or waits for the
+// next one otherwise
+func (c *watchedConn) check() {
+	deadline, reason := c.nextTimeout()
+
+	c.mu.Lock()
+	if c.stopped {
+		c.mu.Unlock()
+		return
+	}
+	if wait := time.Until(deadline); wait > 0 {
+		c.timer.Reset(wait)
+		c.mu.Unlock()
+		return
+	}
+	c.stopped = true
+	c.err = reason
+	c.mu.Unlock()
+
+	c.Conn.Close()
+}
+
+// expired replaces the error of a read or write with the timeout that
+// closed the connection
+func (c *watchedConn) expired(err error) error {
+	if err == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return c.err
+	}
+	return err
+}
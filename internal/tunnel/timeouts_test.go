@@ -0,0 +1,101 @@
+package tunnel
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"proxyrouter/internal/router"
+)
+
+func TestTimeoutsForRoute(t *testing.T) {
+	defaults := Timeouts{Idle: time.Minute, MaxLifetime: time.Hour}
+	idle, zero := 30, 0
+
+	assert.Equal(t, defaults, defaults.ForRoute(nil))
+	assert.Equal(t, defaults, defaults.ForRoute(&router.Route{MaxLifetimeSec: &zero}))
+	assert.Equal(t, Timeouts{Idle: 30 * time.Second, MaxLifetime: time.Hour}, defaults.ForRoute(&router.Route{IdleTimeoutSec: &idle}))
+}
+
+func TestWatchWithoutTimeouts(t *testing.T) {
+	conn, _ := net.Pipe()
+	assert.Same(t, conn, Watch(conn, Timeouts{}))
+}
+
+func TestWatchIdleCountsBothDirections(t *testing.T) {
+	local, remote := tcpPair(t)
+	conn := Watch(local, Timeouts{Idle: 150 * time.Millisecond})
+	defer conn.Close()
+
+	readErr := make(chan error, 1)
+	go func() {
+		_, err := conn.Read(make([]byte, 1))
+		readErr <- err
+	}()
+	go io.Copy(io.Discard, remote)
+
+	// Writes keep a connection alive that has nothing to read
+	for i := 0; i < 8; i++ {
+		_, err := conn.Write([]byte("x"))
+		require.NoError(t, err)
+		time.Sleep(50 * time.Millisecond)
+	}
+	select {
+	case err := <-readErr:
+		t.Fatalf("connection closed while sending: %v", err)
+	default:
+	}
+
+	select {
+	case err := <-readErr:
+		assert.ErrorIs(t, err, ErrIdleTimeout)
+	case <-time.After(2 * time.Second):
+		t.Fatal("idle connection was not closed")
+	}
+}
+
+func TestWatchIdleResetsOnReads(t *testing.T) {
+	local, remote := tcpPair(t)
+	conn := Watch(local, Timeouts{Idle: 150 * time.Millisecond})
+	defer conn.Close()
+
+	buf := make([]byte, 1)
+	for i := 0; i < 8; i++ {
+		_, err := remote.Write([]byte("x"))
+		require.NoError(t, err)
+		_, err = conn.Read(buf)
+		require.NoError(t, err)
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	_, err := conn.Read(buf)
+	assert.ErrorIs(t, err, ErrIdleTimeout)
+}
+
+func TestWatchMaxLifetime(t *testing.T) {
+	local, remote := tcpPair(t)
+	conn := Watch(local, Timeouts{Idle: time.Minute, MaxLifetime: 200 * time.Millisecond})
+	defer conn.Close()
+
+	// Traffic does not extend the lifetime
+	go func() {
+		for i := 0; i < 20; i++ {
+			if _, err := remote.Write([]byte("x")); err != nil {
+				return
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}()
+
+	start := time.Now()
+	var err error
+	for err == nil {
+		_, err = conn.Read(make([]byte, 1))
+	}
+	assert.ErrorIs(t, err, ErrMaxLifetime)
+	assert.Less(t, time.Since(start), time.Second)
+}
@@ -0,0 +1,7 @@
+-- Migration 010: Add credentials for upstream proxies
+-- This migration adds optional username/password columns to the proxies table.
+-- Passwords are never stored in plain text: password_enc holds the value
+-- sealed with the credential key (see security.credential_key).
+
+ALTER TABLE proxies ADD COLUMN username TEXT;
+ALTER TABLE proxies ADD COLUMN password_enc TEXT;
@@ -0,0 +1,16 @@
+-- Migration 011: Add proxy chains
+-- Routes in the "CHAIN" group dial through an ordered list of hops. Each hop
+-- is either Tor, the general pool or a specific upstream proxy, and the first
+-- hop (position 0) is dialed directly.
+
+CREATE TABLE IF NOT EXISTS route_hops (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  route_id INTEGER NOT NULL REFERENCES routes(id) ON DELETE CASCADE,
+  position INTEGER NOT NULL,        -- 0 = first hop
+  "group" TEXT NOT NULL,            -- "TOR"|"GENERAL"|"UPSTREAM"
+  proxy_id INTEGER,                 -- used when group="UPSTREAM"
+  timeout_ms INTEGER,               -- null = timeouts.dial_ms
+  UNIQUE (route_id, position)
+);
+
+CREATE INDEX IF NOT EXISTS idx_route_hops_route ON route_hops(route_id);
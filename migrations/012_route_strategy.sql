@@ -0,0 +1,5 @@
+-- Migration 012: Add load-balancing strategies
+-- GENERAL routes pick pool proxies with a per-route strategy. NULL keeps the
+-- default of trying the lowest latency proxies first.
+
+ALTER TABLE routes ADD COLUMN strategy TEXT; -- "latency"|"round_robin"|"weighted_latency"|"least_conn"|"p2c"|"hash_client_ip"|"hash_target_host"
@@ -0,0 +1,6 @@
+-- Migration 013: Add sticky sessions
+-- GENERAL routes with an affinity keep sending requests with the same key to
+-- the same pool proxy for affinity_ttl_sec, until that proxy turns unhealthy.
+
+ALTER TABLE routes ADD COLUMN affinity TEXT;          -- "client_ip"|"target_host"|"client_host"|"session" (null = none)
+ALTER TABLE routes ADD COLUMN affinity_ttl_sec INTEGER; -- null = 600
@@ -0,0 +1,10 @@
+-- Migration 014: Add richer route conditions
+-- Every condition is optional; a route matches only when all of its set
+-- conditions match. Scheme and path are only known for plain HTTP requests.
+
+ALTER TABLE routes ADD COLUMN host_regex TEXT;   -- Go regular expression on the target host
+ALTER TABLE routes ADD COLUMN dst_ports TEXT;    -- e.g. "80,443,8000-8999"
+ALTER TABLE routes ADD COLUMN schemes TEXT;      -- e.g. "http,ws"
+ALTER TABLE routes ADD COLUMN methods TEXT;      -- e.g. "GET,HEAD,CONNECT"
+ALTER TABLE routes ADD COLUMN path_prefix TEXT;  -- e.g. "/api/"
+ALTER TABLE routes ADD COLUMN time_window TEXT;  -- cron-style, e.g. "* 9-17 * * 1-5"
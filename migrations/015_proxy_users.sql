@@ -0,0 +1,13 @@
+-- Migration 015: Add credentials for inbound proxy clients
+-- Passwords are hashed with the algorithm in security.password_hash.
+CREATE TABLE IF NOT EXISTS proxy_users (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  username TEXT UNIQUE NOT NULL,
+  password_hash TEXT NOT NULL,
+  enabled INTEGER NOT NULL DEFAULT 1,
+  created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Routes can match on the authenticated user
+ALTER TABLE routes ADD COLUMN client_user TEXT;
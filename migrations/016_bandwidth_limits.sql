@@ -0,0 +1,8 @@
+-- Migration 016: Add bandwidth limits
+-- Tunnels are shaped to bandwidth_limit bytes per second in each direction.
+-- A limit is shared by every connection it applies to: all clients in an ACL
+-- subnet, all connections of a proxy user, or all connections of a route.
+
+ALTER TABLE acl_subnets ADD COLUMN bandwidth_limit INTEGER; -- null = unlimited
+ALTER TABLE proxy_users ADD COLUMN bandwidth_limit INTEGER; -- null = unlimited
+ALTER TABLE routes ADD COLUMN bandwidth_limit INTEGER;      -- null = unlimited
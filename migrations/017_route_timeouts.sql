@@ -0,0 +1,7 @@
+-- Migration 017: Add per-route tunnel timeouts
+-- A tunnel closes after idle_timeout_sec without traffic in either direction
+-- and after max_lifetime_sec in total. Null falls back to timeouts.tunnel_idle_ms
+-- and timeouts.tunnel_lifetime_ms.
+
+ALTER TABLE routes ADD COLUMN idle_timeout_sec INTEGER;
+ALTER TABLE routes ADD COLUMN max_lifetime_sec INTEGER;
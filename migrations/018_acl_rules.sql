@@ -0,0 +1,9 @@
+-- Migration 018: Add deny rules, priorities, comments and expiry to the ACL
+-- Entries that contain a client are ordered by priority (lowest first), then
+-- by prefix length (longest first); at a tie deny wins. The first entry
+-- decides. Clients no entry contains are denied. Expired entries are ignored.
+
+ALTER TABLE acl_subnets ADD COLUMN action TEXT NOT NULL DEFAULT 'allow'; -- "allow"|"deny"
+ALTER TABLE acl_subnets ADD COLUMN priority INTEGER NOT NULL DEFAULT 100;
+ALTER TABLE acl_subnets ADD COLUMN comment TEXT;
+ALTER TABLE acl_subnets ADD COLUMN expires_at DATETIME; -- null = never
@@ -0,0 +1,9 @@
+-- Migration 019: Make settings rows overrides of config.yaml
+-- A row in settings now wins over the config file, and deleting it falls back
+-- to the file. The defaults seeded by migration 004 were never read, so rows
+-- still holding them are removed rather than left to mask config.yaml.
+
+DELETE FROM settings WHERE key = 'proxy_sources' AND value = '[]';
+DELETE FROM settings WHERE key = 'refresh_interval_sec' AND value = '900';
+DELETE FROM settings WHERE key = 'health_check_interval_sec' AND value = '300';
+DELETE FROM settings WHERE key = 'max_upload_size_mb' AND value = '10';